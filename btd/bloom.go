@@ -0,0 +1,72 @@
+package btd
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+// BloomFilter is a fixed size bloom filter over spent token hashes.
+//
+// Each element is hashed with SHA-256 and the first two big endian uint64 words,
+// h1 and h2, select bits (h1 + i*h2) mod M for i in [0, K).
+type BloomFilter struct {
+	M    uint64 `json:"m"`
+	K    uint64 `json:"k"`
+	Bits []byte `json:"bits"`
+}
+
+// NewBloomFilter sizes a filter to hold n elements with false positive rate p
+func NewBloomFilter(n int, p float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	bits := (uint64(m) + 7) / 8
+	return &BloomFilter{
+		M:    bits * 8,
+		K:    uint64(k),
+		Bits: make([]byte, bits),
+	}
+}
+
+func bloomHashes(sum [sha256.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16])
+}
+
+// Add a spent token hash to the filter
+func (f *BloomFilter) Add(sum [sha256.Size]byte) {
+	h1, h2 := bloomHashes(sum)
+	for i := uint64(0); i < f.K; i++ {
+		bit := (h1 + i*h2) % f.M
+		f.Bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Contains returns false if the hash was definitely not added to the filter
+func (f *BloomFilter) Contains(sum [sha256.Size]byte) bool {
+	h1, h2 := bloomHashes(sum)
+	for i := uint64(0); i < f.K; i++ {
+		bit := (h1 + i*h2) % f.M
+		if f.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SpentTokenHash is the hash of a redeemed token used in bundles and deltas, it
+// avoids distributing raw token preimages to edge services
+func SpentTokenHash(issuerType string, id string) [sha256.Size]byte {
+	h := sha256.New()
+	_, _ = h.Write([]byte(issuerType))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(id))
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,60 @@
+package btd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+)
+
+// Decoded lengths of the values exchanged with clients, which are encoded as padded
+// standard base64
+const (
+	TokenPreimageLength         = 64
+	VerificationSignatureLength = 64
+	BlindedTokenLength          = 32
+)
+
+// EncodingError rejects a value that is not the canonical encoding of its type
+type EncodingError struct {
+	Name   string
+	Reason string
+}
+
+func (e *EncodingError) Error() string {
+	return fmt.Sprintf("%s %s", e.Name, e.Reason)
+}
+
+// ValidateEncoding checks that text is the canonical padded standard base64 encoding
+// of length bytes before it is handed to the FFI, which only reports that decoding
+// failed and truncates at a NUL byte. Encodings with other characters, line breaks or
+// non-zero padding bits are rejected rather than normalized, so that every value has
+// exactly one accepted encoding.
+func ValidateEncoding(name string, text []byte, length int) error {
+	if len(text) != base64.StdEncoding.EncodedLen(length) {
+		return &EncodingError{Name: name, Reason: fmt.Sprintf("must be %d base64 characters encoding %d bytes", base64.StdEncoding.EncodedLen(length), length)}
+	}
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Strict().Decode(decoded, text)
+	if err != nil || n != length {
+		return &EncodingError{Name: name, Reason: "must be standard base64 with padding"}
+	}
+	if !bytes.Equal([]byte(base64.StdEncoding.EncodeToString(decoded[:n])), text) {
+		return &EncodingError{Name: name, Reason: "is not canonically encoded"}
+	}
+	return nil
+}
+
+// ValidateTokenPreimage checks the encoding of a token preimage
+func ValidateTokenPreimage(text []byte) error {
+	return ValidateEncoding("token preimage", text, TokenPreimageLength)
+}
+
+// ValidateVerificationSignature checks the encoding of a redemption signature
+func ValidateVerificationSignature(text []byte) error {
+	return ValidateEncoding("signature", text, VerificationSignatureLength)
+}
+
+// ValidateBlindedToken checks the encoding of a blinded token
+func ValidateBlindedToken(text []byte) error {
+	return ValidateEncoding("blinded token", text, BlindedTokenLength)
+}
@@ -72,38 +72,57 @@ func init() {
 // ApproveTokens applies the issuer's secret key to each token in the request.
 // It returns an array of marshaled approved values along with a batch DLEQ proof.
 func ApproveTokens(blindedTokens []*crypto.BlindedToken, key *crypto.SigningKey) ([]*crypto.SignedToken, *crypto.BatchDLEQProof, error) {
+	signedTokens := make([]*crypto.SignedToken, len(blindedTokens))
+	if err := SignTokens(blindedTokens, signedTokens, key); err != nil {
+		return []*crypto.SignedToken{}, nil, err
+	}
+
+	proof, err := ProveTokens(blindedTokens, signedTokens, key)
+	if err != nil {
+		return []*crypto.SignedToken{}, nil, err
+	}
+	return signedTokens, proof, nil
+}
+
+// SignTokens signs each blinded token into the same index of signedTokens. It is safe
+// to call concurrently for disjoint parts of a batch.
+func SignTokens(blindedTokens []*crypto.BlindedToken, signedTokens []*crypto.SignedToken, key *crypto.SigningKey) error {
 	var err error
 
 	blindedTokenCounter.Add(float64(len(blindedTokens)))
-	signedTokens := make([]*crypto.SignedToken, len(blindedTokens))
 	for i, blindedToken := range blindedTokens {
 		signTokenCounter.Add(1)
 		timer := prometheus.NewTimer(signTokenDuration)
 		signedTokens[i], err = key.Sign(blindedToken)
 		if err != nil {
-			return []*crypto.SignedToken{}, nil, err
+			return err
 		}
 		timer.ObserveDuration()
 	}
+	return nil
+}
 
+// ProveTokens creates the batch DLEQ proof that a batch was signed with the key, and
+// verifies it before it is returned to the client
+func ProveTokens(blindedTokens []*crypto.BlindedToken, signedTokens []*crypto.SignedToken, key *crypto.SigningKey) (*crypto.BatchDLEQProof, error) {
 	timer := prometheus.NewTimer(createBatchProofDuration)
 	proof, err := crypto.NewBatchDLEQProof(blindedTokens, signedTokens, key)
 	if err != nil {
-		return []*crypto.SignedToken{}, nil, err
+		return nil, err
 	}
 	timer.ObserveDuration()
 
 	timer = prometheus.NewTimer(verifyBatchProofDuration)
 	ok, err := proof.Verify(blindedTokens, signedTokens, key.PublicKey())
 	if err != nil {
-		return []*crypto.SignedToken{}, nil, err
+		return nil, err
 	}
 	if !ok {
-		return []*crypto.SignedToken{}, nil, ErrInvalidBatchProof
+		return nil, ErrInvalidBatchProof
 	}
 	timer.ObserveDuration()
 
-	return signedTokens, proof, err
+	return proof, nil
 }
 
 // VerifyTokenRedemption checks a redemption request against the observed request data
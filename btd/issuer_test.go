@@ -1,8 +1,15 @@
 package btd
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
 	"log"
+	"strings"
 	"testing"
+	"time"
 
 	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
 )
@@ -166,3 +173,293 @@ func TestBadMAC(t *testing.T) {
 		t.Fatal("No error occurred even though MAC should be bad")
 	}
 }
+
+func TestVerifier(t *testing.T) {
+	sKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage, sig, err := makeTokenRedempRequest(sKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier(time.Minute)
+	if err := verifier.Verify("example", preimage, sig, testPayload); err != ErrUnknownIssuer {
+		t.Fatalf("Issuer types without keys should be unknown, got %v", err)
+	}
+
+	now := time.Now()
+	verifier.SetKeys("example", []Key{{SigningKey: sKey, StartAt: now.Add(-2 * time.Hour), EndAt: now.Add(-time.Hour)}})
+	if err := verifier.Verify("example", preimage, sig, testPayload); err != ErrTokenOutsideValidity {
+		t.Fatalf("Tokens of a key that ended should be outside their validity, got %v", err)
+	}
+
+	verifier.SetKeys("example", []Key{{SigningKey: sKey, StartAt: now.Add(-time.Hour), EndAt: now.Add(-30 * time.Second)}})
+	if err := verifier.Verify("example", preimage, sig, testPayload); err != nil {
+		t.Fatalf("Keys that ended within the skew should verify, got %v", err)
+	}
+	if err := verifier.Verify("example", preimage, sig, "bad payload"); err == nil {
+		t.Fatal("No error occurred even though MAC should be bad")
+	}
+
+	id, err := preimage.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := NewBloomFilter(1, 0.001)
+	spent.Add(SpentTokenHash("example", string(id)))
+	verifier.SetSpent(spent)
+	if err := verifier.Verify("example", preimage, sig, testPayload); err != ErrPossiblySpent {
+		t.Fatalf("Tokens in the spent filter should be reported, got %v", err)
+	}
+}
+
+func TestKeyBundle(t *testing.T) {
+	sKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage, sig, err := makeTokenRedempRequest(sKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestationPublic, attestationKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(version int64, expiresAt time.Time) *SignedKeyBundle {
+		bundle, err := SealKeyBundle(map[string][]BundledKey{"example": {{ID: "key", Key: Key{SigningKey: sKey}}}}, &recipient.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle.Version, bundle.GeneratedAt, bundle.ExpiresAt = version, time.Now(), expiresAt
+		encoded, err := json.Marshal(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &SignedKeyBundle{Algorithm: "Ed25519", Bundle: encoded, Signature: ed25519.Sign(attestationKey, encoded)}
+	}
+
+	verifier := NewVerifier(0)
+	signed := sign(2, time.Now().Add(time.Hour))
+	if version, err := verifier.LoadKeyBundle(signed, attestationPublic, recipient); err != nil || version != 2 {
+		t.Fatalf("The bundle should load, got %d %v", version, err)
+	}
+	if err := verifier.Verify("example", preimage, sig, testPayload); err != nil {
+		t.Fatalf("Keys of the bundle should verify, got %v", err)
+	}
+
+	if _, err := verifier.LoadKeyBundle(sign(1, time.Now().Add(time.Hour)), attestationPublic, recipient); err != ErrStaleKeyBundle {
+		t.Fatalf("Older bundles should be rejected, got %v", err)
+	}
+	if _, err := verifier.LoadKeyBundle(sign(3, time.Now().Add(-time.Second)), attestationPublic, recipient); err != ErrExpiredKeyBundle {
+		t.Fatalf("Expired bundles should be rejected, got %v", err)
+	}
+	tampered := *signed
+	tampered.Bundle = append([]byte{}, signed.Bundle...)
+	tampered.Bundle[len(tampered.Bundle)-2] ^= 1
+	if _, err := verifier.LoadKeyBundle(&tampered, attestationPublic, recipient); err != ErrInvalidKeyBundle {
+		t.Fatalf("Tampered bundles should be rejected, got %v", err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OpenKeyBundle(sign(4, time.Now().Add(time.Hour)), attestationPublic, other); err == nil {
+		t.Fatal("Bundles should only open with the recipient key")
+	}
+}
+
+func TestValidateEncoding(t *testing.T) {
+	sKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage, _, err := makeTokenRedempRequest(sKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := preimage.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateTokenPreimage(text); err != nil {
+		t.Fatalf("Preimages encoded by the FFI should be valid, got %v", err)
+	}
+
+	padded := base64.StdEncoding.EncodeToString(make([]byte, TokenPreimageLength))
+	for name, invalid := range map[string]string{
+		"empty":           "",
+		"short":           padded[:len(padded)-4],
+		"url alphabet":    strings.Replace(padded, "A", "-", 1),
+		"unpadded":        base64.RawStdEncoding.EncodeToString(make([]byte, TokenPreimageLength)) + "A",
+		"line break":      padded[:40] + "\n" + padded[42:],
+		"nul":             padded[:40] + "\x00" + padded[41:],
+		"padding bits":    padded[:len(padded)-3] + "B==",
+		"blinded token":   base64.StdEncoding.EncodeToString(make([]byte, BlindedTokenLength)),
+		"trailing spaces": padded[:len(padded)-1] + " ",
+	} {
+		if err := ValidateTokenPreimage([]byte(invalid)); err == nil {
+			t.Errorf("The %s preimage %q should be rejected", name, invalid)
+		}
+	}
+}
+
+func FuzzValidateEncoding(f *testing.F) {
+	f.Add([]byte(base64.StdEncoding.EncodeToString(make([]byte, TokenPreimageLength))))
+	f.Add([]byte(base64.StdEncoding.EncodeToString(make([]byte, BlindedTokenLength))))
+	f.Add([]byte("not base64"))
+	f.Fuzz(func(t *testing.T, text []byte) {
+		if ValidateTokenPreimage(text) == nil {
+			preimage := &crypto.TokenPreimage{}
+			if err := preimage.UnmarshalText(text); err != nil {
+				t.Fatalf("The FFI should decode valid preimage %q, got %v", text, err)
+			}
+			encoded, err := preimage.MarshalText()
+			if err != nil || string(encoded) != string(text) {
+				t.Fatalf("Valid preimage %q should be canonical, the FFI encodes it as %q", text, encoded)
+			}
+		}
+		if ValidateVerificationSignature(text) == nil {
+			signature := &crypto.VerificationSignature{}
+			if err := signature.UnmarshalText(text); err != nil {
+				t.Fatalf("The FFI should decode valid signature %q, got %v", text, err)
+			}
+		}
+	})
+}
+
+type textValue interface {
+	MarshalText() ([]byte, error)
+	UnmarshalText([]byte) error
+}
+
+// fuzzTextRoundTrip checks that text the FFI decodes into a fresh value of newValue
+// encodes to text that decodes to the same encoding again
+func fuzzTextRoundTrip(t *testing.T, text []byte, newValue func() textValue) textValue {
+	value := newValue()
+	if value.UnmarshalText(text) != nil {
+		return nil
+	}
+	encoded, err := value.MarshalText()
+	if err != nil {
+		t.Fatalf("Value decoded from %q should encode: %v", text, err)
+	}
+	again := newValue()
+	if err := again.UnmarshalText(encoded); err != nil {
+		t.Fatalf("Encoding %q of %q should decode: %v", encoded, text, err)
+	}
+	reencoded, err := again.MarshalText()
+	if err != nil || string(reencoded) != string(encoded) {
+		t.Fatalf("Encoding %q of %q is not stable, got %q", encoded, text, reencoded)
+	}
+	return value
+}
+
+func FuzzSigningKeyText(f *testing.F) {
+	sKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+	text, err := sKey.MarshalText()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(text)
+	f.Add(text[:len(text)-2])
+	f.Add([]byte(base64.StdEncoding.EncodeToString(make([]byte, 32))))
+	f.Add([]byte(""))
+	f.Fuzz(func(t *testing.T, text []byte) {
+		value := fuzzTextRoundTrip(t, text, func() textValue { return &crypto.SigningKey{} })
+		if value == nil {
+			return
+		}
+		// Deriving the public key and signing with a decoded key must not fail
+		key := value.(*crypto.SigningKey)
+		if _, err := key.PublicKey().MarshalText(); err != nil {
+			t.Fatalf("Public key of %q should encode: %v", text, err)
+		}
+		_, blindedTokens, err := makeTokenIssueRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ApproveTokens(blindedTokens[:1], key); err != nil {
+			t.Fatalf("Signing key %q should approve tokens: %v", text, err)
+		}
+	})
+}
+
+func FuzzTokenPreimageText(f *testing.F) {
+	sKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+	preimage, signature, err := makeTokenRedempRequest(sKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	preimageText, err := preimage.MarshalText()
+	if err != nil {
+		f.Fatal(err)
+	}
+	signatureText, err := signature.MarshalText()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(preimageText, signatureText)
+	f.Add(preimageText[:len(preimageText)-1], signatureText[1:])
+	f.Add([]byte(base64.StdEncoding.EncodeToString(make([]byte, TokenPreimageLength))), []byte("AAAA"))
+	f.Fuzz(func(t *testing.T, preimageText, signatureText []byte) {
+		preimage := fuzzTextRoundTrip(t, preimageText, func() textValue { return &crypto.TokenPreimage{} })
+		signature := fuzzTextRoundTrip(t, signatureText, func() textValue { return &crypto.VerificationSignature{} })
+		fuzzTextRoundTrip(t, preimageText, func() textValue { return &crypto.BlindedToken{} })
+		fuzzTextRoundTrip(t, preimageText, func() textValue { return &crypto.PublicKey{} })
+		if preimage == nil || signature == nil {
+			return
+		}
+		// Only the seeded redemption verifies, adversarial ones must fail without panicking
+		_ = VerifyTokenRedemption(preimage.(*crypto.TokenPreimage), signature.(*crypto.VerificationSignature), testPayload, []*crypto.SigningKey{sKey})
+	})
+}
+
+func BenchmarkApproveTokens(b *testing.B) {
+	_, blindedTokens, err := makeTokenIssueRequest()
+	if err != nil {
+		b.Fatal(err)
+	}
+	sKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ApproveTokens(blindedTokens, sKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerifyTokenRedemption(b *testing.B) {
+	sKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	preimage, sig, err := makeTokenRedempRequest(sKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := VerifyTokenRedemption(preimage, sig, testPayload, []*crypto.SigningKey{sKey}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package btd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+)
+
+// KeyBundleFormat is bumped whenever the layout of KeyBundle changes
+const KeyBundleFormat = 1
+
+// keyBundleLabel binds the encrypted data key to its use in key bundles
+var keyBundleLabel = []byte("key-bundle")
+
+var (
+	ErrInvalidKeyBundle     = errors.New("key bundle signature does not verify")
+	ErrUnsupportedKeyBundle = errors.New("unsupported key bundle format")
+	ErrExpiredKeyBundle     = errors.New("key bundle has expired")
+	ErrStaleKeyBundle       = errors.New("key bundle is not newer than the loaded one")
+)
+
+// SignedKeyBundle is a KeyBundle signed with the server's Ed25519 attestation key. The
+// bundle is signed as is and kept encoded, so that edge services verify the exact
+// bytes before decoding them.
+type SignedKeyBundle struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Bundle    []byte `json:"bundle"`
+	Signature []byte `json:"signature"`
+}
+
+// KeyBundle distributes the signing keys of unexpired issuers to edge services that
+// verify redemptions offline. Signing keys are encrypted with AES-256-GCM under
+// DataKey, which is encrypted under the RSA public key of the edge services.
+type KeyBundle struct {
+	Format int `json:"format"`
+	// Version increases with every bundle, older bundles than a loaded one are rejected
+	Version     int64             `json:"version"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	DataKey     string            `json:"data_key"`
+	Issuers     []KeyBundleIssuer `json:"issuers"`
+}
+
+// KeyBundleIssuer lists the keys of an issuer type, including those of its rotated issuers
+type KeyBundleIssuer struct {
+	IssuerType string         `json:"issuer_type"`
+	Keys       []KeyBundleKey `json:"keys"`
+}
+
+// KeyBundleKey is an encrypted signing key bound to its ID, with the period its tokens
+// are redeemable in for keys of version 3 issuers
+type KeyBundleKey struct {
+	ID         string     `json:"id"`
+	SigningKey string     `json:"signing_key"`
+	StartAt    *time.Time `json:"start_at,omitempty"`
+	EndAt      *time.Time `json:"end_at,omitempty"`
+}
+
+// BundledKey is a key to seal into a key bundle with the ID its ciphertext is bound to
+type BundledKey struct {
+	ID string
+	Key
+}
+
+// SealKeyBundle returns a bundle of the keys of each issuer type encrypted under the
+// RSA public key of the edge services, its version and validity are left to the caller
+func SealKeyBundle(keys map[string][]BundledKey, recipient *rsa.PublicKey) (*KeyBundle, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	defer wipe(dataKey)
+	sealedDataKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient, dataKey, keyBundleLabel)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newKeyBundleCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &KeyBundle{
+		Format:  KeyBundleFormat,
+		DataKey: base64.StdEncoding.EncodeToString(sealedDataKey),
+		Issuers: []KeyBundleIssuer{},
+	}
+	issuerTypes := make([]string, 0, len(keys))
+	for issuerType := range keys {
+		issuerTypes = append(issuerTypes, issuerType)
+	}
+	sort.Strings(issuerTypes)
+	for _, issuerType := range issuerTypes {
+		issuer := KeyBundleIssuer{IssuerType: issuerType}
+		for _, key := range keys[issuerType] {
+			text, err := key.SigningKey.MarshalText()
+			if err != nil {
+				return nil, err
+			}
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, err
+			}
+			bundled := KeyBundleKey{
+				ID:         key.ID,
+				SigningKey: base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, text, []byte(key.ID))),
+			}
+			wipe(text)
+			if !key.StartAt.IsZero() || !key.EndAt.IsZero() {
+				startAt, endAt := key.StartAt, key.EndAt
+				bundled.StartAt, bundled.EndAt = &startAt, &endAt
+			}
+			issuer.Keys = append(issuer.Keys, bundled)
+		}
+		bundle.Issuers = append(bundle.Issuers, issuer)
+	}
+	return bundle, nil
+}
+
+// OpenKeyBundle verifies a signed key bundle with the attestation public key and
+// decrypts its keys with the RSA private key of the edge services
+func OpenKeyBundle(signed *SignedKeyBundle, attestationKey ed25519.PublicKey, recipient *rsa.PrivateKey) (*KeyBundle, map[string][]Key, error) {
+	if signed.Algorithm != "Ed25519" || !ed25519.Verify(attestationKey, signed.Bundle, signed.Signature) {
+		return nil, nil, ErrInvalidKeyBundle
+	}
+	var bundle KeyBundle
+	if err := json.Unmarshal(signed.Bundle, &bundle); err != nil {
+		return nil, nil, err
+	}
+	if bundle.Format != KeyBundleFormat {
+		return nil, nil, ErrUnsupportedKeyBundle
+	}
+	if !bundle.ExpiresAt.After(time.Now()) {
+		return nil, nil, ErrExpiredKeyBundle
+	}
+
+	sealedDataKey, err := base64.StdEncoding.DecodeString(bundle.DataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, recipient, sealedDataKey, keyBundleLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(dataKey)
+	aead, err := newKeyBundleCipher(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := map[string][]Key{}
+	for _, issuer := range bundle.Issuers {
+		for _, bundled := range issuer.Keys {
+			sealed, err := base64.StdEncoding.DecodeString(bundled.SigningKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(sealed) < aead.NonceSize() {
+				return nil, nil, fmt.Errorf("signing key %s is truncated", bundled.ID)
+			}
+			nonce := sealed[:aead.NonceSize()]
+			text, err := aead.Open(nil, nonce, sealed[len(nonce):], []byte(bundled.ID))
+			if err != nil {
+				return nil, nil, fmt.Errorf("signing key %s could not be decrypted: %v", bundled.ID, err)
+			}
+			key := Key{SigningKey: &crypto.SigningKey{}}
+			err = key.SigningKey.UnmarshalText(text)
+			wipe(text)
+			if err != nil {
+				return nil, nil, err
+			}
+			if bundled.StartAt != nil && bundled.EndAt != nil {
+				key.StartAt, key.EndAt = *bundled.StartAt, *bundled.EndAt
+			}
+			keys[issuer.IssuerType] = append(keys[issuer.IssuerType], key)
+		}
+	}
+	return &bundle, keys, nil
+}
+
+// LoadKeyBundle replaces every key of the verifier with the keys of a signed key
+// bundle, unless it is not newer than the bundle loaded before, and returns its version
+func (v *Verifier) LoadKeyBundle(signed *SignedKeyBundle, attestationKey ed25519.PublicKey, recipient *rsa.PrivateKey) (int64, error) {
+	bundle, keys, err := OpenKeyBundle(signed, attestationKey, recipient)
+	if err != nil {
+		return 0, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if bundle.Version <= v.bundleVersion {
+		return 0, ErrStaleKeyBundle
+	}
+	v.keys = keys
+	v.bundleVersion = bundle.Version
+	return bundle.Version, nil
+}
+
+func newKeyBundleCipher(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wipe overwrites key material once it is no longer needed
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
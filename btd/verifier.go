@@ -0,0 +1,129 @@
+package btd
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+)
+
+var (
+	ErrTokenOutsideValidity = errors.New("token is not valid at this time")
+	ErrUnknownIssuer        = errors.New("no keys are known for the issuer type")
+	ErrPossiblySpent        = errors.New("token may have been spent, the server has to confirm the redemption")
+)
+
+// Key is a signing key of an issuer together with the period its tokens are redeemable
+// in. Keys of version 1 issuers have no period and are always valid.
+type Key struct {
+	SigningKey *crypto.SigningKey
+	StartAt    time.Time
+	EndAt      time.Time
+}
+
+// ValidAround reports whether a key is valid at now, give or take skew
+func (key Key) ValidAround(now time.Time, skew time.Duration) bool {
+	if key.StartAt.IsZero() && key.EndAt.IsZero() {
+		return true
+	}
+	return !now.Before(key.StartAt.Add(-skew)) && now.Before(key.EndAt.Add(skew))
+}
+
+// VerifyTokenRedemptionAt checks a redemption against the keys valid at now, give or
+// take skew. Tokens signed by one of the other keys are rejected with
+// ErrTokenOutsideValidity, those are only verified once the valid keys failed.
+func VerifyTokenRedemptionAt(preimage *crypto.TokenPreimage, signature *crypto.VerificationSignature, payload string, keys []Key, now time.Time, skew time.Duration) error {
+	current := []*crypto.SigningKey{}
+	others := []*crypto.SigningKey{}
+	for _, key := range keys {
+		if key.ValidAround(now, skew) {
+			current = append(current, key.SigningKey)
+		} else {
+			others = append(others, key.SigningKey)
+		}
+	}
+
+	var err error
+	if len(current) > 0 {
+		err = VerifyTokenRedemption(preimage, signature, payload, current)
+		if err == nil {
+			return nil
+		}
+	}
+	if len(others) > 0 {
+		if VerifyTokenRedemption(preimage, signature, payload, others) == nil {
+			return ErrTokenOutsideValidity
+		}
+	}
+	if err == nil {
+		err = ErrTokenOutsideValidity
+	}
+	return err
+}
+
+// Verifier verifies redemptions locally for services that hold the signing keys of
+// the issuer types they accept, without a request to the server for every token.
+// The public keys of the issuer directory can not verify redemptions, only the
+// signing keys can.
+//
+// Verification does not record the redemption. With the spent token filter of a
+// verification bundle, tokens that may have been spent are reported so that the
+// server can decide, tokens spent after the filter was built are not detected.
+type Verifier struct {
+	// Skew is how far clocks are allowed to drift at key validity boundaries
+	Skew time.Duration
+
+	mu    sync.RWMutex
+	keys  map[string][]Key
+	spent *BloomFilter
+	// bundleVersion is the version of the last key bundle loaded
+	bundleVersion int64
+}
+
+// NewVerifier returns a verifier without any keys
+func NewVerifier(skew time.Duration) *Verifier {
+	return &Verifier{Skew: skew, keys: map[string][]Key{}}
+}
+
+// SetKeys replaces the keys of an issuer type, no keys forget the type
+func (v *Verifier) SetKeys(issuerType string, keys []Key) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(keys) == 0 {
+		delete(v.keys, issuerType)
+		return
+	}
+	v.keys[issuerType] = append([]Key{}, keys...)
+}
+
+// SetSpent replaces the filter of spent tokens, nil stops checking for spent tokens
+func (v *Verifier) SetSpent(spent *BloomFilter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.spent = spent
+}
+
+// Verify checks a redemption of a token of an issuer type at the current time
+func (v *Verifier) Verify(issuerType string, preimage *crypto.TokenPreimage, signature *crypto.VerificationSignature, payload string) error {
+	v.mu.RLock()
+	keys, spent := v.keys[issuerType], v.spent
+	v.mu.RUnlock()
+	if len(keys) == 0 {
+		return ErrUnknownIssuer
+	}
+
+	if err := VerifyTokenRedemptionAt(preimage, signature, payload, keys, time.Now(), v.Skew); err != nil {
+		return err
+	}
+	if spent != nil {
+		id, err := preimage.MarshalText()
+		if err != nil {
+			return err
+		}
+		if spent.Contains(SpentTokenHash(issuerType, string(id))) {
+			return ErrPossiblySpent
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+// Command genvectors writes deterministic issuance and redemption test vectors as
+// JSON, for client implementations in other languages to check their
+// interoperability with the server.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/brave-intl/challenge-bypass-server/server"
+)
+
+func main() {
+	seed := flag.String("seed", server.DefaultVectorSeed, "seed the signing key and tokens are derived from")
+	tokens := flag.Int("n", 5, "number of tokens")
+	message := flag.String("message", server.DefaultVectorMessage, "message the redemptions sign")
+	out := flag.String("o", "", "file to write the vectors to instead of stdout")
+	flag.Parse()
+
+	set, err := server.GenerateTestVectors(*seed, *tokens, *message)
+	if err != nil {
+		log.Fatalf("could not generate test vectors: %s", err)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(set); err != nil {
+		log.Fatal(err)
+	}
+}
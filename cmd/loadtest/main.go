@@ -0,0 +1,202 @@
+// Command loadtest drives token issuance and redemption against a running server
+// and reports latency percentiles for each.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/brave-intl/challenge-bypass-server/server"
+)
+
+type config struct {
+	url          string
+	token        string
+	issuer       string
+	createIssuer bool
+	concurrency  int
+	requests     int
+	batch        int
+	payload      string
+}
+
+// results collects the latencies of one kind of request across all workers
+type results struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+}
+
+func (r *results) record(d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.latencies = append(r.latencies, d)
+}
+
+func (r *results) report(w io.Writer, name string, elapsed time.Duration) {
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(r.latencies) == 0 {
+			return 0
+		}
+		return r.latencies[int(p*float64(len(r.latencies)-1))]
+	}
+	fmt.Fprintf(w, "%-10s ok=%d errors=%d rate=%.1f/s p50=%s p90=%s p99=%s max=%s\n",
+		name, len(r.latencies), r.errors, float64(len(r.latencies))/elapsed.Seconds(),
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.url, "url", "http://localhost:2416", "base url of the server under test")
+	flag.StringVar(&cfg.token, "token", os.Getenv("TOKEN"), "bearer token for the server, defaults to $TOKEN")
+	flag.StringVar(&cfg.issuer, "issuer", "loadtest", "issuer type to issue and redeem against")
+	flag.BoolVar(&cfg.createIssuer, "create_issuer", false, "create the issuer before starting")
+	flag.IntVar(&cfg.concurrency, "c", 10, "number of concurrent workers")
+	flag.IntVar(&cfg.requests, "n", 100, "number of issuance requests per worker")
+	flag.IntVar(&cfg.batch, "batch", 10, "blinded tokens per issuance request, each is then redeemed")
+	flag.StringVar(&cfg.payload, "payload", "loadtest", "payload signed by each redemption")
+	flag.Parse()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	if cfg.createIssuer {
+		body := fmt.Sprintf(`{"name":%q,"max_tokens":%d}`, cfg.issuer, cfg.batch)
+		if _, err := do(client, cfg, http.MethodPost, "/v1/issuer/", []byte(body)); err != nil {
+			log.Fatalf("could not create issuer: %s", err)
+		}
+	}
+
+	body, err := do(client, cfg, http.MethodGet, "/v1/issuer/"+cfg.issuer, nil)
+	if err != nil {
+		log.Fatalf("could not fetch issuer: %s", err)
+	}
+	var issuer server.IssuerResponse
+	if err := json.Unmarshal(body, &issuer); err != nil {
+		log.Fatalf("could not parse issuer: %s", err)
+	}
+
+	var issuance, redemption results
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < cfg.requests; j++ {
+				tokens, err := issue(client, cfg, issuer.PublicKey, &issuance)
+				if err != nil {
+					continue
+				}
+				for _, token := range tokens {
+					redeem(client, cfg, token, &redemption)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("%d workers, %d issuance requests of %d tokens each, %s\n", cfg.concurrency, cfg.concurrency*cfg.requests, cfg.batch, elapsed)
+	issuance.report(os.Stdout, "issue", elapsed)
+	redemption.report(os.Stdout, "redeem", elapsed)
+}
+
+// issue requests signatures for a batch of new tokens, returning them unblinded
+func issue(client *http.Client, cfg config, publicKey *crypto.PublicKey, res *results) ([]*crypto.UnblindedToken, error) {
+	tokens := make([]*crypto.Token, cfg.batch)
+	blindedTokens := make([]*crypto.BlindedToken, cfg.batch)
+	for i := range tokens {
+		token, err := crypto.RandomToken()
+		if err != nil {
+			return nil, err
+		}
+		tokens[i] = token
+		blindedTokens[i] = token.Blind()
+	}
+
+	body, err := json.Marshal(server.BlindedTokenIssueRequest{BlindedTokens: blindedTokens})
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	body, err = do(client, cfg, http.MethodPost, "/v1/blindedToken/"+cfg.issuer, body)
+	res.record(time.Since(start), err)
+	if err != nil {
+		log.Printf("issue: %s", err)
+		return nil, err
+	}
+
+	var resp server.BlindedTokenIssueResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.BatchProof.VerifyAndUnblind(tokens, blindedTokens, resp.SignedTokens, publicKey)
+}
+
+func redeem(client *http.Client, cfg config, token *crypto.UnblindedToken, res *results) {
+	signature, err := token.DeriveVerificationKey().Sign(cfg.payload)
+	if err != nil {
+		res.record(0, err)
+		return
+	}
+
+	body, err := json.Marshal(server.BlindedTokenRedeemRequest{
+		Payload:       cfg.payload,
+		TokenPreimage: token.Preimage(),
+		Signature:     signature,
+	})
+	if err != nil {
+		res.record(0, err)
+		return
+	}
+
+	start := time.Now()
+	_, err = do(client, cfg, http.MethodPost, "/v1/blindedToken/"+cfg.issuer+"/redemption/", body)
+	res.record(time.Since(start), err)
+	if err != nil {
+		log.Printf("redeem: %s", err)
+	}
+}
+
+func do(client *http.Client, cfg config, method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, cfg.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, respBody)
+	}
+	return respBody, nil
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/brave-intl/challenge-bypass-server/server"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var migrateBaseline int
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply any pending database migrations, like migrate up",
+	Args:  cobra.NoArgs,
+	RunE:  migrateUp,
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply any pending database migrations",
+	Args:  cobra.NoArgs,
+	RunE:  migrateUp,
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down [steps]",
+	Short: "Revert the latest applied database migrations, one unless steps are given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		steps := 1
+		if len(args) > 0 {
+			var err error
+			if steps, err = strconv.Atoi(args[0]); err != nil || steps <= 0 {
+				return fmt.Errorf("steps must be a positive number, not %s", args[0])
+			}
+		}
+
+		reverted, err := srv.RevertMigrations(steps)
+		for _, migration := range reverted {
+			logger.WithFields(logrus.Fields{"prefix": "main", "version": migration.Version, "name": migration.Name}).Info("Reverted migration")
+		}
+		return err
+	},
+}
+
+func migrateUp(cmd *cobra.Command, args []string) error {
+	applied, err := srv.Migrate(migrateBaseline)
+	for _, migration := range applied {
+		logger.WithFields(logrus.Fields{"prefix": "main", "version": migration.Version, "name": migration.Name}).Info("Applied migration")
+	}
+	return err
+}
+
+var issuerRequest server.IssuerCreateRequest
+var issuerExpiresAt string
+
+var createIssuerCmd = &cobra.Command{
+	Use:   "create-issuer",
+	Short: "Create an issuer and print its public keys",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if issuerExpiresAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, issuerExpiresAt)
+			if err != nil {
+				return err
+			}
+			issuerRequest.ExpiresAt = &expiresAt
+		}
+
+		issuer, err := srv.CreateIssuer(issuerRequest)
+		if err != nil {
+			return err
+		}
+		return printJSON(issuer)
+	},
+}
+
+var rotateIssuersCmd = &cobra.Command{
+	Use:   "rotate-issuers",
+	Short: "Replace every issuer that is due for rotation and print the replacements",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		issuers, err := srv.RotateIssuers()
+		if err != nil {
+			return err
+		}
+		for _, issuer := range issuers {
+			if err := printJSON(issuer); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var retireIssuerCmd = &cobra.Command{
+	Use:   "retire-issuer <type>",
+	Short: "Immediately expire every issuer of a type, its tokens can no longer be redeemed",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		retired, err := srv.RetireIssuer(args[0])
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"prefix": "main", "retired": retired}).Info("Retired issuer")
+		return nil
+	},
+}
+
+var revokeRequest server.IssuerRevokeRequest
+
+var revokeIssuerCmd = &cobra.Command{
+	Use:   "revoke-issuer <id>",
+	Short: "Revoke a compromised issuer, its tokens are rejected as revoked",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		resp, err := srv.RevokeIssuer(args[0], revokeRequest.Reason, revokeRequest.Replace)
+		if err != nil {
+			return err
+		}
+		return printJSON(resp)
+	},
+}
+
+var renameIssuerCmd = &cobra.Command{
+	Use:   "rename-issuer <type> <new-type>",
+	Short: "Rename every issuer of a type, clients can keep using the old name",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := srv.RenameIssuer(args[0], args[1]); err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"prefix": "main", "from": args[0], "to": args[1]}).Info("Renamed issuer")
+		return nil
+	},
+}
+
+var listIssuersCmd = &cobra.Command{
+	Use:   "list-issuers",
+	Short: "Print every unexpired issuer, including rotated ones",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		issuers, err := srv.ListIssuers()
+		if err != nil {
+			return err
+		}
+		for _, issuer := range issuers {
+			if err := printJSON(issuer); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var apiKeyRequest server.APIKeyCreateRequest
+
+var createAPIKeyCmd = &cobra.Command{
+	Use:   "create-api-key",
+	Short: "Create an API key and print it, the key cannot be retrieved again",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := srv.CreateAPIKey(apiKeyRequest.Name, apiKeyRequest.Tenant)
+		if err != nil {
+			return err
+		}
+		return printJSON(key)
+	},
+}
+
+var exportIssuer, exportSince, exportOutput string
+
+var exportRedemptionsCmd = &cobra.Command{
+	Use:   "export-redemptions",
+	Short: "Write redemptions as newline delimited JSON",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var since time.Time
+		if exportSince != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, exportSince); err != nil {
+				return err
+			}
+		}
+
+		out := os.Stdout
+		if exportOutput != "" {
+			f, err := os.Create(exportOutput)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		count, err := srv.ExportRedemptions(out, exportIssuer, since)
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"prefix": "main", "redemptions": count}).Info("Exported redemptions")
+		return nil
+	},
+}
+
+var importFormat string
+
+var importRedemptionsCmd = &cobra.Command{
+	Use:   "import-redemptions <file>",
+	Short: "Verify and record redemptions from a csv or ndjson file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if importFormat == "" {
+			importFormat = server.ImportFormatFromPath(args[0])
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		summary, err := srv.ImportRedemptions(f, importFormat, os.Stdout)
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{
+			"prefix":     "main",
+			"redeemed":   summary.Redeemed,
+			"duplicates": summary.Duplicates,
+			"invalid":    summary.Invalid,
+			"errors":     summary.Errors,
+		}).Info("Finished importing redemptions")
+		return nil
+	},
+}
+
+var exportBundleCmd = &cobra.Command{
+	Use:   "export-bundle <file>",
+	Short: "Write an offline verification bundle",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := srv.ExportVerificationBundle(f); err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"prefix": "main"}).Info("Exported verification bundle")
+		return nil
+	},
+}
+
+var backupPublicKey, restorePrivateKey string
+
+var backupIssuersCmd = &cobra.Command{
+	Use:   "backup-issuers <file>",
+	Short: "Write every issuer with its signing keys encrypted under an RSA public key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		publicKey, err := ioutil.ReadFile(backupPublicKey)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		count, err := srv.BackupIssuers(f, publicKey)
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"prefix": "main", "issuers": count}).Info("Backed up issuers")
+		return nil
+	},
+}
+
+var restoreIssuersCmd = &cobra.Command{
+	Use:   "restore-issuers <file>",
+	Short: "Restore the issuers of a backup, keeping their ids, versions and keys",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		privateKey, err := ioutil.ReadFile(restorePrivateKey)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		count, err := srv.RestoreIssuers(f, privateKey)
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"prefix": "main", "issuers": count}).Info("Restored issuers")
+		return nil
+	},
+}
+
+var backfillDynamoCmd = &cobra.Command{
+	Use:   "backfill-dynamo",
+	Short: "Copy the redemptions of dual written issuers from Postgres to DynamoDB",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		count, err := srv.BackfillDynamo()
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"prefix": "main", "redemptions": count}).Info("Backfilled DynamoDB")
+		return nil
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{migrateCmd, migrateUpCmd} {
+		cmd.Flags().IntVar(&migrateBaseline, "baseline", 0, "record the migrations up to this version as applied without running them, for databases created before migrations were recorded")
+	}
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd)
+
+	createIssuerCmd.Flags().StringVar(&issuerRequest.Name, "name", "", "issuer type")
+	createIssuerCmd.Flags().IntVar(&issuerRequest.MaxTokens, "max-tokens", 0, "maximum tokens per issuance request")
+	createIssuerCmd.Flags().IntVar(&issuerRequest.Version, "version", 0, "issuer version, 1 or 3, 1 by default")
+	createIssuerCmd.Flags().Int64Var(&issuerRequest.BucketSeconds, "bucket-seconds", 0, "key validity bucket length of version 3 issuers")
+	createIssuerCmd.Flags().IntVar(&issuerRequest.Buffer, "buffer", 0, "number of buckets version 3 issuers sign ahead for")
+	createIssuerCmd.Flags().StringVar(&issuerExpiresAt, "expires-at", "", "RFC3339 time the issuer expires and is rotated ahead of")
+	createIssuerCmd.Flags().IntVar(&issuerRequest.RotationWindowDays, "rotation-window-days", 0, "days before expiry the issuer is rotated, overriding the default")
+	createIssuerCmd.Flags().IntVar(&issuerRequest.ValidDays, "valid-days", 0, "days the issuer and its replacements are valid for")
+	createIssuerCmd.Flags().IntVar(&issuerRequest.RedemptionRetentionDays, "redemption-retention-days", 0, "days redemptions are kept before archival, overriding the default")
+	createIssuerCmd.Flags().StringVar(&issuerRequest.RedemptionStore, "redemption-store", "", "postgres, the default, or redis to record redemptions in Redis only")
+	createIssuerCmd.Flags().StringArrayVar(&issuerRequest.PayloadPolicy, "payload-policy", nil, "payload transformer applied before redemptions are persisted, repeated in order, e.g. strip:email")
+	createIssuerCmd.Flags().StringVar(&issuerRequest.Profile, "profile", "", "issuer profile providing the settings that are not given")
+	_ = createIssuerCmd.MarkFlagRequired("name")
+
+	createAPIKeyCmd.Flags().StringVar(&apiKeyRequest.Name, "name", "", "name usage is accounted to")
+	createAPIKeyCmd.Flags().StringVar(&apiKeyRequest.Tenant, "tenant", "", "tenant whose issuers the key can use")
+	_ = createAPIKeyCmd.MarkFlagRequired("name")
+
+	revokeIssuerCmd.Flags().StringVar(&revokeRequest.Reason, "reason", "", "why the issuer is revoked, recorded in the audit log")
+	revokeIssuerCmd.Flags().BoolVar(&revokeRequest.Replace, "replace", false, "replace an active issuer with a new one with the same settings")
+	_ = revokeIssuerCmd.MarkFlagRequired("reason")
+
+	exportRedemptionsCmd.Flags().StringVar(&exportIssuer, "issuer", "", "only export redemptions of this issuer type")
+	exportRedemptionsCmd.Flags().StringVar(&exportSince, "since", "", "only export redemptions after this RFC3339 time")
+	exportRedemptionsCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "file to write to instead of stdout")
+
+	importRedemptionsCmd.Flags().StringVar(&importFormat, "format", "", "format of the import file (csv or ndjson), inferred from the file extension by default")
+
+	backupIssuersCmd.Flags().StringVar(&backupPublicKey, "public-key", "", "PEM encoded RSA public key the signing keys are encrypted under")
+	_ = backupIssuersCmd.MarkFlagRequired("public-key")
+	restoreIssuersCmd.Flags().StringVar(&restorePrivateKey, "private-key", "", "PEM encoded RSA private key matching the public key of the backup")
+	_ = restoreIssuersCmd.MarkFlagRequired("private-key")
+
+	rootCmd.AddCommand(
+		migrateCmd,
+		createIssuerCmd,
+		rotateIssuersCmd,
+		retireIssuerCmd,
+		revokeIssuerCmd,
+		renameIssuerCmd,
+		listIssuersCmd,
+		createAPIKeyCmd,
+		exportRedemptionsCmd,
+		importRedemptionsCmd,
+		exportBundleCmd,
+		backupIssuersCmd,
+		restoreIssuersCmd,
+		backfillDynamoCmd,
+	)
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(b))
+	return err
+}
@@ -2,57 +2,139 @@ package main
 
 import (
 	"context"
-	"flag"
+	"fmt"
 	"os"
-	"strconv"
+	"strings"
 
 	"github.com/brave-intl/challenge-bypass-server/server"
 	raven "github.com/getsentry/raven-go"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
+var (
+	configFile string
+	srv        = *server.DefaultServer
+
+	serverCtx context.Context
+	logger    *logrus.Logger
+)
+
+var rootCmd = &cobra.Command{
+	Use:               "challenge-bypass-server",
+	Short:             "Blinded token issuance and redemption server",
+	PersistentPreRunE: loadConfig,
+	RunE:              serve,
+	SilenceUsage:      true,
+	// Commands exit as soon as they finish, wait for any events they published
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		srv.WaitForEvents()
+	},
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the HTTP server, the default when no command is given",
+	Args:  cobra.NoArgs,
+	RunE:  serve,
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "JSON, YAML or TOML config file, overridden by the environment and flags")
+	rootCmd.PersistentFlags().StringVar(&srv.DbConfigPath, "db_config", "", "path to the json file with database configuration")
+	// Flags are registered as strings and parsed like the environment, only flags that
+	// are given override the other sources
+	for _, setting := range server.DefaultServer.Settings() {
+		rootCmd.PersistentFlags().StringP(setting.Flag, setting.Shorthand, "", fmt.Sprintf("%s (%s)", setting.Usage, setting.Env))
+	}
+	rootCmd.AddCommand(serveCmd)
+}
+
 func main() {
-	// Server setup
-	var configFile string
-	var err error
+	serverCtx, logger = server.SetupLogger(context.Background())
 
-	serverCtx, logger := server.SetupLogger(context.Background())
+	rootCmd.SetArgs(singleDashArgs(rootCmd, os.Args[1:]))
+	if err := rootCmd.Execute(); err != nil {
+		logger.Panic(err)
+	}
+}
 
-	logger.WithFields(logrus.Fields{"prefix": "main"}).Info("Loading config")
+// singleDashArgs rewrites long flags given with a single dash, such as -config or
+// -db_config=path, to the double dash cobra expects. The flag package the server used
+// before its subcommands accepted both, and cobra would read them as a bundle of
+// shorthands. Shorthands such as -p are left alone.
+func singleDashArgs(root *cobra.Command, args []string) []string {
+	long := map[string]bool{}
+	var collect func(cmd *cobra.Command)
+	collect = func(cmd *cobra.Command) {
+		cmd.PersistentFlags().VisitAll(func(f *pflag.Flag) { long[f.Name] = true })
+		cmd.Flags().VisitAll(func(f *pflag.Flag) { long[f.Name] = true })
+		for _, sub := range cmd.Commands() {
+			collect(sub)
+		}
+	}
+	collect(root)
 
-	srv := *server.DefaultServer
+	normalized := make([]string, len(args))
+	for i, arg := range args {
+		normalized[i] = arg
+		if arg == "--" {
+			copy(normalized[i:], args[i:])
+			break
+		}
+		if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' && long[strings.SplitN(arg[1:], "=", 2)[0]] {
+			normalized[i] = "-" + arg
+		}
+	}
+	return normalized
+}
 
-	flag.StringVar(&configFile, "config", "", "local config file for development (overrides cli options)")
-	flag.StringVar(&srv.DbConfigPath, "db_config", "", "path to the json file with database configuration")
-	flag.IntVar(&srv.ListenPort, "p", 2416, "port to listen on")
-	flag.Parse()
+// loadConfig applies the config file, the environment and flags in increasing order
+// of precedence. Every command shares it so operational tasks run against the same
+// database as the server.
+func loadConfig(cmd *cobra.Command, args []string) error {
+	logger.WithFields(logrus.Fields{"prefix": "main"}).Info("Loading config")
 
 	if configFile != "" {
+		var err error
 		srv, err = server.LoadConfigFile(configFile)
 		if err != nil {
-			logger.Panic(err)
-			return
+			return err
 		}
 	}
 
-	if port := os.Getenv("PORT"); port != "" {
-		if portNumber, err := strconv.Atoi(port); err == nil {
-			srv.ListenPort = portNumber
+	if err := srv.ApplyEnv(); err != nil {
+		return err
+	}
+	for _, setting := range srv.Settings() {
+		if flag := cmd.Flags().Lookup(setting.Flag); flag != nil && flag.Changed {
+			if err := setting.Set(flag.Value.String()); err != nil {
+				return err
+			}
 		}
 	}
+	srv.LoadDbConfig(srv.Database)
+	if err := srv.InitSecrets(); err != nil {
+		return err
+	}
 
-	err = srv.InitDbConfig()
-	if err != nil {
-		logger.Panic(err)
+	// Vault secrets override the database config from every other source
+	if err := srv.InitVault(); err != nil {
+		return err
 	}
+	return srv.Validate()
+}
 
+func serve(cmd *cobra.Command, args []string) error {
+	if summary, err := srv.EffectiveConfig(); err == nil {
+		logger.WithFields(logrus.Fields{"prefix": "main"}).Info("Effective config: " + summary)
+	}
 	logger.WithFields(logrus.Fields{"prefix": "main"}).Info("Starting server")
 
-	err = srv.ListenAndServe(serverCtx, logger)
-
+	err := srv.ListenAndServe(serverCtx, logger)
 	if err != nil {
 		raven.CaptureErrorAndWait(err, nil)
-		logger.Panic(err)
-		return
 	}
+	return err
 }
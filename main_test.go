@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSingleDashArgs(t *testing.T) {
+	args := []string{
+		"-config", "config.yaml", "-db_config=db.json", "-p", "2416", "--port", "2416",
+		"export-redemptions", "-since", "2020-01-01T00:00:00Z", "-o", "out.ndjson", "-unknown",
+		"--", "-config",
+	}
+	expected := []string{
+		"--config", "config.yaml", "--db_config=db.json", "-p", "2416", "--port", "2416",
+		"export-redemptions", "--since", "2020-01-01T00:00:00Z", "-o", "out.ndjson", "-unknown",
+		"--", "-config",
+	}
+	if normalized := singleDashArgs(rootCmd, args); !reflect.DeepEqual(expected, normalized) {
+		t.Errorf("Single dash long flags should be normalized, got %v", normalized)
+	}
+
+	if err := rootCmd.ParseFlags(singleDashArgs(rootCmd, []string{"-config", "config.yaml", "-p", "2416"})); err != nil {
+		t.Fatalf("Flags of the flag package should still parse: %s", err)
+	}
+	if configFile != "config.yaml" {
+		t.Errorf("-config should set the config file, got %q", configFile)
+	}
+	if port := rootCmd.Flags().Lookup("port"); port == nil || port.Value.String() != "2416" {
+		t.Errorf("-p should set the listen port")
+	}
+}
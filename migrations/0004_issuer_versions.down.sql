@@ -0,0 +1,10 @@
+drop table issuer_keys;
+
+delete from issuers where signing_key is null;
+alter table issuers alter column signing_key set not null;
+alter table issuers drop column buffer;
+alter table issuers drop column bucket_seconds;
+alter table issuers drop column created_at;
+alter table issuers drop column version;
+alter table issuers drop constraint issuers_id_key;
+alter table issuers drop column id;
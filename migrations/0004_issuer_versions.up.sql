@@ -0,0 +1,20 @@
+alter table issuers add column id uuid;
+update issuers set id = md5(random()::text || clock_timestamp()::text)::uuid;
+alter table issuers alter column id set not null;
+alter table issuers add constraint issuers_id_key unique (id);
+
+alter table issuers add column version integer not null default 1;
+alter table issuers add column created_at timestamp not null default now();
+alter table issuers add column bucket_seconds bigint not null default 0;
+alter table issuers add column buffer integer not null default 1;
+alter table issuers alter column signing_key drop not null;
+
+create table issuer_keys (
+  id uuid not null primary key,
+  issuer_id uuid not null references issuers(id) on delete cascade,
+  signing_key text not null,
+  start_at timestamp not null,
+  end_at timestamp not null,
+  created_at timestamp not null default now(),
+  unique (issuer_id, start_at)
+);
@@ -0,0 +1,3 @@
+drop trigger audit_log_append_only on audit_log;
+drop function audit_log_append_only();
+drop table audit_log;
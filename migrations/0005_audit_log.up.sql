@@ -0,0 +1,22 @@
+create table audit_log (
+  id bigserial primary key,
+  ts timestamp not null default now(),
+  actor text not null,
+  action text not null,
+  issuer_id uuid,
+  issuer_type text,
+  request_id text,
+  details text
+);
+
+create index audit_log_issuer_id on audit_log (issuer_id);
+create index audit_log_ts on audit_log (ts);
+
+create function audit_log_append_only() returns trigger as $$
+begin
+  raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+
+create trigger audit_log_append_only before update or delete on audit_log
+  for each row execute procedure audit_log_append_only();
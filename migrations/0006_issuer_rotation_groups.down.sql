@@ -0,0 +1,14 @@
+alter table issuers drop column group_id;
+drop table issuer_groups;
+
+delete from issuers where rotated_at is not null;
+drop index issuers_active_type;
+drop index issuers_type;
+alter table issuers drop column rotated_at;
+alter table issuers drop column expires_at;
+
+alter table issuer_keys drop constraint issuer_keys_issuer_id_fkey;
+alter table issuers drop constraint issuers_pkey;
+alter table issuers add primary key (issuer_type);
+alter table issuers add constraint issuers_id_key unique (id);
+alter table issuer_keys add constraint issuer_keys_issuer_id_fkey foreign key (issuer_id) references issuers(id) on delete cascade;
@@ -0,0 +1,19 @@
+alter table issuer_keys drop constraint issuer_keys_issuer_id_fkey;
+alter table issuers drop constraint issuers_id_key;
+alter table issuers drop constraint issuers_pkey;
+alter table issuers add primary key (id);
+alter table issuer_keys add constraint issuer_keys_issuer_id_fkey foreign key (issuer_id) references issuers(id) on delete cascade;
+
+alter table issuers add column expires_at timestamp;
+alter table issuers add column rotated_at timestamp;
+
+create index issuers_type on issuers (issuer_type);
+create unique index issuers_active_type on issuers (issuer_type) where rotated_at is null;
+
+create table issuer_groups (
+  id uuid not null primary key,
+  name text not null unique,
+  created_at timestamp not null default now()
+);
+
+alter table issuers add column group_id uuid references issuer_groups(id);
@@ -0,0 +1,3 @@
+drop index redemptions_id_hash;
+alter table redemptions drop column id_hash;
+drop table redemption_hash_salt;
@@ -0,0 +1,7 @@
+create table redemption_hash_salt (
+  id integer not null primary key check (id = 1),
+  salt text not null
+);
+
+alter table redemptions add column id_hash text;
+create index redemptions_id_hash on redemptions (issuer_type, id_hash);
@@ -0,0 +1,2 @@
+alter table issuers drop column valid_days;
+alter table issuers drop column rotation_window_days;
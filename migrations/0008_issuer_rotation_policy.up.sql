@@ -0,0 +1,2 @@
+alter table issuers add column rotation_window_days integer;
+alter table issuers add column valid_days integer;
@@ -0,0 +1 @@
+drop table pending_issuers;
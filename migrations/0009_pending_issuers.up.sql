@@ -0,0 +1,11 @@
+create table pending_issuers (
+  id uuid not null primary key,
+  predecessor_id uuid not null unique,
+  issuer_type text not null,
+  signing_key text not null,
+  activates_at timestamp not null,
+  expires_at timestamp not null,
+  created_at timestamp not null default now()
+);
+
+create index pending_issuers_type on pending_issuers (issuer_type);
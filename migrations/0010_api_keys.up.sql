@@ -0,0 +1,16 @@
+create table api_keys (
+  id uuid not null primary key,
+  name text not null unique,
+  key_hash text not null unique,
+  tenant text,
+  created_at timestamp not null default now(),
+  revoked_at timestamp
+);
+
+create table api_key_usage (
+  api_key_id uuid not null references api_keys(id) on delete cascade,
+  day date not null,
+  issued bigint not null default 0,
+  redeemed bigint not null default 0,
+  primary key (api_key_id, day)
+);
@@ -0,0 +1,7 @@
+create table issuer_aliases (
+  alias text not null primary key,
+  issuer_type text not null,
+  created_at timestamp not null default now()
+);
+
+create index issuer_aliases_type on issuer_aliases (issuer_type);
@@ -0,0 +1,2 @@
+alter table redemptions drop column void_reason;
+alter table redemptions drop column voided_at;
@@ -0,0 +1,2 @@
+alter table redemptions add column voided_at timestamp;
+alter table redemptions add column void_reason text;
@@ -0,0 +1 @@
+alter table issuers drop column redemption_retention_days;
@@ -0,0 +1 @@
+alter table issuers add column redemption_retention_days integer;
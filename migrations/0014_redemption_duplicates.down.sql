@@ -0,0 +1 @@
+drop table redemption_duplicates;
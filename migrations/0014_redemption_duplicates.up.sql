@@ -0,0 +1,6 @@
+create table redemption_duplicates (
+  issuer_type text not null,
+  hour timestamp not null,
+  attempts bigint not null default 0,
+  primary key (issuer_type, hour)
+);
@@ -0,0 +1,10 @@
+create table duplicate_attempts (
+  id bigserial primary key,
+  issuer_type text not null,
+  id_hash text not null,
+  payload text,
+  caller text not null,
+  attempted_at timestamp not null default now()
+);
+
+create index duplicate_attempts_attempted_at on duplicate_attempts (attempted_at);
@@ -0,0 +1,7 @@
+create table redemption_attributes (
+  issuer_type text not null,
+  bucket timestamp not null,
+  country text not null,
+  redemptions bigint not null default 0,
+  primary key (issuer_type, bucket, country)
+);
@@ -0,0 +1 @@
+alter table issuers drop column revoked_at, drop column revocation_reason;
@@ -0,0 +1 @@
+alter table issuers add column revoked_at timestamp, add column revocation_reason text;
@@ -0,0 +1 @@
+drop table token_reservations;
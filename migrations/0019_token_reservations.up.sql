@@ -0,0 +1,8 @@
+create table token_reservations (
+  id_hash text primary key,
+  issuer_type text not null,
+  reservation_id text not null,
+  expires_at timestamp not null
+);
+
+create index token_reservations_expires_at on token_reservations (expires_at);
@@ -0,0 +1,4 @@
+alter table token_reservations add column token_id text, add column payload text,
+  add column state text not null default 'reserved', add column created_at timestamp not null default now();
+
+create unique index token_reservations_reservation_id on token_reservations (reservation_id);
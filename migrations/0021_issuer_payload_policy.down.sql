@@ -0,0 +1 @@
+alter table issuers drop column payload_policy;
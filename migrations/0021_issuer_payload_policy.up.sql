@@ -0,0 +1 @@
+alter table issuers add column payload_policy text[];
@@ -0,0 +1 @@
+drop table issuer_freezes;
@@ -0,0 +1,7 @@
+create table issuer_freezes (
+  issuer_type text not null primary key,
+  operations text not null,
+  reason text not null,
+  actor text not null,
+  frozen_at timestamp not null default now()
+);
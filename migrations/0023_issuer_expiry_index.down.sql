@@ -0,0 +1 @@
+drop index issuers_type_expires_at;
@@ -0,0 +1 @@
+create index issuers_type_expires_at on issuers (issuer_type, expires_at);
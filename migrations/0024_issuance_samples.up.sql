@@ -0,0 +1,12 @@
+create table issuance_samples (
+  id bigserial primary key,
+  issuer_id uuid,
+  issuer_type text not null,
+  caller text not null,
+  batch_size integer not null,
+  duration_ms double precision not null,
+  sample_percent integer not null,
+  sampled_at timestamp not null default now()
+);
+
+create index issuance_samples_sampled_at on issuance_samples (sampled_at);
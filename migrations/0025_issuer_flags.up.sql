@@ -0,0 +1 @@
+alter table issuers add column flags jsonb not null default '{}';
@@ -0,0 +1,8 @@
+create table request_nonces (
+  key_id text not null,
+  nonce text not null,
+  seen_at timestamp not null default now(),
+  primary key (key_id, nonce)
+);
+
+create index request_nonces_seen_at on request_nonces (seen_at);
@@ -0,0 +1,6 @@
+create table issuance_quota_usage (
+  issuer_type text not null,
+  window_start timestamp not null,
+  used bigint not null,
+  primary key (issuer_type, window_start)
+);
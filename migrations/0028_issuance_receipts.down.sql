@@ -0,0 +1 @@
+drop table issuance_receipts;
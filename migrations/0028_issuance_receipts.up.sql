@@ -0,0 +1,10 @@
+create table issuance_receipts (
+  log_index bigint primary key,
+  issuer_id uuid not null,
+  issuer_type text not null,
+  public_key text not null,
+  token_count integer not null,
+  batch_root bytea not null,
+  leaf_hash bytea not null,
+  signed_at timestamp not null
+);
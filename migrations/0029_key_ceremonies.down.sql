@@ -0,0 +1 @@
+drop table key_ceremonies;
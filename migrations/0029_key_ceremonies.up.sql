@@ -0,0 +1,11 @@
+create table key_ceremonies (
+  id uuid not null primary key,
+  issuer_type text not null unique,
+  request jsonb not null,
+  shares_required integer not null,
+  contributors text[] not null default '{}',
+  accumulated_key text,
+  created_by text not null,
+  created_at timestamp not null default now(),
+  expires_at timestamp not null
+);
@@ -0,0 +1,5 @@
+drop index issuers_canary_type;
+drop index issuers_active_type;
+update issuers set rotated_at = now() where canary_percent is not null and rotated_at is null;
+create unique index issuers_active_type on issuers (issuer_type) where rotated_at is null;
+alter table issuers drop column canary_percent;
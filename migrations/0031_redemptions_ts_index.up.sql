@@ -0,0 +1,5 @@
+-- migrate:no-transaction
+-- Building the index concurrently keeps redemptions flowing on large tables. A build
+-- that failed leaves an invalid index behind, which is dropped before trying again.
+drop index concurrently if exists redemptions_ts;
+create index concurrently redemptions_ts on redemptions (ts);
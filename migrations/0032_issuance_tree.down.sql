@@ -0,0 +1,2 @@
+drop table issuance_tree_state;
+drop table issuance_tree_nodes;
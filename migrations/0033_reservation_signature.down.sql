@@ -0,0 +1 @@
+alter table token_reservations drop column signature, drop column request_payload;
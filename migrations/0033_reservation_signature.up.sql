@@ -0,0 +1 @@
+alter table token_reservations add column signature text, add column request_payload text;
@@ -0,0 +1,3 @@
+drop table issuers;
+drop index redemptions_type;
+drop table redemptions;
@@ -0,0 +1,9 @@
+alter table issuers rename column "issuerType" to issuer_type;
+alter table issuers rename column "signingKey" to signing_key;
+alter table issuers rename column "maxTokens" to max_tokens;
+
+drop index redemptions_type;
+alter table redemptions rename column "issuerType" to issuer_type;
+
+-- CockroachDB has no hash indexes
+create index redemptions_type on redemptions (issuer_type);
@@ -0,0 +1,16 @@
+create table audit_log (
+  id bigserial primary key,
+  ts timestamp not null default now(),
+  actor text not null,
+  action text not null,
+  issuer_id uuid,
+  issuer_type text,
+  request_id text,
+  details text
+);
+
+create index audit_log_issuer_id on audit_log (issuer_id);
+create index audit_log_ts on audit_log (ts);
+
+-- CockroachDB has no triggers, audit_log is kept append-only by not granting UPDATE
+-- and DELETE on it to the server's user
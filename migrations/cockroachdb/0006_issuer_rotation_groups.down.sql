@@ -0,0 +1,13 @@
+alter table issuers drop column group_id;
+drop table issuer_groups;
+
+delete from issuers where rotated_at is not null;
+drop index issuers@issuers_active_type cascade;
+drop index issuers@issuers_type;
+alter table issuers drop column rotated_at;
+alter table issuers drop column expires_at;
+
+-- The primary key on id is kept as the unique index issuers_id_key
+alter table issuer_keys drop constraint issuer_keys_issuer_id_fkey;
+alter table issuers alter primary key using columns (issuer_type);
+alter table issuer_keys add constraint issuer_keys_issuer_id_fkey foreign key (issuer_id) references issuers(id) on delete cascade;
@@ -0,0 +1,2 @@
+drop index token_reservations@token_reservations_reservation_id cascade;
+alter table token_reservations drop column token_id, drop column payload, drop column state, drop column created_at;
@@ -0,0 +1,5 @@
+drop index issuers@issuers_canary_type cascade;
+drop index issuers@issuers_active_type cascade;
+update issuers set rotated_at = now() where canary_percent is not null and rotated_at is null;
+create unique index issuers_active_type on issuers (issuer_type) where rotated_at is null;
+alter table issuers drop column canary_percent;
@@ -0,0 +1,4 @@
+alter table issuers add column canary_percent integer;
+drop index issuers@issuers_active_type cascade;
+create unique index issuers_active_type on issuers (issuer_type) where rotated_at is null and canary_percent is null;
+create unique index issuers_canary_type on issuers (issuer_type) where rotated_at is null and canary_percent is not null;
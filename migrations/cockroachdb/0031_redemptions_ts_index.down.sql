@@ -0,0 +1 @@
+drop index if exists redemptions@redemptions_ts;
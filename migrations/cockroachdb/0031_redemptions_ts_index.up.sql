@@ -0,0 +1,2 @@
+-- CockroachDB builds indexes online without CONCURRENTLY
+create index if not exists redemptions_ts on redemptions (ts);
@@ -0,0 +1,194 @@
+// Package migrations loads the SQL migrations of the server's schema and applies them
+// to Postgres, CockroachDB or SQLite, recording a checksum of every applied migration.
+//
+// Migrations are named NNNN_name.up.sql and NNNN_name.down.sql. The files at the top
+// of the source directory are written for Postgres. CockroachDB uses them as well,
+// except where a file of the same version in the cockroachdb directory replaces one
+// CockroachDB does not support. SQLite only uses the sqlite directory, which has to
+// provide every version from its first one on.
+//
+// A script starting with the line "-- migrate:no-transaction" runs its statements one
+// at a time outside of a transaction, for statements such as CREATE INDEX CONCURRENTLY
+// that Postgres refuses in one. Such scripts have to be safe to run again, since a
+// failure can leave them partially applied.
+package migrations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Backend is a database the migrations can be applied to
+type Backend string
+
+const (
+	// Postgres is the default backend
+	Postgres Backend = "postgres"
+	// CockroachDB speaks the Postgres protocol but applies each statement on its own,
+	// schema changes can not share a transaction with the writes that depend on them
+	CockroachDB Backend = "cockroachdb"
+	// SQLite needs the sqlite3 database/sql driver, registered by builds tagged sqlite
+	SQLite Backend = "sqlite"
+)
+
+// ParseBackend returns the backend with the given name, Postgres when it is empty
+func ParseBackend(name string) (Backend, error) {
+	switch backend := Backend(name); backend {
+	case "":
+		return Postgres, nil
+	case Postgres, CockroachDB, SQLite:
+		return backend, nil
+	}
+	return "", fmt.Errorf("database backend %q is not one of postgres, cockroachdb or sqlite", name)
+}
+
+// DriverName is the database/sql driver the backend is opened with
+func (b Backend) DriverName() string {
+	if b == SQLite {
+		return "sqlite3"
+	}
+	return "postgres"
+}
+
+// Migration is one version of the schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	// Down is empty for migrations that can not be reverted
+	Down string
+}
+
+// Checksum identifies the up migration, applied migrations whose file has changed
+// since are reported rather than silently diverging from the database
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// noTransactionMarker starts the scripts that can not run in a transaction
+const noTransactionMarker = "-- migrate:no-transaction"
+
+func noTransaction(script string) bool {
+	return strings.HasPrefix(strings.TrimSpace(script), noTransactionMarker)
+}
+
+// Load reads the migrations of a backend from a directory, given as a path or as a
+// file:// URL, in the order they are applied
+func Load(source string, backend Backend) ([]Migration, error) {
+	dir := source
+	if strings.Contains(source, "://") {
+		if !strings.HasPrefix(source, "file://") {
+			return nil, fmt.Errorf("migrations can only be read from a file:// URL, not %s", source)
+		}
+		dir = strings.TrimPrefix(source, "file://")
+	}
+
+	shared, err := readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if backend == SQLite {
+		return loadSQLite(dir, shared)
+	}
+	if backend != CockroachDB {
+		return shared, nil
+	}
+
+	overrides, err := readDir(filepath.Join(dir, string(CockroachDB)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	index := map[int]int{}
+	for i, m := range shared {
+		index[m.Version] = i
+	}
+	for _, m := range overrides {
+		i, ok := index[m.Version]
+		if !ok {
+			return nil, fmt.Errorf("migration %d_%s of %s replaces a migration that does not exist", m.Version, m.Name, backend)
+		}
+		shared[i] = m
+	}
+	return shared, nil
+}
+
+// loadSQLite reads the SQLite migrations, which start from a complete schema rather
+// than replaying the history of the Postgres one, but have to keep up with it since
+func loadSQLite(dir string, shared []Migration) ([]Migration, error) {
+	migrations, err := readDir(filepath.Join(dir, string(SQLite)))
+	if err != nil {
+		return nil, err
+	}
+	versions := map[int]bool{}
+	for _, m := range migrations {
+		versions[m.Version] = true
+	}
+	for _, m := range shared {
+		if m.Version >= migrations[0].Version && !versions[m.Version] {
+			return nil, fmt.Errorf("migration %d_%s has no SQLite version", m.Version, m.Name)
+		}
+	}
+	return migrations, nil
+}
+
+// readDir reads the migrations in a directory, ignoring its subdirectories
+func readDir(dir string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, file := range files {
+		match := migrationFile.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up migration in %s", m.Version, m.Name, dir)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("no migrations found in %s", dir)
+	}
+	return migrations, nil
+}
@@ -0,0 +1,130 @@
+package migrations
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadBundledMigrations(t *testing.T) {
+	postgres, err := Load(".", Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range postgres {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d_%s should be version %d", m.Version, m.Name, i+1)
+		}
+		if m.Down == "" {
+			t.Errorf("migration %d_%s has no down migration", m.Version, m.Name)
+		}
+	}
+	latest := postgres[len(postgres)-1].Version
+
+	cockroach, err := Load("file://.", CockroachDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cockroach) != len(postgres) {
+		t.Fatalf("CockroachDB has %d migrations rather than %d", len(cockroach), len(postgres))
+	}
+	if cockroach[0].Checksum() == postgres[0].Checksum() {
+		t.Error("The CockroachDB version of migration 1 should replace the Postgres one")
+	}
+	if cockroach[1].Checksum() != postgres[1].Checksum() {
+		t.Error("CockroachDB should share migration 2 with Postgres")
+	}
+
+	sqlite, err := Load(".", SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlite[len(sqlite)-1].Version != latest {
+		t.Errorf("SQLite migrations end at %d rather than %d", sqlite[len(sqlite)-1].Version, latest)
+	}
+}
+
+func TestLoadRequiresSQLiteVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sqlite"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"0001_a.up.sql", "0002_b.up.sql", "0003_c.up.sql", "sqlite/0002_schema.up.sql"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("select 1;"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Load(dir, SQLite); err == nil {
+		t.Fatal("Loading SQLite migrations without version 3 should fail")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sqlite/0003_c.up.sql"), []byte("select 1;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := Load(dir, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 2 {
+		t.Fatalf("SQLite should start from its own version 2, got %+v", migrations)
+	}
+
+	if _, err := Load("s3://bucket/migrations", Postgres); err == nil {
+		t.Fatal("Only file:// URLs should be supported")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- leading comment; not a statement
+create table a (b text default 'x;y');
+create function f() returns trigger as $$
+begin
+  raise exception 'no';
+end;
+$$ language plpgsql;
+-- trailing comment;
+`
+	expected := []string{
+		"-- leading comment; not a statement\ncreate table a (b text default 'x;y')",
+		"create function f() returns trigger as $$\nbegin\n  raise exception 'no';\nend;\n$$ language plpgsql",
+	}
+	if actual := splitStatements(script); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestNoTransaction(t *testing.T) {
+	postgres, err := Load(".", Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range postgres {
+		if m.Version == 31 && (!noTransaction(m.Up) || !noTransaction(m.Down)) {
+			t.Error("The redemptions ts index should be built outside of a transaction")
+		}
+		if m.Version == 1 && noTransaction(m.Up) {
+			t.Error("Migrations should run in a transaction unless marked")
+		}
+		if m.Version == 31 && len(splitStatements(m.Up)) != 2 {
+			t.Errorf("expected the invalid index to be dropped before building it, got %q", splitStatements(m.Up))
+		}
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	if backend, err := ParseBackend(""); err != nil || backend != Postgres {
+		t.Fatalf("An empty backend should be Postgres, got %q %v", backend, err)
+	}
+	if backend, err := ParseBackend("cockroachdb"); err != nil || backend.DriverName() != "postgres" {
+		t.Fatalf("CockroachDB should use the postgres driver, got %q %v", backend, err)
+	}
+	if _, err := ParseBackend("mysql"); err == nil {
+		t.Fatal("Unknown backends should be rejected")
+	}
+}
@@ -0,0 +1,361 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migrationLockID is the Postgres advisory lock serializing migrations of instances
+// starting at the same time
+const migrationLockID = 4171203
+
+// migrationLockPoll is how often an instance checks whether the migration lock is free
+var migrationLockPoll = 500 * time.Millisecond
+
+var (
+	// ErrBaselineRequired is returned for databases that have a schema without any
+	// recorded migrations, they were created before migrations were recorded
+	ErrBaselineRequired = errors.New("the database has a schema but no recorded migrations, run migrate up --baseline <version>")
+	// ErrDirtyMigration is returned for databases whose last golang-migrate migration failed
+	ErrDirtyMigration = errors.New("schema_migrations records a failed migration, fix the schema and run migrate up --baseline <version>")
+	// ErrAlreadyRecorded is returned for a baseline of a database whose migrations are recorded
+	ErrAlreadyRecorded = errors.New("a baseline only applies to databases without recorded migrations")
+	// ErrChecksumMismatch is returned once an applied migration has changed since
+	ErrChecksumMismatch = errors.New("an applied migration has changed")
+)
+
+// Migrator applies migrations to a database, recording each applied migration and
+// its checksum in schema_versions
+type Migrator struct {
+	db         *sql.DB
+	backend    Backend
+	migrations []Migration
+}
+
+// applied is a row of schema_versions
+type applied struct {
+	version  int
+	checksum string
+}
+
+// New returns a migrator applying the migrations of a backend to a database
+func New(db *sql.DB, backend Backend, migrations []Migration) *Migrator {
+	return &Migrator{db: db, backend: backend, migrations: migrations}
+}
+
+// Up applies every pending migration and returns them. A positive baseline first
+// records the migrations up to that version as applied without running them, for
+// databases created before migrations were recorded. Databases migrated by
+// golang-migrate are baselined at the version of their schema_migrations.
+func (m *Migrator) Up(baseline int) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.unlock(ctx, conn)
+
+	history, err := m.history(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if baseline > 0 {
+		if len(history) > 0 {
+			return nil, ErrAlreadyRecorded
+		}
+		if history, err = m.baseline(ctx, conn, baseline); err != nil {
+			return nil, err
+		}
+	} else if len(history) == 0 {
+		adopted, err := m.checkEmpty(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		if adopted > 0 {
+			if history, err = m.baseline(ctx, conn, adopted); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := m.verify(history); err != nil {
+		return nil, err
+	}
+
+	recorded := map[int]bool{}
+	latest := 0
+	for _, row := range history {
+		recorded[row.version] = true
+		latest = row.version
+	}
+	var done []Migration
+	for _, migration := range m.migrations {
+		if recorded[migration.Version] {
+			continue
+		}
+		if migration.Version < latest {
+			return done, fmt.Errorf("migration %d_%s is older than the applied migration %d", migration.Version, migration.Name, latest)
+		}
+		if err := m.apply(ctx, conn, migration.Up, m.record(migration)); err != nil {
+			return done, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down reverts the latest steps applied migrations and returns them
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.unlock(ctx, conn)
+
+	history, err := m.history(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.verify(history); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(history) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.find(history[i].version)
+		if migration.Down == "" {
+			return done, fmt.Errorf("migration %d_%s can not be reverted", migration.Version, migration.Name)
+		}
+		forget := fmt.Sprintf(`DELETE FROM schema_versions WHERE version = %d`, migration.Version)
+		if err := m.apply(ctx, conn, migration.Down, forget); err != nil {
+			return done, fmt.Errorf("reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, *migration)
+	}
+	return done, nil
+}
+
+// lock reserves a connection for the migrations, holding the advisory lock on Postgres.
+// CockroachDB and SQLite have no advisory locks, a concurrent migration fails instead
+// once it records a version that was applied in the meantime. The lock is polled
+// rather than waited for, since a waiting session holds a snapshot that a concurrent
+// index build of the instance migrating would wait on in turn.
+func (m *Migrator) lock(ctx context.Context) (*sql.Conn, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if m.backend != Postgres {
+		return conn, nil
+	}
+	for {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, migrationLockID).Scan(&locked); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if locked {
+			return conn, nil
+		}
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+			return nil, ctx.Err()
+		case <-time.After(migrationLockPoll):
+		}
+	}
+}
+
+func (m *Migrator) unlock(ctx context.Context, conn *sql.Conn) {
+	if m.backend == Postgres {
+		_, _ = conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	}
+	_ = conn.Close()
+}
+
+// history returns the recorded migrations in the order they were applied
+func (m *Migrator) history(ctx context.Context, conn *sql.Conn) ([]applied, error) {
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_versions (
+			version bigint NOT NULL PRIMARY KEY,
+			name text NOT NULL,
+			checksum text NOT NULL,
+			applied_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, checksum FROM schema_versions ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []applied
+	for rows.Next() {
+		var row applied
+		if err := rows.Scan(&row.version, &row.checksum); err != nil {
+			return nil, err
+		}
+		history = append(history, row)
+	}
+	return history, rows.Err()
+}
+
+// verify checks that every recorded migration is still the one that was applied
+func (m *Migrator) verify(history []applied) error {
+	for _, row := range history {
+		migration := m.find(row.version)
+		if migration == nil {
+			return fmt.Errorf("migration %d is applied but unknown, the database is newer than the migrations", row.version)
+		}
+		if migration.Checksum() != row.checksum {
+			return fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
+
+// checkEmpty returns ErrBaselineRequired for databases with a schema that was not
+// created by recorded migrations. Databases golang-migrate migrated cleanly return the
+// version it recorded in schema_migrations instead, which is adopted as a baseline.
+func (m *Migrator) checkEmpty(ctx context.Context, conn *sql.Conn) (int, error) {
+	query := `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'issuers'`
+	if m.backend == SQLite {
+		query = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'issuers'`
+	}
+	var tables int
+	if err := conn.QueryRowContext(ctx, query).Scan(&tables); err != nil {
+		return 0, err
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+
+	// golang-migrate recorded the version of databases it migrated in schema_migrations,
+	// with dirty set while a migration was running or once it failed
+	var version int
+	var dirty bool
+	if err := conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations`).Scan(&version, &dirty); err != nil {
+		return 0, ErrBaselineRequired
+	}
+	if dirty {
+		return 0, fmt.Errorf("%w, version %d", ErrDirtyMigration, version)
+	}
+	if m.find(version) == nil {
+		return 0, fmt.Errorf("%w, schema_migrations has version %d which is not a migration", ErrBaselineRequired, version)
+	}
+	return version, nil
+}
+
+// baseline records the migrations up to version as applied without running them
+func (m *Migrator) baseline(ctx context.Context, conn *sql.Conn, version int) ([]applied, error) {
+	if m.find(version) == nil {
+		return nil, fmt.Errorf("baseline %d is not the version of a migration", version)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var history []applied
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		if _, err := tx.ExecContext(ctx, m.record(migration)); err != nil {
+			return nil, err
+		}
+		history = append(history, applied{version: migration.Version, checksum: migration.Checksum()})
+	}
+	return history, tx.Commit()
+}
+
+// apply runs a migration together with the statement recording it. Postgres and
+// SQLite run both in a transaction, CockroachDB and scripts marked no-transaction run
+// the statements one at a time so a failed migration can be partially applied.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script, record string) error {
+	if m.backend == CockroachDB || noTransaction(script) {
+		for _, statement := range append(splitStatements(script), record) {
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// record returns the statement recording a migration as applied. The values are
+// digits and identifiers, so unlike placeholders the statement is the same on
+// every backend.
+func (m *Migrator) record(migration Migration) string {
+	return fmt.Sprintf(`INSERT INTO schema_versions (version, name, checksum) VALUES (%d, '%s', '%s')`,
+		migration.Version, migration.Name, migration.Checksum())
+}
+
+func (m *Migrator) find(version int) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// splitStatements splits a script at the semicolons ending its statements, skipping
+// those in quotes, dollar quoted bodies and comments
+func splitStatements(script string) []string {
+	var statements []string
+	var quote string
+	start, code := 0, false
+	for i := 0; i < len(script); i++ {
+		switch {
+		case quote == "--":
+			if script[i] == '\n' {
+				quote = ""
+			}
+		case quote != "":
+			if strings.HasPrefix(script[i:], quote) {
+				i += len(quote) - 1
+				quote = ""
+			}
+		case strings.HasPrefix(script[i:], "--"):
+			quote = "--"
+		case strings.HasPrefix(script[i:], "$$"):
+			quote, code = "$$", true
+			i++
+		case script[i] == '\'' || script[i] == '"':
+			quote, code = script[i:i+1], true
+		case script[i] == ';':
+			if code {
+				statements = append(statements, strings.TrimSpace(script[start:i]))
+			}
+			start, code = i+1, false
+		case script[i] != ' ' && script[i] != '\t' && script[i] != '\n' && script[i] != '\r':
+			code = true
+		}
+	}
+	if code {
+		statements = append(statements, strings.TrimSpace(script[start:]))
+	}
+	return statements
+}
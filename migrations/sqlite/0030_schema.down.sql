@@ -0,0 +1,20 @@
+drop table key_ceremonies;
+drop table issuance_receipts;
+drop table issuance_quota_usage;
+drop table request_nonces;
+drop table issuance_samples;
+drop table api_key_usage;
+drop table api_keys;
+drop table audit_log;
+drop table token_reservations;
+drop table redemption_attributes;
+drop table duplicate_attempts;
+drop table redemption_duplicates;
+drop table redemption_hash_salt;
+drop table redemptions;
+drop table issuer_freezes;
+drop table issuer_aliases;
+drop table pending_issuers;
+drop table issuer_keys;
+drop table issuers;
+drop table issuer_groups;
@@ -0,0 +1,224 @@
+-- SQLite starts from the schema of version 30 rather than replaying the Postgres
+-- migrations before it. Identifiers are text, arrays are JSON arrays.
+create table issuer_groups (
+  id text not null primary key,
+  name text not null unique,
+  created_at timestamp not null default current_timestamp
+);
+
+create table issuers (
+  id text not null primary key,
+  issuer_type text not null,
+  signing_key text,
+  max_tokens integer not null,
+  version integer not null default 1,
+  created_at timestamp not null default current_timestamp,
+  bucket_seconds bigint not null default 0,
+  buffer integer not null default 1,
+  expires_at timestamp,
+  rotated_at timestamp,
+  group_id text references issuer_groups(id),
+  rotation_window_days integer,
+  valid_days integer,
+  redemption_retention_days integer,
+  redemption_store text,
+  revoked_at timestamp,
+  revocation_reason text,
+  payload_policy text,
+  flags text not null default '{}',
+  canary_percent integer
+);
+
+create index issuers_type on issuers (issuer_type);
+create index issuers_type_expires_at on issuers (issuer_type, expires_at);
+create unique index issuers_active_type on issuers (issuer_type) where rotated_at is null and canary_percent is null;
+create unique index issuers_canary_type on issuers (issuer_type) where rotated_at is null and canary_percent is not null;
+
+create table issuer_keys (
+  id text not null primary key,
+  issuer_id text not null references issuers(id) on delete cascade,
+  signing_key text not null,
+  start_at timestamp not null,
+  end_at timestamp not null,
+  created_at timestamp not null default current_timestamp,
+  unique (issuer_id, start_at)
+);
+
+create table pending_issuers (
+  id text not null primary key,
+  predecessor_id text not null unique,
+  issuer_type text not null,
+  signing_key text not null,
+  activates_at timestamp not null,
+  expires_at timestamp not null,
+  created_at timestamp not null default current_timestamp
+);
+
+create index pending_issuers_type on pending_issuers (issuer_type);
+
+create table issuer_aliases (
+  alias text not null primary key,
+  issuer_type text not null,
+  created_at timestamp not null default current_timestamp
+);
+
+create index issuer_aliases_type on issuer_aliases (issuer_type);
+
+create table issuer_freezes (
+  issuer_type text not null primary key,
+  operations text not null,
+  reason text not null,
+  actor text not null,
+  frozen_at timestamp not null default current_timestamp
+);
+
+create table redemptions (
+  id text not null primary key,
+  issuer_type text not null,
+  ts timestamp not null,
+  payload text,
+  id_hash text,
+  voided_at timestamp,
+  void_reason text
+);
+
+create index redemptions_type on redemptions (issuer_type);
+create index redemptions_id_hash on redemptions (issuer_type, id_hash);
+
+create table redemption_hash_salt (
+  id integer not null primary key check (id = 1),
+  salt text not null
+);
+
+create table redemption_duplicates (
+  issuer_type text not null,
+  hour timestamp not null,
+  attempts bigint not null default 0,
+  primary key (issuer_type, hour)
+);
+
+create table duplicate_attempts (
+  id integer primary key autoincrement,
+  issuer_type text not null,
+  id_hash text not null,
+  payload text,
+  caller text not null,
+  attempted_at timestamp not null default current_timestamp
+);
+
+create index duplicate_attempts_attempted_at on duplicate_attempts (attempted_at);
+
+create table redemption_attributes (
+  issuer_type text not null,
+  bucket timestamp not null,
+  country text not null,
+  redemptions bigint not null default 0,
+  primary key (issuer_type, bucket, country)
+);
+
+create table token_reservations (
+  id_hash text primary key,
+  issuer_type text not null,
+  reservation_id text not null,
+  expires_at timestamp not null,
+  token_id text,
+  payload text,
+  state text not null default 'reserved',
+  created_at timestamp not null default current_timestamp
+);
+
+create index token_reservations_expires_at on token_reservations (expires_at);
+create unique index token_reservations_reservation_id on token_reservations (reservation_id);
+
+create table audit_log (
+  id integer primary key autoincrement,
+  ts timestamp not null default current_timestamp,
+  actor text not null,
+  action text not null,
+  issuer_id text,
+  issuer_type text,
+  request_id text,
+  details text
+);
+
+create index audit_log_issuer_id on audit_log (issuer_id);
+create index audit_log_ts on audit_log (ts);
+
+create trigger audit_log_no_update before update on audit_log
+begin
+  select raise(abort, 'audit_log is append-only');
+end;
+
+create trigger audit_log_no_delete before delete on audit_log
+begin
+  select raise(abort, 'audit_log is append-only');
+end;
+
+create table api_keys (
+  id text not null primary key,
+  name text not null unique,
+  key_hash text not null unique,
+  tenant text,
+  created_at timestamp not null default current_timestamp,
+  revoked_at timestamp
+);
+
+create table api_key_usage (
+  api_key_id text not null references api_keys(id) on delete cascade,
+  day date not null,
+  issued bigint not null default 0,
+  redeemed bigint not null default 0,
+  primary key (api_key_id, day)
+);
+
+create table issuance_samples (
+  id integer primary key autoincrement,
+  issuer_id text,
+  issuer_type text not null,
+  caller text not null,
+  batch_size integer not null,
+  duration_ms double precision not null,
+  sample_percent integer not null,
+  sampled_at timestamp not null default current_timestamp
+);
+
+create index issuance_samples_sampled_at on issuance_samples (sampled_at);
+
+create table request_nonces (
+  key_id text not null,
+  nonce text not null,
+  seen_at timestamp not null default current_timestamp,
+  primary key (key_id, nonce)
+);
+
+create index request_nonces_seen_at on request_nonces (seen_at);
+
+create table issuance_quota_usage (
+  issuer_type text not null,
+  window_start timestamp not null,
+  used bigint not null,
+  primary key (issuer_type, window_start)
+);
+
+create table issuance_receipts (
+  log_index bigint primary key,
+  issuer_id text not null,
+  issuer_type text not null,
+  public_key text not null,
+  token_count integer not null,
+  batch_root blob not null,
+  leaf_hash blob not null,
+  signed_at timestamp not null
+);
+
+create table key_ceremonies (
+  id text not null primary key,
+  issuer_type text not null unique,
+  request text not null,
+  shares_required integer not null,
+  contributors text not null default '[]',
+  accumulated_key text,
+  created_by text not null,
+  created_at timestamp not null default current_timestamp,
+  expires_at timestamp not null
+);
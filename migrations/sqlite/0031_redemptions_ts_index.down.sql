@@ -0,0 +1 @@
+drop index redemptions_ts;
@@ -0,0 +1 @@
+create index redemptions_ts on redemptions (ts);
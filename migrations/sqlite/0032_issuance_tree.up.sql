@@ -0,0 +1,13 @@
+create table issuance_tree_nodes (
+  level smallint not null,
+  node_index bigint not null,
+  hash blob not null,
+  primary key (level, node_index)
+);
+
+create table issuance_tree_state (
+  id boolean not null primary key default true check (id),
+  tree_size bigint not null
+);
+
+insert into issuance_tree_state (tree_size) select count(*) from issuance_receipts;
@@ -0,0 +1,2 @@
+alter table token_reservations drop column request_payload;
+alter table token_reservations drop column signature;
@@ -0,0 +1,2 @@
+alter table token_reservations add column signature text;
+alter table token_reservations add column request_payload text;
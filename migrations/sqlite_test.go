@@ -0,0 +1,61 @@
+//go:build sqlite
+// +build sqlite
+
+package migrations
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLiteMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open(SQLite.DriverName(), filepath.Join(dir, "migrations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations, err := Load(".", SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(db, SQLite, migrations)
+	applied, err := m.Up(0)
+	if err != nil {
+		t.Fatalf("Applying the SQLite migrations failed: %s", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("Applied %d of %d SQLite migrations", len(applied), len(migrations))
+	}
+	if applied, err = m.Up(0); err != nil || len(applied) != 0 {
+		t.Fatalf("Migrating again should apply nothing, applied %d: %v", len(applied), err)
+	}
+	if _, err := db.Exec(`INSERT INTO redemptions(id, issuer_type, ts, payload) VALUES ('id', 'type', CURRENT_TIMESTAMP, '')`); err != nil {
+		t.Errorf("The migrated schema should accept redemptions: %s", err)
+	}
+
+	reverted, err := m.Down(len(migrations))
+	if err != nil {
+		t.Fatalf("Reverting the SQLite migrations failed: %s", err)
+	}
+	if len(reverted) != len(migrations) {
+		t.Fatalf("Reverted %d of %d SQLite migrations", len(reverted), len(migrations))
+	}
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'issuers'`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Error("Reverting every migration should drop the issuers table")
+	}
+}
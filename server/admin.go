@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/brave-intl/bat-go/middleware"
+	"github.com/go-chi/chi"
+	"github.com/pressly/lg"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthStatus is the readiness of the server as served by the admin listener
+type HealthStatus struct {
+	Ready   bool   `json:"ready"`
+	Version string `json:"version"`
+}
+
+// healthHandler answers 200 once the server is ready and 503 until then, unlike the
+// heartbeat at / which only tells that the process is up
+func (c *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := HealthStatus{Ready: c.isReady(), Version: Version}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = encodeResponse(w, status)
+}
+
+// mountAdminRoutes mounts the operator API, diagnostics and metrics, which are served
+// alongside the API unless AdminListenPort is set
+func (c *Server) mountAdminRoutes(r chi.Router) {
+	r.Mount("/v1/audit", c.auditRouter())
+	r.Mount("/v1/redemption", c.redemptionRouter())
+	r.Mount("/v1/apikey", c.apiKeyRouter())
+	r.Mount("/v1/admin", c.adminRouter(r))
+	r.Mount("/v1/graphql", c.graphQLRouter())
+	if c.DebugListenPort == 0 {
+		r.Route("/debug", func(r chi.Router) {
+			r.Use(tokenAuthorizedOnly)
+			r.Use(operatorOnly)
+			r.Mount("/", c.debugRouter())
+		})
+	}
+	r.Get("/metrics", middleware.Metrics())
+}
+
+// adminRouter serves operator tools that do not touch the database, and the API docs
+// describing every route of root
+func (c *Server) adminRouter(root chi.Routes) chi.Router {
+	r := chi.NewRouter()
+	r.Use(tokenAuthorizedOnly)
+	r.Use(operatorOnly)
+	// The docs are left unsigned so that they can be browsed
+	r.With(c.requireSignature).Method(http.MethodPost, "/selftest", middleware.InstrumentHandler("SelfTest", c.appHandler(c.selfTestHandler)))
+	r.Get("/docs", swaggerUIHandler)
+	r.Get("/openapi.json", openAPIHandler(root, true))
+	return r
+}
+
+// setupAdminRouter serves the admin routes, health and the full issuer API on the
+// admin listener. The admin API keeps requiring tokens, the listener is not a
+// substitute for authentication. setupRouter must have been called first.
+func (c *Server) setupAdminRouter(ctx context.Context, logger *logrus.Logger) (context.Context, *chi.Mux) {
+	r := c.newRouter(logger)
+	r.Get("/health", c.healthHandler)
+	r.Mount("/v1/issuer", c.issuerRouter(true))
+	c.mountAdminRoutes(r)
+	r.Get("/v1/openapi.json", openAPIHandler(r, false))
+	return ctx, r
+}
+
+// listenAndServeAdmin serves the admin routes on AdminListenPort, which should be
+// bound to an interface only reachable from inside the deployment
+func (c *Server) listenAndServeAdmin(ctx context.Context, logger *logrus.Logger) {
+	addr := fmt.Sprintf("%s:%d", c.AdminListenHost, c.AdminListenPort)
+	srv := http.Server{Addr: addr, Handler: chi.ServerBaseContext(c.setupAdminRouter(ctx, logger))}
+	if err := srv.ListenAndServe(); err != nil {
+		lg.Errorf("Admin listener stopped: %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EventRedemptionAnomaly is published when the redemption rate of an issuer type
+// is flagged by the anomaly detector
+const EventRedemptionAnomaly = "redemption.anomaly"
+
+const (
+	anomalyInterval             = time.Minute
+	defaultAnomalyWindowMinutes = 60
+)
+
+var (
+	// redemptionRates counts the redemptions of each issuer type on this instance
+	// since the rates were last checked, it lives outside of Server since servers are
+	// copied by value while being configured
+	redemptionRates = &rateCounter{counts: map[string]int64{}}
+
+	anomalyCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redemption_anomaly_count",
+		Help: "Number of intervals in which the redemption rate of an issuer type was flagged as anomalous",
+	}, []string{"issuer_type"})
+)
+
+// AnomalyConfig enables watching the redemption rate of each issuer type for spikes
+type AnomalyConfig struct {
+	// Multiple of the baseline redemptions per minute above which a minute is
+	// anomalous, 0 disables the default detector
+	Multiple int `json:"multiple,omitempty"`
+	// WindowMinutes is how many minutes the baseline is averaged over
+	WindowMinutes int `json:"window_minutes,omitempty"`
+	// MinRedemptions per minute below which a minute is never anomalous, so that
+	// quiet issuer types do not alert on a handful of redemptions
+	MinRedemptions int `json:"min_redemptions,omitempty"`
+	// WebhookURL receives every anomaly as JSON
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// Anomaly is an unusual redemption rate of an issuer type
+type Anomaly struct {
+	IssuerType  string    `json:"issuer_type"`
+	Timestamp   time.Time `json:"timestamp"`
+	Redemptions int64     `json:"redemptions"`
+	Baseline    float64   `json:"baseline"`
+	Detector    string    `json:"detector"`
+}
+
+// AnomalyDetector is given the redemptions of each issuer type over the last minute
+// on this instance, and returns the issuer types whose rate is anomalous. Issuer
+// types without redemptions are left out of counts.
+type AnomalyDetector interface {
+	Observe(counts map[string]int64, at time.Time) []Anomaly
+}
+
+type rateCounter struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+func (r *rateCounter) add(issuerType string, n int) {
+	r.Lock()
+	r.counts[issuerType] += int64(n)
+	r.Unlock()
+}
+
+// swap returns the counts so far and starts counting from zero
+func (r *rateCounter) swap() map[string]int64 {
+	r.Lock()
+	defer r.Unlock()
+	counts := r.counts
+	r.counts = map[string]int64{}
+	return counts
+}
+
+// movingAverageDetector flags a minute whose redemptions exceed a multiple of the
+// average of the minutes before it. Issuer types are only judged once a full window
+// of minutes has been seen, so that restarts and new issuer types do not alert.
+type movingAverageDetector struct {
+	multiple float64
+	window   int
+	minimum  int64
+
+	mu      sync.Mutex
+	history map[string][]int64
+}
+
+func newMovingAverageDetector(cfg AnomalyConfig) *movingAverageDetector {
+	window := cfg.WindowMinutes
+	if window <= 0 {
+		window = defaultAnomalyWindowMinutes
+	}
+	return &movingAverageDetector{
+		multiple: float64(cfg.Multiple),
+		window:   window,
+		minimum:  int64(cfg.MinRedemptions),
+		history:  map[string][]int64{},
+	}
+}
+
+func (d *movingAverageDetector) Observe(counts map[string]int64, at time.Time) []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for issuerType := range counts {
+		if _, ok := d.history[issuerType]; !ok {
+			d.history[issuerType] = nil
+		}
+	}
+
+	var anomalies []Anomaly
+	for issuerType, history := range d.history {
+		count := counts[issuerType]
+		if len(history) == d.window {
+			var sum int64
+			for _, n := range history {
+				sum += n
+			}
+			baseline := float64(sum) / float64(d.window)
+			if count >= d.minimum && float64(count) > d.multiple*baseline {
+				anomalies = append(anomalies, Anomaly{
+					IssuerType:  issuerType,
+					Timestamp:   at,
+					Redemptions: count,
+					Baseline:    baseline,
+					Detector:    "moving_average",
+				})
+			}
+			history = history[1:]
+		}
+		d.history[issuerType] = append(history, count)
+	}
+	return anomalies
+}
+
+// countRedemptions adds recorded redemptions to the rate of an issuer type
+func (c *Server) countRedemptions(issuerType string, n int) {
+	if c.AnomalyDetector != nil {
+		redemptionRates.add(issuerType, n)
+	}
+}
+
+// initAnomalyDetector sets up the moving average detector unless programs embedding
+// the server configured their own
+func (c *Server) initAnomalyDetector() {
+	if c.AnomalyDetector == nil && c.Anomaly.Multiple > 0 {
+		c.AnomalyDetector = newMovingAverageDetector(c.Anomaly)
+	}
+}
+
+// checkRedemptionRates hands the redemptions counted since the last check to the
+// detector and reports the anomalies it finds
+func (c *Server) checkRedemptionRates(now time.Time) []Anomaly {
+	anomalies := c.AnomalyDetector.Observe(redemptionRates.swap(), now)
+	for _, anomaly := range anomalies {
+		anomalyCounter.With(prometheus.Labels{"issuer_type": anomaly.IssuerType}).Inc()
+		lg.Warnf("Anomalous redemption rate of %s: %d redemptions in the last minute against a baseline of %.1f",
+			anomaly.IssuerType, anomaly.Redemptions, anomaly.Baseline)
+		c.publishEvent(Event{
+			Type:       EventRedemptionAnomaly,
+			Timestamp:  anomaly.Timestamp.UTC(),
+			IssuerType: anomaly.IssuerType,
+			Details:    fmt.Sprintf("redemptions=%d baseline=%.1f detector=%s", anomaly.Redemptions, anomaly.Baseline, anomaly.Detector),
+		})
+		if c.Anomaly.WebhookURL != "" {
+			postWebhook("anomaly", c.Anomaly.WebhookURL, anomaly)
+		}
+	}
+	return anomalies
+}
+
+func (c *Server) checkRedemptionRatesPeriodically() {
+	for {
+		time.Sleep(anomalyInterval)
+		c.checkRedemptionRates(time.Now())
+	}
+}
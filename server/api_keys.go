@@ -0,0 +1,553 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brave-intl/bat-go/middleware"
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// apiKeyRevocationChannel is the Postgres channel the hashes of revoked keys are
+	// announced on, so that every instance drops them from its cache
+	apiKeyRevocationChannel = "api_key_revocations"
+
+	maxUnknownAPIKeys        = 10000
+	unknownAPIKeyTTL         = time.Minute
+	apiKeyUsageFlushInterval = 10 * time.Second
+)
+
+var (
+	// unknownAPIKeys remembers bearer tokens that are not API keys, so that callers
+	// retrying with a revoked or mistyped key do not query the database on every
+	// request. pendingUsage aggregates the usage of API keys on this instance until it
+	// is flushed. Both live outside of Server since servers are copied by value while
+	// being configured.
+	unknownAPIKeys = newUnknownKeyCache(maxUnknownAPIKeys, unknownAPIKeyTTL)
+	pendingUsage   = &usageCounter{counts: map[usageKey]apiKeyUsageCount{}}
+
+	APIKeyNotFoundError  = newStorageError(ErrNotFound, "API key with the given name does not exist")
+	APIKeyExistsError    = newStorageError(ErrDuplicate, "An API key with the given name already exists")
+	EmptyAPIKeyNameError = errors.New("API keys require a name")
+
+	issuedTokenCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "issued_token_count",
+		Help: "Number of tokens signed, by caller",
+	}, []string{"client"})
+	redeemedTokenCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redeemed_token_count",
+		Help: "Number of tokens redeemed, by caller",
+	}, []string{"client"})
+	usageFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "api_key_usage_failure_count",
+		Help: "Number of API key usage flushes that failed, their usage is retried with the next flush",
+	})
+)
+
+// APIKey authenticates a single caller, whose issuance and redemptions are accounted to it
+type APIKey struct {
+	ID     string
+	Name   string
+	Tenant string
+}
+
+type APIKeyCreateRequest struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant"`
+}
+
+// APIKeyResponse describes a key, Key is only returned when the key is created
+type APIKeyResponse struct {
+	Name      string     `json:"name"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Key       string     `json:"key,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Issued    int64      `json:"issued"`
+	Redeemed  int64      `json:"redeemed"`
+}
+
+// APIKeyUsage is the usage of a key on one day
+type APIKeyUsage struct {
+	Day      string `json:"day"`
+	Issued   int64  `json:"issued"`
+	Redeemed int64  `json:"redeemed"`
+}
+
+type apiKeyContextKey struct{}
+
+// unknownKeyCache holds at most max hashes of unknown keys for ttl each, the least
+// recently added are dropped first
+type unknownKeyCache struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type unknownKey struct {
+	keyHash string
+	expires time.Time
+}
+
+func newUnknownKeyCache(max int, ttl time.Duration) *unknownKeyCache {
+	return &unknownKeyCache{max: max, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (u *unknownKeyCache) contains(keyHash string, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	elem, ok := u.entries[keyHash]
+	if !ok {
+		return false
+	}
+	if now.After(elem.Value.(*unknownKey).expires) {
+		u.order.Remove(elem)
+		delete(u.entries, keyHash)
+		return false
+	}
+	return true
+}
+
+func (u *unknownKeyCache) add(keyHash string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if elem, ok := u.entries[keyHash]; ok {
+		elem.Value.(*unknownKey).expires = now.Add(u.ttl)
+		u.order.MoveToFront(elem)
+		return
+	}
+	u.entries[keyHash] = u.order.PushFront(&unknownKey{keyHash: keyHash, expires: now.Add(u.ttl)})
+	for u.order.Len() > u.max {
+		delete(u.entries, u.order.Remove(u.order.Back()).(*unknownKey).keyHash)
+	}
+}
+
+func (u *unknownKeyCache) remove(keyHash string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if elem, ok := u.entries[keyHash]; ok {
+		u.order.Remove(elem)
+		delete(u.entries, keyHash)
+	}
+}
+
+type usageKey struct {
+	apiKeyID string
+	day      string
+}
+
+type apiKeyUsageCount struct {
+	issued   int64
+	redeemed int64
+}
+
+type usageCounter struct {
+	sync.Mutex
+	counts map[usageKey]apiKeyUsageCount
+}
+
+func (u *usageCounter) add(key usageKey, issued, redeemed int64) {
+	u.Lock()
+	count := u.counts[key]
+	count.issued += issued
+	count.redeemed += redeemed
+	u.counts[key] = count
+	u.Unlock()
+}
+
+func (u *usageCounter) swap() map[usageKey]apiKeyUsageCount {
+	u.Lock()
+	defer u.Unlock()
+	counts := u.counts
+	u.counts = map[usageKey]apiKeyUsageCount{}
+	return counts
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAPIKey stores a new key, returning the secret that callers present as their
+// bearer token. Only its hash is kept.
+func (c *Server) createAPIKey(name, tenant string) (*APIKeyResponse, error) {
+	if name == "" {
+		return nil, EmptyAPIKeyNameError
+	}
+	if err := validIssuerName(tenant); err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	resp := &APIKeyResponse{Name: name, Tenant: tenant, Key: hex.EncodeToString(secret)}
+
+	err := c.db.QueryRow(
+		`INSERT INTO api_keys(id, name, key_hash, tenant) VALUES ($1, $2, $3, NULLIF($4, '')) RETURNING created_at`,
+		uuid.NewV4().String(), name, hashAPIKey(resp.Key), tenant).Scan(&resp.CreatedAt)
+	if err != nil {
+		if errors.Is(classifyStorageError(err), ErrDuplicate) {
+			return nil, APIKeyExistsError
+		}
+		return nil, err
+	}
+	unknownAPIKeys.remove(hashAPIKey(resp.Key))
+	return resp, nil
+}
+
+// fetchAPIKey returns the unrevoked key matching a bearer token. Tokens that are not
+// keys are remembered for unknownAPIKeyTTL.
+func (c *Server) fetchAPIKey(token string) (*APIKey, error) {
+	keyHash := hashAPIKey(token)
+	if c.caches != nil {
+		if cached, found := c.caches["api_keys"].Get(keyHash); found {
+			return cached.(*APIKey), nil
+		}
+	}
+	if unknownAPIKeys.contains(keyHash, time.Now()) {
+		return nil, APIKeyNotFoundError
+	}
+
+	var tenant sql.NullString
+	key := &APIKey{}
+	err := c.db.QueryRow(
+		`SELECT id, name, tenant FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`, keyHash).Scan(&key.ID, &key.Name, &tenant)
+	if err == sql.ErrNoRows {
+		unknownAPIKeys.add(keyHash, time.Now())
+		return nil, APIKeyNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+	key.Tenant = tenant.String
+
+	if c.caches != nil {
+		c.caches["api_keys"].SetDefault(keyHash, key)
+	}
+	return key, nil
+}
+
+// revokeAPIKey stops accepting a key, its usage is kept. Other instances are told to
+// drop the key from their cache once the revocation is committed.
+func (c *Server) revokeAPIKey(name string) error {
+	var keyHash string
+	err := c.db.QueryRow(
+		`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, NOW()) WHERE name = $1 RETURNING key_hash`, name).Scan(&keyHash)
+	if err == sql.ErrNoRows {
+		return APIKeyNotFoundError
+	}
+	if err != nil {
+		return err
+	}
+	if c.caches != nil {
+		c.caches["api_keys"].Delete(keyHash)
+	}
+	c.notifyAPIKeyRevocation(keyHash)
+	return nil
+}
+
+// notifyAPIKeyRevocation tells every instance listening that a key was revoked. A
+// lost notification leaves other instances accepting the key until their cache
+// expires.
+func (c *Server) notifyAPIKeyRevocation(keyHash string) {
+	if _, err := c.db.Exec(`SELECT pg_notify($1, $2)`, apiKeyRevocationChannel, keyHash); err != nil {
+		lg.Errorf("Could not notify other instances of a revoked API key: %s", err)
+		c.reportError(nil, err, map[string]string{"storage": "api_keys"})
+	}
+}
+
+// fetchAPIKeys lists every key with its total usage
+func (c *Server) fetchAPIKeys() ([]APIKeyResponse, error) {
+	rows, err := c.db.Query(
+		`SELECT name, tenant, created_at, revoked_at, COALESCE(SUM(issued), 0), COALESCE(SUM(redeemed), 0)
+		FROM api_keys LEFT JOIN api_key_usage ON api_key_usage.api_key_id = api_keys.id
+		GROUP BY api_keys.id ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []APIKeyResponse{}
+	for rows.Next() {
+		var key APIKeyResponse
+		var tenant sql.NullString
+		var revokedAt pq.NullTime
+		if err := rows.Scan(&key.Name, &tenant, &key.CreatedAt, &revokedAt, &key.Issued, &key.Redeemed); err != nil {
+			return nil, err
+		}
+		key.Tenant = tenant.String
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// fetchAPIKeyUsage returns the daily usage of a key in [since, until)
+func (c *Server) fetchAPIKeyUsage(name string, since, until time.Time) ([]APIKeyUsage, error) {
+	var id string
+	if err := c.db.QueryRow(`SELECT id FROM api_keys WHERE name = $1`, name).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, APIKeyNotFoundError
+		}
+		return nil, err
+	}
+
+	rows, err := c.db.Query(
+		`SELECT to_char(day, 'YYYY-MM-DD'), issued, redeemed FROM api_key_usage
+		WHERE api_key_id = $1 AND day >= $2::date AND day < $3::date ORDER BY day`, id, since.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	usage := []APIKeyUsage{}
+	for rows.Next() {
+		var day APIKeyUsage
+		if err := rows.Scan(&day.Day, &day.Issued, &day.Redeemed); err != nil {
+			return nil, err
+		}
+		usage = append(usage, day)
+	}
+	return usage, rows.Err()
+}
+
+func requestAPIKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// isSharedToken reports whether a token is in the shared token list or among the
+// tokens loaded from secrets, so that it is not looked up as an API key
+func isSharedToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, shared := range middleware.TokenList {
+		if subtle.ConstantTimeCompare([]byte(shared), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return sharedTokens.valid(token, time.Now())
+}
+
+// tokenAuthorizedOnly accepts callers with a shared token, it replaces
+// middleware.SimpleTokenAuthorizedOnly so that rotated tokens are accepted
+func tokenAuthorizedOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer := r.Header.Get("Authorization")
+		if len(bearer) > 7 && strings.ToUpper(bearer[0:6]) == "BEARER" && isSharedToken(bearer[7:]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	})
+}
+
+// resolveAPIKey adds the API key matching the caller's bearer token to the request
+// context, along with the key's tenant
+func (c *Server) resolveAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer := r.Header.Get("Authorization")
+		if c.isReady() && requestClaims(r) == nil && len(bearer) > 7 && strings.ToUpper(bearer[0:6]) == "BEARER" && !isSharedToken(bearer[7:]) {
+			key, err := c.fetchAPIKey(bearer[7:])
+			if err == nil {
+				ctx := context.WithValue(r.Context(), apiKeyContextKey{}, key)
+				if key.Tenant != "" {
+					ctx = context.WithValue(ctx, tenantKey{}, key.Tenant)
+				}
+				r = r.WithContext(ctx)
+			} else if !errors.Is(err, ErrNotFound) {
+				lg.Errorf("Could not look up API key: %s", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized accepts callers with an API key, a valid JWT or a token from the shared
+// token list
+func authorized(next http.Handler) http.Handler {
+	simpleToken := tokenAuthorizedOnly(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestAPIKey(r) != nil || requestClaims(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		simpleToken.ServeHTTP(w, r)
+	})
+}
+
+// recordUsage accounts issued and redeemed tokens to the caller. The usage of API keys
+// is aggregated in memory and written every apiKeyUsageFlushInterval, so that busy
+// keys do not contend on their row of the day.
+func (c *Server) recordUsage(r *http.Request, issued, redeemed int) {
+	client := clientKeyID(r)
+	if issued > 0 {
+		issuedTokenCounter.With(prometheus.Labels{"client": client}).Add(float64(issued))
+	}
+	if redeemed > 0 {
+		redeemedTokenCounter.With(prometheus.Labels{"client": client}).Add(float64(redeemed))
+	}
+
+	if key := requestAPIKey(r); key != nil {
+		pendingUsage.add(usageKey{apiKeyID: key.ID, day: time.Now().UTC().Format("2006-01-02")}, int64(issued), int64(redeemed))
+	}
+}
+
+// flushAPIKeyUsage adds the usage aggregated since the last flush to the database.
+// Usage that cannot be written is put back for the next flush, the usage of keys
+// deleted in the meantime is dropped like their recorded usage.
+func (c *Server) flushAPIKeyUsage() error {
+	counts := pendingUsage.swap()
+	for key, count := range counts {
+		_, err := c.db.Exec(
+			`INSERT INTO api_key_usage(api_key_id, day, issued, redeemed) SELECT id, $2::date, $3, $4 FROM api_keys WHERE id = $1
+			ON CONFLICT (api_key_id, day) DO UPDATE
+			SET issued = api_key_usage.issued + EXCLUDED.issued, redeemed = api_key_usage.redeemed + EXCLUDED.redeemed`,
+			key.apiKeyID, key.day, count.issued, count.redeemed)
+		if err != nil {
+			for key, count := range counts {
+				pendingUsage.add(key, count.issued, count.redeemed)
+			}
+			return err
+		}
+		delete(counts, key)
+	}
+	return nil
+}
+
+func (c *Server) flushAPIKeyUsagePeriodically() {
+	for {
+		time.Sleep(apiKeyUsageFlushInterval)
+		if err := c.flushAPIKeyUsage(); err != nil {
+			incrementCounter(usageFailureCounter)
+			lg.Errorf("Could not record API key usage: %s", err)
+			c.reportError(nil, err, map[string]string{"storage": "api_key_usage"})
+		}
+	}
+}
+
+func apiKeyError(err error) *handlers.AppError {
+	switch {
+	case err == EmptyAPIKeyNameError, err == InvalidIssuerNameError:
+		return handlers.WrapError("Invalid API key", err)
+	case errors.Is(err, ErrDuplicate):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	case errors.Is(err, ErrNotFound):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
+		}
+	}
+	return &handlers.AppError{
+		Error:   err,
+		Message: "Could not access API keys",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+func (c *Server) apiKeyCreateHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req APIKeyCreateRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	key, err := c.createAPIKey(req.Name, req.Tenant)
+	if err != nil {
+		return apiKeyError(err)
+	}
+
+	entry := newAuditEntry(r, AuditAPIKeyCreate, nil)
+	entry.Details = key.Name
+	c.recordAudit(entry)
+
+	return encodeResponse(w, key)
+}
+
+func (c *Server) apiKeyListHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	keys, err := c.fetchAPIKeys()
+	if err != nil {
+		return apiKeyError(err)
+	}
+	return encodeResponse(w, keys)
+}
+
+func (c *Server) apiKeyUsageHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	until := time.Now().Add(24 * time.Hour)
+	since := until.Add(-31 * 24 * time.Hour)
+	var err error
+	if s := r.FormValue("since"); s != "" {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			return handlers.WrapError(ErrInvalidSince.Error(), err)
+		}
+	}
+	if u := r.FormValue("until"); u != "" {
+		if until, err = time.Parse(time.RFC3339, u); err != nil {
+			return handlers.WrapError("until must be an RFC3339 timestamp", err)
+		}
+	}
+
+	usage, err := c.fetchAPIKeyUsage(chi.URLParam(r, "name"), since, until)
+	if err != nil {
+		return apiKeyError(err)
+	}
+	return encodeResponse(w, usage)
+}
+
+func (c *Server) apiKeyRevokeHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	name := chi.URLParam(r, "name")
+	if err := c.revokeAPIKey(name); err != nil {
+		return apiKeyError(err)
+	}
+
+	entry := newAuditEntry(r, AuditAPIKeyRevoke, nil)
+	entry.Details = name
+	c.recordAudit(entry)
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// apiKeyRouter manages API keys, it is only available to operators using the shared token list
+func (c *Server) apiKeyRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(c.requireReady)
+	r.Use(tokenAuthorizedOnly)
+	r.Use(operatorOnly)
+	r.Use(c.requireSignature)
+	r.Method(http.MethodPost, "/", middleware.InstrumentHandler("CreateAPIKey", c.appHandler(c.apiKeyCreateHandler)))
+	r.Method(http.MethodGet, "/", middleware.InstrumentHandler("ListAPIKeys", c.appHandler(c.apiKeyListHandler)))
+	r.Method(http.MethodGet, "/{name}/usage", middleware.InstrumentHandler("GetAPIKeyUsage", c.appHandler(c.apiKeyUsageHandler)))
+	r.Method(http.MethodDelete, "/{name}", middleware.InstrumentHandler("RevokeAPIKey", c.appHandler(c.apiKeyRevokeHandler)))
+	return r
+}
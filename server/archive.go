@@ -0,0 +1,230 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/lib/pq"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const defaultArchiveBatchSize = 10000
+
+var (
+	archiveInterval = 24 * time.Hour
+
+	ErrArchiveNotConfigured = errors.New("redemption archival requires a local path or S3 bucket")
+
+	archivedRedemptionCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "archived_redemption_count",
+		Help: "Number of redemptions moved from the database to the archive",
+	})
+)
+
+// archivableRedemptions matches redemptions older than $1, or than the redemption
+// retention of their type before $3, that no issuer of their type, under its current
+// name, still accepting redemptions with a clock skew of $2 seconds could have
+// signed. Tokens are always signed before they are redeemed, so once such a
+// redemption is removed its token still cannot be redeemed again. Issuers without an
+// expiry, which includes every issuer created before expiries were recorded, accept
+// redemptions forever, so the redemptions of their type are intentionally never
+// archived until the type is retired.
+const archivableRedemptions = `ts < COALESCE((
+	SELECT $3::timestamp - MAX(redemption_retention_days) * interval '1 day' FROM issuers
+	WHERE issuers.issuer_type = ` + currentRedemptionIssuerType + `), $1) AND ts < COALESCE((
+	SELECT MIN(created_at) FROM issuers
+	WHERE issuers.issuer_type = ` + currentRedemptionIssuerType + ` AND ` + unexpiredIssuersWithSkew + `), 'infinity')`
+
+// archivedRedemption is the parquet schema of archived redemptions
+type archivedRedemption struct {
+	IssuerType string `parquet:"name=issuer_type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	ID         string `parquet:"name=id, type=UTF8"`
+	Timestamp  int64  `parquet:"name=ts, type=TIMESTAMP_MICROS"`
+	Payload    string `parquet:"name=payload, type=UTF8"`
+}
+
+// archiveRedemptions moves redemptions older than ArchiveAfterDays into snappy
+// compressed parquet files of up to ArchiveBatchSize redemptions, kept under
+// ArchiveLocalPath and uploaded to ArchiveS3Bucket when configured. Each file is
+// archived in its own transaction so that rows are only locked while their file is
+// written, they are only deleted once it has been, and no locations are returned if
+// there was nothing to archive.
+func (c *Server) archiveRedemptions(now time.Time) ([]string, int, error) {
+	if c.ArchiveLocalPath == "" && c.ArchiveS3Bucket == "" {
+		return nil, 0, ErrArchiveNotConfigured
+	}
+	cutoff := now.Add(-time.Duration(c.ArchiveAfterDays) * 24 * time.Hour).UTC()
+	batchSize := c.ArchiveBatchSize
+	if batchSize == 0 {
+		batchSize = defaultArchiveBatchSize
+	}
+
+	dir := c.ArchiveLocalPath
+	if dir == "" {
+		tmp, err := ioutil.TempDir("", "redemptions")
+		if err != nil {
+			return nil, 0, err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+
+	var locations []string
+	total := 0
+	for batch := 1; ; batch++ {
+		name := fmt.Sprintf("redemptions-%s-%d.parquet", now.UTC().Format("20060102T150405Z"), batch)
+		location, count, err := c.archiveRedemptionBatch(dir, name, cutoff, now, batchSize)
+		if err != nil {
+			return locations, total, err
+		}
+		if count > 0 {
+			locations = append(locations, location)
+			total += count
+		}
+		if count < batchSize {
+			return locations, total, nil
+		}
+	}
+}
+
+// archiveRedemptionBatch archives the oldest archivable redemptions to a file of the
+// given name. Rows locked by another instance archiving at the same time are skipped.
+func (c *Server) archiveRedemptionBatch(dir, name string, cutoff, now time.Time, batchSize int) (string, int, error) {
+	path := filepath.Join(dir, name)
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(
+		`SELECT issuer_type, id, ts, payload FROM redemptions WHERE `+archivableRedemptions+`
+		ORDER BY ts LIMIT $4 FOR UPDATE SKIP LOCKED`, cutoff, c.ClockSkewSec, now.UTC(), batchSize)
+	if err != nil {
+		return "", 0, err
+	}
+	ids, err := writeRedemptionArchive(path, rows)
+	if err != nil || len(ids) == 0 {
+		_ = os.Remove(path)
+		return "", 0, err
+	}
+
+	location := path
+	if c.ArchiveS3Bucket != "" {
+		location, err = c.uploadRedemptionArchive(path, c.ArchiveS3Prefix+name)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM redemptions WHERE id = ANY($1)`, pq.Array(ids)); err != nil {
+		return "", 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", 0, err
+	}
+
+	archivedRedemptionCounter.Add(float64(len(ids)))
+	c.recordAudit(AuditEntry{
+		Actor:   AuditActorSystem,
+		Action:  AuditRedemptionArchive,
+		Details: fmt.Sprintf("%d redemptions to %s", len(ids), location),
+	})
+	return location, len(ids), nil
+}
+
+// writeRedemptionArchive writes every redemption in rows to a parquet file at path,
+// returning the ids written
+func writeRedemptionArchive(path string, rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	fw, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := writer.NewParquetWriter(fw, new(archivedRedemption), 1)
+	if err != nil {
+		_ = fw.Close()
+		return nil, err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+
+	ids := []string{}
+	for rows.Next() {
+		var redemption archivedRedemption
+		var ts time.Time
+		if err := rows.Scan(&redemption.IssuerType, &redemption.ID, &ts, &redemption.Payload); err != nil {
+			_ = fw.Close()
+			return nil, err
+		}
+		redemption.Timestamp = ts.UnixNano() / int64(time.Microsecond)
+		if err := pw.Write(redemption); err != nil {
+			_ = fw.Close()
+			return nil, err
+		}
+		ids = append(ids, redemption.ID)
+	}
+	if err := rows.Err(); err != nil {
+		_ = fw.Close()
+		return nil, err
+	}
+
+	if err := pw.WriteStop(); err != nil {
+		_ = fw.Close()
+		return nil, err
+	}
+	return ids, fw.Close()
+}
+
+func (c *Server) uploadRedemptionArchive(path, key string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sess, err := c.getAWSSession()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(c.ArchiveS3Bucket),
+		Key:         aws.String(key),
+		Body:        f,
+		ContentType: aws.String("application/vnd.apache.parquet"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s", c.ArchiveS3Bucket, key), nil
+}
+
+// archiveRedemptionsPeriodically runs redemption archival until the process exits.
+// Instances racing to archive the same rows skip the batches locked by the others.
+func (c *Server) archiveRedemptionsPeriodically() {
+	for {
+		locations, count, err := c.archiveRedemptions(time.Now())
+		if err != nil {
+			lg.Errorf("Could not archive redemptions: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "archive_redemptions"})
+		}
+		if count > 0 {
+			lg.Infof("Archived %d redemptions to %s", count, strings.Join(locations, ", "))
+		}
+		time.Sleep(archiveInterval)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+)
+
+// attestationAlgorithm is the only algorithm attestations are signed with
+const attestationAlgorithm = "Ed25519"
+
+var ErrInvalidAttestationKey = errors.New("attestation key must be a PEM encoded PKCS8 Ed25519 private key")
+
+// IssuerAttestation vouches for the public keys served by the issuer directory. The
+// statement is signed as is and kept encoded, so that clients verify the exact bytes
+// before decoding them as an AttestationStatement.
+type IssuerAttestation struct {
+	Algorithm string `json:"algorithm"`
+	// KeyID is the hex encoded start of the SHA-256 hash of the attestation public key
+	KeyID     string `json:"key_id"`
+	Statement []byte `json:"statement"`
+	Signature []byte `json:"signature"`
+}
+
+// AttestationStatement lists the issuers of the directory, with their public keys and
+// validity windows, as of SignedAt
+type AttestationStatement struct {
+	SignedAt time.Time        `json:"signed_at"`
+	Issuers  []IssuerResponse `json:"issuers"`
+}
+
+// initAttestation loads the attestation key, it does nothing unless a path is
+// configured. The key is provisioned offline, clients pin its public key.
+func (c *Server) initAttestation() error {
+	if c.AttestationKeyPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.AttestationKeyPath)
+	if err != nil {
+		return err
+	}
+	key, err := parseAttestationKey(data)
+	if err != nil {
+		return err
+	}
+	c.attestationKey = key
+	return nil
+}
+
+func parseAttestationKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidAttestationKey
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidAttestationKey
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidAttestationKey
+	}
+	return key, nil
+}
+
+// attestationKeyID identifies an attestation public key, so that clients pinning
+// several keys during a key change know which one to verify with
+func attestationKeyID(key ed25519.PublicKey) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+// attestIssuers signs a statement of the issuers listed in a directory
+func (c *Server) attestIssuers(issuers []IssuerResponse, now time.Time) (*IssuerAttestation, error) {
+	statement, err := json.Marshal(AttestationStatement{SignedAt: now.UTC(), Issuers: issuers})
+	if err != nil {
+		return nil, err
+	}
+	return &IssuerAttestation{
+		Algorithm: attestationAlgorithm,
+		KeyID:     attestationKeyID(c.attestationKey.Public().(ed25519.PublicKey)),
+		Statement: statement,
+		Signature: ed25519.Sign(c.attestationKey, statement),
+	}, nil
+}
+
+// issuerAttestationHandler serves a signed statement of the issuer directory, taking
+// the same filters as the directory
+func (c *Server) issuerAttestationHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	if c.attestationKey == nil {
+		return &handlers.AppError{
+			Message: "Issuer attestation is not configured",
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	issuers, appErr := c.issuerDirectory(r, time.Now())
+	if appErr != nil {
+		return appErr
+	}
+	attestation, err := c.attestIssuers(issuers, time.Now())
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not attest issuers",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return encodeResponse(w, attestation)
+}
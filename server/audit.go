@@ -0,0 +1,352 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/brave-intl/bat-go/middleware"
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/go-chi/chi"
+	chiware "github.com/go-chi/chi/middleware"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	AuditIssuerCreate      = "issuer.create"
+	AuditIssuerKeyCreate   = "issuer.key_create"
+	AuditIssuerRotate      = "issuer.rotate"
+	AuditIssuerRetire      = "issuer.retire"
+	AuditIssuerRevoke      = "issuer.revoke"
+	AuditIssuerPolicy      = "issuer.policy"
+	AuditIssuerRename      = "issuer.rename"
+	AuditIssuerBackup      = "issuer.backup"
+	AuditIssuerRestore     = "issuer.restore"
+	AuditIssuerFreeze      = "issuer.freeze"
+	AuditIssuerUnfreeze    = "issuer.unfreeze"
+	AuditIssuerFlags       = "issuer.flags"
+	AuditIssuerCeremony    = "issuer.ceremony"
+	AuditIssuerCanary      = "issuer.canary"
+	AuditBundleExport      = "bundle.export"
+	AuditKeyBundleExport   = "bundle.key_export"
+	AuditRedemptionArchive = "redemption.archive"
+	AuditRedemptionCleanup = "redemption.cleanup"
+	AuditRedemptionVoid    = "redemption.void"
+	AuditRedemptionRestore = "redemption.restore"
+	AuditLogExport         = "audit.export"
+	AuditAPIKeyCreate      = "api_key.create"
+	AuditAPIKeyRevoke      = "api_key.revoke"
+
+	// AuditActorSystem is recorded for actions the server takes on its own
+	AuditActorSystem = "system"
+	// AuditActorCLI is recorded for actions taken by operators from the command line
+	AuditActorCLI = "cli"
+
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+var (
+	ErrAuditExportNotConfigured = errors.New("audit log export is not configured")
+
+	auditFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "audit_log_failure_count",
+		Help: "Number of audit log entries that could not be recorded",
+	})
+)
+
+// AuditEntry is a single record in the append-only audit log
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	IssuerID   string    `json:"issuer_id,omitempty"`
+	IssuerType string    `json:"issuer_type,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Details    string    `json:"details,omitempty"`
+}
+
+// AuditQuery filters audit log entries, entries are returned newest first
+type AuditQuery struct {
+	IssuerID   string
+	IssuerType string
+	Action     string
+	Since      time.Time
+	Until      time.Time
+	BeforeID   int64
+	Limit      int
+}
+
+// newAuditEntry attributes an action to the caller of r
+func newAuditEntry(r *http.Request, action string, issuer *Issuer) AuditEntry {
+	entry := AuditEntry{
+		Actor:     clientKeyID(r),
+		Action:    action,
+		RequestID: chiware.GetReqID(r.Context()),
+	}
+	if issuer != nil {
+		entry.IssuerID = issuer.ID
+		entry.IssuerType = issuer.IssuerType
+	}
+	return entry
+}
+
+// recordAudit appends an entry to the audit log and publishes it as an event. Failures
+// are logged and counted rather than failing the already completed action.
+func (c *Server) recordAudit(entry AuditEntry) {
+	var issuerID interface{}
+	if entry.IssuerID != "" {
+		issuerID = entry.IssuerID
+	}
+
+	_, err := c.db.Exec(
+		`INSERT INTO audit_log(actor, action, issuer_id, issuer_type, request_id, details) VALUES ($1, $2, $3, $4, $5, $6)`,
+		entry.Actor, entry.Action, issuerID, entry.IssuerType, entry.RequestID, entry.Details)
+	if err != nil {
+		incrementCounter(auditFailureCounter)
+		lg.Errorf("Could not record audit log entry %s: %s", entry.Action, err)
+		c.reportError(nil, err, map[string]string{"storage": "audit_log", "issuer_type": entry.IssuerType, "request_id": entry.RequestID})
+	}
+
+	c.publishEvent(Event{
+		Type:       entry.Action,
+		Actor:      entry.Actor,
+		IssuerID:   entry.IssuerID,
+		IssuerType: entry.IssuerType,
+		Details:    entry.Details,
+	})
+}
+
+func (c *Server) fetchAuditEntries(q AuditQuery) ([]AuditEntry, error) {
+	conditions := []string{}
+	args := []interface{}{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if q.IssuerID != "" {
+		where("issuer_id = $%d", q.IssuerID)
+	}
+	if q.IssuerType != "" {
+		where("issuer_type = $%d", q.IssuerType)
+	}
+	if q.Action != "" {
+		where("action = $%d", q.Action)
+	}
+	if !q.Since.IsZero() {
+		where("ts >= $%d", q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		where("ts < $%d", q.Until.UTC())
+	}
+	if q.BeforeID != 0 {
+		where("id < $%d", q.BeforeID)
+	}
+
+	query := `SELECT id, ts, actor, action, issuer_id, issuer_type, request_id, details FROM audit_log`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, q.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := c.queryReadOnly(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var issuerID, issuerType, requestID, details sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Timestamp, &entry.Actor, &entry.Action, &issuerID, &issuerType, &requestID, &details); err != nil {
+			return nil, err
+		}
+		entry.IssuerID = issuerID.String
+		entry.IssuerType = issuerType.String
+		entry.RequestID = requestID.String
+		entry.Details = details.String
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func parseAuditQuery(r *http.Request) (AuditQuery, error) {
+	q := AuditQuery{
+		IssuerID:   r.FormValue("issuer_id"),
+		IssuerType: r.FormValue("issuer_type"),
+		Action:     r.FormValue("action"),
+		Limit:      defaultAuditLimit,
+	}
+
+	var err error
+	if since := r.FormValue("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			return q, err
+		}
+	}
+	if until := r.FormValue("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339Nano, until); err != nil {
+			return q, err
+		}
+	}
+	if beforeID := r.FormValue("before_id"); beforeID != "" {
+		if q.BeforeID, err = strconv.ParseInt(beforeID, 10, 64); err != nil {
+			return q, err
+		}
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return q, err
+		}
+		if q.Limit < 1 || q.Limit > maxAuditLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxAuditLimit)
+		}
+	}
+	return q, nil
+}
+
+func (c *Server) auditQueryHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		return handlers.WrapError("Invalid audit log query", err)
+	}
+
+	entries, err := c.fetchAuditEntries(q)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not query audit log",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	return encodeResponse(w, entries)
+}
+
+// exportAuditLog uploads the entries matching q to S3 as newline delimited JSON. The
+// entries are streamed to the uploader page by page, so that only the parts being
+// uploaded are held in memory whatever the size of the export.
+func (c *Server) exportAuditLog(q AuditQuery) (string, int, error) {
+	if c.AuditS3Bucket == "" {
+		return "", 0, ErrAuditExportNotConfigured
+	}
+
+	sess, err := c.getAWSSession()
+	if err != nil {
+		return "", 0, err
+	}
+
+	type written struct {
+		count int
+		err   error
+	}
+	body, writer := io.Pipe()
+	done := make(chan written, 1)
+	go func() {
+		count, err := c.writeAuditEntries(writer, q)
+		_ = writer.CloseWithError(err)
+		done <- written{count, err}
+	}()
+
+	key := fmt.Sprintf("%saudit-%s.ndjson", c.AuditS3Prefix, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	_, err = s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(c.AuditS3Bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	// A failed upload stops reading, which fails the writes still pending
+	_ = body.Close()
+	result := <-done
+	if result.err != nil && result.err != io.ErrClosedPipe {
+		return "", result.count, result.err
+	}
+	return key, result.count, err
+}
+
+// writeAuditEntries writes the entries matching q to w as newline delimited JSON and
+// returns how many were written
+func (c *Server) writeAuditEntries(w io.Writer, q AuditQuery) (int, error) {
+	encoder := json.NewEncoder(w)
+	count := 0
+	for {
+		entries, err := c.fetchAuditEntries(q)
+		if err != nil {
+			return count, err
+		}
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return count, err
+			}
+		}
+		count += len(entries)
+		if len(entries) < q.Limit {
+			return count, nil
+		}
+		q.BeforeID = entries[len(entries)-1].ID
+	}
+}
+
+func (c *Server) auditExportHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		return handlers.WrapError("Invalid audit log query", err)
+	}
+	q.Limit = maxAuditLimit
+
+	key, count, err := c.exportAuditLog(q)
+	if err != nil {
+		if err == ErrAuditExportNotConfigured {
+			return &handlers.AppError{
+				Message: err.Error(),
+				Code:    http.StatusNotImplemented,
+			}
+		}
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not export audit log",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	entry := newAuditEntry(r, AuditLogExport, nil)
+	entry.Details = fmt.Sprintf("s3://%s/%s", c.AuditS3Bucket, key)
+	c.recordAudit(entry)
+
+	return encodeResponse(w, map[string]interface{}{
+		"bucket":  c.AuditS3Bucket,
+		"key":     key,
+		"entries": count,
+	})
+}
+
+// auditRouter always requires a valid bearer token since the audit log is used for compliance reviews
+func (c *Server) auditRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(c.requireReady)
+	r.Use(tokenAuthorizedOnly)
+	r.Use(operatorOnly)
+	r.Use(c.requireSignature)
+	r.Method(http.MethodGet, "/", middleware.InstrumentHandler("QueryAuditLog", c.appHandler(c.auditQueryHandler)))
+	r.Method(http.MethodPost, "/export", middleware.InstrumentHandler("ExportAuditLog", c.appHandler(c.auditExportHandler)))
+	r.Method(http.MethodGet, "/issuance", middleware.InstrumentHandler("GetIssuanceSamples", c.appHandler(c.issuanceSamplesHandler)))
+	r.Method(http.MethodGet, "/receipts", middleware.InstrumentHandler("ListIssuanceReceipts", c.appHandler(c.issuanceReceiptsHandler)))
+	r.Method(http.MethodGet, "/receipts/head", middleware.InstrumentHandler("GetIssuanceTreeHead", c.appHandler(c.issuanceTreeHeadHandler)))
+	r.Method(http.MethodGet, "/receipts/{index}/proof", middleware.InstrumentHandler("GetIssuanceInclusionProof", c.appHandler(c.issuanceProofHandler)))
+	return r
+}
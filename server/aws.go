@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	defaultAWSMaxIdleConnsPerHost   = 100
+	defaultAWSIdleConnTimeoutSec    = 90
+	defaultAWSDialTimeoutMs         = 2000
+	defaultAWSTLSHandshakeTimeoutMs = 2000
+)
+
+var (
+	// awsSession is the AWS session shared by all AWS clients, it lives outside of
+	// Server since servers are copied by value while being configured, and copies
+	// would otherwise each create a session. awsSessionMu guards its lazy creation.
+	awsSession   *session.Session
+	awsSessionMu sync.Mutex
+)
+
+// AWSHTTPConfig tunes the connections of an AWS client. The SDK uses
+// http.DefaultClient otherwise, which keeps only two idle connections per host, so
+// bursts of calls pay for new TCP and TLS connections.
+type AWSHTTPConfig struct {
+	// MaxIdleConnsPerHost is the number of connections kept open for reuse, 100 by
+	// default
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	// IdleConnTimeoutSec closes connections unused for longer, 90 by default
+	IdleConnTimeoutSec int `json:"idle_conn_timeout_sec,omitempty"`
+	// DialTimeoutMs and TLSHandshakeTimeoutMs bound establishing a connection, 2000
+	// by default
+	DialTimeoutMs         int `json:"dial_timeout_ms,omitempty"`
+	TLSHandshakeTimeoutMs int `json:"tls_handshake_timeout_ms,omitempty"`
+	// ResponseTimeoutMs bounds the wait for a response once a request is sent,
+	// there is no limit by default
+	ResponseTimeoutMs int `json:"response_timeout_ms,omitempty"`
+	// HTTP2 negotiates HTTP/2 with endpoints that offer it, multiplexing calls over a
+	// single connection
+	HTTP2 bool `json:"http2,omitempty"`
+}
+
+// newClient returns an HTTP client with the configured transport
+func (h AWSHTTPConfig) newClient() *http.Client {
+	maxIdle := h.MaxIdleConnsPerHost
+	if maxIdle == 0 {
+		maxIdle = defaultAWSMaxIdleConnsPerHost
+	}
+	idleTimeout := h.IdleConnTimeoutSec
+	if idleTimeout == 0 {
+		idleTimeout = defaultAWSIdleConnTimeoutSec
+	}
+	dialTimeout := h.DialTimeoutMs
+	if dialTimeout == 0 {
+		dialTimeout = defaultAWSDialTimeoutMs
+	}
+	tlsTimeout := h.TLSHandshakeTimeoutMs
+	if tlsTimeout == 0 {
+		tlsTimeout = defaultAWSTLSHandshakeTimeoutMs
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   time.Duration(dialTimeout) * time.Millisecond,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			// Every connection of the client goes to the same few endpoints
+			MaxIdleConns:          maxIdle,
+			MaxIdleConnsPerHost:   maxIdle,
+			IdleConnTimeout:       time.Duration(idleTimeout) * time.Second,
+			TLSHandshakeTimeout:   time.Duration(tlsTimeout) * time.Millisecond,
+			ResponseHeaderTimeout: time.Duration(h.ResponseTimeoutMs) * time.Millisecond,
+			ExpectContinueTimeout: time.Second,
+			ForceAttemptHTTP2:     h.HTTP2,
+		},
+	}
+}
+
+// getAWSSession returns the AWS session shared by all AWS clients of the process,
+// creating it from the standard AWS environment on first use
+func (c *Server) getAWSSession() (*session.Session, error) {
+	awsSessionMu.Lock()
+	defer awsSessionMu.Unlock()
+
+	if awsSession == nil {
+		sess, err := session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, err
+		}
+		awsSession = sess
+	}
+	return awsSession, nil
+}
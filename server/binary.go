@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/brave-intl/challenge-bypass-server/btd"
+	"github.com/fxamacker/cbor"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeCBOR = "application/cbor"
+)
+
+// cborOptions encode times as RFC3339 strings, as they are in JSON responses
+var cborOptions = cbor.EncOptions{TimeRFC3339: true}
+
+// cborIssueRequest is BlindedTokenIssueRequest with the tokens as raw bytes rather
+// than base64 strings
+type cborIssueRequest struct {
+	BlindedTokens [][]byte `cbor:"blinded_tokens"`
+}
+
+type cborIssueResponse struct {
+	BatchProof   []byte     `cbor:"batch_proof"`
+	SignedTokens [][]byte   `cbor:"signed_tokens"`
+	PublicKey    []byte     `cbor:"public_key,omitempty"`
+	ExpiresAt    *time.Time `cbor:"expires_at,omitempty"`
+}
+
+type cborIssueResponseV3 struct {
+	SigningResults []cborSigningResult `cbor:"signing_results"`
+}
+
+type cborSigningResult struct {
+	ValidFrom    time.Time `cbor:"valid_from"`
+	ValidTo      time.Time `cbor:"valid_to"`
+	PublicKey    []byte    `cbor:"public_key"`
+	BatchProof   []byte    `cbor:"batch_proof"`
+	SignedTokens [][]byte  `cbor:"signed_tokens"`
+}
+
+// requestIsCBOR reports whether the request body is CBOR rather than JSON
+func requestIsCBOR(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == contentTypeCBOR
+}
+
+// responseIsCBOR reports whether the response should be CBOR, which is the case when
+// Accept prefers it to JSON, or when there is no Accept header and the request was CBOR
+func responseIsCBOR(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return requestIsCBOR(r)
+	}
+	return negotiateEncoding(accept, []string{contentTypeJSON, contentTypeCBOR}) == contentTypeCBOR
+}
+
+// rawBytes returns the bytes behind the base64 text encoding of the crypto types
+func rawBytes(m encoding.TextMarshaler) ([]byte, error) {
+	text, err := m.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(string(text))
+}
+
+func rawBytesList(ms []*crypto.SignedToken) ([][]byte, error) {
+	list := make([][]byte, len(ms))
+	for i, m := range ms {
+		raw, err := rawBytes(m)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = raw
+	}
+	return list, nil
+}
+
+// decodeIssueRequest decodes an issuance request sent as either JSON or CBOR, rejecting
+// requests for more than maxTokens tokens, the issuer's batch cap, before parsing them
+func decodeIssueRequest(w http.ResponseWriter, r *http.Request, limit int64, issuer *Issuer, maxTokens int, request *BlindedTokenIssueRequest) *handlers.AppError {
+	if !requestIsCBOR(r) {
+		tooMany := false
+		if appErr := decodeBody(w, r, limit, func(body io.Reader) error {
+			err := decodeIssueJSON(body, maxTokens, request)
+			tooMany = err == errTooManyTokens
+			return err
+		}); appErr != nil {
+			if tooMany {
+				return tooManyTokensError(r, issuer, maxTokens, 0)
+			}
+			return appErr
+		}
+		return nil
+	}
+
+	var raw cborIssueRequest
+	if appErr := decodeBody(w, r, limit, func(body io.Reader) error {
+		return cbor.NewDecoder(body).Decode(&raw)
+	}); appErr != nil {
+		return appErr
+	}
+	if raw.BlindedTokens == nil {
+		return nil
+	}
+	if len(raw.BlindedTokens) > maxTokens {
+		return tooManyTokensError(r, issuer, maxTokens, len(raw.BlindedTokens))
+	}
+
+	request.BlindedTokens = make([]*crypto.BlindedToken, len(raw.BlindedTokens))
+	for i, b := range raw.BlindedTokens {
+		// Raw bytes have a single encoding, only their length needs checking
+		if len(b) != btd.BlindedTokenLength {
+			return handlers.WrapError("Could not parse the request body",
+				&btd.EncodingError{Name: "blinded token", Reason: fmt.Sprintf("must be %d bytes", btd.BlindedTokenLength)})
+		}
+		token := &crypto.BlindedToken{}
+		if err := token.UnmarshalText([]byte(base64.StdEncoding.EncodeToString(b))); err != nil {
+			return handlers.WrapError("Could not parse the request body", err)
+		}
+		request.BlindedTokens[i] = token
+	}
+	return nil
+}
+
+// encodeIssueResponse writes an issuance response as JSON, or as CBOR when the client
+// asked for it
+func encodeIssueResponse(w http.ResponseWriter, r *http.Request, v interface{}) *handlers.AppError {
+	w.Header().Add("Vary", "Accept")
+	if !responseIsCBOR(r) {
+		if err := encodeIssueJSON(w, v); err != nil {
+			return &handlers.AppError{
+				Error:   err,
+				Message: "Could not encode response",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return nil
+	}
+
+	var (
+		raw interface{}
+		err error
+	)
+	switch resp := v.(type) {
+	case BlindedTokenIssueResponse:
+		raw, err = cborResponse(resp)
+	case BlindedTokenIssueResponseV3:
+		raw, err = cborResponseV3(resp)
+	}
+	var body []byte
+	if err == nil {
+		body, err = cbor.Marshal(raw, cborOptions)
+	}
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not encode response",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	w.Header().Set("Content-Type", contentTypeCBOR)
+	_, _ = w.Write(body)
+	return nil
+}
+
+func cborResponse(resp BlindedTokenIssueResponse) (cborIssueResponse, error) {
+	proof, err := rawBytes(resp.BatchProof)
+	if err != nil {
+		return cborIssueResponse{}, err
+	}
+	signedTokens, err := rawBytesList(resp.SignedTokens)
+	if err != nil {
+		return cborIssueResponse{}, err
+	}
+	raw := cborIssueResponse{BatchProof: proof, SignedTokens: signedTokens, ExpiresAt: resp.ExpiresAt}
+	if resp.PublicKey != nil {
+		if raw.PublicKey, err = rawBytes(resp.PublicKey); err != nil {
+			return cborIssueResponse{}, err
+		}
+	}
+	return raw, nil
+}
+
+func cborResponseV3(resp BlindedTokenIssueResponseV3) (cborIssueResponseV3, error) {
+	raw := cborIssueResponseV3{SigningResults: []cborSigningResult{}}
+	for _, result := range resp.SigningResults {
+		publicKey, err := rawBytes(result.PublicKey)
+		if err != nil {
+			return raw, err
+		}
+		signed, err := cborResponse(BlindedTokenIssueResponse{BatchProof: result.BatchProof, SignedTokens: result.SignedTokens})
+		if err != nil {
+			return raw, err
+		}
+		raw.SigningResults = append(raw.SigningResults, cborSigningResult{
+			ValidFrom:    result.ValidFrom,
+			ValidTo:      result.ValidTo,
+			PublicKey:    publicKey,
+			BatchProof:   signed.BatchProof,
+			SignedTokens: signed.SignedTokens,
+		})
+	}
+	return raw, nil
+}
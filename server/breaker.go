@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	defaultBreakerTimeout          = 250 * time.Millisecond
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerOpenDuration     = 30 * time.Second
+)
+
+var (
+	ErrCircuitOpen       = newStorageError(ErrUnavailable, "Dependency is unavailable after repeated failures")
+	ErrDependencyTimeout = newStorageError(ErrUnavailable, "Dependency did not respond within its latency budget")
+
+	breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "State of each circuit breaker, 0 closed, 1 open and 2 half open",
+	}, []string{"breaker"})
+
+	breakerRejectCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_reject_count",
+		Help: "Number of calls rejected by an open circuit breaker",
+	}, []string{"breaker"})
+)
+
+// BreakerConfig bounds the latency of calls to a dependency and stops calling it
+// while it keeps failing, so that a slow dependency cannot tie up every request
+type BreakerConfig struct {
+	// TimeoutMs is the latency budget of a single call, 250ms by default
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+	// FailureThreshold is the number of consecutive failures that opens the breaker,
+	// 5 by default
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	// OpenSec is how long an open breaker rejects calls before letting a trial call
+	// through, 30 by default
+	OpenSec int `json:"open_sec,omitempty"`
+}
+
+type circuitBreaker struct {
+	name             string
+	timeout          time.Duration
+	failureThreshold int
+	openDuration     time.Duration
+	// failure decides which errors count against the dependency, errors such as a
+	// duplicate redemption are answers rather than failures
+	failure func(error) bool
+	now     func() time.Time
+	// throttle, when set, sheds calls while the dependency throttles them, throttled
+	// calls then do not count against the dependency
+	throttle *adaptiveThrottle
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(name string, conf BreakerConfig, failure func(error) bool) *circuitBreaker {
+	b := &circuitBreaker{
+		name:             name,
+		timeout:          time.Duration(conf.TimeoutMs) * time.Millisecond,
+		failureThreshold: conf.FailureThreshold,
+		openDuration:     time.Duration(conf.OpenSec) * time.Second,
+		failure:          failure,
+		now:              time.Now,
+	}
+	if b.timeout == 0 {
+		b.timeout = defaultBreakerTimeout
+	}
+	if b.failureThreshold == 0 {
+		b.failureThreshold = defaultBreakerFailureThreshold
+	}
+	if b.openDuration == 0 {
+		b.openDuration = defaultBreakerOpenDuration
+	}
+	breakerStateGauge.With(prometheus.Labels{"breaker": name}).Set(breakerClosed)
+	return b
+}
+
+// call runs fn within the latency budget, or fails fast with ErrCircuitOpen while the
+// breaker is open and with ErrThrottled when the throttle sheds it. fn should give up
+// once its context is done, its result is discarded when it does not return in time.
+func (b *circuitBreaker) call(fn func(ctx context.Context) error) error {
+	if b.throttle != nil && !b.throttle.allow() {
+		return ErrThrottled
+	}
+	if !b.allow() {
+		breakerRejectCounter.With(prometheus.Labels{"breaker": b.name}).Inc()
+		return ErrCircuitOpen
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ErrDependencyTimeout
+	}
+	if b.throttle != nil {
+		b.throttle.record(err)
+		if isThrottle(err) {
+			b.record(false)
+			return err
+		}
+	}
+	b.record(err != nil && (errors.Is(err, ErrDependencyTimeout) || b.failure == nil || b.failure(err)))
+	return err
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.openDuration {
+			return false
+		}
+		// Only the trial call is let through until it succeeds
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.failureThreshold {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	breakerStateGauge.With(prometheus.Labels{"breaker": b.name}).Set(float64(state))
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brave-intl/bat-go/middleware"
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/brave-intl/challenge-bypass-server/btd"
+	"github.com/go-chi/chi"
+)
+
+var (
+	bundleFalsePositiveRate = 0.001
+	defaultSpentDeltaLimit  = 1000
+	maxSpentDeltaLimit      = 10000
+	defaultBundleCacheSec   = 60
+
+	// verificationBundles holds the bundles built recently for each tenant, it lives
+	// outside of Server since servers are copied by value while being configured
+	verificationBundles = &bundleCache{entries: map[string]*cachedBundle{}}
+
+	ErrInvalidSince = errors.New("since must be an RFC3339 timestamp")
+)
+
+// VerificationBundle contains everything an edge service needs to verify redemptions
+// offline, with staleness bounded by AsOf
+type VerificationBundle struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Issuers     []IssuerResponse `json:"issuers"`
+	Spent       SpentTokenFilter `json:"spent"`
+}
+
+// SpentTokenFilter is a bloom filter of spent token hashes as of a point in time
+type SpentTokenFilter struct {
+	AsOf  time.Time `json:"as_of"`
+	Count int       `json:"count"`
+	btd.BloomFilter
+}
+
+// SpentTokenDelta lists the hashes of tokens spent in (Since, Until]
+type SpentTokenDelta struct {
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	HasMore bool      `json:"has_more"`
+	Spent   []string  `json:"spent"`
+}
+
+// BuildVerificationBundle snapshots the issuer public keys and spent tokens of every tenant
+func (c *Server) BuildVerificationBundle() (*VerificationBundle, error) {
+	return c.buildVerificationBundle(func(string) bool { return true })
+}
+
+// buildVerificationBundle snapshots the issuers and spent tokens of the issuer types
+// matched by include
+func (c *Server) buildVerificationBundle(include func(issuerType string) bool) (*VerificationBundle, error) {
+	if err := c.ensureDb(); err != nil {
+		return nil, err
+	}
+
+	issuers, err := c.fetchAllIssuers(false)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := VerificationBundle{
+		GeneratedAt: time.Now().UTC(),
+		Issuers:     []IssuerResponse{},
+	}
+	for _, issuer := range issuers {
+		if include(issuer.IssuerType) {
+			bundle.Issuers = append(bundle.Issuers, newIssuerResponse(issuer, bundle.GeneratedAt))
+		}
+	}
+
+	// Redemptions still being committed are left to the deltas following the bundle
+	if bundle.Spent.AsOf, err = c.spentHorizon(); err != nil {
+		return nil, err
+	}
+
+	var hashes [][32]byte
+	err = c.fetchSpentTokens(bundle.Spent.AsOf, func(issuerType, id string) {
+		if include(issuerType) {
+			hashes = append(hashes, btd.SpentTokenHash(issuerType, id))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filter := btd.NewBloomFilter(len(hashes), bundleFalsePositiveRate)
+	for _, hash := range hashes {
+		filter.Add(hash)
+	}
+	bundle.Spent.Count = len(hashes)
+	bundle.Spent.BloomFilter = *filter
+
+	return &bundle, nil
+}
+
+// ExportVerificationBundle writes a verification bundle as JSON to w
+func (c *Server) ExportVerificationBundle(w io.Writer) error {
+	bundle, err := c.BuildVerificationBundle()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(bundle)
+}
+
+// bundleCache shares the bundles built for a tenant between requests. Each tenant has
+// an entry of its own, so that concurrent requests wait for a single build.
+type bundleCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedBundle
+}
+
+type cachedBundle struct {
+	mu      sync.Mutex
+	bundle  *VerificationBundle
+	builtAt time.Time
+}
+
+// get returns the bundle of a tenant built less than ttl ago, building it otherwise.
+// Cached bundles are as correct as fresh ones, edge services fetch the spent tokens
+// after their as_of with the delta.
+func (cache *bundleCache) get(tenant string, ttl time.Duration, build func() (*VerificationBundle, error)) (*VerificationBundle, error) {
+	cache.mu.Lock()
+	entry, ok := cache.entries[tenant]
+	if !ok {
+		entry = &cachedBundle{}
+		cache.entries[tenant] = entry
+	}
+	cache.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.bundle != nil && time.Since(entry.builtAt) < ttl {
+		return entry.bundle, nil
+	}
+	bundle, err := build()
+	if err != nil {
+		return nil, err
+	}
+	entry.bundle, entry.builtAt = bundle, time.Now()
+	return bundle, nil
+}
+
+func (c *Server) bundleCacheTTL() time.Duration {
+	if c.BundleCacheSec > 0 {
+		return time.Duration(c.BundleCacheSec) * time.Second
+	}
+	return time.Duration(defaultBundleCacheSec) * time.Second
+}
+
+func (c *Server) bundleHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	tenant := requestTenant(r)
+	bundle, err := verificationBundles.get(tenant, c.bundleCacheTTL(), func() (*VerificationBundle, error) {
+		return c.buildVerificationBundle(func(issuerType string) bool {
+			return inTenant(tenant, issuerType)
+		})
+	})
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not build verification bundle",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	c.recordAudit(newAuditEntry(r, AuditBundleExport, nil))
+
+	return encodeResponse(w, bundle)
+}
+
+func (c *Server) spentDeltaHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	since, err := time.Parse(time.RFC3339Nano, r.FormValue("since"))
+	if err != nil {
+		return handlers.WrapError(ErrInvalidSince.Error(), err)
+	}
+
+	limit := defaultSpentDeltaLimit
+	if l := r.FormValue("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxSpentDeltaLimit {
+			return &handlers.AppError{
+				Message: "limit must be between 1 and " + strconv.Itoa(maxSpentDeltaLimit),
+				Code:    http.StatusBadRequest,
+			}
+		}
+	}
+
+	redemptions, until, hasMore, err := c.fetchSpentTokenDelta(since.UTC(), limit)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not fetch spent tokens",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	delta := SpentTokenDelta{
+		Since:   since,
+		Until:   until,
+		HasMore: hasMore,
+		Spent:   []string{},
+	}
+	tenant := requestTenant(r)
+	for _, redemption := range redemptions {
+		if !inTenant(tenant, redemption.IssuerType) {
+			continue
+		}
+		hash := btd.SpentTokenHash(redemption.IssuerType, redemption.Id)
+		delta.Spent = append(delta.Spent, hex.EncodeToString(hash[:]))
+	}
+
+	return encodeResponse(w, delta)
+}
+
+func (c *Server) bundleRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(c.requireReady)
+	if os.Getenv("ENV") == "production" {
+		r.Use(authorized)
+	}
+	r.Use(requireScope(ScopeBundleRead))
+	r.Method(http.MethodGet, "/", middleware.InstrumentHandler("GetVerificationBundle", c.appHandler(c.bundleHandler)))
+	r.Method(http.MethodGet, "/spent", middleware.InstrumentHandler("GetSpentTokenDelta", c.appHandler(c.spentDeltaHandler)))
+	r.Method(http.MethodGet, "/keys", middleware.InstrumentHandler("GetKeyBundle", c.appHandler(c.keyBundleHandler)))
+	return r
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// parseTrustedProxies parses the IPs and CIDRs of TrustedProxies, returning the entries
+// that are neither
+func parseTrustedProxies(entries []string) ([]*net.IPNet, []string) {
+	var proxies []*net.IPNet
+	var invalid []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		} else if _, network, err := net.ParseCIDR(entry); err == nil {
+			proxies = append(proxies, network)
+			continue
+		}
+		invalid = append(invalid, entry)
+	}
+	return proxies, invalid
+}
+
+func trustedProxy(proxies []*net.IPNet, ip net.IP) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the client addresses a request went through, closest to the
+// client first, from the Forwarded header or else from X-Forwarded-For
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	for _, header := range r.Header["Forwarded"] {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name := strings.TrimSpace(pair)
+				if i := strings.Index(name, "="); i > 0 && strings.EqualFold(name[:i], "for") {
+					hops = append(hops, name[i+1:])
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	return hops
+}
+
+// parseHop reads the address of a forwarding hop, which may be quoted, bracketed or
+// carry a port as in "[2001:db8::1]:4711"
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// resolveClientIP replaces the remote address of requests forwarded by TrustedProxies
+// with the address of the client, so that logs and everything keyed by client see it
+// rather than the load balancer. Forwarding headers are read from right to left,
+// skipping trusted proxies, and ignored unless the request came from one, since
+// clients can send them as well.
+func (c *Server) resolveClientIP(next http.Handler) http.Handler {
+	proxies, _ := parseTrustedProxies(c.TrustedProxies)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip != nil && len(proxies) > 0 {
+			hops := forwardedFor(r)
+			for i := len(hops) - 1; i >= 0 && trustedProxy(proxies, ip); i-- {
+				hop := parseHop(hops[i])
+				if hop == nil {
+					break
+				}
+				ip = hop
+			}
+			if ip.String() != host {
+				r.RemoteAddr = ip.String()
+			}
+		}
+		if ip != nil {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client that sent a request, resolved through
+// TrustedProxies, or nil when it is unknown
+func clientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pressly/lg"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+	encodingZstd    = "zstd"
+
+	defaultCompressionMinBytes = 1024
+)
+
+// defaultEncodings are offered when none are configured, zstd is opt in since few
+// clients support it yet
+var defaultEncodings = []string{encodingGzip, encodingDeflate}
+
+// CompressionConfig compresses issuance responses, which are hundreds of kilobytes of
+// base64 for large batches
+type CompressionConfig struct {
+	// Encodings are offered in order of preference, among gzip, deflate and zstd
+	Encodings []string `json:"encodings,omitempty"`
+	// MinBytes is the smallest response that is compressed, 1024 by default
+	MinBytes int `json:"min_bytes,omitempty"`
+	// Disabled serves every response uncompressed
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// negotiateEncoding picks the first of the offered encodings that the Accept-Encoding
+// header accepts with the highest quality, or "" for an uncompressed response
+func negotiateEncoding(header string, offered []string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingDeflate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	default:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+}
+
+// bufferedResponse holds a response until the handler returns, so that it is only
+// compressed when it is large enough to benefit
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// Push lets handlers push resources through the buffered response
+func (b *bufferedResponse) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := b.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// compressResponse compresses responses of at least MinBytes with the encoding
+// negotiated through Accept-Encoding
+func (c *Server) compressResponse(next http.Handler) http.Handler {
+	cfg := c.Compression
+	if cfg.Disabled {
+		return next
+	}
+	if len(cfg.Encodings) == 0 {
+		cfg.Encodings = defaultEncodings
+	}
+	if cfg.MinBytes == 0 {
+		cfg.MinBytes = defaultCompressionMinBytes
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w}
+		next.ServeHTTP(buffered, r)
+		if buffered.status == 0 {
+			buffered.status = http.StatusOK
+		}
+
+		if buffered.body.Len() < cfg.MinBytes || w.Header().Get("Content-Encoding") != "" {
+			w.WriteHeader(buffered.status)
+			_, _ = w.Write(buffered.body.Bytes())
+			return
+		}
+
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(buffered.body.Bytes()))
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buffered.status)
+
+		encoder, err := newEncoder(encoding, w)
+		if err == nil {
+			_, err = encoder.Write(buffered.body.Bytes())
+			if closeErr := encoder.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			lg.Errorf("Could not compress response: %s", err)
+		}
+	})
+}
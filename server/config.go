@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/brave-intl/challenge-bypass-server/migrations"
+	"github.com/ghodss/yaml"
+)
+
+// encryptedConfigExt marks config files encrypted with KMS, the extension before it
+// selects the format, e.g. config.yaml.kms
+const encryptedConfigExt = ".kms"
+
+const redacted = "<redacted>"
+
+// configVariable matches ${NAME} references to environment variables in config files
+var configVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// decryptConfig returns the plaintext of a KMS ciphertext blob, either raw or base64
+// encoded as written by the AWS CLI
+func (c *Server) decryptConfig(data []byte) ([]byte, error) {
+	blob := data
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+		blob = decoded
+	}
+
+	sess, err := c.getAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	// The ciphertext identifies the key, so no key id is needed to decrypt it
+	out, err := kms.New(sess).Decrypt(&kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt config with KMS: %s", err)
+	}
+	return out.Plaintext, nil
+}
+
+// interpolateConfig replaces ${NAME} with the value of the environment variable, escaped
+// so that values can be placed inside JSON strings. Referencing an unset variable is
+// an error rather than silently producing an empty secret.
+func interpolateConfig(data []byte) ([]byte, error) {
+	var missing string
+	result := configVariable.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := string(configVariable.FindSubmatch(ref)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if missing == "" {
+				missing = name
+			}
+			return ref
+		}
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+	if missing != "" {
+		return nil, fmt.Errorf("config references unset environment variable %s", missing)
+	}
+	return result, nil
+}
+
+// configToJSON converts YAML and TOML config files to JSON by their extension, so
+// every format is decoded with the same field names
+func configToJSON(ext string, data []byte) ([]byte, error) {
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		return yaml.YAMLToJSON(data)
+	case ".toml":
+		var values map[string]interface{}
+		if _, err := toml.Decode(string(data), &values); err != nil {
+			return nil, err
+		}
+		return json.Marshal(values)
+	default:
+		return data, nil
+	}
+}
+
+// decodeConfig reads the config file into conf, rejecting fields that do not exist so
+// that misspelt settings are not silently ignored
+func (c *Server) decodeConfig(filePath string, data []byte) error {
+	var err error
+	name := filePath
+	if strings.EqualFold(filepath.Ext(name), encryptedConfigExt) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		if data, err = c.decryptConfig(data); err != nil {
+			return err
+		}
+	}
+	if data, err = interpolateConfig(data); err != nil {
+		return err
+	}
+	if data, err = configToJSON(filepath.Ext(name), data); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("invalid config file %s: %s", filePath, err)
+	}
+	return nil
+}
+
+// Validate checks the loaded configuration, reporting every problem at once
+func (c *Server) Validate() error {
+	var problems []string
+	if c.dbConfig.ConnectionURI == "" {
+		problems = append(problems, "a database connection URI is required")
+	}
+	if _, err := migrations.ParseBackend(c.dbConfig.Backend); err != nil {
+		problems = append(problems, err.Error())
+	}
+	// Warming holds its connections until all are open, so at least one must be left
+	if c.dbConfig.MaxConnection > 0 && c.dbConfig.WarmConnections >= c.dbConfig.MaxConnection {
+		problems = append(problems, fmt.Sprintf("database.warmConnections %d must be below database.maxConnection %d",
+			c.dbConfig.WarmConnections, c.dbConfig.MaxConnection))
+	}
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		problems = append(problems, fmt.Sprintf("listen_port %d is not a valid port", c.ListenPort))
+	}
+	if c.DebugListenPort < 0 || c.DebugListenPort > 65535 || (c.DebugListenPort != 0 && c.DebugListenPort == c.ListenPort) {
+		problems = append(problems, fmt.Sprintf("debug_listen_port %d is not a valid port separate from listen_port", c.DebugListenPort))
+	}
+	if c.AdminListenPort < 0 || c.AdminListenPort > 65535 || (c.AdminListenPort != 0 && (c.AdminListenPort == c.ListenPort || c.AdminListenPort == c.DebugListenPort)) {
+		problems = append(problems, fmt.Sprintf("admin_listen_port %d is not a valid port separate from listen_port and debug_listen_port", c.AdminListenPort))
+	}
+	for name, value := range map[string]int64{
+		"max_tokens":                           int64(c.MaxTokens),
+		"database.defaultMaxTokens":            int64(c.Database.DefaultMaxTokens),
+		"startup_max_wait_sec":                 int64(c.StartupMaxWaitSec),
+		"archive_after_days":                   int64(c.ArchiveAfterDays),
+		"archive_batch_size":                   int64(c.ArchiveBatchSize),
+		"cleanup_after_days":                   int64(c.CleanupAfterDays),
+		"cleanup_batch_size":                   int64(c.CleanupBatchSize),
+		"cleanup_batch_delay_ms":               int64(c.CleanupBatchDelayMs),
+		"future_issuer_keys":                   int64(c.FutureIssuerKeys),
+		"clock_skew_sec":                       int64(c.ClockSkewSec),
+		"redemption_issuer_limit":              int64(c.RedemptionIssuerLimit),
+		"reservation_window_sec":               int64(c.ReservationWindowSec),
+		"max_keys_in_memory":                   int64(c.MaxKeysInMemory),
+		"signing_workers":                      int64(c.SigningWorkers),
+		"signing_queue_depth":                  int64(c.SigningQueueDepth),
+		"issuance_memory_bytes":                c.IssuanceMemoryBytes,
+		"memory_limit_bytes":                   c.MemoryLimitBytes,
+		"gc_percent":                           int64(c.GCPercent),
+		"cors.max_age_sec":                     int64(c.CORS.MaxAgeSec),
+		"events.workers":                       int64(c.Events.Workers),
+		"events.queue_depth":                   int64(c.Events.QueueDepth),
+		"request_limits.issuance_bytes":        c.RequestLimits.IssuanceBytes,
+		"request_limits.redemption_bytes":      c.RequestLimits.RedemptionBytes,
+		"request_limits.admin_bytes":           c.RequestLimits.AdminBytes,
+		"compression.min_bytes":                int64(c.Compression.MinBytes),
+		"jwt.refresh_sec":                      int64(c.JWT.RefreshSec),
+		"request_signing.max_skew_sec":         int64(c.RequestSigning.MaxSkewSec),
+		"secrets.poll_sec":                     int64(c.Secrets.PollSec),
+		"secrets.grace_sec":                    int64(c.Secrets.GraceSec),
+		"quotas.window_sec":                    int64(c.Quotas.WindowSec),
+		"dynamo.breaker.timeout_ms":            int64(c.Dynamo.Breaker.TimeoutMs),
+		"dynamo.breaker.failure_threshold":     int64(c.Dynamo.Breaker.FailureThreshold),
+		"dynamo.breaker.open_sec":              int64(c.Dynamo.Breaker.OpenSec),
+		"dynamo.throttle.window_sec":           int64(c.Dynamo.Throttle.WindowSec),
+		"dynamo.throttle.headroom_percent":     int64(c.Dynamo.Throttle.HeadroomPercent),
+		"dynamo.replication_check_ms":          int64(c.Dynamo.ReplicationCheckMs),
+		"dynamo.http.max_idle_conns_per_host":  int64(c.Dynamo.HTTP.MaxIdleConnsPerHost),
+		"dynamo.http.idle_conn_timeout_sec":    int64(c.Dynamo.HTTP.IdleConnTimeoutSec),
+		"dynamo.http.dial_timeout_ms":          int64(c.Dynamo.HTTP.DialTimeoutMs),
+		"dynamo.http.tls_handshake_timeout_ms": int64(c.Dynamo.HTTP.TLSHandshakeTimeoutMs),
+		"dynamo.http.response_timeout_ms":      int64(c.Dynamo.HTTP.ResponseTimeoutMs),
+		"redis.timeout_ms":                     int64(c.Redis.TimeoutMs),
+		"redemption_queue.max_entries":         int64(c.RedemptionQueue.MaxEntries),
+		"redemption_queue.replay_interval_sec": int64(c.RedemptionQueue.ReplayIntervalSec),
+		"retry.max_attempts":                   int64(c.Retry.MaxAttempts),
+		"retry.initial_backoff_ms":             int64(c.Retry.InitialBackoffMs),
+		"retry.max_backoff_ms":                 int64(c.Retry.MaxBackoffMs),
+		"anomaly.multiple":                     int64(c.Anomaly.Multiple),
+		"anomaly.window_minutes":               int64(c.Anomaly.WindowMinutes),
+		"anomaly.min_redemptions":              int64(c.Anomaly.MinRedemptions),
+		"enrichment.bucket_minutes":            int64(c.Enrichment.BucketMinutes),
+		"enrichment.min_count":                 int64(c.Enrichment.MinCount),
+		"key_history_rate_per_minute":          int64(c.KeyHistoryRatePerMinute),
+		"bundle_cache_sec":                     int64(c.BundleCacheSec),
+		"key_bundle.validity_sec":              int64(c.KeyBundle.ValiditySec),
+		"key_bundle.publish_interval_sec":      int64(c.KeyBundle.PublishIntervalSec),
+	} {
+		if value < 0 {
+			problems = append(problems, name+" must not be negative")
+		}
+	}
+	if c.IssuanceSamplePercent < 0 || c.IssuanceSamplePercent > 100 {
+		problems = append(problems, fmt.Sprintf("issuance_sample_percent %d is not between 0 and 100", c.IssuanceSamplePercent))
+	}
+	if c.Quotas.LeasePercent < 0 || c.Quotas.LeasePercent > 100 {
+		problems = append(problems, fmt.Sprintf("quotas.lease_percent %d is not between 0 and 100", c.Quotas.LeasePercent))
+	}
+	for issuerType, quota := range c.Quotas.Issuance {
+		if quota <= 0 {
+			problems = append(problems, fmt.Sprintf("issuance quota of %s must be positive", issuerType))
+		}
+	}
+	if _, invalid := parseTrustedProxies(c.TrustedProxies); len(invalid) > 0 {
+		problems = append(problems, fmt.Sprintf("trusted_proxies entries %s are not IPs or CIDRs", strings.Join(invalid, ", ")))
+	}
+	if _, invalid := parseSigningKeys(c.RequestSigning.Keys); len(invalid) > 0 {
+		problems = append(problems, fmt.Sprintf("request_signing.keys entries %s must be id:hmac:<hex secret of at least %d bytes> or id:ed25519:<base64 public key>",
+			strings.Join(invalid, ", "), signingMinSecret))
+	}
+	if c.MaintenanceSchedule != "" {
+		if _, err := parseMaintenanceSchedule(c.MaintenanceSchedule); err != nil {
+			problems = append(problems, fmt.Sprintf("maintenance_schedule is not a valid cron expression: %s", err))
+		}
+	}
+	if c.ArchiveAfterDays > 0 && c.ArchiveLocalPath == "" && c.ArchiveS3Bucket == "" {
+		problems = append(problems, "archive_after_days requires archive_local_path or archive_s3_bucket")
+	}
+	if c.KeyBundle.PublicKeyPath != "" && c.AttestationKeyPath == "" {
+		problems = append(problems, "key_bundle.public_key_path requires attestation_key_path to sign key bundles")
+	}
+	if c.KeyBundle.S3Bucket != "" && c.KeyBundle.PublicKeyPath == "" {
+		problems = append(problems, "key_bundle.s3_bucket requires key_bundle.public_key_path")
+	}
+	if c.KeyBundle.ValiditySec > 0 && c.KeyBundle.ValiditySec <= c.KeyBundle.PublishIntervalSec {
+		problems = append(problems, "key_bundle.validity_sec must be longer than key_bundle.publish_interval_sec")
+	}
+	if budget := c.issuanceMemoryBudget(); budget > 0 && budget < estimateIssuanceBytes(1) {
+		problems = append(problems, fmt.Sprintf("issuance memory budget of %d bytes must be at least %d bytes to issue a single token", budget, estimateIssuanceBytes(1)))
+	}
+	if c.MemoryLimitBytes > 0 && c.IssuanceMemoryBytes > c.MemoryLimitBytes {
+		problems = append(problems, "issuance_memory_bytes must not exceed memory_limit_bytes")
+	}
+	if c.JWT.JWKSURL != "" {
+		if u, err := url.Parse(c.JWT.JWKSURL); err != nil || !u.IsAbs() {
+			problems = append(problems, "jwt.jwks_url must be an absolute URL")
+		}
+	}
+	for _, encoding := range c.Compression.Encodings {
+		switch encoding {
+		case encodingGzip, encodingDeflate, encodingZstd:
+		default:
+			problems = append(problems, fmt.Sprintf("compression encoding %q must be gzip, deflate or zstd", encoding))
+		}
+	}
+	for name, profile := range c.IssuerProfiles {
+		if profile.MaxTokens < 0 || profile.BucketSeconds < 0 || profile.Buffer < 0 || profile.ValidDays < 0 || profile.RotationWindowDays < 0 || profile.RedemptionRetentionDays < 0 {
+			problems = append(problems, fmt.Sprintf("settings of issuer profile %s must not be negative", name))
+		}
+		if profile.Version != 0 && profile.Version != IssuerVersion1 && profile.Version != IssuerVersion3 {
+			problems = append(problems, fmt.Sprintf("version of issuer profile %s must be 1 or 3", name))
+		}
+		switch profile.RedemptionStore {
+		case "", RedemptionStorePostgres, RedemptionStoreRedis:
+		default:
+			problems = append(problems, fmt.Sprintf("redemption store of issuer profile %s must be postgres or redis", name))
+		}
+		if err := c.validatePayloadPolicy(profile.PayloadPolicy); err != nil {
+			problems = append(problems, fmt.Sprintf("payload policy of issuer profile %s must list known transformers with valid arguments", name))
+		}
+	}
+	// Finer buckets or smaller counts could single out clients, so they are refused
+	// rather than left to the operator's judgement
+	if c.Enrichment.BucketMinutes > 0 && c.Enrichment.BucketMinutes < minEnrichmentBucketMins {
+		problems = append(problems, fmt.Sprintf("enrichment.bucket_minutes must be at least %d", minEnrichmentBucketMins))
+	}
+	if c.Enrichment.MinCount > 0 && c.Enrichment.MinCount < minEnrichmentMinCount {
+		problems = append(problems, fmt.Sprintf("enrichment.min_count must be at least %d", minEnrichmentMinCount))
+	}
+	switch c.Vault.KeyStorage {
+	case "", VaultKeyStorageKV, VaultKeyStorageTransit:
+	default:
+		problems = append(problems, "vault.key_storage must be kv or transit")
+	}
+	switch c.Dynamo.Mode {
+	case "":
+	case DynamoModeDualWrite:
+		if c.Dynamo.Table == "" {
+			problems = append(problems, "dynamo.mode requires dynamo.table")
+		}
+	default:
+		problems = append(problems, "dynamo.mode must be dual_write")
+	}
+	if c.Dynamo.GlobalTable && c.Dynamo.Mode == "" {
+		problems = append(problems, "dynamo.global_table requires dynamo.mode")
+	}
+	for _, tenant := range c.Tenants {
+		if tenant == "" || strings.Contains(tenant, tenantSeparator) {
+			problems = append(problems, fmt.Sprintf("tenant %q must be non-empty and must not contain %s", tenant, tenantSeparator))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// redactURI removes the password from a connection URI
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		// Key/value connection strings are redacted entirely
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// EffectiveConfig describes the configuration in use as JSON with secrets redacted,
+// so that it can be logged at startup
+func (c *Server) EffectiveConfig() (string, error) {
+	conf := *c
+	conf.Tenants = nil
+	conf.Database = DbConfig{}
+	if conf.Vault.RoleID != "" {
+		conf.Vault.RoleID = redacted
+	}
+	if conf.SentryDSN != "" {
+		conf.SentryDSN = redacted
+	}
+	if conf.PanicWebhookURL != "" {
+		conf.PanicWebhookURL = redacted
+	}
+	if conf.Anomaly.WebhookURL != "" {
+		conf.Anomaly.WebhookURL = redacted
+	}
+	if conf.RevocationWebhookURL != "" {
+		conf.RevocationWebhookURL = redacted
+	}
+	if conf.Redis.URL != "" {
+		conf.Redis.URL = redactURI(conf.Redis.URL)
+	}
+	// Key ids are kept so that the configured keys can be told apart
+	conf.RequestSigning.Keys = nil
+	for _, entry := range c.RequestSigning.Keys {
+		conf.RequestSigning.Keys = append(conf.RequestSigning.Keys, strings.SplitN(entry, ":", 2)[0]+":"+redacted)
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return "", err
+	}
+	var summary map[string]interface{}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return "", err
+	}
+
+	tenants := []string{}
+	for _, tenant := range c.Tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	summary["tenants"] = tenants
+
+	db := c.dbConfig
+	if db.ConnectionURI != "" {
+		db.ConnectionURI = redactURI(db.ConnectionURI)
+	}
+	if db.ReadOnlyConnectionURI != "" {
+		db.ReadOnlyConnectionURI = redactURI(db.ReadOnlyConnectionURI)
+	}
+	summary["database"] = db
+
+	data, err = json.Marshal(summary)
+	return string(data), err
+}
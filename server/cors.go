@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/go-chi/cors"
+)
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// CORSConfig allows browser based clients on the listed origins to call the token and
+// issuer APIs directly, CORS is disabled when no origins are configured
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	MaxAgeSec      int      `json:"max_age_sec,omitempty"`
+}
+
+// corsHandler answers preflight requests before authentication, since browsers do not
+// send credentials with them
+func (c *Server) corsHandler(next http.Handler) http.Handler {
+	cfg := c.CORS
+	if len(cfg.AllowedOrigins) == 0 {
+		return next
+	}
+	if len(cfg.AllowedMethods) == 0 {
+		cfg.AllowedMethods = defaultCORSMethods
+	}
+	if len(cfg.AllowedHeaders) == 0 {
+		cfg.AllowedHeaders = defaultCORSHeaders
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins: cfg.AllowedOrigins,
+		AllowedMethods: cfg.AllowedMethods,
+		AllowedHeaders: cfg.AllowedHeaders,
+		// Lets browser clients send conditional requests for issuers
+		ExposedHeaders: []string{"ETag"},
+		MaxAge:         cfg.MaxAgeSec,
+	}).Handler(next)
+}
@@ -1,90 +1,247 @@
 package server
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
 	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
-	migrate "github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/brave-intl/challenge-bypass-server/migrations"
 	"github.com/lib/pq"
 	cache "github.com/patrickmn/go-cache"
+	"github.com/pressly/lg"
 	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
 )
 
 type CachingConfig struct {
 	Enabled       bool `json:"enabled"`
 	ExpirationSec int  `json:"expirationSec"`
+	// Warm loads the active issuers and their signing keys before the server reports ready
+	Warm bool `json:"warm"`
 }
 
 type DbConfig struct {
-	ConnectionURI string        `json:"connectionURI"`
-	CachingConfig CachingConfig `json:"caching"`
-	MaxConnection int           `json:"maxConnection"`
+	ConnectionURI         string        `json:"connectionURI"`
+	ReadOnlyConnectionURI string        `json:"readOnlyConnectionURI"`
+	CachingConfig         CachingConfig `json:"caching"`
+	MaxConnection         int           `json:"maxConnection"`
+	// WarmConnections is the number of connections kept established ahead of traffic
+	WarmConnections int `json:"warmConnections"`
+	WarmIntervalSec int `json:"warmIntervalSec"`
+	// MigrationsURL is where migrations are read from, the docker image path by default
+	MigrationsURL string `json:"migrationsURL"`
+	// Backend is postgres, the default. migrate also supports cockroachdb and sqlite.
+	Backend string `json:"backend"`
+	// DefaultMaxTokens is the batch cap of issuers created without max_tokens, 40 when unset
+	DefaultMaxTokens int `json:"defaultMaxTokens"`
 }
 
+// defaultMaxTokens is the batch cap of issuers created without max_tokens when
+// DefaultMaxTokens is unset
+const defaultMaxTokens = 40
+
+const (
+	// IssuerVersion1 issuers sign with a single long lived key
+	IssuerVersion1 = 1
+	// IssuerVersion3 issuers sign with keys bound to consecutive time buckets,
+	// tokens are only redeemable during the bucket they were signed for
+	IssuerVersion3 = 3
+)
+
 type Issuer struct {
-	IssuerType string
-	SigningKey *crypto.SigningKey
-	MaxTokens  int
+	ID             string
+	IssuerType     string
+	SigningKey     *crypto.SigningKey
+	MaxTokens      int
+	Version        int
+	CreatedAt      time.Time
+	BucketDuration time.Duration
+	Buffer         int
+	Keys           []IssuerKey
+	// ExpiresAt is zero for issuers that never expire
+	ExpiresAt time.Time
+	// RotatedAt is set once a replacement issuer has been created, rotated issuers
+	// no longer sign but still verify redemptions until they expire
+	RotatedAt time.Time
+	GroupID   string
+	// RotationWindowDays and ValidDays override the rotation window and the validity
+	// period of replacements, zero uses the defaults
+	RotationWindowDays int
+	ValidDays          int
+	// RedemptionRetentionDays overrides ArchiveAfterDays for redemptions of the type
+	RedemptionRetentionDays int
+	// RedemptionStore is where redemptions of the type are recorded, Postgres when empty
+	RedemptionStore string
+	// PayloadPolicy lists the payload transformers redemption payloads of the type go
+	// through before they are persisted
+	PayloadPolicy []string
+	// RevokedAt is set once the issuer's keys were revoked as compromised
+	RevokedAt time.Time
+	// Flags holds the issuer flags set for the type, unset ones take their default
+	Flags map[string]bool
+	// CanaryPercent is the percentage of issuance requests a canary issuer signs
+	// alongside the active issuer, zero for other issuers
+	CanaryPercent int
 }
 
 type Redemption struct {
-	IssuerType string    `json:"issuerType"`
-	Id         string    `json:"id"`
-	Timestamp  time.Time `json:"timestamp"`
-	Payload    string    `json:"payload"`
+	IssuerType string     `json:"issuerType"`
+	Id         string     `json:"id"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Payload    string     `json:"payload"`
+	VoidedAt   *time.Time `json:"voidedAt,omitempty"`
+	VoidReason string     `json:"voidReason,omitempty"`
 }
 
 type CacheInterface interface {
 	Get(k string) (interface{}, bool)
 	SetDefault(k string, x interface{})
+	Delete(k string)
+	Flush()
 }
 
+// defaultMaxIdleConns matches the database/sql default
+const defaultMaxIdleConns = 2
+
+const defaultMigrationsURL = "file:///src/migrations"
+
+var redemptionHashBackfillBatch = 1000
+
 var (
-	IssuerNotFoundError      = errors.New("Issuer with the given name does not exist")
-	DuplicateRedemptionError = errors.New("Duplicate Redemption")
-	RedemptionNotFoundError  = errors.New("Redemption with the given id does not exist")
+	IssuerNotFoundError      = newStorageError(ErrNotFound, "Issuer with the given name does not exist")
+	UnsupportedVersionError  = errors.New("Unsupported issuer version")
+	InvalidBucketError       = errors.New("Version 3 issuers require a positive bucket duration and buffer")
+	InvalidExpiryError       = errors.New("Issuer expiry must be in the future")
+	IssuerExistsError        = newStorageError(ErrDuplicate, "An active issuer with the given name already exists")
+	InvalidRotationError     = errors.New("Issuer rotation window and validity must not be negative")
+	InvalidMaxTokensError    = errors.New("Issuer max_tokens must not be negative")
+	DuplicateRedemptionError = newStorageError(ErrDuplicate, "Duplicate Redemption")
+	RedemptionNotFoundError  = newStorageError(ErrNotFound, "Redemption with the given id does not exist")
+	ErrMigrateOnlyBackend    = errors.New("the server needs postgres, only migrate supports cockroachdb and sqlite")
+	ErrNoSQLiteDriver        = errors.New("sqlite needs a build with -tags sqlite")
 )
 
 func (c *Server) LoadDbConfig(config DbConfig) {
 	c.dbConfig = config
 }
 
-func (c *Server) initDb() {
+func (c *Server) initDb() error {
 	cfg := c.dbConfig
-
-	db, err := sql.Open("postgres", cfg.ConnectionURI)
-	if err != nil {
-		panic(err)
+	// The server relies on Postgres features CockroachDB lacks, such as ctid, NOTIFY,
+	// advisory locks and VACUUM, so other backends are only migrated
+	if backend, err := migrations.ParseBackend(cfg.Backend); err != nil {
+		return err
+	} else if backend != migrations.Postgres {
+		return ErrMigrateOnlyBackend
 	}
-	db.SetMaxOpenConns(cfg.MaxConnection)
-	c.db = db
 
-	driver, err := postgres.WithInstance(db, &postgres.Config{})
-	if err != nil {
-		panic(err)
-	}
-	m, err := migrate.NewWithDatabaseInstance(
-		"file:///src/migrations",
-		"postgres", driver)
-	if err != nil {
-		panic(err)
+	if err := c.retryStartup("postgres", c.connectDb); err != nil {
+		return err
 	}
-	err = m.Migrate(3)
-	if err != migrate.ErrNoChange && err != nil {
-		panic(err)
+	if err := checkSchema(c.db, expectedSchema); err != nil {
+		return err
 	}
 
+	signingKeys.resize(c.MaxKeysInMemory)
+	signers = newSigningPool(c.SigningWorkers, c.SigningQueueDepth)
+	eventQueue = newEventPublisher(c.Events.QueueDepth)
+	issuanceMemory = newMemoryBudget(c.issuanceMemoryBudget())
+	verificationBundles = &bundleCache{entries: map[string]*cachedBundle{}}
+
 	if cfg.CachingConfig.Enabled {
 		c.caches = make(map[string]CacheInterface)
 		defaultDuration := time.Duration(cfg.CachingConfig.ExpirationSec) * time.Second
 		c.caches["issuers"] = cache.New(defaultDuration, 2*defaultDuration)
 		c.caches["redemptions"] = cache.New(defaultDuration, 2*defaultDuration)
+		c.caches["redeemed"] = cache.New(defaultDuration, 2*defaultDuration)
+		c.caches["api_keys"] = cache.New(defaultDuration, 2*defaultDuration)
+		c.caches["issuer_aliases"] = cache.New(defaultDuration, 2*defaultDuration)
+	}
+
+	if err := c.loadRedemptionHashSalt(); err != nil {
+		return err
+	}
+	if err := c.initDynamo(); err != nil {
+		return err
+	}
+	if err := c.initRedis(); err != nil {
+		return err
+	}
+	go func() {
+		if err := c.backfillRedemptionHashes(); err != nil {
+			lg.Errorf("Could not backfill redemption id hashes: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "backfill_redemption_hashes"})
+		}
+	}()
+
+	if cfg.WarmConnections > 0 {
+		c.warmAll()
+		go c.keepConnectionsWarm()
+	}
+	if cfg.CachingConfig.Warm {
+		c.warmIssuers()
+	}
+
+	c.markReady()
+	return nil
+}
+
+// connectDb opens the database connections and applies migrations, it is safe to retry
+func (c *Server) connectDb() error {
+	cfg := c.dbConfig
+
+	db, connector := openRotatingDB(cfg.ConnectionURI)
+	db.SetMaxOpenConns(cfg.MaxConnection)
+	if cfg.WarmConnections > defaultMaxIdleConns {
+		db.SetMaxIdleConns(cfg.WarmConnections)
+	}
+
+	migrator, err := c.migrator(db)
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	if _, err := migrator.Up(0); err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	if cfg.ReadOnlyConnectionURI != "" {
+		dbReadOnly, readOnlyConnector := openRotatingDB(cfg.ReadOnlyConnectionURI)
+		dbReadOnly.SetMaxOpenConns(cfg.MaxConnection)
+		if cfg.WarmConnections > defaultMaxIdleConns {
+			dbReadOnly.SetMaxIdleConns(cfg.WarmConnections)
+		}
+		c.dbReadOnly = dbReadOnly
+		c.dbReadOnlyConnector = readOnlyConnector
+	}
+
+	c.db = db
+	c.dbConnector = connector
+	return nil
+}
+
+// migrator returns the migrations of the configured backend for a database
+func (c *Server) migrator(db *sql.DB) (*migrations.Migrator, error) {
+	backend, err := migrations.ParseBackend(c.dbConfig.Backend)
+	if err != nil {
+		return nil, err
+	}
+	migrationsURL := c.dbConfig.MigrationsURL
+	if migrationsURL == "" {
+		migrationsURL = defaultMigrationsURL
+	}
+	list, err := migrations.Load(migrationsURL, backend)
+	if err != nil {
+		return nil, err
 	}
+	return migrations.New(db, backend, list), nil
 }
 
 var (
@@ -103,11 +260,21 @@ var (
 		Help: "Number of calls to redeem token",
 	})
 
+	cachedDuplicateCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cached_duplicate_redemption_count",
+		Help: "Number of duplicate redemptions rejected from the cache without querying the database",
+	})
+
 	fetchRedemptionCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "fetch_redemption_count",
 		Help: "Number of calls to fetch redemption",
 	})
 
+	readOnlyFallbackCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_read_only_fallback_count",
+		Help: "Number of reads retried against the primary because the read replica failed",
+	})
+
 	// Timers for SQL calls
 	latencyBuckets = []float64{.25, .5, 1, 2.5, 5, 10}
 
@@ -140,109 +307,555 @@ func incrementCounter(c prometheus.Counter) {
 	c.Add(1)
 }
 
-func (c *Server) fetchIssuer(issuerType string) (*Issuer, error) {
+// queryReadOnly runs a read query against the read replica when one is configured,
+// falling back to the primary if the replica is unavailable. Transient errors of the
+// primary are retried.
+func (c *Server) queryReadOnly(query string, args ...interface{}) (*sql.Rows, error) {
+	if c.dbReadOnly != nil {
+		rows, err := c.dbReadOnly.Query(query, args...)
+		if err == nil {
+			return rows, nil
+		}
+		incrementCounter(readOnlyFallbackCounter)
+	}
+
+	var rows *sql.Rows
+	err := c.retry("postgres_read", true, func() error {
+		var err error
+		rows, err = c.db.Query(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+const issuerColumns = `id, issuer_type, signing_key, max_tokens, version, created_at, bucket_seconds, buffer, expires_at, rotated_at, group_id, rotation_window_days, valid_days, redemption_retention_days, redemption_store, revoked_at, payload_policy, flags, canary_percent`
+
+// unexpiredIssuers restricts a query to issuers that can still verify redemptions,
+// ordered so that the active issuer of each type comes first
+const unexpiredIssuers = `(expires_at IS NULL OR expires_at > NOW())`
+const activeIssuerFirst = `rotated_at IS NOT NULL, canary_percent IS NOT NULL, created_at DESC`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanIssuer(row rowScanner) (*Issuer, error) {
+	var signingKey []byte
+	var bucketSeconds int64
+	var expiresAt, rotatedAt, revokedAt pq.NullTime
+	var groupID, redemptionStore sql.NullString
+	var rotationWindowDays, validDays, retentionDays, canaryPercent sql.NullInt64
+	var payloadPolicy pq.StringArray
+	var flags []byte
+	var issuer = &Issuer{}
+	if err := row.Scan(&issuer.ID, &issuer.IssuerType, &signingKey, &issuer.MaxTokens, &issuer.Version, &issuer.CreatedAt, &bucketSeconds, &issuer.Buffer, &expiresAt, &rotatedAt, &groupID, &rotationWindowDays, &validDays, &retentionDays, &redemptionStore, &revokedAt, &payloadPolicy, &flags, &canaryPercent); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(flags, &issuer.Flags); err != nil {
+		return nil, err
+	}
+	if len(issuer.Flags) == 0 {
+		issuer.Flags = nil
+	}
+	issuer.BucketDuration = time.Duration(bucketSeconds) * time.Second
+	issuer.ExpiresAt = expiresAt.Time
+	issuer.RotatedAt = rotatedAt.Time
+	issuer.GroupID = groupID.String
+	issuer.RotationWindowDays = int(rotationWindowDays.Int64)
+	issuer.ValidDays = int(validDays.Int64)
+	issuer.RedemptionRetentionDays = int(retentionDays.Int64)
+	issuer.RedemptionStore = redemptionStore.String
+	issuer.RevokedAt = revokedAt.Time
+	issuer.PayloadPolicy = payloadPolicy
+	issuer.CanaryPercent = int(canaryPercent.Int64)
+
+	if signingKey != nil {
+		var err error
+		if issuer.SigningKey, err = unsealSigningKey(signingKey); err != nil {
+			return nil, err
+		}
+	}
+	return issuer, nil
+}
+
+// scanIssuers reads all issuers from rows, closing them before loading any version 3 keys
+func (c *Server) scanIssuers(rows *sql.Rows, query func(string, ...interface{}) (*sql.Rows, error)) ([]*Issuer, error) {
+	defer rows.Close()
+
+	issuers := []*Issuer{}
+	for rows.Next() {
+		issuer, err := scanIssuer(rows)
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, issuer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, issuer := range issuers {
+		if issuer.Version == IssuerVersion3 {
+			var err error
+			if issuer.Keys, err = c.fetchIssuerKeys(query, issuer.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return issuers, nil
+}
+
+// fetchIssuers returns the unexpired issuers of a type, the active issuer first
+// followed by rotated issuers whose tokens are still redeemable
+func (c *Server) fetchIssuers(issuerType string) ([]*Issuer, error) {
 	defer incrementCounter(fetchIssuerCounter)
 
 	if c.caches != nil {
 		if cached, found := c.caches["issuers"].Get(issuerType); found {
-			return cached.(*Issuer), nil
+			return cached.([]*Issuer), nil
 		}
 	}
 
 	queryTimer := prometheus.NewTimer(fetchIssuerByTypeDBDuration)
-	rows, err := c.db.Query(
-		`SELECT issuer_type, signing_key, max_tokens FROM issuers WHERE issuer_type=$1`, issuerType)
+	rows, err := c.queryReadOnly(
+		`SELECT `+issuerColumns+` FROM issuers WHERE issuer_type=$1 AND `+unexpiredIssuersWithSkew+` ORDER BY `+activeIssuerFirst,
+		issuerType, c.ClockSkewSec)
 	if err != nil {
 		return nil, err
 	}
 	queryTimer.ObserveDuration()
 
-	defer rows.Close()
-
-	if rows.Next() {
-		var signingKey []byte
-		var issuer = &Issuer{}
-		if err := rows.Scan(&issuer.IssuerType, &signingKey, &issuer.MaxTokens); err != nil {
-			return nil, err
-		}
+	issuers, err := c.scanIssuers(rows, c.queryReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if len(issuers) == 0 {
+		return nil, IssuerNotFoundError
+	}
 
-		issuer.SigningKey = &crypto.SigningKey{}
-		err := issuer.SigningKey.UnmarshalText(signingKey)
-		if err != nil {
-			return nil, err
-		}
+	if c.caches != nil {
+		c.caches["issuers"].SetDefault(issuerType, issuers)
+	}
 
-		if c.caches != nil {
-			c.caches["issuers"].SetDefault(issuerType, issuer)
-		}
+	return issuers, nil
+}
 
-		return issuer, nil
+// fetchIssuer returns the issuer currently used to sign tokens of a type
+func (c *Server) fetchIssuer(issuerType string) (*Issuer, error) {
+	issuers, err := c.fetchIssuers(issuerType)
+	if err != nil {
+		return nil, err
 	}
+	return issuers[0], nil
+}
 
-	if err := rows.Err(); err != nil {
+// fetchIssuerByID returns an issuer whether or not it is still active
+func (c *Server) fetchIssuerByID(id string) (*Issuer, error) {
+	if _, err := uuid.FromString(id); err != nil {
+		return nil, IssuerNotFoundError
+	}
+	rows, err := c.queryReadOnly(`SELECT `+issuerColumns+` FROM issuers WHERE id = $1`, id)
+	if err != nil {
 		return nil, err
 	}
+	issuers, err := c.scanIssuers(rows, c.queryReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if len(issuers) == 0 {
+		return nil, IssuerNotFoundError
+	}
+	return issuers[0], nil
+}
 
-	return nil, IssuerNotFoundError
+// forgetIssuers drops any cached issuers of a type, on this instance right away and on
+// the others once they are notified
+func (c *Server) forgetIssuers(issuerType string) {
+	if c.caches != nil {
+		c.dropCachedIssuers(issuerType)
+	}
+	c.notifyIssuerChange(issuerType)
 }
 
-func (c *Server) createIssuer(issuerType string, maxTokens int) error {
-	defer incrementCounter(createIssuerCounter)
-	if maxTokens == 0 {
-		maxTokens = 40
+// dropCachedIssuers drops the cached unexpired and revoked issuers of a type, and
+// its freeze
+func (c *Server) dropCachedIssuers(issuerType string) {
+	c.caches["issuers"].Delete(issuerType)
+	c.caches["issuers"].Delete(revokedIssuersCacheKey(issuerType))
+	c.caches["issuers"].Delete(issuerFreezeCacheKey(issuerType))
+}
+
+// createIssuer generates signing keys for and stores a new issuer. The ID,
+// SigningKey and Keys of the passed issuer are populated on success.
+func (c *Server) createIssuer(issuer *Issuer) error {
+	if err := c.validateNewIssuer(issuer); err != nil {
+		return err
 	}
 
-	signingKey, err := crypto.RandomSigningKey()
+	tx, err := c.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	signingKeyTxt, err := signingKey.MarshalText()
+	if err := c.insertIssuer(tx, issuer); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.forgetIssuers(issuer.IssuerType)
+
+	if issuer.Version == IssuerVersion3 {
+		issuer.Keys, err = c.fetchIssuerKeys(c.db.Query, issuer.ID)
+		return err
+	}
+	return nil
+}
+
+// validateNewIssuer checks the settings of an issuer that insertIssuer does not
+func (c *Server) validateNewIssuer(issuer *Issuer) error {
+	if issuer.RedemptionStore == RedemptionStoreRedis && c.redis == nil {
+		return ErrRedisDisabled
+	}
+	if err := c.validatePayloadPolicy(issuer.PayloadPolicy); err != nil {
+		return err
+	}
+	return validateIssuerFlags(issuer.Flags)
+}
+
+// defaultMaxTokens returns the batch cap of issuers created without max_tokens
+func (c *Server) defaultMaxTokens() int {
+	if c.dbConfig.DefaultMaxTokens > 0 {
+		return c.dbConfig.DefaultMaxTokens
+	}
+	return defaultMaxTokens
+}
+
+// issuerMaxTokens returns the batch cap of an issuer, the default for issuers stored
+// without one
+func (c *Server) issuerMaxTokens(issuer *Issuer) int {
+	if issuer.MaxTokens > 0 {
+		return issuer.MaxTokens
+	}
+	return c.defaultMaxTokens()
+}
+
+// insertIssuer generates signing keys for and inserts a new issuer as part of tx, a
+// version 1 issuer that already has an id and key, such as a pending issuer, keeps them
+func (c *Server) insertIssuer(tx *sql.Tx, issuer *Issuer) error {
+	defer incrementCounter(createIssuerCounter)
+	if issuer.MaxTokens < 0 {
+		return InvalidMaxTokensError
+	}
+	issuer.MaxTokens = c.issuerMaxTokens(issuer)
+	if issuer.Version == 0 {
+		issuer.Version = IssuerVersion1
+	}
+	if issuer.RotationWindowDays < 0 || issuer.ValidDays < 0 || issuer.RedemptionRetentionDays < 0 {
+		return InvalidRotationError
+	}
+	if issuer.ExpiresAt.IsZero() && issuer.ValidDays > 0 {
+		issuer.ExpiresAt = time.Now().Add(time.Duration(issuer.ValidDays) * 24 * time.Hour)
+	}
+	if !issuer.ExpiresAt.IsZero() && !issuer.ExpiresAt.After(time.Now()) {
+		return InvalidExpiryError
+	}
+	switch issuer.RedemptionStore {
+	case "", RedemptionStorePostgres:
+	case RedemptionStoreRedis:
+		// Redemptions are only kept in Redis until the issuer expires
+		if issuer.ExpiresAt.IsZero() {
+			return ErrRedisRedemptionExpiry
+		}
+	default:
+		return ErrInvalidRedemptionStore
+	}
+
+	var signingKeyTxt []byte
+	switch issuer.Version {
+	case IssuerVersion1:
+		if issuer.SigningKey == nil {
+			signingKey, err := crypto.RandomSigningKey()
+			if err != nil {
+				return err
+			}
+			issuer.SigningKey = signingKey
+		}
+
+		var err error
+		signingKeyTxt, err = sealSigningKey(issuer.SigningKey)
+		if err != nil {
+			return err
+		}
+		defer zeroize(signingKeyTxt)
+	case IssuerVersion3:
+		if issuer.BucketDuration < time.Second || issuer.Buffer < 1 {
+			return InvalidBucketError
+		}
+	default:
+		return UnsupportedVersionError
+	}
+
+	if issuer.ID == "" {
+		issuer.ID = uuid.NewV4().String()
+	}
+
+	var expiresAt pq.NullTime
+	if !issuer.ExpiresAt.IsZero() {
+		expiresAt = pq.NullTime{Time: issuer.ExpiresAt.UTC(), Valid: true}
+	}
+	var groupID sql.NullString
+	if issuer.GroupID != "" {
+		groupID = sql.NullString{String: issuer.GroupID, Valid: true}
+	}
+
+	rotationWindowDays := sql.NullInt64{Int64: int64(issuer.RotationWindowDays), Valid: issuer.RotationWindowDays > 0}
+	validDays := sql.NullInt64{Int64: int64(issuer.ValidDays), Valid: issuer.ValidDays > 0}
+	retentionDays := sql.NullInt64{Int64: int64(issuer.RedemptionRetentionDays), Valid: issuer.RedemptionRetentionDays > 0}
+	redemptionStore := sql.NullString{String: issuer.RedemptionStore, Valid: issuer.RedemptionStore != ""}
+	canaryPercent := sql.NullInt64{Int64: int64(issuer.CanaryPercent), Valid: issuer.CanaryPercent > 0}
+	flags, err := marshalIssuerFlags(issuer.Flags)
 	if err != nil {
 		return err
 	}
 
+	// Renamed types stay reserved so that clients using the old name are not
+	// silently moved to a different issuer
+	var aliased bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM issuer_aliases WHERE alias = $1)`, issuer.IssuerType).Scan(&aliased); err != nil {
+		return err
+	}
+	if aliased {
+		return IssuerExistsError
+	}
+
 	queryTimer := prometheus.NewTimer(createIssuerDBDuration)
-	rows, err := c.db.Query(
-		`INSERT INTO issuers(issuer_type, signing_key, max_tokens) VALUES ($1, $2, $3)`, issuerType, signingKeyTxt, maxTokens)
+	_, err = tx.Exec(
+		`INSERT INTO issuers(id, issuer_type, signing_key, max_tokens, version, bucket_seconds, buffer, expires_at, group_id, rotation_window_days, valid_days, redemption_retention_days, redemption_store, payload_policy, flags, canary_percent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+		issuer.ID, issuer.IssuerType, signingKeyTxt, issuer.MaxTokens, issuer.Version, int64(issuer.BucketDuration/time.Second), issuer.Buffer, expiresAt, groupID, rotationWindowDays, validDays, retentionDays, redemptionStore, pq.Array(issuer.PayloadPolicy), flags, canaryPercent)
 	if err != nil {
+		if errors.Is(classifyStorageError(err), ErrDuplicate) {
+			return IssuerExistsError
+		}
 		return err
 	}
 	queryTimer.ObserveDuration()
 
-	defer rows.Close()
+	if issuer.Version == IssuerVersion3 {
+		if _, err := insertIssuerKeys(tx, issuer, time.Now()); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 type Queryable interface {
 	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// loadRedemptionHashSalt reads the salt used to hash redemption ids, generating it
+// the first time any instance starts against the database
+func (c *Server) loadRedemptionHashSalt() error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	_, err := c.db.Exec(
+		`INSERT INTO redemption_hash_salt(id, salt) VALUES (1, $1) ON CONFLICT (id) DO NOTHING`, hex.EncodeToString(salt))
+	if err != nil {
+		return err
+	}
+
+	var saltTxt string
+	if err := c.db.QueryRow(`SELECT salt FROM redemption_hash_salt WHERE id = 1`).Scan(&saltTxt); err != nil {
+		return err
+	}
+	c.redemptionHashSalt, err = hex.DecodeString(saltTxt)
+	return err
+}
+
+// redemptionIDHash is the salted hash of a redemption id, used to look redemptions up
+// without the raw preimage appearing in request URLs
+func (c *Server) redemptionIDHash(id string) string {
+	h := sha256.New()
+	_, _ = h.Write(c.redemptionHashSalt)
+	_, _ = h.Write([]byte(id))
+	return hex.EncodeToString(h.Sum(nil))
 }
 
+// backfillRedemptionHashes hashes the ids of redemptions recorded before the id_hash
+// column was added, in batches so that it can run alongside traffic
+func (c *Server) backfillRedemptionHashes() error {
+	for {
+		rows, err := c.db.Query(`SELECT id FROM redemptions WHERE id_hash IS NULL LIMIT $1`, redemptionHashBackfillBatch)
+		if err != nil {
+			return err
+		}
+		ids := []string{}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		for _, id := range ids {
+			if _, err := c.db.Exec(`UPDATE redemptions SET id_hash = $1 WHERE id = $2`, c.redemptionIDHash(id), id); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// redeemToken records a redemption with the payload transformed by the payload policy
+// of the issuer type, before it reaches any store including the queue
 func (c *Server) redeemToken(issuerType string, preimage *crypto.TokenPreimage, payload string) error {
+	payload, err := c.transformPayload(issuerType, payload)
+	if err != nil {
+		return err
+	}
+	return c.redeemTransformedToken(issuerType, preimage, payload)
+}
+
+// redeemTransformedToken records a redemption whose payload already went through the
+// payload policy
+func (c *Server) redeemTransformedToken(issuerType string, preimage *crypto.TokenPreimage, payload string) error {
 	defer incrementCounter(redeemTokenCounter)
-	return redeemTokenWithDB(c.db, issuerType, preimage, payload)
+
+	preimageTxt, err := preimage.MarshalText()
+	if err != nil {
+		return err
+	}
+	id := string(preimageTxt)
+	if c.redeemedRecently(issuerType, id) {
+		incrementCounter(cachedDuplicateCounter)
+		return DuplicateRedemptionError
+	}
+
+	// Redis is the only store of the types that use it
+	if c.redisRedemptions(issuerType) {
+		err = c.redeemRedisToken(issuerType, id, payload)
+		if err != nil && !errors.Is(err, ErrDuplicate) {
+			return err
+		}
+		c.rememberRedemption(issuerType, id)
+		if err != nil {
+			return err
+		}
+		c.publishRedemption(issuerType, preimage, payload)
+		c.countRedemptions(issuerType, 1)
+		return nil
+	}
+
+	// Queued redemptions are not in Postgres until they are replayed
+	if c.redemptionQueue != nil && c.isQueued(id) {
+		c.rememberRedemption(issuerType, id)
+		return DuplicateRedemptionError
+	}
+
+	// While dual writing DynamoDB is the double spend check, Postgres still catches
+	// redemptions recorded before the migration started
+	dual := c.dualWrites(issuerType)
+	var writer string
+	if dual {
+		writer, err = c.putDynamoRedemption(Redemption{IssuerType: issuerType, Id: id, Timestamp: time.Now(), Payload: payload})
+		if (errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrThrottled)) && c.Dynamo.FallbackToPostgres {
+			// The backfill copies the redemption once DynamoDB recovers
+			incrementCounter(dynamoWriteFailureCounter)
+			dual = false
+		} else if err != nil {
+			return err
+		}
+	}
+
+	err = c.retry("postgres_redeem", false, func() error {
+		return c.redeemTokenWithDB(c.db, issuerType, preimage, payload)
+	})
+	if err != nil && !errors.Is(err, ErrDuplicate) {
+		// A queued redemption keeps its DynamoDB item, which guards it until replayed
+		err = c.redeemQueued(issuerType, preimage, payload, err)
+	}
+	if errors.Is(err, ErrDuplicate) {
+		c.rememberRedemption(issuerType, id)
+	}
+	if err != nil {
+		if dual && !errors.Is(err, ErrDuplicate) {
+			c.deleteDynamoRedemption(id, writer)
+		}
+		return err
+	}
+	if dual {
+		c.scheduleReplicationCheck(issuerType, id, writer, payload)
+	}
+	c.rememberRedemption(issuerType, id)
+	c.publishRedemption(issuerType, preimage, payload)
+	c.countRedemptions(issuerType, 1)
+	return nil
 }
 
-func redeemTokenWithDB(db Queryable, issuerType string, preimage *crypto.TokenPreimage, payload string) error {
+// redeemedRecently reports whether this instance has seen the token redeemed, so that
+// retried redemptions are rejected without querying the database. Only voiding undoes
+// a redemption, which clears the cache of the instance handling it, other instances
+// keep rejecting the token until their entry expires. Tokens that were not redeemed
+// are never cached, a miss always falls through to the database.
+func (c *Server) redeemedRecently(issuerType, id string) bool {
+	if c.caches == nil {
+		return false
+	}
+	_, found := c.caches["redeemed"].Get(fmt.Sprintf("%s:%s", issuerType, id))
+	return found
+}
+
+func (c *Server) rememberRedemption(issuerType, id string) {
+	if c.caches != nil {
+		c.caches["redeemed"].SetDefault(fmt.Sprintf("%s:%s", issuerType, id), true)
+	}
+}
+
+func (c *Server) redeemTokenWithDB(db Queryable, issuerType string, preimage *crypto.TokenPreimage, payload string) error {
 	preimageTxt, err := preimage.MarshalText()
 	if err != nil {
 		return err
 	}
+	return c.insertRedemption(db, issuerType, string(preimageTxt), payload)
+}
 
+// insertRedemption records a redemption at the time of the database, returning
+// DuplicateRedemptionError if the token was already redeemed
+func (c *Server) insertRedemption(db Queryable, issuerType, id, payload string) error {
+	// A voided redemption is replaced, so that the token can be redeemed again
 	queryTimer := prometheus.NewTimer(createRedemptionDBDuration)
-	rows, err := db.Query(
-		`INSERT INTO redemptions(id, issuer_type, ts, payload) VALUES ($1, $2, NOW(), $3)`, preimageTxt, issuerType, payload)
+	result, err := db.Exec(
+		`INSERT INTO redemptions(id, issuer_type, ts, payload, id_hash) VALUES ($1, $2, NOW(), $3, $4)
+		ON CONFLICT (id) DO UPDATE SET issuer_type = EXCLUDED.issuer_type, ts = EXCLUDED.ts, payload = EXCLUDED.payload,
+			id_hash = EXCLUDED.id_hash, voided_at = NULL, void_reason = NULL
+		WHERE redemptions.voided_at IS NOT NULL`,
+		id, issuerType, payload, c.redemptionIDHash(id))
 
 	queryTimer.ObserveDuration()
 
 	if err != nil {
-		if err, ok := err.(*pq.Error); ok && err.Code == "23505" { // unique constraint violation
-			return DuplicateRedemptionError
-		}
 		return err
 	}
-
-	defer rows.Close()
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return DuplicateRedemptionError
+	}
 	return nil
 }
 
@@ -254,9 +867,39 @@ func (c *Server) fetchRedemption(issuerType, id string) (*Redemption, error) {
 		}
 	}
 
+	if c.redisRedemptions(issuerType) {
+		redemption, err := c.getRedisRedemption(issuerType, id)
+		if err == nil && c.caches != nil {
+			c.caches["redemptions"].SetDefault(fmt.Sprintf("%s:%s", issuerType, id), redemption)
+		}
+		return redemption, err
+	}
+
+	if c.dualWrites(issuerType) {
+		redemption, err := c.getDynamoRedemption(issuerType, id)
+		if err == nil {
+			if c.caches != nil {
+				c.caches["redemptions"].SetDefault(fmt.Sprintf("%s:%s", issuerType, id), redemption)
+			}
+			return redemption, nil
+		}
+		// Redemptions recorded before the migration are only in Postgres
+		if !errors.Is(err, ErrNotFound) {
+			incrementCounter(dynamoReadFallbackCounter)
+		}
+	}
+
+	if c.redemptionQueue != nil {
+		if redemption, err := c.fetchQueuedRedemption(issuerType, id); err == nil {
+			return redemption, nil
+		}
+	}
+
+	// Redemptions the backfill has not reached yet are matched on the raw id
 	queryTimer := prometheus.NewTimer(fetchRedemptionDBDuration)
-	rows, err := c.db.Query(
-		`SELECT id, issuer_type, ts, payload FROM redemptions WHERE id = $1 AND issuer_type = $2`, id, issuerType)
+	rows, err := c.queryReadOnly(
+		`SELECT id, issuer_type, ts, payload FROM redemptions
+		WHERE `+issuerTypeNames("$1")+` AND (id_hash = $2 OR (id_hash IS NULL AND id = $3)) AND voided_at IS NULL`, issuerType, c.redemptionIDHash(id), id)
 
 	queryTimer.ObserveDuration()
 
@@ -285,3 +928,101 @@ func (c *Server) fetchRedemption(issuerType, id string) (*Redemption, error) {
 
 	return nil, RedemptionNotFoundError
 }
+
+// fetchAllIssuers returns every unexpired issuer, including rotated issuers whose
+// tokens are still redeemable, and expired issuers as well when includeExpired is set
+func (c *Server) fetchAllIssuers(includeExpired bool) ([]*Issuer, error) {
+	condition := unexpiredIssuers
+	if includeExpired {
+		condition = "TRUE"
+	}
+	rows, err := c.queryReadOnly(
+		`SELECT ` + issuerColumns + ` FROM issuers WHERE ` + condition + ` ORDER BY issuer_type, ` + activeIssuerFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.scanIssuers(rows, c.queryReadOnly)
+}
+
+// fetchSpentTokens calls fn for every redemption recorded at or before asOf.
+// The primary is used so that the snapshot lines up with subsequent deltas.
+func (c *Server) fetchSpentTokens(asOf time.Time, fn func(issuerType, id string)) error {
+	rows, err := c.db.Query(`SELECT issuer_type, id FROM redemptions WHERE ts <= $1 AND voided_at IS NULL`, asOf)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var issuerType, id string
+		if err := rows.Scan(&issuerType, &id); err != nil {
+			return err
+		}
+		fn(issuerType, id)
+	}
+
+	return rows.Err()
+}
+
+// spentHorizon returns the latest time up to which every redemption is committed.
+// Redemptions are stamped with the start of their transaction, so one committing late
+// has an earlier timestamp than redemptions already visible. The horizon stays just
+// before the start of the oldest transaction in flight, and spent tokens are only
+// listed up to it so that consumers paging by timestamp never skip a redemption.
+func (c *Server) spentHorizon() (time.Time, error) {
+	var horizon time.Time
+	err := c.db.QueryRow(`
+		SELECT COALESCE(MIN(xact_start)::timestamp, LOCALTIMESTAMP) - interval '1 microsecond'
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND pid <> pg_backend_pid()
+			AND backend_type = 'client backend' AND xact_start IS NOT NULL`).Scan(&horizon)
+	return horizon, err
+}
+
+// fetchSpentTokenDelta returns redemptions recorded after since, up to roughly limit rows.
+// All redemptions sharing the final timestamp are included so the returned upper bound
+// can be used as the next lower bound without skipping any rows. The upper bound never
+// passes the spent horizon, it stays at since while a transaction older than since is
+// in flight.
+func (c *Server) fetchSpentTokenDelta(since time.Time, limit int) ([]Redemption, time.Time, bool, error) {
+	horizon, err := c.spentHorizon()
+	if err != nil {
+		return nil, horizon, false, err
+	}
+	if !horizon.After(since) {
+		return []Redemption{}, since, false, nil
+	}
+
+	var until time.Time
+	hasMore := true
+	err = c.db.QueryRow(
+		`SELECT ts FROM redemptions WHERE ts > $1 AND ts <= $2 ORDER BY ts LIMIT 1 OFFSET $3`, since, horizon, limit-1).Scan(&until)
+	if err == sql.ErrNoRows {
+		hasMore = false
+		until, err = horizon, nil
+	}
+	if err != nil {
+		return nil, until, false, err
+	}
+
+	rows, err := c.db.Query(
+		`SELECT id, issuer_type, ts FROM redemptions WHERE ts > $1 AND ts <= $2 AND voided_at IS NULL ORDER BY ts`, since, until)
+	if err != nil {
+		return nil, until, false, err
+	}
+
+	defer rows.Close()
+
+	redemptions := []Redemption{}
+	for rows.Next() {
+		var redemption Redemption
+		if err := rows.Scan(&redemption.Id, &redemption.IssuerType, &redemption.Timestamp); err != nil {
+			return nil, until, false, err
+		}
+		redemptions = append(redemptions, redemption)
+	}
+
+	return redemptions, until, hasMore, rows.Err()
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/brave-intl/bat-go/middleware"
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/go-chi/chi"
+	chiware "github.com/go-chi/chi/middleware"
+	"github.com/pressly/lg"
+)
+
+// defaultDebugListenHost keeps the unauthenticated debug port off other interfaces
+// unless it is bound to one explicitly
+const defaultDebugListenHost = "127.0.0.1"
+
+var startedAt = time.Now()
+
+// DebugStatus describes the running process for diagnosing production issues
+type DebugStatus struct {
+	Version   string         `json:"version"`
+	GoVersion string         `json:"go_version"`
+	Module    string         `json:"module,omitempty"`
+	StartedAt time.Time      `json:"started_at"`
+	Ready     bool           `json:"ready"`
+	Runtime   RuntimeStatus  `json:"runtime"`
+	Caches    map[string]int `json:"caches"`
+	// Database has the connection pool stats of the primary and read only databases
+	Database map[string]sql.DBStats `json:"database"`
+}
+
+// RuntimeStatus is a summary of the Go runtime statistics
+type RuntimeStatus struct {
+	Goroutines     int    `json:"goroutines"`
+	HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	HeapObjects    uint64 `json:"heap_objects"`
+	SysBytes       uint64 `json:"sys_bytes"`
+	NumGC          uint32 `json:"num_gc"`
+	PauseTotalNs   uint64 `json:"pause_total_ns"`
+}
+
+// itemCounter is implemented by the in memory caches
+type itemCounter interface {
+	ItemCount() int
+}
+
+func (c *Server) debugStatus() DebugStatus {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	status := DebugStatus{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		StartedAt: startedAt,
+		Ready:     c.isReady(),
+		Runtime: RuntimeStatus{
+			Goroutines:     runtime.NumGoroutine(),
+			HeapAllocBytes: mem.HeapAlloc,
+			HeapObjects:    mem.HeapObjects,
+			SysBytes:       mem.Sys,
+			NumGC:          mem.NumGC,
+			PauseTotalNs:   mem.PauseTotalNs,
+		},
+		Caches:   map[string]int{},
+		Database: map[string]sql.DBStats{},
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		status.Module = fmt.Sprintf("%s@%s", info.Main.Path, info.Main.Version)
+	}
+	for name, cache := range c.caches {
+		if counter, ok := cache.(itemCounter); ok {
+			status.Caches[name] = counter.ItemCount()
+		}
+	}
+	if c.db != nil {
+		status.Database["primary"] = c.db.Stats()
+	}
+	if c.dbReadOnly != nil {
+		status.Database["read_only"] = c.dbReadOnly.Stats()
+	}
+	return status
+}
+
+func (c *Server) debugStatusHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	return encodeResponse(w, c.debugStatus())
+}
+
+// debugRouter serves net/http/pprof, expvar, the status of the process and test
+// vectors, it must be
+// mounted at /debug for pprof to find the named profiles
+func (c *Server) debugRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Method(http.MethodGet, "/status", middleware.InstrumentHandler("GetDebugStatus", c.appHandler(c.debugStatusHandler)))
+	r.Method(http.MethodGet, "/vectors", middleware.InstrumentHandler("GetTestVectors", c.appHandler(c.testVectorsHandler)))
+	r.Mount("/", chiware.Profiler())
+	return r
+}
+
+// debugListenAddr is the address of the debug port, on loopback unless
+// DebugListenHost is set
+func (c *Server) debugListenAddr() string {
+	host := c.DebugListenHost
+	if host == "" {
+		host = defaultDebugListenHost
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.DebugListenPort))
+}
+
+// listenAndServeDebug serves the debug routes without authentication on their own
+// port, which must only be reachable by operators
+func (c *Server) listenAndServeDebug() {
+	r := chi.NewRouter()
+	r.Mount("/debug", c.debugRouter())
+
+	if err := http.ListenAndServe(c.debugListenAddr(), r); err != nil {
+		lg.Errorf("Debug listener stopped: %s", err)
+	}
+}
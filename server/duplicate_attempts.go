@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	duplicateAttemptRetention = 30 * 24 * time.Hour
+	duplicateAttemptInterval  = time.Hour
+	duplicateSummaryLimit     = 100
+)
+
+var duplicateRedemptionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "duplicate_redemption_count",
+	Help: "Number of attempts to redeem a token that was already redeemed, by issuer type and caller",
+}, []string{"issuer_type", "client"})
+
+// ErrorCodeDuplicateRedemption is the data.error_code of duplicate redemptions answered
+// with DuplicateRedemptionDetails
+const ErrorCodeDuplicateRedemption = "duplicate_redemption"
+
+// DuplicateAttemptSummary aggregates the attempts of one caller to redeem tokens of an
+// issuer type that were already redeemed
+type DuplicateAttemptSummary struct {
+	IssuerType   string    `json:"issuer_type"`
+	Caller       string    `json:"caller"`
+	Attempts     int64     `json:"attempts"`
+	Tokens       int64     `json:"tokens"`
+	FirstAttempt time.Time `json:"first_attempt"`
+	LastAttempt  time.Time `json:"last_attempt"`
+}
+
+// recordDuplicate keeps an attempt to redeem an already redeemed token, which is a
+// fraud signal when repeated. The preimage is kept as its salted hash, as for
+// redemptions. Attempts are also counted per hour for the issuer stats, which
+// outlive the attempts themselves.
+func (c *Server) recordDuplicate(r *http.Request, issuerType string, preimage *crypto.TokenPreimage, payload string) {
+	caller := clientKeyID(r)
+	duplicateRedemptionCounter.With(prometheus.Labels{"issuer_type": issuerType, "client": caller}).Inc()
+
+	tokenID, err := preimage.MarshalText()
+	if err != nil {
+		lg.Errorf("Could not record duplicate redemption of %s: %s", issuerType, err)
+		return
+	}
+	// Attempts are kept with the payload the redemption would have been recorded with
+	if payload, err = c.transformPayload(issuerType, payload); err != nil {
+		lg.Errorf("Could not record duplicate redemption of %s: %s", issuerType, err)
+		return
+	}
+	if err := c.recordDuplicateAttempt(issuerType, string(tokenID), payload, caller); err != nil {
+		lg.Errorf("Could not record duplicate redemption of %s: %s", issuerType, err)
+		c.reportError(r, err, map[string]string{"storage": "duplicate_attempts"})
+	}
+}
+
+// duplicateRedemptionAppError answers the redemption of an already redeemed token. With
+// DuplicateRedemptionDetails, data gives when the token was first redeemed, the
+// SHA-256 hash of the payload it was recorded with and whether the payload of this
+// attempt would be recorded the same, so that callers can tell their own retries
+// from replays of their tokens.
+func (c *Server) duplicateRedemptionAppError(err error, issuerType string, preimage *crypto.TokenPreimage, payload string) *handlers.AppError {
+	appErr := storageAppError(err, "Could not mark token redemption")
+	if !c.DuplicateRedemptionDetails {
+		return appErr
+	}
+
+	tokenID, err := preimage.MarshalText()
+	if err != nil {
+		return appErr
+	}
+	original, err := c.fetchRedemption(issuerType, string(tokenID))
+	if err != nil {
+		lg.Errorf("Could not look up the original redemption of a duplicate %s token: %s", issuerType, err)
+		return appErr
+	}
+	transformed, err := c.transformPayload(issuerType, payload)
+	samePayload := err == nil && transformed == original.Payload
+
+	payloadHash := sha256.Sum256([]byte(original.Payload))
+	appErr.Data = map[string]interface{}{
+		"error_code":   ErrorCodeDuplicateRedemption,
+		"redeemed_at":  original.Timestamp,
+		"payload_hash": hex.EncodeToString(payloadHash[:]),
+		"same_payload": samePayload,
+	}
+	return appErr
+}
+
+// recordDuplicateAttempt stores an attempt along with the hourly count of the issuer type
+func (c *Server) recordDuplicateAttempt(issuerType, tokenID, payload, caller string) error {
+	_, err := c.db.Exec(
+		`WITH attempt AS (
+			INSERT INTO duplicate_attempts(issuer_type, id_hash, payload, caller) VALUES ($1, $2, $3, $4)
+		)
+		INSERT INTO redemption_duplicates(issuer_type, hour, attempts) VALUES ($1, date_trunc('hour', NOW()), 1)
+		ON CONFLICT (issuer_type, hour) DO UPDATE SET attempts = redemption_duplicates.attempts + 1`,
+		issuerType, c.redemptionIDHash(tokenID), payload, caller)
+	return err
+}
+
+// fetchDuplicateSummaries aggregates the duplicate attempts made since a time, most
+// attempts first, optionally for a single issuer type
+func (c *Server) fetchDuplicateSummaries(issuerType string, since time.Time) ([]DuplicateAttemptSummary, error) {
+	rows, err := c.queryReadOnly(
+		`SELECT issuer_type, caller, COUNT(*), COUNT(DISTINCT id_hash), MIN(attempted_at), MAX(attempted_at)
+		FROM duplicate_attempts
+		WHERE attempted_at >= $1 AND ($2 = '' OR issuer_type = $2)
+		GROUP BY issuer_type, caller
+		ORDER BY COUNT(*) DESC, issuer_type, caller
+		LIMIT $3`,
+		since.UTC(), issuerType, duplicateSummaryLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []DuplicateAttemptSummary{}
+	for rows.Next() {
+		var summary DuplicateAttemptSummary
+		if err := rows.Scan(&summary.IssuerType, &summary.Caller, &summary.Attempts, &summary.Tokens, &summary.FirstAttempt, &summary.LastAttempt); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// pruneDuplicateAttempts deletes the attempts older than duplicateAttemptRetention
+func (c *Server) pruneDuplicateAttempts(now time.Time) (int64, error) {
+	result, err := c.db.Exec(`DELETE FROM duplicate_attempts WHERE attempted_at < $1`, now.Add(-duplicateAttemptRetention).UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (c *Server) pruneDuplicateAttemptsPeriodically() {
+	for {
+		if count, err := c.pruneDuplicateAttempts(time.Now()); err != nil {
+			lg.Errorf("Could not prune duplicate redemption attempts: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "prune_duplicate_attempts"})
+		} else if count > 0 {
+			lg.Infof("Pruned %d duplicate redemption attempts", count)
+		}
+		time.Sleep(duplicateAttemptInterval)
+	}
+}
+
+func (c *Server) duplicateAttemptsHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	since := time.Now().Add(-24 * time.Hour)
+	if value := r.FormValue("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return handlers.WrapError("Invalid since", err)
+		}
+	}
+
+	issuerType := r.FormValue("issuer")
+	if issuerType != "" {
+		issuerType = c.resolveIssuerType(issuerType)
+	}
+	summaries, err := c.fetchDuplicateSummaries(issuerType, since)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not fetch duplicate redemption attempts",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return encodeResponse(w, summaries)
+}
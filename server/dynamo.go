@@ -0,0 +1,412 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DynamoModeDualWrite writes redemptions of version 1 issuers to both Postgres and
+// DynamoDB and reads them from DynamoDB first, so that the double spend store can be
+// migrated while Postgres keeps every redemption
+const DynamoModeDualWrite = "dual_write"
+
+var (
+	dynamoBackfillBatch = 1000
+	// dynamoTransactionSize is the most items DynamoDB accepts in one transaction
+	dynamoTransactionSize = 25
+
+	defaultReplicationCheckMs = 2000
+)
+
+var (
+	ErrDynamoDisabled = errors.New("DynamoDB redemption store is not configured")
+
+	dynamoWriteFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dynamo_write_failure_count",
+		Help: "Number of redemptions recorded in Postgres that could not be written to DynamoDB",
+	})
+
+	dynamoBatchFallbackCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dynamo_batch_fallback_count",
+		Help: "Number of batched DynamoDB writes retried one redemption at a time because one of them was already written",
+	})
+
+	dynamoReadFallbackCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dynamo_read_fallback_count",
+		Help: "Number of redemption reads retried against Postgres because DynamoDB failed",
+	})
+
+	dynamoReplicationConflictCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynamo_replication_conflict_count",
+		Help: "Number of redemptions accepted in this region that were also accepted in another region before replication caught up",
+	}, []string{"issuer_type"})
+)
+
+// DynamoConfig configures the DynamoDB redemption store
+type DynamoConfig struct {
+	// Mode is dual_write to migrate redemptions to DynamoDB, DynamoDB is not used
+	// when empty
+	Mode  string `json:"mode,omitempty"`
+	Table string `json:"table,omitempty"`
+	// Endpoint overrides the DynamoDB endpoint, e.g. to use DynamoDB local
+	Endpoint string `json:"endpoint,omitempty"`
+	// Breaker bounds the latency of DynamoDB calls and stops calling DynamoDB while
+	// it keeps failing
+	Breaker BreakerConfig `json:"breaker"`
+	// Throttle sheds DynamoDB calls while DynamoDB throttles them, e.g. because the
+	// provisioned throughput is too low, answering them with 429 rather than retrying
+	// into it. Throttled calls then do not open the breaker.
+	Throttle ThrottleConfig `json:"throttle"`
+	// FallbackToPostgres records redemptions in Postgres while the breaker is open,
+	// requests fail with 503 otherwise
+	FallbackToPostgres bool `json:"fallback_to_postgres,omitempty"`
+	// GlobalTable marks Table as a global table replicated to other regions, whose
+	// conditional writes only see the redemptions already replicated to this region
+	GlobalTable bool `json:"global_table,omitempty"`
+	// Region is the replica this instance reads and writes, the AWS region by default
+	Region string `json:"region,omitempty"`
+	// ReplicationCheckMs is how long after a redemption of a global table it is read
+	// back to detect a conflicting redemption in another region, 2000 by default
+	ReplicationCheckMs int `json:"replication_check_ms,omitempty"`
+	// HTTP tunes the connections to DynamoDB, which every redemption waits on
+	HTTP AWSHTTPConfig `json:"http"`
+}
+
+// replicationCheckDelay returns how long to wait for replication before checking a
+// redemption of a global table for conflicts
+func (d DynamoConfig) replicationCheckDelay() time.Duration {
+	if d.ReplicationCheckMs > 0 {
+		return time.Duration(d.ReplicationCheckMs) * time.Millisecond
+	}
+	return time.Duration(defaultReplicationCheckMs) * time.Millisecond
+}
+
+// initDynamo creates the DynamoDB client, it does nothing unless a mode is configured
+func (c *Server) initDynamo() error {
+	if c.Dynamo.Mode == "" {
+		return nil
+	}
+
+	sess, err := c.getAWSSession()
+	if err != nil {
+		return err
+	}
+	// Calls are retried by c.retry, which knows which of them are idempotent
+	config := aws.NewConfig().WithMaxRetries(0).WithHTTPClient(c.Dynamo.HTTP.newClient())
+	if c.Dynamo.Endpoint != "" {
+		config = config.WithEndpoint(c.Dynamo.Endpoint)
+	}
+	c.dynamoRegion = aws.StringValue(sess.Config.Region)
+	if c.Dynamo.Region != "" {
+		config = config.WithRegion(c.Dynamo.Region)
+		c.dynamoRegion = c.Dynamo.Region
+	}
+	c.dynamo = dynamodb.New(sess, config)
+	c.dynamoBreaker = newCircuitBreaker("dynamo", c.Dynamo.Breaker, func(err error) bool {
+		return !errors.Is(err, ErrDuplicate) && !errors.Is(err, ErrNotFound)
+	})
+	if c.Dynamo.Throttle.Enabled {
+		c.dynamoBreaker.throttle = newAdaptiveThrottle("dynamo", c.Dynamo.Throttle)
+	}
+	return nil
+}
+
+// dualWrites reports whether redemptions of an issuer type are written to DynamoDB,
+// which is the case while its active issuer is a version 1 issuer
+func (c *Server) dualWrites(issuerType string) bool {
+	if c.dynamo == nil {
+		return false
+	}
+	issuer, err := c.fetchIssuer(issuerType)
+	return err == nil && issuer.Version == IssuerVersion1
+}
+
+// putDynamoRedemption records a redemption unless one with the same id exists, in
+// which case it returns DuplicateRedemptionError. Each write is tagged with a unique
+// writer id, which is returned, and the region it was made in, so that a write
+// replaced by a conflicting one from another region can be told apart.
+func (c *Server) putDynamoRedemption(redemption Redemption) (string, error) {
+	item, writer := c.dynamoRedemptionItem(redemption)
+	err := c.retry("dynamo_put", false, func() error {
+		return c.dynamoBreaker.call(func(ctx context.Context) error {
+			_, err := c.dynamo.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+				TableName:           aws.String(c.Dynamo.Table),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			})
+			if err, ok := err.(awserr.Error); ok && err.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				return DuplicateRedemptionError
+			}
+			return err
+		})
+	})
+	return writer, err
+}
+
+// dynamoRedemptionItem returns the item of a redemption along with its writer id
+func (c *Server) dynamoRedemptionItem(redemption Redemption) (map[string]*dynamodb.AttributeValue, string) {
+	writer := uuid.NewV4().String()
+	item := map[string]*dynamodb.AttributeValue{
+		"id":         {S: aws.String(redemption.Id)},
+		"issuerType": {S: aws.String(redemption.IssuerType)},
+		"timestamp":  {S: aws.String(redemption.Timestamp.UTC().Format(time.RFC3339Nano))},
+		"writer":     {S: aws.String(writer)},
+	}
+	if c.dynamoRegion != "" {
+		item["region"] = &dynamodb.AttributeValue{S: aws.String(c.dynamoRegion)}
+	}
+	// DynamoDB rejects empty string attributes
+	if redemption.Payload != "" {
+		item["payload"] = &dynamodb.AttributeValue{S: aws.String(redemption.Payload)}
+	}
+	return item, writer
+}
+
+// getDynamoRedemption reads a redemption, ids are unique across issuer types as
+// they are in Postgres
+func (c *Server) getDynamoRedemption(issuerType, id string) (*Redemption, error) {
+	var out *dynamodb.GetItemOutput
+	err := c.retry("dynamo_get", true, func() error {
+		return c.dynamoBreaker.call(func(ctx context.Context) error {
+			var err error
+			out, err = c.dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+				TableName:      aws.String(c.Dynamo.Table),
+				Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+				ConsistentRead: aws.Bool(true),
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	item := out.Item
+	if item == nil || item["issuerType"] == nil || aws.StringValue(item["issuerType"].S) != issuerType {
+		return nil, RedemptionNotFoundError
+	}
+	redemption := &Redemption{IssuerType: issuerType, Id: id}
+	if item["payload"] != nil {
+		redemption.Payload = aws.StringValue(item["payload"].S)
+	}
+	if item["timestamp"] != nil {
+		redemption.Timestamp, _ = time.Parse(time.RFC3339Nano, aws.StringValue(item["timestamp"].S))
+	}
+	return redemption, nil
+}
+
+// deleteDynamoRedemption removes a redemption that could not be recorded in Postgres,
+// so that the client can retry it. With a writer, the redemption is only removed if
+// it is still the one written then, rather than one replicated from another region.
+func (c *Server) deleteDynamoRedemption(id, writer string) {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(c.Dynamo.Table),
+		Key:       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+	}
+	if writer != "" {
+		input.ConditionExpression = aws.String("writer = :writer")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":writer": {S: aws.String(writer)}}
+	}
+	err := c.retry("dynamo_delete", true, func() error {
+		return c.dynamoBreaker.call(func(ctx context.Context) error {
+			_, err := c.dynamo.DeleteItemWithContext(ctx, input)
+			if err, ok := err.(awserr.Error); ok && err.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				return nil
+			}
+			return err
+		})
+	})
+	if err != nil {
+		incrementCounter(dynamoWriteFailureCounter)
+		lg.Errorf("Could not remove redemption from DynamoDB after Postgres failed: %s", err)
+		c.reportError(nil, err, map[string]string{"storage": "dynamo"})
+	}
+}
+
+// copyRedemptionToDynamo writes a redemption already recorded in Postgres, redemptions
+// DynamoDB already has are left as they are
+func (c *Server) copyRedemptionToDynamo(redemption Redemption) error {
+	if _, err := c.putDynamoRedemption(redemption); err != nil && !errors.Is(err, ErrDuplicate) {
+		incrementCounter(dynamoWriteFailureCounter)
+		return err
+	}
+	return nil
+}
+
+// copyRedemptionsToDynamo writes redemptions already recorded in Postgres in
+// transactions of up to dynamoTransactionSize puts, each conditional on the redemption
+// not being in DynamoDB yet. BatchWriteItem can not be conditional and would replace
+// redemptions replicated from other regions. A transaction is canceled as a whole
+// when one of its redemptions is already there, its redemptions are then written one
+// at a time, leaving those DynamoDB already has as they are. Retries of a transaction
+// carry the same client request token, so that DynamoDB applies it at most once.
+func (c *Server) copyRedemptionsToDynamo(redemptions []Redemption) error {
+	for start := 0; start < len(redemptions); start += dynamoTransactionSize {
+		end := start + dynamoTransactionSize
+		if end > len(redemptions) {
+			end = len(redemptions)
+		}
+		batch := redemptions[start:end]
+		if len(batch) == 1 {
+			if err := c.copyRedemptionToDynamo(batch[0]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		items := make([]*dynamodb.TransactWriteItem, len(batch))
+		for i, redemption := range batch {
+			item, _ := c.dynamoRedemptionItem(redemption)
+			items[i] = &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+				TableName:           aws.String(c.Dynamo.Table),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			}}
+		}
+		input := &dynamodb.TransactWriteItemsInput{
+			TransactItems:      items,
+			ClientRequestToken: aws.String(uuid.NewV4().String()),
+		}
+
+		var canceled bool
+		err := c.retry("dynamo_transact_write", true, func() error {
+			return c.dynamoBreaker.call(func(ctx context.Context) error {
+				_, err := c.dynamo.TransactWriteItemsWithContext(ctx, input)
+				awsErr, ok := err.(awserr.Error)
+				if canceled = ok && awsErr.Code() == dynamodb.ErrCodeTransactionCanceledException; canceled {
+					return nil
+				}
+				return err
+			})
+		})
+		if err != nil {
+			incrementCounter(dynamoWriteFailureCounter)
+			return err
+		}
+		if canceled {
+			incrementCounter(dynamoBatchFallbackCounter)
+			for _, redemption := range batch {
+				if err := c.copyRedemptionToDynamo(redemption); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// backfillDynamo copies the redemptions of every issuer type that is dual written from
+// Postgres to DynamoDB, it is safe to run repeatedly and while serving
+func (c *Server) backfillDynamo() (int, error) {
+	if c.dynamo == nil {
+		return 0, ErrDynamoDisabled
+	}
+
+	dualWritten := map[string]bool{}
+	copied := 0
+	lastID := ""
+	for {
+		rows, err := c.db.Query(
+			`SELECT id, issuer_type, ts, payload FROM redemptions WHERE id > $1 AND voided_at IS NULL ORDER BY id LIMIT $2`,
+			lastID, dynamoBackfillBatch)
+		if err != nil {
+			return copied, err
+		}
+
+		var batch []Redemption
+		for rows.Next() {
+			var redemption Redemption
+			if err := rows.Scan(&redemption.Id, &redemption.IssuerType, &redemption.Timestamp, &redemption.Payload); err != nil {
+				rows.Close()
+				return copied, err
+			}
+			batch = append(batch, redemption)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return copied, err
+		}
+		if len(batch) == 0 {
+			return copied, nil
+		}
+
+		for _, redemption := range batch {
+			dual, ok := dualWritten[redemption.IssuerType]
+			if !ok {
+				dual = c.dualWrites(redemption.IssuerType)
+				dualWritten[redemption.IssuerType] = dual
+			}
+			if !dual {
+				continue
+			}
+			_, err := c.putDynamoRedemption(redemption)
+			if errors.Is(err, ErrDuplicate) {
+				continue
+			}
+			if err != nil {
+				incrementCounter(dynamoWriteFailureCounter)
+				return copied, err
+			}
+			copied++
+		}
+		lastID = batch[len(batch)-1].Id
+	}
+}
+
+// checkDynamoReplication reads back a redemption of a global table once replication
+// should have caught up. Conditional writes in different regions do not see each
+// other until replicated, and the last write wins, so a redemption that was replaced
+// by another region's write is a token redeemed in both regions. It cannot be undone,
+// it is counted and recorded as a duplicate attempt for investigation instead.
+func (c *Server) checkDynamoReplication(issuerType, id, writer, payload string) (bool, error) {
+	var out *dynamodb.GetItemOutput
+	err := c.retry("dynamo_get", true, func() error {
+		return c.dynamoBreaker.call(func(ctx context.Context) error {
+			var err error
+			out, err = c.dynamo.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+				TableName:      aws.String(c.Dynamo.Table),
+				Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+				ConsistentRead: aws.Bool(true),
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// A redemption voided in the meantime is no longer there
+	if out.Item == nil || out.Item["writer"] == nil || aws.StringValue(out.Item["writer"].S) == writer {
+		return false, nil
+	}
+
+	region := "unknown"
+	if out.Item["region"] != nil {
+		region = aws.StringValue(out.Item["region"].S)
+	}
+	dynamoReplicationConflictCounter.With(prometheus.Labels{"issuer_type": issuerType}).Inc()
+	lg.Warnf("Redemption of %s in %s was also accepted in %s before replication", issuerType, c.dynamoRegion, region)
+	return true, c.recordDuplicateAttempt(issuerType, id, payload, "replication:"+region)
+}
+
+// scheduleReplicationCheck checks a redemption of a global table for conflicts in the
+// background once replication should have caught up
+func (c *Server) scheduleReplicationCheck(issuerType, id, writer, payload string) {
+	if !c.Dynamo.GlobalTable {
+		return
+	}
+	time.AfterFunc(c.Dynamo.replicationCheckDelay(), func() {
+		if _, err := c.checkDynamoReplication(issuerType, id, writer, payload); err != nil {
+			lg.Errorf("Could not check replication of redemption of %s: %s", issuerType, err)
+			c.reportError(nil, err, map[string]string{"storage": "dynamo", "issuer_type": issuerType})
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/pressly/lg"
+)
+
+const (
+	// unknownCountry is the ISO 3166 user assigned code recorded when the country
+	// header is missing or malformed
+	unknownCountry = "ZZ"
+	// otherCountry groups the countries of a bucket with fewer than k redemptions
+	otherCountry = "other"
+
+	defaultCountryHeader        = "CloudFront-Viewer-Country"
+	defaultEnrichmentBucketMins = 60
+	defaultEnrichmentMinCount   = 10
+	// Enrichment cannot be configured finer than these, see Validate
+	minEnrichmentBucketMins = 60
+	minEnrichmentMinCount   = 5
+
+	enrichmentFlushInterval = time.Minute
+	enrichmentRetention     = 90 * 24 * time.Hour
+)
+
+// pendingAttributes aggregates the attributes of redemptions on this instance until
+// they are flushed, it lives outside of Server since servers are copied by value
+// while being configured
+var pendingAttributes = &attributeCounter{counts: map[attributeKey]int64{}}
+
+// EnrichmentConfig enables counting redemptions by coarse client attributes for
+// abuse analysis. Only the country, as given by the CDN, and the time bucket of
+// a redemption are kept, as counts that are not linked to the redemption records.
+type EnrichmentConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// CountryHeader carries the two letter country code of the client, as set by
+	// the CDN in front of the server
+	CountryHeader string `json:"country_header,omitempty"`
+	// BucketMinutes is the granularity of redemption times, at least 60
+	BucketMinutes int `json:"bucket_minutes,omitempty"`
+	// MinCount is the k of k-anonymity, countries with fewer redemptions in a bucket
+	// are only reported as part of "other"
+	MinCount int `json:"min_count,omitempty"`
+}
+
+func (cfg EnrichmentConfig) countryHeader() string {
+	if cfg.CountryHeader == "" {
+		return defaultCountryHeader
+	}
+	return cfg.CountryHeader
+}
+
+func (cfg EnrichmentConfig) bucket() time.Duration {
+	if cfg.BucketMinutes <= 0 {
+		return defaultEnrichmentBucketMins * time.Minute
+	}
+	return time.Duration(cfg.BucketMinutes) * time.Minute
+}
+
+func (cfg EnrichmentConfig) minCount() int64 {
+	if cfg.MinCount <= 0 {
+		return defaultEnrichmentMinCount
+	}
+	return int64(cfg.MinCount)
+}
+
+// RedemptionAttributes counts the redemptions of an issuer type from a country in a
+// time bucket
+type RedemptionAttributes struct {
+	IssuerType  string    `json:"issuer_type"`
+	Bucket      time.Time `json:"bucket"`
+	Country     string    `json:"country"`
+	Redemptions int64     `json:"redemptions"`
+}
+
+type attributeKey struct {
+	issuerType string
+	bucket     time.Time
+	country    string
+}
+
+type attributeCounter struct {
+	sync.Mutex
+	counts map[attributeKey]int64
+}
+
+func (a *attributeCounter) add(key attributeKey, n int) {
+	a.Lock()
+	a.counts[key] += int64(n)
+	a.Unlock()
+}
+
+func (a *attributeCounter) swap() map[attributeKey]int64 {
+	a.Lock()
+	defer a.Unlock()
+	counts := a.counts
+	a.counts = map[attributeKey]int64{}
+	return counts
+}
+
+// requestCountry is the country code the CDN attached to r. Anything but two
+// letters is recorded as unknown so that the header cannot smuggle in finer data.
+func (c *Server) requestCountry(r *http.Request) string {
+	country := strings.ToUpper(strings.TrimSpace(r.Header.Get(c.Enrichment.countryHeader())))
+	if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+		return unknownCountry
+	}
+	return country
+}
+
+// enrichRedemptions counts redemptions of an issuer type by the attributes of r
+func (c *Server) enrichRedemptions(r *http.Request, issuerType string, n int) {
+	if !c.Enrichment.Enabled || n == 0 {
+		return
+	}
+	pendingAttributes.add(attributeKey{
+		issuerType: issuerType,
+		bucket:     time.Now().UTC().Truncate(c.Enrichment.bucket()),
+		country:    c.requestCountry(r),
+	}, n)
+}
+
+// flushRedemptionAttributes adds the counts aggregated since the last flush to the
+// database. Counts that cannot be written are put back for the next flush.
+func (c *Server) flushRedemptionAttributes() error {
+	counts := pendingAttributes.swap()
+	for key, n := range counts {
+		_, err := c.db.Exec(
+			`INSERT INTO redemption_attributes(issuer_type, bucket, country, redemptions) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (issuer_type, bucket, country) DO UPDATE
+			SET redemptions = redemption_attributes.redemptions + EXCLUDED.redemptions`,
+			key.issuerType, key.bucket, key.country, n)
+		if err != nil {
+			for key, n := range counts {
+				pendingAttributes.add(key, int(n))
+			}
+			return err
+		}
+		delete(counts, key)
+	}
+	return nil
+}
+
+func (c *Server) flushRedemptionAttributesPeriodically() {
+	for {
+		time.Sleep(enrichmentFlushInterval)
+		if err := c.flushRedemptionAttributes(); err != nil {
+			lg.Errorf("Could not record redemption attributes: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "flush_redemption_attributes"})
+		}
+		if _, err := c.db.Exec(`DELETE FROM redemption_attributes WHERE bucket < $1`, time.Now().Add(-enrichmentRetention).UTC()); err != nil {
+			lg.Errorf("Could not prune redemption attributes: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "prune_redemption_attributes"})
+		}
+	}
+}
+
+// fetchRedemptionAttributes returns the redemption counts by country since a time.
+// Countries with fewer than MinCount redemptions in a bucket are folded into "other",
+// which is itself left out when it is below MinCount.
+func (c *Server) fetchRedemptionAttributes(issuerType string, since time.Time) ([]RedemptionAttributes, error) {
+	rows, err := c.queryReadOnly(
+		`SELECT issuer_type, bucket, country, redemptions FROM redemption_attributes
+		WHERE bucket >= $1 AND ($2 = '' OR issuer_type = $2)`,
+		since.UTC(), issuerType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	minCount := c.Enrichment.minCount()
+	others := map[attributeKey]int64{}
+	attributes := []RedemptionAttributes{}
+	for rows.Next() {
+		var row RedemptionAttributes
+		if err := rows.Scan(&row.IssuerType, &row.Bucket, &row.Country, &row.Redemptions); err != nil {
+			return nil, err
+		}
+		if row.Redemptions >= minCount {
+			attributes = append(attributes, row)
+		} else {
+			others[attributeKey{issuerType: row.IssuerType, bucket: row.Bucket, country: otherCountry}] += row.Redemptions
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for key, n := range others {
+		if n >= minCount {
+			attributes = append(attributes, RedemptionAttributes{IssuerType: key.issuerType, Bucket: key.bucket, Country: key.country, Redemptions: n})
+		}
+	}
+
+	sort.Slice(attributes, func(i, j int) bool {
+		a, b := attributes[i], attributes[j]
+		if !a.Bucket.Equal(b.Bucket) {
+			return a.Bucket.Before(b.Bucket)
+		}
+		if a.IssuerType != b.IssuerType {
+			return a.IssuerType < b.IssuerType
+		}
+		return a.Country < b.Country
+	})
+	return attributes, nil
+}
+
+func (c *Server) redemptionAttributesHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	since := time.Now().Add(-24 * time.Hour)
+	if value := r.FormValue("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return handlers.WrapError("Invalid since", err)
+		}
+	}
+
+	issuerType := r.FormValue("issuer")
+	if issuerType != "" {
+		issuerType = c.resolveIssuerType(issuerType)
+	}
+	attributes, err := c.fetchRedemptionAttributes(issuerType, since)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not fetch redemption attributes",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return encodeResponse(w, attributes)
+}
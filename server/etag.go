@@ -0,0 +1,55 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+)
+
+// responseETag is a strong validator derived from the encoded response, issuer
+// responses only change when keys rotate so it is stable between rotations
+func responseETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, weak validators
+// match as well since the comparison for GET is weak
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeConditionalResponse writes v as JSON with an ETag, answering 304 without a
+// body when the client already has the current representation
+func encodeConditionalResponse(w http.ResponseWriter, r *http.Request, v interface{}) *handlers.AppError {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not encode response",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	// Match the trailing newline written by encodeResponse
+	body = append(body, '\n')
+
+	etag := responseETag(body)
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+	return nil
+}
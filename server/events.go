@@ -0,0 +1,287 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EventRedemption is published for every recorded redemption, issuer events use the
+// audit log action of the change
+const EventRedemption = "redemption.create"
+
+// defaultEventTypes are published when no filter is configured
+var defaultEventTypes = []string{
+	AuditIssuerCreate,
+	AuditIssuerRotate,
+	AuditIssuerRetire,
+	AuditIssuerRevoke,
+	AuditIssuerPolicy,
+	EventRedemption,
+	EventRedemptionAnomaly,
+}
+
+const (
+	// eventBatchSize is the most entries SNS PublishBatch and SQS SendMessageBatch take
+	eventBatchSize         = 10
+	defaultEventWorkers    = 4
+	defaultEventQueueDepth = 10000
+)
+
+var (
+	// eventQueue holds events waiting to be published, it lives outside of Server since
+	// servers are copied by value while being configured
+	eventQueue = newEventPublisher(0)
+
+	eventFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "event_publish_failure_count",
+		Help: "Number of events that could not be published to SNS or SQS",
+	})
+
+	eventDropCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "event_drop_count",
+		Help: "Number of events dropped because the event queue was full",
+	})
+)
+
+// EventConfig enables publishing issuer and redemption events to an SNS topic
+// and/or an SQS queue
+type EventConfig struct {
+	SNSTopicARN string `json:"sns_topic_arn,omitempty"`
+	SQSQueueURL string `json:"sqs_queue_url,omitempty"`
+	// Types limits the published events, a trailing * matches any event with that
+	// prefix. Issuer creation, rotation, retirement, revocation and policy changes and
+	// redemptions are published by default.
+	Types []string `json:"types,omitempty"`
+	// Workers publish queued events in batches, 4 by default
+	Workers int `json:"workers,omitempty"`
+	// QueueDepth bounds the events waiting for a worker, 10000 by default. Events
+	// published while the queue is full are dropped.
+	QueueDepth int `json:"queue_depth,omitempty"`
+}
+
+// Event is the message body published for each event
+type Event struct {
+	Type       string    `json:"type"`
+	Timestamp  time.Time `json:"timestamp"`
+	Actor      string    `json:"actor,omitempty"`
+	IssuerID   string    `json:"issuer_id,omitempty"`
+	IssuerType string    `json:"issuer_type,omitempty"`
+	Details    string    `json:"details,omitempty"`
+	// TokenHash is the salted hash of a redeemed token, as used by the redemption check
+	TokenHash string `json:"token_hash,omitempty"`
+	Payload   string `json:"payload,omitempty"`
+}
+
+func (cfg EventConfig) enabled() bool {
+	return cfg.SNSTopicARN != "" || cfg.SQSQueueURL != ""
+}
+
+func (cfg EventConfig) matches(eventType string) bool {
+	types := cfg.Types
+	if len(types) == 0 {
+		types = defaultEventTypes
+	}
+	for _, t := range types {
+		if t == eventType || (strings.HasSuffix(t, "*") && strings.HasPrefix(eventType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventPublisher publishes queued events on a fixed number of workers, so that a slow
+// or failing AWS endpoint holds at most the queue in memory
+type eventPublisher struct {
+	events  chan Event
+	pending sync.WaitGroup
+	started sync.Once
+}
+
+func newEventPublisher(depth int) *eventPublisher {
+	if depth <= 0 {
+		depth = defaultEventQueueDepth
+	}
+	return &eventPublisher{events: make(chan Event, depth)}
+}
+
+// start runs the workers the first time it is called
+func (p *eventPublisher) start(workers int, send func([]Event) (int, error)) {
+	if workers <= 0 {
+		workers = defaultEventWorkers
+	}
+	p.started.Do(func() {
+		for i := 0; i < workers; i++ {
+			go p.run(send)
+		}
+	})
+}
+
+// enqueue queues an event, dropping it when the queue is full
+func (p *eventPublisher) enqueue(event Event) bool {
+	p.pending.Add(1)
+	select {
+	case p.events <- event:
+		return true
+	default:
+		p.pending.Done()
+		incrementCounter(eventDropCounter)
+		return false
+	}
+}
+
+// run sends the queued events, taking whatever else is queued into the same batch
+func (p *eventPublisher) run(send func([]Event) (int, error)) {
+	for event := range p.events {
+		batch := []Event{event}
+	collect:
+		for len(batch) < eventBatchSize {
+			select {
+			case event := <-p.events:
+				batch = append(batch, event)
+			default:
+				break collect
+			}
+		}
+
+		failed, err := send(batch)
+		if failed > 0 {
+			eventFailureCounter.Add(float64(failed))
+			lg.Errorf("Could not publish %d of %d events: %s", failed, len(batch), err)
+		}
+		for range batch {
+			p.pending.Done()
+		}
+	}
+}
+
+// publishEvent queues an event if it passes the configured filter. Failures are logged
+// and counted rather than failing the already completed action.
+func (c *Server) publishEvent(event Event) {
+	if !c.Events.enabled() || !c.Events.matches(event.Type) {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	eventQueue.start(c.Events.Workers, c.sendEvents)
+	eventQueue.enqueue(event)
+}
+
+// sendEvents publishes a batch of events, returning how many could not be published
+// to every destination
+func (c *Server) sendEvents(events []Event) (int, error) {
+	bodies := make([]string, len(events))
+	for i, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return len(events), err
+		}
+		bodies[i] = string(body)
+	}
+
+	sess, err := c.getAWSSession()
+	if err != nil {
+		c.reportError(nil, err, map[string]string{"storage": "events"})
+		return len(events), err
+	}
+
+	// Entries are identified by their position in the batch, an event failing for
+	// both destinations is only counted once
+	failed := map[string]bool{}
+	var errs []string
+	fail := func(id string, reason string) {
+		failed[id] = true
+		errs = append(errs, reason)
+	}
+
+	// The event type is also sent as an attribute so subscribers can filter on it
+	if c.Events.SNSTopicARN != "" {
+		entries := make([]*sns.PublishBatchRequestEntry, len(events))
+		for i, event := range events {
+			entries[i] = &sns.PublishBatchRequestEntry{
+				Id:      aws.String(strconv.Itoa(i)),
+				Message: aws.String(bodies[i]),
+				MessageAttributes: map[string]*sns.MessageAttributeValue{
+					"type": {DataType: aws.String("String"), StringValue: aws.String(event.Type)},
+				},
+			}
+		}
+		out, err := sns.New(sess).PublishBatch(&sns.PublishBatchInput{
+			TopicArn:                   aws.String(c.Events.SNSTopicARN),
+			PublishBatchRequestEntries: entries,
+		})
+		if err != nil {
+			c.reportError(nil, err, map[string]string{"storage": "events"})
+			return len(events), err
+		}
+		for _, entry := range out.Failed {
+			fail(aws.StringValue(entry.Id), fmt.Sprintf("sns %s: %s", aws.StringValue(entry.Code), aws.StringValue(entry.Message)))
+		}
+	}
+	if c.Events.SQSQueueURL != "" {
+		entries := make([]*sqs.SendMessageBatchRequestEntry, len(events))
+		for i, event := range events {
+			entries[i] = &sqs.SendMessageBatchRequestEntry{
+				Id:          aws.String(strconv.Itoa(i)),
+				MessageBody: aws.String(bodies[i]),
+				MessageAttributes: map[string]*sqs.MessageAttributeValue{
+					"type": {DataType: aws.String("String"), StringValue: aws.String(event.Type)},
+				},
+			}
+		}
+		out, err := sqs.New(sess).SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(c.Events.SQSQueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			c.reportError(nil, err, map[string]string{"storage": "events"})
+			return len(events), err
+		}
+		for _, entry := range out.Failed {
+			fail(aws.StringValue(entry.Id), fmt.Sprintf("sqs %s: %s", aws.StringValue(entry.Code), aws.StringValue(entry.Message)))
+		}
+	}
+
+	if len(failed) == 0 {
+		return 0, nil
+	}
+	err = errors.New(strings.Join(errs, ", "))
+	c.reportError(nil, err, map[string]string{"storage": "events"})
+	return len(failed), err
+}
+
+// publishRedemption publishes the event for a recorded redemption
+func (c *Server) publishRedemption(issuerType string, preimage *crypto.TokenPreimage, payload string) {
+	if !c.Events.enabled() {
+		return
+	}
+	preimageTxt, err := preimage.MarshalText()
+	if err != nil {
+		return
+	}
+	c.publishEvent(Event{
+		Type:       EventRedemption,
+		IssuerType: issuerType,
+		TokenHash:  c.redemptionIDHash(string(preimageTxt)),
+		Payload:    payload,
+	})
+}
+
+// WaitForEvents blocks until events published so far have been sent, so that
+// short lived commands do not exit before publishing
+func (c *Server) WaitForEvents() {
+	eventQueue.pending.Wait()
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/brave-intl/bat-go/middleware"
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/go-chi/chi"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+const (
+	// graphQLMaxDepth bounds the nesting of queries, the schema is at most four deep
+	graphQLMaxDepth = 5
+	// graphQLMaxCost bounds the work of a query. Every returned object costs 1 and
+	// the stats of an issuer, which take two queries, cost graphQLStatsCost.
+	graphQLMaxCost   = 1000
+	graphQLStatsCost = 10
+	// graphQLMaxList bounds every list, which is also its default length
+	graphQLMaxList = 100
+)
+
+var ErrGraphQLTooComplex = errors.New("Query exceeds the complexity limit")
+
+const graphQLSchema = `
+scalar Time
+
+schema {
+	query: Query
+}
+
+type Query {
+	issuers(status: String, first: Int): [Issuer!]!
+	issuer(type: String!): Issuer
+	redemption(issuer: String!, preimage: String!): Redemption
+	duplicateAttempts(issuer: String, since: Time, first: Int): [DuplicateAttempts!]!
+}
+
+type Issuer {
+	id: ID!
+	type: String!
+	name: String!
+	tenant: String
+	version: Int!
+	status: String!
+	publicKey: String
+	maxTokens: Int!
+	createdAt: Time!
+	expiresAt: Time
+	rotatedAt: Time
+	stats: IssuerStats!
+}
+
+type IssuerStats {
+	redemptions: RedemptionCounts!
+	duplicateAttempts: RedemptionCounts!
+}
+
+type RedemptionCounts {
+	total: Float!
+	last24h: Float!
+	last7d: Float!
+}
+
+type Redemption {
+	issuer: String!
+	timestamp: Time!
+	payload: String!
+}
+
+type DuplicateAttempts {
+	issuer: String!
+	caller: String!
+	attempts: Float!
+	tokens: Float!
+	firstAttempt: Time!
+	lastAttempt: Time!
+}
+`
+
+// GraphQLRequest is the body of a GraphQL query
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type graphQLCostKey struct{}
+
+// graphQLCost is the work done so far for a query, resolvers run concurrently
+type graphQLCost struct {
+	spent int64
+}
+
+// chargeGraphQL adds to the cost of the query in ctx, failing once it is over budget
+func chargeGraphQL(ctx context.Context, cost int) error {
+	spent, ok := ctx.Value(graphQLCostKey{}).(*graphQLCost)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt64(&spent.spent, int64(cost)) > graphQLMaxCost {
+		return ErrGraphQLTooComplex
+	}
+	return nil
+}
+
+func graphQLListLength(first *int32) int {
+	if first == nil || *first <= 0 || *first > graphQLMaxList {
+		return graphQLMaxList
+	}
+	return int(*first)
+}
+
+// graphQLQuery resolves the fields of the Query type, issuers are shown across
+// tenants since the endpoint is only served to operators
+type graphQLQuery struct {
+	c *Server
+}
+
+func (q *graphQLQuery) Issuers(ctx context.Context, args struct {
+	Status *string
+	First  *int32
+}) ([]*graphQLIssuer, error) {
+	includeExpired := args.Status != nil && *args.Status == IssuerStatusExpired
+	issuers, err := q.c.fetchAllIssuers(includeExpired)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	limit := graphQLListLength(args.First)
+	resolved := []*graphQLIssuer{}
+	for _, issuer := range issuers {
+		if len(resolved) == limit {
+			break
+		}
+		if args.Status != nil && issuerStatus(issuer, now) != *args.Status {
+			continue
+		}
+		if err := chargeGraphQL(ctx, 1); err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, &graphQLIssuer{c: q.c, issuer: issuer, now: now})
+	}
+	return resolved, nil
+}
+
+func (q *graphQLQuery) Issuer(ctx context.Context, args struct{ Type string }) (*graphQLIssuer, error) {
+	issuers, err := q.c.fetchIssuers(q.c.resolveIssuerType(args.Type))
+	if errors.Is(err, IssuerNotFoundError) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := chargeGraphQL(ctx, 1); err != nil {
+		return nil, err
+	}
+	return &graphQLIssuer{c: q.c, issuer: issuers[0], now: time.Now()}, nil
+}
+
+func (q *graphQLQuery) Redemption(ctx context.Context, args struct {
+	Issuer   string
+	Preimage string
+}) (*graphQLRedemption, error) {
+	redemption, err := q.c.fetchRedemption(q.c.resolveIssuerType(args.Issuer), args.Preimage)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := chargeGraphQL(ctx, 1); err != nil {
+		return nil, err
+	}
+	return &graphQLRedemption{redemption}, nil
+}
+
+func (q *graphQLQuery) DuplicateAttempts(ctx context.Context, args struct {
+	Issuer *string
+	Since  *graphql.Time
+	First  *int32
+}) ([]*graphQLDuplicateAttempts, error) {
+	issuerType := ""
+	if args.Issuer != nil {
+		issuerType = q.c.resolveIssuerType(*args.Issuer)
+	}
+	since := time.Now().Add(-24 * time.Hour)
+	if args.Since != nil {
+		since = args.Since.Time
+	}
+	summaries, err := q.c.fetchDuplicateSummaries(issuerType, since)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit := graphQLListLength(args.First); len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	if err := chargeGraphQL(ctx, len(summaries)); err != nil {
+		return nil, err
+	}
+	resolved := make([]*graphQLDuplicateAttempts, len(summaries))
+	for i := range summaries {
+		resolved[i] = &graphQLDuplicateAttempts{summaries[i]}
+	}
+	return resolved, nil
+}
+
+type graphQLIssuer struct {
+	c      *Server
+	issuer *Issuer
+	now    time.Time
+}
+
+func (i *graphQLIssuer) ID() graphql.ID { return graphql.ID(i.issuer.ID) }
+func (i *graphQLIssuer) Type() string   { return i.issuer.IssuerType }
+func (i *graphQLIssuer) Version() int32 { return int32(i.issuer.Version) }
+func (i *graphQLIssuer) Status() string { return issuerStatus(i.issuer, i.now) }
+
+func (i *graphQLIssuer) MaxTokens() int32 { return int32(i.issuer.MaxTokens) }
+
+func (i *graphQLIssuer) Name() string {
+	_, name := splitIssuerType(i.issuer.IssuerType)
+	return name
+}
+
+func (i *graphQLIssuer) Tenant() *string {
+	tenant, _ := splitIssuerType(i.issuer.IssuerType)
+	if tenant == "" {
+		return nil
+	}
+	return &tenant
+}
+
+func (i *graphQLIssuer) PublicKey() (*string, error) {
+	publicKey := newIssuerResponse(i.issuer, i.now).PublicKey
+	if publicKey == nil {
+		return nil, nil
+	}
+	text, err := publicKey.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	encoded := string(text)
+	return &encoded, nil
+}
+
+func (i *graphQLIssuer) CreatedAt() graphql.Time  { return graphql.Time{Time: i.issuer.CreatedAt} }
+func (i *graphQLIssuer) ExpiresAt() *graphql.Time { return optionalGraphQLTime(i.issuer.ExpiresAt) }
+func (i *graphQLIssuer) RotatedAt() *graphql.Time { return optionalGraphQLTime(i.issuer.RotatedAt) }
+
+func (i *graphQLIssuer) Stats(ctx context.Context) (*graphQLIssuerStats, error) {
+	if err := chargeGraphQL(ctx, graphQLStatsCost); err != nil {
+		return nil, err
+	}
+	redemptions, duplicates, err := i.c.fetchIssuerStats(i.issuer.IssuerType)
+	if err != nil {
+		return nil, err
+	}
+	return &graphQLIssuerStats{redemptions: redemptions, duplicates: duplicates}, nil
+}
+
+func optionalGraphQLTime(t time.Time) *graphql.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: t}
+}
+
+type graphQLIssuerStats struct {
+	redemptions, duplicates RedemptionCounts
+}
+
+func (s *graphQLIssuerStats) Redemptions() *graphQLCounts {
+	return &graphQLCounts{s.redemptions}
+}
+
+func (s *graphQLIssuerStats) DuplicateAttempts() *graphQLCounts {
+	return &graphQLCounts{s.duplicates}
+}
+
+// graphQLCounts exposes counts as floats, GraphQL integers are only 32 bits
+type graphQLCounts struct {
+	counts RedemptionCounts
+}
+
+func (c *graphQLCounts) Total() float64   { return float64(c.counts.Total) }
+func (c *graphQLCounts) Last24h() float64 { return float64(c.counts.Last24h) }
+func (c *graphQLCounts) Last7d() float64  { return float64(c.counts.Last7d) }
+
+type graphQLRedemption struct {
+	redemption *Redemption
+}
+
+func (r *graphQLRedemption) Issuer() string  { return r.redemption.IssuerType }
+func (r *graphQLRedemption) Payload() string { return r.redemption.Payload }
+func (r *graphQLRedemption) Timestamp() graphql.Time {
+	return graphql.Time{Time: r.redemption.Timestamp}
+}
+
+type graphQLDuplicateAttempts struct {
+	summary DuplicateAttemptSummary
+}
+
+func (d *graphQLDuplicateAttempts) Issuer() string    { return d.summary.IssuerType }
+func (d *graphQLDuplicateAttempts) Caller() string    { return d.summary.Caller }
+func (d *graphQLDuplicateAttempts) Attempts() float64 { return float64(d.summary.Attempts) }
+func (d *graphQLDuplicateAttempts) Tokens() float64   { return float64(d.summary.Tokens) }
+func (d *graphQLDuplicateAttempts) FirstAttempt() graphql.Time {
+	return graphql.Time{Time: d.summary.FirstAttempt}
+}
+func (d *graphQLDuplicateAttempts) LastAttempt() graphql.Time {
+	return graphql.Time{Time: d.summary.LastAttempt}
+}
+
+func (c *Server) graphQLHandler(schema *graphql.Schema) handlers.AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+		var req GraphQLRequest
+		if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+			return appErr
+		}
+		if req.Query == "" {
+			return &handlers.AppError{
+				Message: "Missing query",
+				Code:    http.StatusBadRequest,
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), graphQLCostKey{}, &graphQLCost{})
+		return encodeResponse(w, schema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+	}
+}
+
+// graphQLRouter serves a read-only GraphQL view of issuers, redemptions and their
+// stats to operators, errors of the query are part of the 200 response
+func (c *Server) graphQLRouter() chi.Router {
+	schema, err := graphql.ParseSchema(graphQLSchema, &graphQLQuery{c: c},
+		graphql.MaxDepth(graphQLMaxDepth), graphql.MaxParallelism(4))
+	if err != nil {
+		panic(fmt.Sprintf("invalid GraphQL schema: %s", err))
+	}
+
+	r := chi.NewRouter()
+	r.Use(c.requireReady)
+	r.Use(tokenAuthorizedOnly)
+	r.Use(operatorOnly)
+	r.Use(c.requireSignature)
+	r.Method(http.MethodPost, "/", middleware.InstrumentHandler("GraphQL", c.appHandler(c.graphQLHandler(schema))))
+	return r
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/brave-intl/challenge-bypass-server/btd"
+)
+
+const (
+	ImportFormatCSV    = "csv"
+	ImportFormatNDJSON = "ndjson"
+
+	ImportStatusRedeemed  = "redeemed"
+	ImportStatusDuplicate = "duplicate"
+	ImportStatusInvalid   = "invalid"
+	ImportStatusError     = "error"
+)
+
+var (
+	ErrUnknownImportFormat = errors.New("unknown import format, expected csv or ndjson")
+	ErrInvalidImportHeader = errors.New("csv header must contain issuer, t, signature and payload columns")
+)
+
+// RedemptionImportRecord is a single redemption collected by an offline system
+type RedemptionImportRecord struct {
+	Issuer        string                        `json:"issuer"`
+	TokenPreimage *crypto.TokenPreimage         `json:"t"`
+	Signature     *crypto.VerificationSignature `json:"signature"`
+	Payload       string                        `json:"payload"`
+}
+
+// RedemptionImportResult is the outcome of importing a single row
+type RedemptionImportResult struct {
+	Line   int    `json:"line"`
+	Issuer string `json:"issuer,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RedemptionImportSummary counts the outcomes of an import
+type RedemptionImportSummary struct {
+	Redeemed   int `json:"redeemed"`
+	Duplicates int `json:"duplicates"`
+	Invalid    int `json:"invalid"`
+	Errors     int `json:"errors"`
+}
+
+// ImportFormatFromPath guesses the import format from a file extension
+func ImportFormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ImportFormatCSV
+	case ".ndjson", ".jsonl", ".json":
+		return ImportFormatNDJSON
+	}
+	return ""
+}
+
+// ImportRedemptions verifies and records each redemption read from r, writing one
+// JSON result per row to out. Rows are recorded independently so that a single
+// invalid or duplicate token does not prevent the rest of the file from importing.
+func (c *Server) ImportRedemptions(r io.Reader, format string, out io.Writer) (RedemptionImportSummary, error) {
+	var summary RedemptionImportSummary
+
+	if err := c.ensureDb(); err != nil {
+		return summary, err
+	}
+
+	encoder := json.NewEncoder(out)
+	handle := func(line int, record *RedemptionImportRecord, parseErr error) error {
+		result := c.importRedemption(line, record, parseErr)
+		switch result.Status {
+		case ImportStatusRedeemed:
+			summary.Redeemed++
+		case ImportStatusDuplicate:
+			summary.Duplicates++
+		case ImportStatusInvalid:
+			summary.Invalid++
+		default:
+			summary.Errors++
+		}
+		return encoder.Encode(result)
+	}
+
+	var err error
+	switch format {
+	case ImportFormatCSV:
+		err = readCSVRedemptions(r, handle)
+	case ImportFormatNDJSON:
+		err = readNDJSONRedemptions(r, c.redemptionLimit(), handle)
+	default:
+		err = ErrUnknownImportFormat
+	}
+	return summary, err
+}
+
+func (c *Server) importRedemption(line int, record *RedemptionImportRecord, parseErr error) RedemptionImportResult {
+	result := RedemptionImportResult{Line: line}
+	if parseErr != nil {
+		result.Status = ImportStatusInvalid
+		result.Error = parseErr.Error()
+		return result
+	}
+	result.Issuer = record.Issuer
+
+	if record.TokenPreimage == nil || record.Signature == nil {
+		result.Status = ImportStatusInvalid
+		result.Error = "missing preimage or signature"
+		return result
+	}
+
+	issuers, err := c.fetchIssuers(record.Issuer)
+	if err != nil {
+		if errors.Is(err, IssuerNotFoundError) {
+			result.Status = ImportStatusInvalid
+		} else {
+			result.Status = ImportStatusError
+		}
+		result.Error = err.Error()
+		return result
+	}
+
+	if err := c.verifyRedemption(issuers, record.TokenPreimage, record.Signature, record.Payload); err != nil {
+		result.Status = ImportStatusInvalid
+		result.Error = err.Error()
+		return result
+	}
+
+	if err := c.redeemToken(record.Issuer, record.TokenPreimage, record.Payload); err != nil {
+		if errors.Is(err, ErrDuplicate) {
+			result.Status = ImportStatusDuplicate
+		} else {
+			result.Status = ImportStatusError
+			result.Error = err.Error()
+		}
+		return result
+	}
+
+	result.Status = ImportStatusRedeemed
+	return result
+}
+
+func readNDJSONRedemptions(r io.Reader, maxLine int64, handle func(int, *RedemptionImportRecord, error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), int(maxLine))
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var record RedemptionImportRecord
+		err := validateTokenEncodings([]byte(text))
+		if err == nil {
+			err = json.Unmarshal([]byte(text), &record)
+		}
+		if err != nil {
+			if err := handle(line, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := handle(line, &record, nil); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func readCSVRedemptions(r io.Reader, handle func(int, *RedemptionImportRecord, error) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"issuer", "t", "signature", "payload"} {
+		if _, ok := columns[name]; !ok {
+			return ErrInvalidImportHeader
+		}
+	}
+
+	line := 1
+	for {
+		row, err := reader.Read()
+		line++
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				if err := handle(line, nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+
+		record, err := parseCSVRedemption(row, columns)
+		if err := handle(line, record, err); err != nil {
+			return err
+		}
+	}
+}
+
+func parseCSVRedemption(row []string, columns map[string]int) (*RedemptionImportRecord, error) {
+	field := func(name string) (string, error) {
+		i := columns[name]
+		if i >= len(row) {
+			return "", fmt.Errorf("missing %s column", name)
+		}
+		return strings.TrimSpace(row[i]), nil
+	}
+
+	var record RedemptionImportRecord
+	var err error
+	if record.Issuer, err = field("issuer"); err != nil {
+		return nil, err
+	}
+	if record.Payload, err = field("payload"); err != nil {
+		return nil, err
+	}
+
+	preimage, err := field("t")
+	if err != nil {
+		return nil, err
+	}
+	if err := btd.ValidateTokenPreimage([]byte(preimage)); err != nil {
+		return nil, err
+	}
+	record.TokenPreimage = &crypto.TokenPreimage{}
+	if err := record.TokenPreimage.UnmarshalText([]byte(preimage)); err != nil {
+		return nil, err
+	}
+
+	signature, err := field("signature")
+	if err != nil {
+		return nil, err
+	}
+	if err := btd.ValidateVerificationSignature([]byte(signature)); err != nil {
+		return nil, err
+	}
+	record.Signature = &crypto.VerificationSignature{}
+	if err := record.Signature.UnmarshalText([]byte(signature)); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
@@ -0,0 +1,610 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// issuanceLogAppends gathers the receipts of concurrent issuance requests into a
+	// single append, it lives outside of Server since servers are copied by value while
+	// being configured
+	issuanceLogAppends = &receiptAppender{}
+
+	issuanceLogFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "issuance_log_failure_count",
+		Help: "Number of signed batches withheld because they could not be added to the issuance log",
+	})
+)
+
+// IssuanceReceipt records a batch of tokens signed with one key. Receipts are the
+// leaves of the issuance log, a Merkle tree hashed as in RFC 6962, so that auditors
+// holding a signed tree head can check that every token the server signed is counted.
+type IssuanceReceipt struct {
+	Index      int64  `json:"index"`
+	IssuerID   string `json:"issuer_id"`
+	IssuerType string `json:"issuer_type"`
+	PublicKey  string `json:"public_key"`
+	Count      int    `json:"count"`
+	// BatchRoot is the Merkle tree hash of the signed tokens of the batch, in order
+	BatchRoot []byte    `json:"batch_root"`
+	SignedAt  time.Time `json:"signed_at"`
+}
+
+// LeafHash is the hash of the receipt in the issuance log, over its fields separated
+// by newlines with the batch root in hex and the time in RFC 3339
+func (receipt IssuanceReceipt) LeafHash() []byte {
+	return merkleLeafHash([]byte(strings.Join([]string{
+		strconv.FormatInt(receipt.Index, 10),
+		receipt.IssuerID,
+		receipt.IssuerType,
+		receipt.PublicKey,
+		strconv.Itoa(receipt.Count),
+		hex.EncodeToString(receipt.BatchRoot),
+		receipt.SignedAt.UTC().Format(time.RFC3339Nano),
+	}, "\n")))
+}
+
+// IssuanceTreeHead is the size and root hash of the issuance log. It is signed with the
+// attestation key when there is one, over the size, the hex root hash and the time in
+// RFC 3339 separated by newlines.
+type IssuanceTreeHead struct {
+	TreeSize  int64     `json:"tree_size"`
+	RootHash  []byte    `json:"root_hash"`
+	Timestamp time.Time `json:"timestamp"`
+	Algorithm string    `json:"algorithm,omitempty"`
+	KeyID     string    `json:"key_id,omitempty"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+func (head IssuanceTreeHead) payload() []byte {
+	return []byte(strings.Join([]string{
+		strconv.FormatInt(head.TreeSize, 10),
+		hex.EncodeToString(head.RootHash),
+		head.Timestamp.UTC().Format(time.RFC3339Nano),
+	}, "\n"))
+}
+
+// IssuanceInclusionProof is the audit path of a receipt in the issuance log of size
+// TreeSize
+type IssuanceInclusionProof struct {
+	Receipt   IssuanceReceipt `json:"receipt"`
+	TreeSize  int64           `json:"tree_size"`
+	RootHash  []byte          `json:"root_hash"`
+	AuditPath [][]byte        `json:"audit_path"`
+}
+
+// Verify checks that the audit path leads from the receipt to RootHash, which auditors
+// then compare with a signed tree head of the same size
+func (proof IssuanceInclusionProof) Verify() bool {
+	return verifyMerklePath(proof.Receipt.Index, proof.TreeSize, proof.Receipt.LeafHash(), proof.AuditPath, proof.RootHash)
+}
+
+// verifyMerklePath checks the audit path of a leaf as in RFC 9162
+func verifyMerklePath(index, size int64, leaf []byte, path [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	hash := leaf
+	for _, sibling := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = merkleNodeHash(sibling, hash)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = merkleNodeHash(hash, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(hash, root)
+}
+
+func merkleLeafHash(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{0}, data...))
+	return hash[:]
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{1})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// merkleSplit is the largest power of two smaller than n
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleRoot is the tree hash of a list of leaf hashes
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath is the audit path of a leaf, from the leaf up. The log itself is proven
+// from its stored tree nodes, see treePath.
+func merklePath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(merklePath(index, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(index-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// treeNode is the root of the complete subtree of the log over the 2^level leaves
+// from index << level. Every complete subtree is stored once its last leaf is
+// appended, so that heads and proofs only read a logarithmic number of nodes.
+type treeNode struct {
+	level int64
+	index int64
+}
+
+// treeRange is a range of leaves whose tree hash is part of a head or a proof
+type treeRange struct {
+	start int64
+	size  int64
+}
+
+// nodes are the complete subtrees the range is hashed from, largest first. The ranges
+// of the log's heads and proofs start at a multiple of the smallest power of two not
+// below their size, so their subtrees are aligned.
+func (r treeRange) nodes() []treeNode {
+	var nodes []treeNode
+	start := r.start
+	for level := int64(62); level >= 0; level-- {
+		if r.size&(1<<uint(level)) != 0 {
+			nodes = append(nodes, treeNode{level: level, index: start >> uint(level)})
+			start += 1 << uint(level)
+		}
+	}
+	return nodes
+}
+
+// hash is the tree hash of the range from the hashes of its nodes
+func (r treeRange) hash(hashes map[treeNode][]byte) []byte {
+	nodes := r.nodes()
+	if len(nodes) == 0 {
+		return merkleRoot(nil)
+	}
+	hash := hashes[nodes[len(nodes)-1]]
+	for i := len(nodes) - 2; i >= 0; i-- {
+		hash = merkleNodeHash(hashes[nodes[i]], hash)
+	}
+	return hash
+}
+
+// treePath is the audit path of a leaf in the log of the given size as the ranges
+// whose hashes make it up, from the leaf up
+func treePath(index int64, r treeRange) []treeRange {
+	if r.size <= 1 {
+		return []treeRange{}
+	}
+	k := int64(merkleSplit(int(r.size)))
+	if index < r.start+k {
+		return append(treePath(index, treeRange{r.start, k}), treeRange{r.start + k, r.size - k})
+	}
+	return append(treePath(index, treeRange{r.start + k, r.size - k}), treeRange{r.start, k})
+}
+
+// fetchTreeNodes loads the hashes of tree nodes. Nodes that are missing, those of
+// receipts logged before nodes were stored, are hashed from the receipts and stored.
+func fetchTreeNodes(db Queryable, nodes []treeNode) (map[treeNode][]byte, error) {
+	hashes := map[treeNode][]byte{}
+	if len(nodes) == 0 {
+		return hashes, nil
+	}
+	levels := make([]int64, len(nodes))
+	indexes := make([]int64, len(nodes))
+	for i, node := range nodes {
+		levels[i], indexes[i] = node.level, node.index
+	}
+	rows, err := db.Query(
+		`SELECT level, node_index, hash FROM issuance_tree_nodes
+		WHERE (level, node_index) IN (SELECT * FROM unnest($1::smallint[], $2::bigint[]))`,
+		pq.Array(levels), pq.Array(indexes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var node treeNode
+		var hash []byte
+		if err := rows.Scan(&node.level, &node.index, &hash); err != nil {
+			return nil, err
+		}
+		hashes[node] = hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, node := range nodes {
+		if _, ok := hashes[node]; ok {
+			continue
+		}
+		leaves, err := fetchIssuanceLeaves(db, node.index<<uint(node.level), (node.index+1)<<uint(node.level))
+		if err != nil {
+			return nil, err
+		}
+		hashes[node] = merkleRoot(leaves)
+		if _, err := db.Exec(
+			`INSERT INTO issuance_tree_nodes(level, node_index, hash) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+			node.level, node.index, hashes[node]); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// fetchIssuanceLeaves loads the leaf hashes of the receipts from index start to end
+func fetchIssuanceLeaves(db Queryable, start, end int64) ([][]byte, error) {
+	rows, err := db.Query(
+		`SELECT leaf_hash FROM issuance_receipts WHERE log_index >= $1 AND log_index < $2 ORDER BY log_index`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leaves := [][]byte{}
+	for rows.Next() {
+		var leaf []byte
+		if err := rows.Scan(&leaf); err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, leaf)
+	}
+	return leaves, rows.Err()
+}
+
+// issuanceBatch is the tokens of an issuance request signed with one key
+type issuanceBatch struct {
+	publicKey    *crypto.PublicKey
+	signedTokens []*crypto.SignedToken
+}
+
+func newIssuanceReceipt(issuer *Issuer, batch issuanceBatch, now time.Time) (IssuanceReceipt, error) {
+	publicKey, err := batch.publicKey.MarshalText()
+	if err != nil {
+		return IssuanceReceipt{}, err
+	}
+	leaves := make([][]byte, 0, len(batch.signedTokens))
+	for _, token := range batch.signedTokens {
+		text, err := token.MarshalText()
+		if err != nil {
+			return IssuanceReceipt{}, err
+		}
+		leaves = append(leaves, merkleLeafHash(text))
+	}
+	return IssuanceReceipt{
+		IssuerID:   issuer.ID,
+		IssuerType: issuer.IssuerType,
+		PublicKey:  string(publicKey),
+		Count:      len(batch.signedTokens),
+		BatchRoot:  merkleRoot(leaves),
+		// Postgres keeps microseconds, the leaf hash must survive a round trip
+		SignedAt: now.UTC().Truncate(time.Microsecond),
+	}, nil
+}
+
+// receiptAppender appends the receipts of concurrent requests together. The request
+// that finds no append running writes every receipt waiting, including those that
+// arrive meanwhile, and the others wait for the append their receipts are part of.
+type receiptAppender struct {
+	mu        sync.Mutex
+	pending   []*pendingReceipts
+	appending bool
+}
+
+type pendingReceipts struct {
+	receipts []IssuanceReceipt
+	done     chan error
+}
+
+// appendIssuanceReceipts adds a receipt for each batch to the end of the issuance log
+func (c *Server) appendIssuanceReceipts(receipts []IssuanceReceipt) error {
+	own := &pendingReceipts{receipts: receipts, done: make(chan error, 1)}
+	appender := issuanceLogAppends
+	appender.mu.Lock()
+	appender.pending = append(appender.pending, own)
+	if appender.appending {
+		appender.mu.Unlock()
+		return <-own.done
+	}
+	appender.appending = true
+	for len(appender.pending) > 0 {
+		batch := appender.pending
+		appender.pending = nil
+		appender.mu.Unlock()
+
+		err := c.writeIssuanceReceipts(batch)
+		for _, pending := range batch {
+			pending.done <- err
+		}
+		appender.mu.Lock()
+	}
+	appender.appending = false
+	appender.mu.Unlock()
+	return <-own.done
+}
+
+// writeIssuanceReceipts appends receipts to the log in one transaction, storing the
+// tree nodes they complete. The state row serializes appends across instances, so
+// that indexes are contiguous.
+func (c *Server) writeIssuanceReceipts(batch []*pendingReceipts) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var size int64
+	if err := tx.QueryRow(`SELECT tree_size FROM issuance_tree_state FOR UPDATE`).Scan(&size); err != nil {
+		return err
+	}
+	// The subtrees of the current tree are the left siblings of the nodes appended
+	hashes, err := fetchTreeNodes(tx, treeRange{0, size}.nodes())
+	if err != nil {
+		return err
+	}
+	added := map[treeNode][]byte{}
+	for _, pending := range batch {
+		for i := range pending.receipts {
+			pending.receipts[i].Index = size
+			receipt := pending.receipts[i]
+			hash := receipt.LeafHash()
+			_, err := tx.Exec(
+				`INSERT INTO issuance_receipts(log_index, issuer_id, issuer_type, public_key, token_count, batch_root, leaf_hash, signed_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				receipt.Index, receipt.IssuerID, receipt.IssuerType, receipt.PublicKey, receipt.Count,
+				receipt.BatchRoot, hash, receipt.SignedAt)
+			if err != nil {
+				return err
+			}
+
+			node := treeNode{level: 0, index: size}
+			hashes[node], added[node] = hash, hash
+			for node.index&1 == 1 {
+				hash = merkleNodeHash(hashes[treeNode{level: node.level, index: node.index - 1}], hash)
+				node = treeNode{level: node.level + 1, index: node.index >> 1}
+				hashes[node], added[node] = hash, hash
+			}
+			size++
+		}
+	}
+	for node, hash := range added {
+		if _, err := tx.Exec(`INSERT INTO issuance_tree_nodes(level, node_index, hash) VALUES ($1, $2, $3)`,
+			node.level, node.index, hash); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE issuance_tree_state SET tree_size = $1`, size); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// logIssuance records the batches signed for an issuance request when the issuance log
+// is enabled. Signed tokens are only returned once they are in the log.
+func (c *Server) logIssuance(issuer *Issuer, batches []issuanceBatch) *handlers.AppError {
+	if !c.IssuanceLog {
+		return nil
+	}
+	now := time.Now()
+	receipts := make([]IssuanceReceipt, 0, len(batches))
+	for _, batch := range batches {
+		receipt, err := newIssuanceReceipt(issuer, batch, now)
+		if err != nil {
+			return &handlers.AppError{
+				Error:   err,
+				Message: "Could not log signed tokens",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		receipts = append(receipts, receipt)
+	}
+	if err := c.appendIssuanceReceipts(receipts); err != nil {
+		incrementCounter(issuanceLogFailureCounter)
+		lg.Errorf("Could not append to the issuance log for %s: %s", issuer.IssuerType, err)
+		c.reportError(nil, err, map[string]string{"storage": "issuance_receipts", "issuer_type": issuer.IssuerType})
+		return storageAppError(err, "Could not log signed tokens")
+	}
+	return nil
+}
+
+func (c *Server) fetchIssuanceReceipts(start int64, limit int) ([]IssuanceReceipt, error) {
+	rows, err := c.db.Query(
+		`SELECT log_index, issuer_id, issuer_type, public_key, token_count, batch_root, signed_at
+		FROM issuance_receipts WHERE log_index >= $1 ORDER BY log_index LIMIT $2`, start, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := []IssuanceReceipt{}
+	for rows.Next() {
+		var receipt IssuanceReceipt
+		if err := rows.Scan(&receipt.Index, &receipt.IssuerID, &receipt.IssuerType, &receipt.PublicKey,
+			&receipt.Count, &receipt.BatchRoot, &receipt.SignedAt); err != nil {
+			return nil, err
+		}
+		receipt.SignedAt = receipt.SignedAt.UTC()
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+func (c *Server) issuanceTreeSize() (int64, error) {
+	var size int64
+	err := c.db.QueryRow(`SELECT tree_size FROM issuance_tree_state`).Scan(&size)
+	return size, err
+}
+
+// issuanceTreeHead hashes the whole log as of now, signing the head with the
+// attestation key if there is one
+func (c *Server) issuanceTreeHead(now time.Time) (*IssuanceTreeHead, error) {
+	size, err := c.issuanceTreeSize()
+	if err != nil {
+		return nil, err
+	}
+	tree := treeRange{0, size}
+	hashes, err := fetchTreeNodes(c.db, tree.nodes())
+	if err != nil {
+		return nil, err
+	}
+	head := &IssuanceTreeHead{
+		TreeSize:  size,
+		RootHash:  tree.hash(hashes),
+		Timestamp: now.UTC(),
+	}
+	if c.attestationKey != nil {
+		head.Algorithm = attestationAlgorithm
+		head.KeyID = attestationKeyID(c.attestationKey.Public().(ed25519.PublicKey))
+		head.Signature = ed25519.Sign(c.attestationKey, head.payload())
+	}
+	return head, nil
+}
+
+func issuanceLogNotConfigured() *handlers.AppError {
+	return &handlers.AppError{
+		Message: "Issuance log is not configured",
+		Code:    http.StatusNotFound,
+	}
+}
+
+func (c *Server) issuanceReceiptsHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	if !c.IssuanceLog {
+		return issuanceLogNotConfigured()
+	}
+	var start int64
+	if value := r.FormValue("start"); value != "" {
+		var err error
+		if start, err = strconv.ParseInt(value, 10, 64); err != nil || start < 0 {
+			return handlers.WrapError("Invalid issuance log query", errors.New("start must be a non-negative integer"))
+		}
+	}
+	limit := defaultAuditLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxAuditLimit {
+			return handlers.WrapError("Invalid issuance log query", fmt.Errorf("limit must be between 1 and %d", maxAuditLimit))
+		}
+	}
+
+	receipts, err := c.fetchIssuanceReceipts(start, limit)
+	if err != nil {
+		return storageAppError(err, "Could not fetch issuance receipts")
+	}
+	return encodeResponse(w, receipts)
+}
+
+func (c *Server) issuanceTreeHeadHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	if !c.IssuanceLog {
+		return issuanceLogNotConfigured()
+	}
+	head, err := c.issuanceTreeHead(time.Now())
+	if err != nil {
+		return storageAppError(err, "Could not hash the issuance log")
+	}
+	return encodeResponse(w, head)
+}
+
+// issuanceProofHandler serves the inclusion proof of a receipt in the log of size
+// tree_size, the current size by default
+func (c *Server) issuanceProofHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	if !c.IssuanceLog {
+		return issuanceLogNotConfigured()
+	}
+	index, err := strconv.ParseInt(chi.URLParam(r, "index"), 10, 64)
+	if err != nil {
+		return handlers.WrapError("Invalid issuance log query", errors.New("index must be a non-negative integer"))
+	}
+	size := int64(-1)
+	if value := r.FormValue("tree_size"); value != "" {
+		if size, err = strconv.ParseInt(value, 10, 64); err != nil || size < 1 {
+			return handlers.WrapError("Invalid issuance log query", errors.New("tree_size must be a positive integer"))
+		}
+	}
+
+	current, err := c.issuanceTreeSize()
+	if err != nil {
+		return storageAppError(err, "Could not hash the issuance log")
+	}
+	if size > current {
+		return handlers.WrapError("Invalid issuance log query", errors.New("tree_size is larger than the log"))
+	}
+	if size < 0 {
+		size = current
+	}
+	if index < 0 || index >= size {
+		return &handlers.AppError{
+			Message: "Receipt is not in the issuance log",
+			Code:    http.StatusNotFound,
+		}
+	}
+	receipts, err := c.fetchIssuanceReceipts(index, 1)
+	if err != nil {
+		return storageAppError(err, "Could not fetch issuance receipts")
+	}
+
+	tree := treeRange{0, size}
+	path := treePath(index, tree)
+	nodes := tree.nodes()
+	for _, r := range path {
+		nodes = append(nodes, r.nodes()...)
+	}
+	hashes, err := fetchTreeNodes(c.db, nodes)
+	if err != nil {
+		return storageAppError(err, "Could not hash the issuance log")
+	}
+	auditPath := make([][]byte, len(path))
+	for i, r := range path {
+		auditPath[i] = r.hash(hashes)
+	}
+
+	return encodeResponse(w, IssuanceInclusionProof{
+		Receipt:   receipts[0],
+		TreeSize:  size,
+		RootHash:  tree.hash(hashes),
+		AuditPath: auditPath,
+	})
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultQuotaWindow       = time.Hour
+	defaultQuotaLeasePercent = 5
+)
+
+// ErrorCodeIssuanceQuota is the data.error_code of issuance requests over the quota of
+// their issuer type
+const ErrorCodeIssuanceQuota = "issuance_quota_exceeded"
+
+var (
+	quotaExceededCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "issuance_quota_exceeded_count",
+		Help: "Number of issuance requests rejected for exceeding the quota of their issuer type",
+	}, []string{"issuer_type"})
+
+	quotaLeaseCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "issuance_quota_lease_count",
+		Help: "Number of times an instance took a share of an issuance quota from the shared counter",
+	}, []string{"issuer_type"})
+
+	quotaLeaseFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "issuance_quota_lease_failure_count",
+		Help: "Number of issuance quota leases that failed and let the request through",
+	})
+)
+
+// QuotaConfig limits how many tokens each issuer type signs per window across the
+// fleet. Usage is counted in Postgres, and each instance takes a share of the quota
+// at once which it then spends without a round trip.
+type QuotaConfig struct {
+	// Issuance maps issuer types to the most tokens they sign per window
+	Issuance map[string]int64 `json:"issuance,omitempty"`
+	// WindowSec is the length of the quota windows, 3600 by default
+	WindowSec int `json:"window_sec,omitempty"`
+	// LeasePercent is the share of a quota an instance takes at once, 5 by default.
+	// Larger shares need fewer round trips but leave more of the quota unused when
+	// traffic moves between instances late in a window.
+	LeasePercent int `json:"lease_percent,omitempty"`
+}
+
+// quotaLease is the share of the current window's quota of an issuer type that an
+// instance took and has not spent yet. Once the shared counter grants less than was
+// asked for the quota is exhausted, and requests beyond the share are rejected
+// without a round trip until the window ends.
+type quotaLease struct {
+	mu        sync.Mutex
+	window    time.Time
+	remaining int64
+	exhausted bool
+}
+
+// quotaLeases is shared by pointer since servers are copied by value
+type quotaLeases struct {
+	mu     sync.Mutex
+	leases map[string]*quotaLease
+}
+
+func (l *quotaLeases) get(issuerType string) *quotaLease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lease, ok := l.leases[issuerType]
+	if !ok {
+		lease = &quotaLease{}
+		l.leases[issuerType] = lease
+	}
+	return lease
+}
+
+// initQuotas prepares the quota leases if issuance quotas are configured
+func (c *Server) initQuotas() {
+	if len(c.Quotas.Issuance) == 0 {
+		c.quotaLeases = nil
+		return
+	}
+	c.quotaLeases = &quotaLeases{leases: map[string]*quotaLease{}}
+}
+
+func (c *Server) quotaWindow() time.Duration {
+	if c.Quotas.WindowSec > 0 {
+		return time.Duration(c.Quotas.WindowSec) * time.Second
+	}
+	return defaultQuotaWindow
+}
+
+// leaseQuota adds up to want tokens to the shared usage of a window and returns how
+// many of them were still within the quota. Usage may be counted past the quota, so
+// every lease knows what it was granted from the usage it brought the counter to.
+func (c *Server) leaseQuota(issuerType string, window time.Time, want, quota int64) (int64, error) {
+	var used int64
+	err := c.db.QueryRow(
+		`INSERT INTO issuance_quota_usage(issuer_type, window_start, used) VALUES ($1, $2, $3)
+		ON CONFLICT (issuer_type, window_start) DO UPDATE SET used = issuance_quota_usage.used + EXCLUDED.used
+		RETURNING used`, issuerType, window.UTC(), want).Scan(&used)
+	if err != nil {
+		return 0, err
+	}
+	quotaLeaseCounter.With(prometheus.Labels{"issuer_type": issuerType}).Inc()
+
+	granted := quota - (used - want)
+	if granted > want {
+		granted = want
+	}
+	if granted < 0 {
+		granted = 0
+	}
+	return granted, nil
+}
+
+// takeIssuanceQuota spends count tokens of the quota of an issuer type, leasing a new
+// share from the shared counter when the local one runs out. It returns whether the
+// tokens may be signed.
+func (c *Server) takeIssuanceQuota(issuerType string, count int64, now time.Time) (bool, error) {
+	quota, ok := c.Quotas.Issuance[issuerType]
+	if !ok || c.quotaLeases == nil {
+		return true, nil
+	}
+
+	window := now.Truncate(c.quotaWindow())
+	lease := c.quotaLeases.get(issuerType)
+	// Requests for the type wait for a single lease rather than all going to the database
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+	if !lease.window.Equal(window) {
+		lease.window, lease.remaining, lease.exhausted = window, 0, false
+	}
+	if lease.remaining < count && lease.exhausted {
+		return false, nil
+	}
+	if lease.remaining < count {
+		want := count - lease.remaining
+		percent := int64(c.Quotas.LeasePercent)
+		if percent == 0 {
+			percent = defaultQuotaLeasePercent
+		}
+		if share := quota * percent / 100; share > want {
+			want = share
+		}
+		granted, err := c.leaseQuota(issuerType, window, want, quota)
+		if err != nil {
+			return false, err
+		}
+		// A partial grant is kept for smaller requests
+		lease.remaining += granted
+		lease.exhausted = granted < want
+		if lease.remaining < count {
+			return false, nil
+		}
+	}
+	lease.remaining -= count
+	return true, nil
+}
+
+// issuanceQuotaAppError rejects an issuance request over the quota of its issuer type.
+// Requests are let through when the shared counter is unavailable, since failing
+// issuance would be worse than exceeding the quota for a while.
+func (c *Server) issuanceQuotaAppError(w http.ResponseWriter, issuer *Issuer, count int) *handlers.AppError {
+	now := time.Now()
+	allowed, err := c.takeIssuanceQuota(issuer.IssuerType, int64(count), now)
+	if err != nil {
+		incrementCounter(quotaLeaseFailureCounter)
+		lg.Errorf("Could not lease issuance quota of %s: %s", issuer.IssuerType, err)
+		c.reportError(nil, err, map[string]string{"storage": "issuance_quota_usage", "issuer_type": issuer.IssuerType})
+		return nil
+	}
+	if allowed {
+		return nil
+	}
+
+	quotaExceededCounter.With(prometheus.Labels{"issuer_type": issuer.IssuerType}).Inc()
+	resetAt := now.Truncate(c.quotaWindow()).Add(c.quotaWindow())
+	w.Header().Set("Retry-After", strconv.Itoa(int(resetAt.Sub(now).Seconds())+1))
+	return &handlers.AppError{
+		Message: fmt.Sprintf("Issuer type has reached its quota of %d tokens", c.Quotas.Issuance[issuer.IssuerType]),
+		Code:    http.StatusTooManyRequests,
+		Data: map[string]interface{}{
+			"error_code": ErrorCodeIssuanceQuota,
+			"quota":      c.Quotas.Issuance[issuer.IssuerType],
+			"window_sec": int(c.quotaWindow().Seconds()),
+			"reset_at":   resetAt.UTC(),
+		},
+	}
+}
+
+// pruneIssuanceQuotaUsage deletes the usage of windows that ended
+func (c *Server) pruneIssuanceQuotaUsage(now time.Time) (int64, error) {
+	result, err := c.db.Exec(`DELETE FROM issuance_quota_usage WHERE window_start < $1`, now.Add(-2*c.quotaWindow()).UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (c *Server) pruneIssuanceQuotaUsagePeriodically() {
+	for {
+		if _, err := c.pruneIssuanceQuotaUsage(time.Now()); err != nil {
+			lg.Errorf("Could not prune issuance quota usage: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "prune_issuance_quota_usage"})
+		}
+		time.Sleep(c.quotaWindow())
+	}
+}
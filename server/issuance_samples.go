@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EventIssuanceSample is published for every sampled issuance request when
+// IssuanceSamplePercent is set and the event type is enabled
+const EventIssuanceSample = "issuance.sample"
+
+const (
+	issuanceSampleRetention = 30 * 24 * time.Hour
+	issuanceSampleInterval  = time.Hour
+	issuanceSummaryLimit    = 100
+)
+
+var issuanceSampleFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "issuance_sample_failure_count",
+	Help: "Number of sampled issuance requests that could not be recorded",
+})
+
+// IssuanceSummary aggregates the sampled issuance requests of one caller for an issuer
+// type. EstimatedRequests and EstimatedTokens scale the samples by the percentage
+// they were taken at.
+type IssuanceSummary struct {
+	IssuerType        string    `json:"issuer_type"`
+	Caller            string    `json:"caller"`
+	Samples           int64     `json:"samples"`
+	EstimatedRequests float64   `json:"estimated_requests"`
+	EstimatedTokens   float64   `json:"estimated_tokens"`
+	MeanBatchSize     float64   `json:"mean_batch_size"`
+	MaxBatchSize      int64     `json:"max_batch_size"`
+	MeanDurationMs    float64   `json:"mean_duration_ms"`
+	MaxDurationMs     float64   `json:"max_duration_ms"`
+	FirstSample       time.Time `json:"first_sample"`
+	LastSample        time.Time `json:"last_sample"`
+}
+
+// sampleIssuance records IssuanceSamplePercent of the successful issuance requests
+// with their batch size, issuer, caller and duration, for capacity and abuse analysis
+// without logging every request. No token material is kept. Samples are written in
+// the background so that they do not delay the response, failures are logged and
+// counted.
+func (c *Server) sampleIssuance(r *http.Request, issuer *Issuer, batchSize int, duration time.Duration) {
+	percent := c.IssuanceSamplePercent
+	if percent <= 0 || rand.Intn(100) >= percent {
+		return
+	}
+
+	caller := clientKeyID(r)
+	durationMs := float64(duration) / float64(time.Millisecond)
+	go func() {
+		_, err := c.db.Exec(
+			`INSERT INTO issuance_samples(issuer_id, issuer_type, caller, batch_size, duration_ms, sample_percent)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			issuer.ID, issuer.IssuerType, caller, batchSize, durationMs, percent)
+		if err != nil {
+			incrementCounter(issuanceSampleFailureCounter)
+			lg.Errorf("Could not record issuance sample of %s: %s", issuer.IssuerType, err)
+			c.reportError(nil, err, map[string]string{"storage": "issuance_samples", "issuer_type": issuer.IssuerType})
+		}
+	}()
+	c.publishEvent(Event{
+		Type:       EventIssuanceSample,
+		Actor:      caller,
+		IssuerID:   issuer.ID,
+		IssuerType: issuer.IssuerType,
+		Details:    fmt.Sprintf("batch_size=%d duration_ms=%.3f sample_percent=%d", batchSize, durationMs, percent),
+	})
+}
+
+// fetchIssuanceSummaries aggregates the issuance samples taken since a time, most
+// estimated tokens first, optionally for a single issuer type
+func (c *Server) fetchIssuanceSummaries(issuerType string, since time.Time) ([]IssuanceSummary, error) {
+	rows, err := c.queryReadOnly(
+		`SELECT issuer_type, caller, COUNT(*), SUM(100.0 / sample_percent), SUM(batch_size * 100.0 / sample_percent),
+			AVG(batch_size), MAX(batch_size), AVG(duration_ms), MAX(duration_ms), MIN(sampled_at), MAX(sampled_at)
+		FROM issuance_samples
+		WHERE sampled_at >= $1 AND ($2 = '' OR issuer_type = $2)
+		GROUP BY issuer_type, caller
+		ORDER BY SUM(batch_size * 100.0 / sample_percent) DESC, issuer_type, caller
+		LIMIT $3`,
+		since.UTC(), issuerType, issuanceSummaryLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []IssuanceSummary{}
+	for rows.Next() {
+		var summary IssuanceSummary
+		if err := rows.Scan(&summary.IssuerType, &summary.Caller, &summary.Samples, &summary.EstimatedRequests, &summary.EstimatedTokens,
+			&summary.MeanBatchSize, &summary.MaxBatchSize, &summary.MeanDurationMs, &summary.MaxDurationMs,
+			&summary.FirstSample, &summary.LastSample); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// pruneIssuanceSamples deletes the samples older than issuanceSampleRetention
+func (c *Server) pruneIssuanceSamples(now time.Time) (int64, error) {
+	result, err := c.db.Exec(`DELETE FROM issuance_samples WHERE sampled_at < $1`, now.Add(-issuanceSampleRetention).UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (c *Server) pruneIssuanceSamplesPeriodically() {
+	for {
+		if count, err := c.pruneIssuanceSamples(time.Now()); err != nil {
+			lg.Errorf("Could not prune issuance samples: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "prune_issuance_samples"})
+		} else if count > 0 {
+			lg.Infof("Pruned %d issuance samples", count)
+		}
+		time.Sleep(issuanceSampleInterval)
+	}
+}
+
+func (c *Server) issuanceSamplesHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	since := time.Now().Add(-24 * time.Hour)
+	if value := r.FormValue("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return handlers.WrapError("Invalid since", err)
+		}
+	}
+
+	issuerType := r.FormValue("issuer")
+	if issuerType != "" {
+		issuerType = c.resolveIssuerType(issuerType)
+	}
+	summaries, err := c.fetchIssuanceSummaries(issuerType, since)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not fetch issuance samples",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return encodeResponse(w, summaries)
+}
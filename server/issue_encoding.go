@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+)
+
+// maxPooledIssueBuffer keeps the buffers of unusually large responses from being held
+// by the pool
+const maxPooledIssueBuffer = 1 << 20
+
+// issueBuffers holds the buffers issuance responses are written into, sized by the
+// batches recently served
+var issueBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// encodeIssueJSON writes an issuance response with the same bytes as encodeResponse,
+// without reflecting over every signed token. The text of each token is appended as it
+// is marshalled, so that errors still fail the request before anything is written.
+func encodeIssueJSON(w http.ResponseWriter, v interface{}) error {
+	buf := issueBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledIssueBuffer {
+			buf.Reset()
+			issueBuffers.Put(buf)
+		}
+	}()
+
+	var err error
+	switch resp := v.(type) {
+	case BlindedTokenIssueResponse:
+		err = appendIssueResponse(buf, resp)
+	case BlindedTokenIssueResponseV3:
+		err = appendIssueResponseV3(buf, resp)
+	default:
+		return json.NewEncoder(w).Encode(v)
+	}
+	if err != nil {
+		return err
+	}
+	// json.Encoder terminates every value with a newline
+	buf.WriteByte('\n')
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func appendIssueResponse(buf *bytes.Buffer, resp BlindedTokenIssueResponse) error {
+	buf.WriteString(`{"batch_proof":`)
+	if err := appendProof(buf, resp.BatchProof); err != nil {
+		return err
+	}
+	buf.WriteString(`,"signed_tokens":`)
+	if err := appendSignedTokens(buf, resp.SignedTokens); err != nil {
+		return err
+	}
+	if resp.PublicKey != nil {
+		buf.WriteString(`,"public_key":`)
+		if err := appendText(buf, resp.PublicKey); err != nil {
+			return err
+		}
+	}
+	if resp.ExpiresAt != nil {
+		buf.WriteString(`,"expires_at":`)
+		if err := appendTime(buf, *resp.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func appendIssueResponseV3(buf *bytes.Buffer, resp BlindedTokenIssueResponseV3) error {
+	buf.WriteString(`{"signing_results":`)
+	if resp.SigningResults == nil {
+		buf.WriteString("null}")
+		return nil
+	}
+	buf.WriteByte('[')
+	for i, result := range resp.SigningResults {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`{"valid_from":`)
+		if err := appendTime(buf, result.ValidFrom); err != nil {
+			return err
+		}
+		buf.WriteString(`,"valid_to":`)
+		if err := appendTime(buf, result.ValidTo); err != nil {
+			return err
+		}
+		buf.WriteString(`,"public_key":`)
+		if result.PublicKey == nil {
+			buf.WriteString("null")
+		} else if err := appendText(buf, result.PublicKey); err != nil {
+			return err
+		}
+		buf.WriteString(`,"batch_proof":`)
+		if err := appendProof(buf, result.BatchProof); err != nil {
+			return err
+		}
+		buf.WriteString(`,"signed_tokens":`)
+		if err := appendSignedTokens(buf, result.SignedTokens); err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteString("]}")
+	return nil
+}
+
+func appendProof(buf *bytes.Buffer, proof *crypto.BatchDLEQProof) error {
+	if proof == nil {
+		buf.WriteString("null")
+		return nil
+	}
+	return appendText(buf, proof)
+}
+
+func appendSignedTokens(buf *bytes.Buffer, tokens []*crypto.SignedToken) error {
+	if tokens == nil {
+		buf.WriteString("null")
+		return nil
+	}
+	// Signed tokens are 44 base64 characters, quoted and separated by commas
+	buf.Grow(len(tokens)*47 + 2)
+	buf.WriteByte('[')
+	for i, token := range tokens {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if token == nil {
+			buf.WriteString("null")
+			continue
+		}
+		if err := appendText(buf, token); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+// appendText appends the text of a crypto type as a JSON string. Standard base64 never
+// needs escaping, anything else is quoted by encoding/json.
+func appendText(buf *bytes.Buffer, m encoding.TextMarshaler) error {
+	text, err := m.MarshalText()
+	if err != nil {
+		return err
+	}
+	for _, b := range text {
+		if !isBase64Byte(b) {
+			quoted, err := json.Marshal(string(text))
+			if err != nil {
+				return err
+			}
+			buf.Write(quoted)
+			return nil
+		}
+	}
+	buf.WriteByte('"')
+	buf.Write(text)
+	buf.WriteByte('"')
+	return nil
+}
+
+func isBase64Byte(b byte) bool {
+	return 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '+' || b == '/' || b == '='
+}
+
+// appendTime appends a time as encoding/json does, failing for years it can not encode
+func appendTime(buf *bytes.Buffer, t time.Time) error {
+	text, err := t.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	buf.Write(text)
+	return nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var (
+	IssuerAliasNotFoundError = newStorageError(ErrNotFound, "Issuer type has not been renamed")
+	CrossTenantRenameError   = errors.New("Issuer types can only be renamed within their tenant")
+)
+
+// fetchIssuerAlias returns the type an issuer type was renamed to
+func (c *Server) fetchIssuerAlias(alias string) (string, error) {
+	if c.caches != nil {
+		if cached, found := c.caches["issuer_aliases"].Get(alias); found {
+			return cached.(string), nil
+		}
+	}
+
+	var issuerType string
+	err := c.db.QueryRow(`SELECT issuer_type FROM issuer_aliases WHERE alias = $1`, alias).Scan(&issuerType)
+	if err == sql.ErrNoRows {
+		return "", IssuerAliasNotFoundError
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if c.caches != nil {
+		c.caches["issuer_aliases"].SetDefault(alias, issuerType)
+	}
+	return issuerType, nil
+}
+
+// fetchRenamedIssuers returns the issuers an old issuer type now refers to. Aliases
+// are only looked up once a type is not found, so types that were never renamed cost
+// nothing extra.
+func (c *Server) fetchRenamedIssuers(alias string) ([]*Issuer, error) {
+	issuerType, err := c.fetchIssuerAlias(alias)
+	if err != nil {
+		return nil, err
+	}
+	issuers, err := c.fetchIssuers(issuerType)
+	if errors.Is(err, IssuerNotFoundError) && c.caches != nil {
+		// Another instance may have renamed the type again since the alias was cached
+		c.caches["issuer_aliases"].Delete(alias)
+		if issuerType, err = c.fetchIssuerAlias(alias); err != nil {
+			return nil, err
+		}
+		issuers, err = c.fetchIssuers(issuerType)
+	}
+	return issuers, err
+}
+
+// resolveIssuerType returns the current name of an issuer type, which differs from
+// issuerType once the type has been renamed
+func (c *Server) resolveIssuerType(issuerType string) string {
+	if _, err := c.fetchIssuers(issuerType); !errors.Is(err, IssuerNotFoundError) {
+		return issuerType
+	}
+	if issuers, err := c.fetchRenamedIssuers(issuerType); err == nil {
+		return issuers[0].IssuerType
+	}
+	return issuerType
+}
+
+// issuerTypeNames matches the issuer_type column against the type given by param and
+// every name the type had before it was renamed. Redemptions keep the name they were
+// recorded under, so that the spent token hashes already published for them still
+// match.
+func issuerTypeNames(param string) string {
+	return `issuer_type IN (SELECT ` + param + `::text UNION ALL
+		SELECT alias FROM issuer_aliases WHERE issuer_aliases.issuer_type = ` + param + `)`
+}
+
+// currentRedemptionIssuerType is the current name of the type a redemption was
+// recorded under
+const currentRedemptionIssuerType = `COALESCE((
+	SELECT issuer_aliases.issuer_type FROM issuer_aliases WHERE alias = redemptions.issuer_type), redemptions.issuer_type)`
+
+// renameIssuerType moves every issuer and pending issuer of a type to a new name, and
+// records the old name as an alias so that clients using it keep working. Aliases of
+// the old name are moved along with it. Redemptions are left under the name they were
+// recorded under and matched through the alias when they are read, so that renaming
+// never rewrites the redemptions table.
+func (c *Server) renameIssuerType(oldType, newType string) error {
+	oldTenant, _ := splitIssuerType(oldType)
+	newTenant, _ := splitIssuerType(newType)
+	if oldTenant != newTenant {
+		return CrossTenantRenameError
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var locked int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM (SELECT 1 FROM issuers WHERE issuer_type = $1 FOR UPDATE) issuers`,
+		oldType).Scan(&locked); err != nil {
+		return err
+	}
+	if locked == 0 {
+		return IssuerNotFoundError
+	}
+
+	var taken bool
+	if err := tx.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM issuers WHERE issuer_type = $1) OR EXISTS(SELECT 1 FROM issuer_aliases WHERE alias = $1)`,
+		newType).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return IssuerExistsError
+	}
+
+	// Issuance receipts keep the type they were signed under, their hashes cover it,
+	// and redemptions keep theirs for the same reason
+	for _, query := range []string{
+		`UPDATE issuers SET issuer_type = $2 WHERE issuer_type = $1`,
+		`UPDATE pending_issuers SET issuer_type = $2 WHERE issuer_type = $1`,
+		`UPDATE redemption_attributes SET issuer_type = $2 WHERE issuer_type = $1`,
+		`UPDATE duplicate_attempts SET issuer_type = $2 WHERE issuer_type = $1`,
+		`UPDATE redemption_duplicates SET issuer_type = $2 WHERE issuer_type = $1`,
+		`UPDATE issuance_samples SET issuer_type = $2 WHERE issuer_type = $1`,
+		`UPDATE issuance_quota_usage SET issuer_type = $2 WHERE issuer_type = $1`,
+		`UPDATE issuer_aliases SET issuer_type = $2 WHERE issuer_type = $1`,
+		`UPDATE issuer_freezes SET issuer_type = $2 WHERE issuer_type = $1`,
+		`INSERT INTO issuer_aliases(alias, issuer_type) VALUES ($1, $2)`,
+	} {
+		if _, err := tx.Exec(query, oldType, newType); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	c.forgetIssuers(oldType)
+	c.forgetIssuers(newType)
+	return nil
+}
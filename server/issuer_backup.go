@@ -0,0 +1,527 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/lib/pq"
+)
+
+// issuerBackupFormat is bumped whenever the layout of IssuerBackup changes
+const issuerBackupFormat = 1
+
+var (
+	ErrInvalidBackupKey      = errors.New("backup keys must be PEM encoded RSA keys")
+	ErrUnsupportedBackup     = errors.New("unsupported issuer backup format")
+	ErrIssuerRestoreConflict = newStorageError(ErrDuplicate, "the database already contains issuers, groups or aliases from the backup")
+)
+
+// IssuerBackup holds every issuer, issuer key, group and alias of a database. Signing
+// keys are encrypted under DataKey, which is itself encrypted under the RSA public key
+// given when the backup was taken.
+type IssuerBackup struct {
+	Format    int                  `json:"format"`
+	CreatedAt time.Time            `json:"created_at"`
+	DataKey   string               `json:"data_key"`
+	Groups    []IssuerGroupBackup  `json:"groups"`
+	Issuers   []IssuerRecordBackup `json:"issuers"`
+	Aliases   []IssuerAliasBackup  `json:"aliases"`
+}
+
+// IssuerGroupBackup is a row of issuer_groups
+type IssuerGroupBackup struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IssuerRecordBackup is a row of issuers together with its version 3 keys
+type IssuerRecordBackup struct {
+	ID                      string            `json:"id"`
+	IssuerType              string            `json:"issuer_type"`
+	SigningKey              string            `json:"signing_key,omitempty"`
+	MaxTokens               int               `json:"max_tokens"`
+	Version                 int               `json:"version"`
+	CreatedAt               time.Time         `json:"created_at"`
+	BucketSeconds           int64             `json:"bucket_seconds"`
+	Buffer                  int               `json:"buffer"`
+	ExpiresAt               *time.Time        `json:"expires_at,omitempty"`
+	RotatedAt               *time.Time        `json:"rotated_at,omitempty"`
+	GroupID                 string            `json:"group_id,omitempty"`
+	RotationWindowDays      int               `json:"rotation_window_days,omitempty"`
+	ValidDays               int               `json:"valid_days,omitempty"`
+	RedemptionRetentionDays int               `json:"redemption_retention_days,omitempty"`
+	RedemptionStore         string            `json:"redemption_store,omitempty"`
+	PayloadPolicy           []string          `json:"payload_policy,omitempty"`
+	Flags                   map[string]bool   `json:"flags,omitempty"`
+	RevokedAt               *time.Time        `json:"revoked_at,omitempty"`
+	RevocationReason        string            `json:"revocation_reason,omitempty"`
+	CanaryPercent           int               `json:"canary_percent,omitempty"`
+	Keys                    []IssuerKeyBackup `json:"keys,omitempty"`
+}
+
+// IssuerKeyBackup is a row of issuer_keys
+type IssuerKeyBackup struct {
+	ID         string    `json:"id"`
+	SigningKey string    `json:"signing_key"`
+	StartAt    time.Time `json:"start_at"`
+	EndAt      time.Time `json:"end_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// IssuerAliasBackup is a row of issuer_aliases
+type IssuerAliasBackup struct {
+	Alias      string    `json:"alias"`
+	IssuerType string    `json:"issuer_type"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// backupCipher encrypts signing keys with AES-GCM, binding each ciphertext to the id
+// of the row it belongs to so that keys cannot be swapped between records
+type backupCipher struct {
+	aead cipher.AEAD
+}
+
+func newBackupCipher(dataKey []byte) (*backupCipher, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &backupCipher{aead: aead}, nil
+}
+
+func (b *backupCipher) seal(id string, text []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b.aead.Seal(nonce, nonce, text, []byte(id))), nil
+}
+
+func (b *backupCipher) open(id string, sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < b.aead.NonceSize() {
+		return nil, fmt.Errorf("signing key of %s is truncated", id)
+	}
+	nonce := data[:b.aead.NonceSize()]
+	text, err := b.aead.Open(nil, nonce, data[len(nonce):], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("signing key of %s could not be decrypted: %v", id, err)
+	}
+	return text, nil
+}
+
+// parseBackupPublicKey reads a PKIX or PKCS #1 PEM encoded RSA public key
+func parseBackupPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidBackupKey
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidBackupKey
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrInvalidBackupKey
+	}
+	return rsaKey, nil
+}
+
+// parseBackupPrivateKey reads a PKCS #8 or PKCS #1 PEM encoded RSA private key
+func parseBackupPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidBackupKey
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidBackupKey
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidBackupKey
+	}
+	return rsaKey, nil
+}
+
+// BackupIssuers writes every issuer, including expired ones, to w with their signing
+// keys encrypted under publicKey. It returns the number of issuers written.
+func (c *Server) BackupIssuers(w io.Writer, publicKey []byte) (int, error) {
+	if err := c.ensureDb(); err != nil {
+		return 0, err
+	}
+
+	recipient, err := parseBackupPublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return 0, err
+	}
+	defer zeroize(dataKey)
+	sealedDataKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient, dataKey, []byte("issuer-backup"))
+	if err != nil {
+		return 0, err
+	}
+	bc, err := newBackupCipher(dataKey)
+	if err != nil {
+		return 0, err
+	}
+
+	backup := IssuerBackup{
+		Format:    issuerBackupFormat,
+		CreatedAt: time.Now().UTC(),
+		DataKey:   base64.StdEncoding.EncodeToString(sealedDataKey),
+		Groups:    []IssuerGroupBackup{},
+		Issuers:   []IssuerRecordBackup{},
+		Aliases:   []IssuerAliasBackup{},
+	}
+
+	// A repeatable read transaction gives a consistent snapshot of all tables
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY`); err != nil {
+		return 0, err
+	}
+
+	if err := backupIssuerGroups(tx, &backup); err != nil {
+		return 0, err
+	}
+	if err := backupIssuerRecords(tx, bc, &backup); err != nil {
+		return 0, err
+	}
+	for i := range backup.Issuers {
+		if err := backupIssuerKeys(tx, bc, &backup.Issuers[i]); err != nil {
+			return 0, err
+		}
+		if err := backupRevocationReason(tx, &backup.Issuers[i]); err != nil {
+			return 0, err
+		}
+	}
+	if err := backupIssuerAliases(tx, &backup); err != nil {
+		return 0, err
+	}
+
+	if err := json.NewEncoder(w).Encode(backup); err != nil {
+		return 0, err
+	}
+
+	c.recordAudit(AuditEntry{
+		Actor:   AuditActorCLI,
+		Action:  AuditIssuerBackup,
+		Details: fmt.Sprintf("%d issuers", len(backup.Issuers)),
+	})
+	return len(backup.Issuers), nil
+}
+
+func backupIssuerGroups(tx *sql.Tx, backup *IssuerBackup) error {
+	rows, err := tx.Query(`SELECT id, name, created_at FROM issuer_groups ORDER BY created_at`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var group IssuerGroupBackup
+		if err := rows.Scan(&group.ID, &group.Name, &group.CreatedAt); err != nil {
+			return err
+		}
+		backup.Groups = append(backup.Groups, group)
+	}
+	return rows.Err()
+}
+
+func backupIssuerRecords(tx *sql.Tx, bc *backupCipher, backup *IssuerBackup) error {
+	rows, err := tx.Query(`SELECT ` + issuerColumns + ` FROM issuers ORDER BY created_at`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		issuer, err := scanIssuer(rows)
+		if err != nil {
+			return err
+		}
+		record := IssuerRecordBackup{
+			ID:                      issuer.ID,
+			IssuerType:              issuer.IssuerType,
+			MaxTokens:               issuer.MaxTokens,
+			Version:                 issuer.Version,
+			CreatedAt:               issuer.CreatedAt,
+			BucketSeconds:           int64(issuer.BucketDuration / time.Second),
+			Buffer:                  issuer.Buffer,
+			GroupID:                 issuer.GroupID,
+			RotationWindowDays:      issuer.RotationWindowDays,
+			ValidDays:               issuer.ValidDays,
+			RedemptionRetentionDays: issuer.RedemptionRetentionDays,
+			RedemptionStore:         issuer.RedemptionStore,
+			PayloadPolicy:           issuer.PayloadPolicy,
+			Flags:                   issuer.Flags,
+			CanaryPercent:           issuer.CanaryPercent,
+		}
+		if !issuer.ExpiresAt.IsZero() {
+			record.ExpiresAt = &issuer.ExpiresAt
+		}
+		if !issuer.RotatedAt.IsZero() {
+			record.RotatedAt = &issuer.RotatedAt
+		}
+		if !issuer.RevokedAt.IsZero() {
+			record.RevokedAt = &issuer.RevokedAt
+		}
+		if issuer.SigningKey != nil {
+			text, err := issuer.SigningKey.MarshalText()
+			if err != nil {
+				return err
+			}
+			record.SigningKey, err = bc.seal(issuer.ID, text)
+			zeroize(text)
+			if err != nil {
+				return err
+			}
+		}
+		backup.Issuers = append(backup.Issuers, record)
+	}
+	return rows.Err()
+}
+
+func backupRevocationReason(tx *sql.Tx, record *IssuerRecordBackup) error {
+	if record.RevokedAt == nil {
+		return nil
+	}
+	return tx.QueryRow(`SELECT COALESCE(revocation_reason, '') FROM issuers WHERE id = $1`, record.ID).Scan(&record.RevocationReason)
+}
+
+func backupIssuerKeys(tx *sql.Tx, bc *backupCipher, record *IssuerRecordBackup) error {
+	rows, err := tx.Query(
+		`SELECT id, signing_key, start_at, end_at, created_at FROM issuer_keys WHERE issuer_id = $1 ORDER BY start_at`, record.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stored []byte
+		var key IssuerKeyBackup
+		if err := rows.Scan(&key.ID, &stored, &key.StartAt, &key.EndAt, &key.CreatedAt); err != nil {
+			return err
+		}
+		signingKey, err := unsealSigningKey(stored)
+		if err != nil {
+			return err
+		}
+		text, err := signingKey.MarshalText()
+		if err != nil {
+			return err
+		}
+		key.SigningKey, err = bc.seal(key.ID, text)
+		zeroize(text)
+		if err != nil {
+			return err
+		}
+		record.Keys = append(record.Keys, key)
+	}
+	return rows.Err()
+}
+
+func backupIssuerAliases(tx *sql.Tx, backup *IssuerBackup) error {
+	rows, err := tx.Query(`SELECT alias, issuer_type, created_at FROM issuer_aliases ORDER BY created_at`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alias IssuerAliasBackup
+		if err := rows.Scan(&alias.Alias, &alias.IssuerType, &alias.CreatedAt); err != nil {
+			return err
+		}
+		backup.Aliases = append(backup.Aliases, alias)
+	}
+	return rows.Err()
+}
+
+// RestoreIssuers reads a backup written by BackupIssuers and inserts its records with
+// their original ids, versions and timestamps. Signing keys are decrypted with
+// privateKey and stored as configured for this server, e.g. in Vault. Either the
+// whole backup is restored or nothing is, records that already exist are a conflict.
+func (c *Server) RestoreIssuers(r io.Reader, privateKey []byte) (int, error) {
+	if err := c.ensureDb(); err != nil {
+		return 0, err
+	}
+
+	recipient, err := parseBackupPrivateKey(privateKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var backup IssuerBackup
+	if err := json.NewDecoder(r).Decode(&backup); err != nil {
+		return 0, err
+	}
+	if backup.Format != issuerBackupFormat {
+		return 0, ErrUnsupportedBackup
+	}
+	sealedDataKey, err := base64.StdEncoding.DecodeString(backup.DataKey)
+	if err != nil {
+		return 0, err
+	}
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, recipient, sealedDataKey, []byte("issuer-backup"))
+	if err != nil {
+		return 0, fmt.Errorf("backup data key could not be decrypted: %v", err)
+	}
+	defer zeroize(dataKey)
+	bc, err := newBackupCipher(dataKey)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if err := restoreIssuerBackup(tx, bc, &backup); err != nil {
+		_ = tx.Rollback()
+		if errors.Is(classifyStorageError(err), ErrDuplicate) {
+			return 0, ErrIssuerRestoreConflict
+		}
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, record := range backup.Issuers {
+		c.forgetIssuers(record.IssuerType)
+		c.recordAudit(AuditEntry{
+			Actor:      AuditActorCLI,
+			Action:     AuditIssuerRestore,
+			IssuerID:   record.ID,
+			IssuerType: record.IssuerType,
+		})
+	}
+	return len(backup.Issuers), nil
+}
+
+func restoreIssuerBackup(tx *sql.Tx, bc *backupCipher, backup *IssuerBackup) error {
+	for _, group := range backup.Groups {
+		if _, err := tx.Exec(
+			`INSERT INTO issuer_groups(id, name, created_at) VALUES ($1, $2, $3)`,
+			group.ID, group.Name, group.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	for _, record := range backup.Issuers {
+		signingKey, err := restoreSigningKey(bc, record.ID, record.SigningKey)
+		if err != nil {
+			return err
+		}
+
+		var expiresAt, rotatedAt, revokedAt pq.NullTime
+		if record.ExpiresAt != nil {
+			expiresAt = pq.NullTime{Time: record.ExpiresAt.UTC(), Valid: true}
+		}
+		if record.RotatedAt != nil {
+			rotatedAt = pq.NullTime{Time: record.RotatedAt.UTC(), Valid: true}
+		}
+		if record.RevokedAt != nil {
+			revokedAt = pq.NullTime{Time: record.RevokedAt.UTC(), Valid: true}
+		}
+		groupID := sql.NullString{String: record.GroupID, Valid: record.GroupID != ""}
+		rotationWindowDays := sql.NullInt64{Int64: int64(record.RotationWindowDays), Valid: record.RotationWindowDays > 0}
+		validDays := sql.NullInt64{Int64: int64(record.ValidDays), Valid: record.ValidDays > 0}
+		retentionDays := sql.NullInt64{Int64: int64(record.RedemptionRetentionDays), Valid: record.RedemptionRetentionDays > 0}
+		redemptionStore := sql.NullString{String: record.RedemptionStore, Valid: record.RedemptionStore != ""}
+		canaryPercent := sql.NullInt64{Int64: int64(record.CanaryPercent), Valid: record.CanaryPercent > 0}
+		flags, err := marshalIssuerFlags(record.Flags)
+		if err != nil {
+			zeroize(signingKey)
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO issuers(`+issuerColumns+`, revocation_reason)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, NULLIF($20, ''))`,
+			record.ID, record.IssuerType, signingKey, record.MaxTokens, record.Version, record.CreatedAt,
+			record.BucketSeconds, record.Buffer, expiresAt, rotatedAt, groupID, rotationWindowDays, validDays, retentionDays, redemptionStore,
+			revokedAt, pq.Array(record.PayloadPolicy), flags, canaryPercent, record.RevocationReason)
+		zeroize(signingKey)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range record.Keys {
+			signingKey, err := restoreSigningKey(bc, key.ID, key.SigningKey)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(
+				`INSERT INTO issuer_keys(id, issuer_id, signing_key, start_at, end_at, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+				key.ID, record.ID, signingKey, key.StartAt, key.EndAt, key.CreatedAt)
+			zeroize(signingKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, alias := range backup.Aliases {
+		if _, err := tx.Exec(
+			`INSERT INTO issuer_aliases(alias, issuer_type, created_at) VALUES ($1, $2, $3)`,
+			alias.Alias, alias.IssuerType, alias.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSigningKey decrypts a signing key from a backup and returns the form stored in
+// the database, nil for version 3 issuers which keep their keys in issuer_keys
+func restoreSigningKey(bc *backupCipher, id, sealed string) ([]byte, error) {
+	if sealed == "" {
+		return nil, nil
+	}
+	text, err := bc.open(id, sealed)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(text)
+
+	key := &crypto.SigningKey{}
+	if err := key.UnmarshalText(text); err != nil {
+		return nil, err
+	}
+	return sealSigningKey(key)
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Labels of the key that signed or verified tokens of an issuer type with a canary
+const (
+	canaryKeyCanary  = "canary"
+	canaryKeyCurrent = "current"
+)
+
+var (
+	ErrInvalidCanaryPercent = errors.New("canary percent must be between 1 and 100")
+	ErrCanaryExists         = newStorageError(ErrDuplicate, "Issuer type already has a canary")
+	ErrCanaryNotFound       = newStorageError(ErrNotFound, "Issuer type has no canary")
+
+	canaryIssuanceCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "canary_issuance_count",
+		Help: "Number of issuance requests of issuer types with a canary, by the key that signed them",
+	}, []string{"issuer_type", "key"})
+
+	canaryRedemptionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "canary_redemption_count",
+		Help: "Number of verified redemptions of issuer types with a canary, by the key that signed the token",
+	}, []string{"issuer_type", "key"})
+)
+
+// IssuerCanaryRequest creates a canary issuer that signs Percent of the issuance
+// requests of a type alongside the active issuer. Settings left unset are taken from
+// the active issuer. Only Percent is used when changing the share of a canary.
+type IssuerCanaryRequest struct {
+	Percent       int   `json:"percent"`
+	Version       int   `json:"version"`
+	MaxTokens     int   `json:"max_tokens"`
+	BucketSeconds int64 `json:"bucket_seconds"`
+	Buffer        int   `json:"buffer"`
+}
+
+// isCanary reports whether an issuer is a canary that still signs
+func (issuer *Issuer) isCanary() bool {
+	return issuer.CanaryPercent > 0 && issuer.RotatedAt.IsZero()
+}
+
+// canaryIssuer returns the canary among the unexpired issuers of a type, if any
+func canaryIssuer(issuers []*Issuer) *Issuer {
+	for _, issuer := range issuers {
+		if issuer.isCanary() {
+			return issuer
+		}
+	}
+	return nil
+}
+
+// chooseIssuer picks the canary of a type for its percentage of issuance requests that
+// accept its version, and the active issuer otherwise. Requests that do not name the
+// versions they accept only get a canary of the active issuer's version.
+func chooseIssuer(r *http.Request, issuers []*Issuer) *Issuer {
+	active := issuers[0]
+	canary := canaryIssuer(issuers)
+	if canary == nil || canary == active || rand.Intn(100) >= canary.CanaryPercent {
+		return active
+	}
+	versions, err := acceptedIssuerVersions(r)
+	if err != nil {
+		return active
+	}
+	if versions == nil {
+		versions = []int{active.Version}
+	}
+	for _, version := range versions {
+		if version == canary.Version {
+			return canary
+		}
+	}
+	return active
+}
+
+// countCanaryIssuance counts an issuance request of a type with a canary by the key
+// that signed it
+func countCanaryIssuance(issuers []*Issuer, signer *Issuer) {
+	if canaryIssuer(issuers) == nil {
+		return
+	}
+	key := canaryKeyCurrent
+	if signer.isCanary() {
+		key = canaryKeyCanary
+	}
+	canaryIssuanceCounter.With(prometheus.Labels{"issuer_type": signer.IssuerType, "key": key}).Inc()
+}
+
+// countCanaryRedemption counts a verified redemption of a type with a canary by the
+// key that signed the token
+func countCanaryRedemption(issuers []*Issuer, verifier *Issuer) {
+	if canaryIssuer(issuers) == nil {
+		return
+	}
+	key := canaryKeyCurrent
+	if verifier.isCanary() {
+		key = canaryKeyCanary
+	}
+	canaryRedemptionCounter.With(prometheus.Labels{"issuer_type": verifier.IssuerType, "key": key}).Inc()
+}
+
+// fetchActiveIssuerForUpdate locks the active issuer of a type, or its canary
+func (c *Server) fetchActiveIssuerForUpdate(tx *sql.Tx, issuerType string, canary bool) (*Issuer, error) {
+	condition := `canary_percent IS NULL`
+	if canary {
+		condition = `canary_percent IS NOT NULL`
+	}
+	rows, err := tx.Query(
+		`SELECT `+issuerColumns+` FROM issuers WHERE issuer_type = $1 AND rotated_at IS NULL AND `+condition+` AND `+unexpiredIssuers+` FOR UPDATE`,
+		issuerType)
+	if err != nil {
+		return nil, err
+	}
+	issuers, err := c.scanIssuers(rows, tx.Query)
+	if err != nil {
+		return nil, err
+	}
+	if len(issuers) == 0 {
+		if canary {
+			return nil, ErrCanaryNotFound
+		}
+		return nil, IssuerNotFoundError
+	}
+	return issuers[0], nil
+}
+
+// createCanary generates a canary for the active issuer of a type, which is valid for
+// as long as a replacement of the active issuer would be
+func (c *Server) createCanary(issuerType string, req IssuerCanaryRequest, now time.Time) (*Issuer, error) {
+	if req.Percent < 1 || req.Percent > 100 {
+		return nil, ErrInvalidCanaryPercent
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	active, err := c.fetchActiveIssuerForUpdate(tx, issuerType, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.fetchActiveIssuerForUpdate(tx, issuerType, true); err == nil {
+		return nil, ErrCanaryExists
+	} else if !errors.Is(err, ErrCanaryNotFound) {
+		return nil, err
+	}
+
+	canary := active.successor(now)
+	// Canaries join the group of the active issuer when they are promoted
+	canary.GroupID = ""
+	canary.CanaryPercent = req.Percent
+	if req.Version != 0 {
+		canary.Version = req.Version
+	}
+	if req.MaxTokens != 0 {
+		canary.MaxTokens = req.MaxTokens
+	}
+	if req.BucketSeconds != 0 {
+		canary.BucketDuration = time.Duration(req.BucketSeconds) * time.Second
+	}
+	if req.Buffer != 0 {
+		canary.Buffer = req.Buffer
+	}
+	if err := c.insertIssuer(tx, canary); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	c.forgetIssuers(issuerType)
+
+	if canary.Version == IssuerVersion3 {
+		canary.Keys, err = c.fetchIssuerKeys(c.db.Query, canary.ID)
+	}
+	return canary, err
+}
+
+// setCanaryPercent changes the share of issuance requests the canary of a type signs
+func (c *Server) setCanaryPercent(issuerType string, percent int) error {
+	if percent < 1 || percent > 100 {
+		return ErrInvalidCanaryPercent
+	}
+	result, err := c.db.Exec(
+		`UPDATE issuers SET canary_percent = $2
+		WHERE issuer_type = $1 AND rotated_at IS NULL AND canary_percent IS NOT NULL AND `+unexpiredIssuers,
+		issuerType, percent)
+	if err != nil {
+		return err
+	}
+	c.forgetIssuers(issuerType)
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrCanaryNotFound
+	}
+	return nil
+}
+
+// promoteCanary makes the canary of a type its active issuer, the previous active
+// issuer is rotated and its tokens stay redeemable until it expires
+func (c *Server) promoteCanary(issuerType string) (*Issuer, *Issuer, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	canary, err := c.fetchActiveIssuerForUpdate(tx, issuerType, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	active, err := c.fetchActiveIssuerForUpdate(tx, issuerType, false)
+	if err != nil && !errors.Is(err, IssuerNotFoundError) {
+		return nil, nil, err
+	}
+
+	var groupID sql.NullString
+	if active != nil {
+		if _, err := tx.Exec(`UPDATE issuers SET rotated_at = NOW() WHERE id = $1`, active.ID); err != nil {
+			return nil, nil, err
+		}
+		groupID = sql.NullString{String: active.GroupID, Valid: active.GroupID != ""}
+	}
+	if _, err := tx.Exec(`UPDATE issuers SET canary_percent = NULL, group_id = $2 WHERE id = $1`, canary.ID, groupID); err != nil {
+		return nil, nil, err
+	}
+	// Pending replacements were generated for the previous active issuer
+	if err := forgetPendingIssuers(tx, issuerType); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	c.forgetIssuers(issuerType)
+
+	canary.CanaryPercent = 0
+	canary.GroupID = groupID.String
+	return canary, active, nil
+}
+
+// abortCanary stops the canary of a type from signing, tokens it signed stay
+// redeemable until it expires
+func (c *Server) abortCanary(issuerType string) (*Issuer, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	canary, err := c.fetchActiveIssuerForUpdate(tx, issuerType, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE issuers SET rotated_at = NOW() WHERE id = $1`, canary.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	c.forgetIssuers(issuerType)
+	return canary, nil
+}
+
+func canaryError(err error) *handlers.AppError {
+	switch {
+	case err == ErrInvalidCanaryPercent:
+		return handlers.WrapError("Invalid canary", err)
+	case errors.Is(err, ErrCanaryNotFound), errors.Is(err, IssuerNotFoundError):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
+		}
+	case errors.Is(err, ErrCanaryExists):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	}
+	return createIssuerError(err)
+}
+
+func (c *Server) issuerCanaryHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	issuers, appErr := c.getIssuers(issuerTypeParam(r))
+	if appErr != nil {
+		return appErr
+	}
+	canary := canaryIssuer(issuers)
+	if canary == nil {
+		return canaryError(ErrCanaryNotFound)
+	}
+	return encodeResponse(w, newIssuerMetadataResponse(canary, time.Now()))
+}
+
+func (c *Server) issuerCanaryCreateHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req IssuerCanaryRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	issuerType := c.resolveIssuerType(issuerTypeParam(r))
+	canary, err := c.createCanary(issuerType, req, time.Now())
+	if err != nil {
+		return canaryError(err)
+	}
+
+	entry := newAuditEntry(r, AuditIssuerCanary, canary)
+	entry.Details = fmt.Sprintf("created version=%d percent=%d", canary.Version, canary.CanaryPercent)
+	c.recordAudit(entry)
+
+	return encodeResponse(w, newIssuerMetadataResponse(canary, time.Now()))
+}
+
+func (c *Server) issuerCanaryUpdateHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req IssuerCanaryRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	issuerType := c.resolveIssuerType(issuerTypeParam(r))
+	if err := c.setCanaryPercent(issuerType, req.Percent); err != nil {
+		return canaryError(err)
+	}
+	issuers, appErr := c.getIssuers(issuerType)
+	if appErr != nil {
+		return appErr
+	}
+	canary := canaryIssuer(issuers)
+	if canary == nil {
+		return canaryError(ErrCanaryNotFound)
+	}
+
+	entry := newAuditEntry(r, AuditIssuerCanary, canary)
+	entry.Details = fmt.Sprintf("percent=%d", canary.CanaryPercent)
+	c.recordAudit(entry)
+
+	return encodeResponse(w, newIssuerMetadataResponse(canary, time.Now()))
+}
+
+func (c *Server) issuerCanaryPromoteHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	canary, previous, err := c.promoteCanary(c.resolveIssuerType(issuerTypeParam(r)))
+	if err != nil {
+		return canaryError(err)
+	}
+
+	entry := newAuditEntry(r, AuditIssuerCanary, canary)
+	entry.Details = "promoted"
+	if previous != nil {
+		entry.Details = "promoted, replaces " + previous.ID
+	}
+	c.recordAudit(entry)
+
+	return encodeResponse(w, newIssuerMetadataResponse(canary, time.Now()))
+}
+
+func (c *Server) issuerCanaryAbortHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	canary, err := c.abortCanary(c.resolveIssuerType(issuerTypeParam(r)))
+	if err != nil {
+		return canaryError(err)
+	}
+
+	entry := newAuditEntry(r, AuditIssuerCanary, canary)
+	entry.Details = "aborted"
+	c.recordAudit(entry)
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
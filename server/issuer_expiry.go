@@ -0,0 +1,73 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	issuerExpiryInterval = time.Minute
+	// issuerExpiryGrace is how long a type keeps being reported once its latest issuer
+	// has expired, so that retired issuer types stop alerting
+	issuerExpiryGrace = 24 * time.Hour
+
+	issuerExpiryGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "issuer_expires_in_seconds",
+		Help: "Seconds until the latest issuer of each type and version expires, negative once it has",
+	}, []string{"issuer_type", "version"})
+)
+
+// refreshIssuerExpiry sets issuerExpiryGauge from the latest expiry of each issuer
+// type, which only moves forward once the type has been rotated
+func (c *Server) refreshIssuerExpiry() error {
+	rows, err := c.db.Query(
+		`SELECT issuer_type, version, EXTRACT(EPOCH FROM MAX(expires_at) - NOW())
+		FROM issuers WHERE expires_at IS NOT NULL
+		GROUP BY issuer_type, version
+		HAVING MAX(expires_at) > NOW() - $1::float8 * interval '1 second'`,
+		issuerExpiryGrace.Seconds())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	labels := []prometheus.Labels{}
+	values := []float64{}
+	for rows.Next() {
+		var (
+			issuerType string
+			version    int
+			expiresIn  float64
+		)
+		if err := rows.Scan(&issuerType, &version, &expiresIn); err != nil {
+			return err
+		}
+		labels = append(labels, prometheus.Labels{"issuer_type": issuerType, "version": strconv.Itoa(version)})
+		values = append(values, expiresIn)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Types that were removed or retired long ago disappear rather than keep their
+	// last value
+	issuerExpiryGauge.Reset()
+	for i := range labels {
+		issuerExpiryGauge.With(labels[i]).Set(values[i])
+	}
+	return nil
+}
+
+// refreshIssuerExpiryPeriodically keeps issuerExpiryGauge current until the process exits
+func (c *Server) refreshIssuerExpiryPeriodically() {
+	for {
+		if err := c.refreshIssuerExpiry(); err != nil {
+			lg.Errorf("Could not refresh issuer expiry: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "refresh_issuer_expiry"})
+		}
+		time.Sleep(issuerExpiryInterval)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	IssuerStatusActive  = "active"
+	IssuerStatusRotated = "rotated"
+	IssuerStatusExpired = "expired"
+	IssuerStatusRevoked = "revoked"
+	IssuerStatusCanary  = "canary"
+)
+
+var InvalidIssuerFilterError = errors.New("Invalid issuer filter")
+
+// issuerFilter selects and orders the issuers listed by the issuer directory, the
+// zero value lists active issuers by name as the directory always has
+type issuerFilter struct {
+	statuses      map[string]bool
+	version       int
+	prefix        string
+	expiresAfter  time.Time
+	expiresBefore time.Time
+	sort          string
+	descending    bool
+}
+
+// issuerStatus is active until a replacement signs in the issuer's place, and
+// expired once the issuer can no longer verify redemptions, or revoked if its keys
+// were compromised. Canary issuers are canary until they are promoted or aborted.
+func issuerStatus(issuer *Issuer, now time.Time) string {
+	if !issuer.RevokedAt.IsZero() {
+		return IssuerStatusRevoked
+	}
+	if !issuer.ExpiresAt.IsZero() && !issuer.ExpiresAt.After(now) {
+		return IssuerStatusExpired
+	}
+	if !issuer.RotatedAt.IsZero() {
+		return IssuerStatusRotated
+	}
+	if issuer.CanaryPercent > 0 {
+		return IssuerStatusCanary
+	}
+	return IssuerStatusActive
+}
+
+// parseIssuerFilter reads status (a comma separated list, or all), version, prefix,
+// expires_after, expires_before (RFC3339) and sort (name, expires_at or created_at,
+// descending with a leading -)
+func parseIssuerFilter(query url.Values) (issuerFilter, error) {
+	filter := issuerFilter{statuses: map[string]bool{IssuerStatusActive: true}, sort: "name"}
+
+	if status := query.Get("status"); status != "" {
+		filter.statuses = map[string]bool{}
+		for _, s := range strings.Split(status, ",") {
+			switch s {
+			case "all":
+				filter.statuses = nil
+			case IssuerStatusActive, IssuerStatusRotated, IssuerStatusExpired, IssuerStatusRevoked, IssuerStatusCanary:
+				if filter.statuses != nil {
+					filter.statuses[s] = true
+				}
+			default:
+				return filter, InvalidIssuerFilterError
+			}
+		}
+	}
+	if version := query.Get("version"); version != "" {
+		var err error
+		if filter.version, err = strconv.Atoi(version); err != nil {
+			return filter, InvalidIssuerFilterError
+		}
+	}
+	filter.prefix = query.Get("prefix")
+	for param, bound := range map[string]*time.Time{"expires_after": &filter.expiresAfter, "expires_before": &filter.expiresBefore} {
+		if value := query.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, InvalidIssuerFilterError
+			}
+			*bound = t
+		}
+	}
+	if order := query.Get("sort"); order != "" {
+		filter.descending = strings.HasPrefix(order, "-")
+		filter.sort = strings.TrimPrefix(order, "-")
+		switch filter.sort {
+		case "name", "expires_at", "created_at":
+		default:
+			return filter, InvalidIssuerFilterError
+		}
+	}
+	return filter, nil
+}
+
+// includesExpired reports whether expired issuers need to be fetched at all
+func (f issuerFilter) includesExpired() bool {
+	return f.statuses == nil || f.statuses[IssuerStatusExpired] || f.statuses[IssuerStatusRevoked]
+}
+
+func (f issuerFilter) matches(issuer *Issuer, now time.Time) bool {
+	if f.statuses != nil && !f.statuses[issuerStatus(issuer, now)] {
+		return false
+	}
+	if f.version != 0 && issuer.Version != f.version {
+		return false
+	}
+	if _, name := splitIssuerType(issuer.IssuerType); !strings.HasPrefix(name, f.prefix) {
+		return false
+	}
+	// Issuers that never expire fall outside of any expiry window
+	if !f.expiresAfter.IsZero() && (issuer.ExpiresAt.IsZero() || issuer.ExpiresAt.Before(f.expiresAfter)) {
+		return false
+	}
+	if !f.expiresBefore.IsZero() && (issuer.ExpiresAt.IsZero() || !issuer.ExpiresAt.Before(f.expiresBefore)) {
+		return false
+	}
+	return true
+}
+
+// sortIssuers orders issuers stably, issuers that never expire sort after those that do
+func (f issuerFilter) sortIssuers(issuers []*Issuer) {
+	less := func(a, b *Issuer) bool {
+		switch f.sort {
+		case "expires_at":
+			if a.ExpiresAt.IsZero() || b.ExpiresAt.IsZero() {
+				return !a.ExpiresAt.IsZero() && b.ExpiresAt.IsZero()
+			}
+			return a.ExpiresAt.Before(b.ExpiresAt)
+		case "created_at":
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		_, nameA := splitIssuerType(a.IssuerType)
+		_, nameB := splitIssuerType(b.IssuerType)
+		return nameA < nameB
+	}
+	sort.SliceStable(issuers, func(i, j int) bool {
+		if f.descending {
+			return less(issuers[j], issuers[i])
+		}
+		return less(issuers[i], issuers[j])
+	})
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/lib/pq"
+)
+
+// Issuer flags change how an issuer type is redeemed without a config deploy, they
+// are kept with the active issuer and inherited by its replacements
+const (
+	// FlagAllowBatchRedeem lets tokens of the type be redeemed in bulk, true by default
+	FlagAllowBatchRedeem = "allow_batch_redeem"
+	// FlagRequirePayload rejects redemptions and reservations without a payload
+	FlagRequirePayload = "require_payload"
+	// FlagAsyncOnly only lets tokens of the type be redeemed by committing a
+	// reservation, so that they are spent once the work they pay for is done
+	FlagAsyncOnly = "async_only"
+)
+
+// ErrorCodeIssuerFlag is the data.error_code of redemptions the flags of their issuer
+// do not allow, data.flag names the flag
+const ErrorCodeIssuerFlag = "issuer_flag"
+
+// issuerFlagDefaults holds every known flag with its value when it is not set
+var issuerFlagDefaults = map[string]bool{
+	FlagAllowBatchRedeem: true,
+	FlagRequirePayload:   false,
+	FlagAsyncOnly:        false,
+}
+
+var ErrUnknownIssuerFlag = errors.New("flags must be allow_batch_redeem, require_payload or async_only")
+
+// IssuerFlagsRequest sets the flags of an issuer type, flags set to null are
+// restored to their default and omitted ones are left unchanged
+type IssuerFlagsRequest map[string]*bool
+
+// flag returns the value of a flag for the issuer
+func (issuer *Issuer) flag(name string) bool {
+	if value, ok := issuer.Flags[name]; ok {
+		return value
+	}
+	return issuerFlagDefaults[name]
+}
+
+// effectiveFlags returns every known flag with its value for the issuer
+func (issuer *Issuer) effectiveFlags() map[string]bool {
+	flags := make(map[string]bool, len(issuerFlagDefaults))
+	for name := range issuerFlagDefaults {
+		flags[name] = issuer.flag(name)
+	}
+	return flags
+}
+
+func validateIssuerFlags(flags map[string]bool) error {
+	for name := range flags {
+		if _, ok := issuerFlagDefaults[name]; !ok {
+			return ErrUnknownIssuerFlag
+		}
+	}
+	return nil
+}
+
+// marshalIssuerFlags encodes flags for the flags column
+func marshalIssuerFlags(flags map[string]bool) (string, error) {
+	if flags == nil {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(flags)
+	return string(encoded), err
+}
+
+// setIssuerFlags changes the flags of the active issuer of a type
+func (c *Server) setIssuerFlags(issuerType string, req IssuerFlagsRequest) error {
+	set := map[string]bool{}
+	var reset []string
+	for name, value := range req {
+		if _, ok := issuerFlagDefaults[name]; !ok {
+			return ErrUnknownIssuerFlag
+		}
+		if value == nil {
+			reset = append(reset, name)
+		} else {
+			set[name] = *value
+		}
+	}
+	flags, err := marshalIssuerFlags(set)
+	if err != nil {
+		return err
+	}
+
+	result, err := c.db.Exec(
+		`UPDATE issuers SET flags = (flags || $2::jsonb) - $3::text[]
+		WHERE issuer_type = $1 AND rotated_at IS NULL AND `+unexpiredIssuers,
+		issuerType, flags, pq.Array(reset))
+	if err != nil {
+		return err
+	}
+	c.forgetIssuers(issuerType)
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return IssuerNotFoundError
+	}
+	return nil
+}
+
+// issuerFlagAppError rejects a redemption the flags of its issuer do not allow.
+// reserved is set for redemptions committing a reservation and for the verification
+// and reservation that lead to them.
+func issuerFlagAppError(issuer *Issuer, payload string, bulk, reserved bool) *handlers.AppError {
+	var flag, message string
+	switch {
+	case bulk && !issuer.flag(FlagAllowBatchRedeem):
+		flag, message = FlagAllowBatchRedeem, "Tokens of this issuer can not be redeemed in bulk"
+	case payload == "" && issuer.flag(FlagRequirePayload):
+		flag, message = FlagRequirePayload, "Redemptions of this issuer require a payload"
+	case !reserved && issuer.flag(FlagAsyncOnly):
+		flag, message = FlagAsyncOnly, "Tokens of this issuer must be reserved before they are redeemed"
+	default:
+		return nil
+	}
+	return &handlers.AppError{
+		Message: message,
+		Code:    http.StatusBadRequest,
+		Data: map[string]interface{}{
+			"error_code": ErrorCodeIssuerFlag,
+			"flag":       flag,
+		},
+	}
+}
+
+func (c *Server) issuerFlagsHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	issuer, appErr := c.getIssuer(c.resolveIssuerType(issuerTypeParam(r)))
+	if appErr != nil {
+		return appErr
+	}
+	return encodeResponse(w, issuer.effectiveFlags())
+}
+
+func (c *Server) issuerFlagsUpdateHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req IssuerFlagsRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	issuerType := c.resolveIssuerType(issuerTypeParam(r))
+	if err := c.setIssuerFlags(issuerType, req); err != nil {
+		switch {
+		case err == ErrUnknownIssuerFlag:
+			return handlers.WrapError("Invalid issuer flags", err)
+		case errors.Is(err, IssuerNotFoundError):
+			return &handlers.AppError{
+				Message: "Issuer not found",
+				Code:    http.StatusNotFound,
+			}
+		}
+		return storageAppError(err, "Could not update issuer flags")
+	}
+
+	issuer, appErr := c.getIssuer(issuerType)
+	if appErr != nil {
+		return appErr
+	}
+	var changes []string
+	for name, value := range req {
+		if value == nil {
+			changes = append(changes, name+"=default")
+		} else {
+			changes = append(changes, fmt.Sprintf("%s=%t", name, *value))
+		}
+	}
+	sort.Strings(changes)
+	entry := newAuditEntry(r, AuditIssuerFlags, issuer)
+	entry.Details = strings.Join(changes, " ")
+	c.recordAudit(entry)
+	return encodeResponse(w, issuer.effectiveFlags())
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operations a freeze stops, issuance by default
+const (
+	FreezeIssuance   = "issuance"
+	FreezeRedemption = "redemption"
+	FreezeAll        = "all"
+)
+
+// ErrorCodeIssuerFrozen is the data.error_code of requests rejected because their
+// issuer type is frozen
+const ErrorCodeIssuerFrozen = "issuer_frozen"
+
+var (
+	ErrInvalidFreeze   = errors.New("operations must be issuance, redemption or all, and a reason is required")
+	ErrIssuerNotFrozen = newStorageError(ErrNotFound, "Issuer type is not frozen")
+
+	frozenRequestCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "frozen_issuer_request_count",
+		Help: "Number of requests rejected because their issuer type is frozen",
+	}, []string{"issuer_type", "operation"})
+)
+
+// IssuerFreeze temporarily stops issuance, redemption or both for an issuer type
+// without retiring its keys, e.g. during incident response
+type IssuerFreeze struct {
+	IssuerType string    `json:"issuer_type"`
+	Operations string    `json:"operations"`
+	Reason     string    `json:"reason"`
+	Actor      string    `json:"actor"`
+	FrozenAt   time.Time `json:"frozen_at"`
+}
+
+// IssuerFreezeRequest freezes an issuer type, Operations defaults to issuance
+type IssuerFreezeRequest struct {
+	Operations string `json:"operations,omitempty"`
+	Reason     string `json:"reason"`
+}
+
+// stops reports whether the freeze stops an operation
+func (f *IssuerFreeze) stops(operation string) bool {
+	return f.Operations == FreezeAll || f.Operations == operation
+}
+
+func issuerFreezeCacheKey(issuerType string) string {
+	return "frozen:" + issuerType
+}
+
+// freezeIssuerType freezes an issuer type, replacing any freeze it already has. The
+// entry gives the actor and request recorded in the audit log.
+func (c *Server) freezeIssuerType(issuerType, operations, reason string, entry AuditEntry) (*IssuerFreeze, error) {
+	if operations == "" {
+		operations = FreezeIssuance
+	}
+	if reason == "" || (operations != FreezeIssuance && operations != FreezeRedemption && operations != FreezeAll) {
+		return nil, ErrInvalidFreeze
+	}
+
+	var exists bool
+	if err := c.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM issuers WHERE issuer_type = $1)`, issuerType).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, IssuerNotFoundError
+	}
+
+	freeze := &IssuerFreeze{IssuerType: issuerType, Operations: operations, Reason: reason, Actor: entry.Actor}
+	err := c.db.QueryRow(
+		`INSERT INTO issuer_freezes(issuer_type, operations, reason, actor) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (issuer_type) DO UPDATE SET operations = $2, reason = $3, actor = $4, frozen_at = NOW()
+		RETURNING frozen_at`,
+		issuerType, operations, reason, entry.Actor).Scan(&freeze.FrozenAt)
+	if err != nil {
+		return nil, err
+	}
+	c.forgetIssuers(issuerType)
+
+	entry.Action = AuditIssuerFreeze
+	entry.IssuerType = issuerType
+	entry.Details = operations + ": " + reason
+	c.recordAudit(entry)
+	return freeze, nil
+}
+
+// unfreezeIssuerType lifts the freeze of an issuer type
+func (c *Server) unfreezeIssuerType(issuerType string, entry AuditEntry) error {
+	result, err := c.db.Exec(`DELETE FROM issuer_freezes WHERE issuer_type = $1`, issuerType)
+	if err != nil {
+		return err
+	}
+	c.forgetIssuers(issuerType)
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return ErrIssuerNotFrozen
+	}
+
+	entry.Action = AuditIssuerUnfreeze
+	entry.IssuerType = issuerType
+	c.recordAudit(entry)
+	return nil
+}
+
+// fetchIssuerFreeze returns the freeze of an issuer type, nil when it is not frozen
+func (c *Server) fetchIssuerFreeze(issuerType string) (*IssuerFreeze, error) {
+	key := issuerFreezeCacheKey(issuerType)
+	if c.caches != nil {
+		if cached, found := c.caches["issuers"].Get(key); found {
+			return cached.(*IssuerFreeze), nil
+		}
+	}
+
+	freeze := &IssuerFreeze{IssuerType: issuerType}
+	err := c.db.QueryRow(
+		`SELECT operations, reason, actor, frozen_at FROM issuer_freezes WHERE issuer_type = $1`,
+		issuerType).Scan(&freeze.Operations, &freeze.Reason, &freeze.Actor, &freeze.FrozenAt)
+	if err == sql.ErrNoRows {
+		freeze = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if c.caches != nil {
+		c.caches["issuers"].SetDefault(key, freeze)
+	}
+	return freeze, nil
+}
+
+// frozenAppError rejects an operation on a frozen issuer type with a 503 giving the
+// reason of the freeze. Freezes that cannot be looked up are logged and let through,
+// so that a database outage does not stop issuers that are not frozen.
+func (c *Server) frozenAppError(issuerType, operation string) *handlers.AppError {
+	freeze, err := c.fetchIssuerFreeze(issuerType)
+	if err != nil {
+		lg.Errorf("Could not look up the freeze of %s: %s", issuerType, err)
+		return nil
+	}
+	if freeze == nil || !freeze.stops(operation) {
+		return nil
+	}
+	return freeze.appError(operation)
+}
+
+// appError rejects an operation stopped by the freeze
+func (f *IssuerFreeze) appError(operation string) *handlers.AppError {
+	frozenRequestCounter.With(prometheus.Labels{"issuer_type": f.IssuerType, "operation": operation}).Inc()
+	return &handlers.AppError{
+		Message: "Issuer type is frozen",
+		Code:    http.StatusServiceUnavailable,
+		Data: map[string]interface{}{
+			"error_code": ErrorCodeIssuerFrozen,
+			"operations": f.Operations,
+			"reason":     f.Reason,
+			"frozen_at":  f.FrozenAt,
+		},
+	}
+}
+
+func (c *Server) issuerFreezeStatusHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	freeze, err := c.fetchIssuerFreeze(c.resolveIssuerType(issuerTypeParam(r)))
+	if err != nil {
+		return storageAppError(err, "Could not look up issuer freeze")
+	}
+	if freeze == nil {
+		return &handlers.AppError{
+			Message: ErrIssuerNotFrozen.Error(),
+			Code:    http.StatusNotFound,
+		}
+	}
+	return encodeResponse(w, freeze)
+}
+
+func (c *Server) issuerFreezeHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req IssuerFreezeRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	issuerType := c.resolveIssuerType(issuerTypeParam(r))
+	freeze, err := c.freezeIssuerType(issuerType, req.Operations, req.Reason, newAuditEntry(r, AuditIssuerFreeze, nil))
+	switch {
+	case err == ErrInvalidFreeze:
+		return handlers.WrapError("Invalid freeze", err)
+	case errors.Is(err, IssuerNotFoundError):
+		return &handlers.AppError{
+			Message: "Issuer not found",
+			Code:    http.StatusNotFound,
+		}
+	case err != nil:
+		return storageAppError(err, "Could not freeze issuer type")
+	}
+	return encodeResponse(w, freeze)
+}
+
+func (c *Server) issuerUnfreezeHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	issuerType := c.resolveIssuerType(issuerTypeParam(r))
+	if err := c.unfreezeIssuerType(issuerType, newAuditEntry(r, AuditIssuerUnfreeze, nil)); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return &handlers.AppError{
+				Message: err.Error(),
+				Code:    http.StatusNotFound,
+			}
+		}
+		return storageAppError(err, "Could not unfreeze issuer type")
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
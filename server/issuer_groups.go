@@ -0,0 +1,101 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	IssuerGroupNotFoundError = newStorageError(ErrNotFound, "Issuer group with the given name does not exist")
+	IssuerGroupExistsError   = newStorageError(ErrDuplicate, "An issuer group with the given name already exists")
+	EmptyIssuerGroupError    = errors.New("Issuer groups require at least one issuer")
+)
+
+// IssuerGroup links issuers that are created together and rotated together
+type IssuerGroup struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	Issuers   []*Issuer
+}
+
+// createIssuerGroup stores a new group and all of its issuers in a single transaction,
+// either every issuer is created or none are. The group's issuers are populated as
+// with createIssuer on success.
+func (c *Server) createIssuerGroup(group *IssuerGroup) error {
+	if len(group.Issuers) == 0 {
+		return EmptyIssuerGroupError
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	group.ID = uuid.NewV4().String()
+	err = tx.QueryRow(
+		`INSERT INTO issuer_groups(id, name) VALUES ($1, $2) RETURNING created_at`, group.ID, group.Name).Scan(&group.CreatedAt)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(classifyStorageError(err), ErrDuplicate) {
+			return IssuerGroupExistsError
+		}
+		return err
+	}
+
+	for _, issuer := range group.Issuers {
+		if issuer.RedemptionStore == RedemptionStoreRedis && c.redis == nil {
+			_ = tx.Rollback()
+			return ErrRedisDisabled
+		}
+		if err := c.validatePayloadPolicy(issuer.PayloadPolicy); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		issuer.GroupID = group.ID
+		if err := c.insertIssuer(tx, issuer); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, issuer := range group.Issuers {
+		c.forgetIssuers(issuer.IssuerType)
+		if issuer.Version == IssuerVersion3 {
+			if issuer.Keys, err = c.fetchIssuerKeys(c.db.Query, issuer.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchIssuerGroup returns a group along with its active issuers
+func (c *Server) fetchIssuerGroup(name string) (*IssuerGroup, error) {
+	var group IssuerGroup
+	err := c.db.QueryRow(
+		`SELECT id, name, created_at FROM issuer_groups WHERE name = $1`, name).Scan(&group.ID, &group.Name, &group.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, IssuerGroupNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := c.db.Query(
+		`SELECT `+issuerColumns+` FROM issuers WHERE group_id = $1 AND rotated_at IS NULL ORDER BY issuer_type`, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	if group.Issuers, err = c.scanIssuers(rows, c.db.Query); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
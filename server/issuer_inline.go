@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/pressly/lg"
+)
+
+// includeIssuerParam is the include query parameter value asking issuance responses
+// to describe the signing issuer
+const includeIssuerParam = "issuer"
+
+// includeIssuer reports whether an issuance request asks for the signing issuer. When
+// it does, the issuer resource is pushed over HTTP/2, or announced in a preload Link
+// header for proxies terminating HTTP/2 to push, so that clients have it in hand
+// without a second round trip.
+func includeIssuer(w http.ResponseWriter, r *http.Request, issuer *Issuer) bool {
+	included := false
+	for _, include := range r.URL.Query()["include"] {
+		if include == includeIssuerParam {
+			included = true
+		}
+	}
+	if !included {
+		return false
+	}
+
+	target := "/v1/issuer/" + url.PathEscape(issuer.IssuerType)
+	if pusher, ok := w.(http.Pusher); ok {
+		header := http.Header{}
+		for _, name := range []string{"Authorization", "Accept-Encoding"} {
+			if value := r.Header.Get(name); value != "" {
+				header.Set(name, value)
+			}
+		}
+		err := pusher.Push(target, &http.PushOptions{Header: header})
+		if err == nil {
+			return true
+		}
+		if err != http.ErrNotSupported {
+			lg.Log(r.Context()).Debugf("Could not push issuer %s: %s", issuer.IssuerType, err)
+		}
+	}
+	w.Header().Add("Link", "<"+target+">; rel=preload; as=fetch")
+	return true
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultKeyHistoryLimit         = 100
+	maxKeyHistoryLimit             = 1000
+	defaultKeyHistoryRatePerMinute = 60
+)
+
+// ErrorCodeRateLimited is the data.error_code of requests over a per caller rate limit
+const ErrorCodeRateLimited = "rate_limited"
+
+var ErrInvalidKeyHistoryCursor = errors.New("cursor must be the next_cursor of a previous page")
+
+// IssuerKeyHistoryResponse is a page of the keys an issuer type has signed with,
+// newest first
+type IssuerKeyHistoryResponse struct {
+	Keys []IssuerKeyHistoryEntry `json:"keys"`
+	// NextCursor fetches the next page of older keys, it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// IssuerKeyHistoryEntry is a key of a version 1 issuer, or one of the time bucket keys
+// of a version 3 issuer along with the window its tokens are redeemable in. Retired
+// issuers are rotated and expire at the time they were retired.
+type IssuerKeyHistoryEntry struct {
+	ID        string            `json:"id"`
+	IssuerID  string            `json:"issuer_id"`
+	Version   int               `json:"version"`
+	PublicKey *crypto.PublicKey `json:"public_key"`
+	StartAt   *time.Time        `json:"start_at,omitempty"`
+	EndAt     *time.Time        `json:"end_at,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	RotatedAt *time.Time        `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time        `json:"revoked_at,omitempty"`
+}
+
+// keyHistoryCursor is the position of the last key of a page, keys are ordered by the
+// start of their validity and then by ID
+type keyHistoryCursor struct {
+	StartAt time.Time
+	ID      string
+}
+
+func (cursor keyHistoryCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor.StartAt.UTC().Format(time.RFC3339Nano) + " " + cursor.ID))
+}
+
+func parseKeyHistoryCursor(value string) (*keyHistoryCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidKeyHistoryCursor
+	}
+	parts := strings.SplitN(string(decoded), " ", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidKeyHistoryCursor
+	}
+	startAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, ErrInvalidKeyHistoryCursor
+	}
+	return &keyHistoryCursor{StartAt: startAt, ID: parts[1]}, nil
+}
+
+// fetchIssuerKeyHistory returns up to limit keys of every issuer of a type, including
+// expired, rotated and revoked ones, that start before the cursor. Version 1 keys start
+// when their issuer was created.
+func (c *Server) fetchIssuerKeyHistory(issuerType string, cursor *keyHistoryCursor, limit int) ([]IssuerKeyHistoryEntry, *keyHistoryCursor, error) {
+	var cursorStart pq.NullTime
+	var cursorID string
+	if cursor != nil {
+		cursorStart = pq.NullTime{Time: cursor.StartAt, Valid: true}
+		cursorID = cursor.ID
+	}
+	rows, err := c.queryReadOnly(`
+		SELECT i.id::text, i.version, i.created_at, i.expires_at, i.rotated_at, i.revoked_at,
+			COALESCE(k.id::text, i.id::text) AS key_id, COALESCE(k.signing_key, i.signing_key), k.start_at, k.end_at,
+			COALESCE(k.start_at, i.created_at) AS key_start
+		FROM issuers i LEFT JOIN issuer_keys k ON k.issuer_id = i.id
+		WHERE i.issuer_type = $1 AND COALESCE(k.signing_key, i.signing_key) IS NOT NULL
+			AND ($2::timestamp IS NULL OR (COALESCE(k.start_at, i.created_at), COALESCE(k.id::text, i.id::text)) < ($2::timestamp, $3::text))
+		ORDER BY key_start DESC, key_id DESC
+		LIMIT $4`, issuerType, cursorStart, cursorID, limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	entries := []IssuerKeyHistoryEntry{}
+	var last, next *keyHistoryCursor
+	for rows.Next() {
+		var entry IssuerKeyHistoryEntry
+		var signingKey []byte
+		var expiresAt, rotatedAt, revokedAt, startAt, endAt pq.NullTime
+		var keyStart time.Time
+		if err := rows.Scan(&entry.IssuerID, &entry.Version, &entry.CreatedAt, &expiresAt, &rotatedAt, &revokedAt,
+			&entry.ID, &signingKey, &startAt, &endAt, &keyStart); err != nil {
+			return nil, nil, err
+		}
+		// The extra row only tells whether there is another page
+		if len(entries) == limit {
+			next = last
+			break
+		}
+
+		key, err := unsealSigningKey(signingKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.PublicKey = key.PublicKey()
+		entry.StartAt = nullTimePtr(startAt)
+		entry.EndAt = nullTimePtr(endAt)
+		entry.ExpiresAt = nullTimePtr(expiresAt)
+		entry.RotatedAt = nullTimePtr(rotatedAt)
+		entry.RevokedAt = nullTimePtr(revokedAt)
+		entries = append(entries, entry)
+		last = &keyHistoryCursor{StartAt: keyStart, ID: entry.ID}
+	}
+	return entries, next, rows.Err()
+}
+
+func nullTimePtr(t pq.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (c *Server) keyHistoryRatePerMinute() int {
+	if c.KeyHistoryRatePerMinute > 0 {
+		return c.KeyHistoryRatePerMinute
+	}
+	return defaultKeyHistoryRatePerMinute
+}
+
+func (c *Server) issuerKeyHistoryHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var cursor *keyHistoryCursor
+	if value := r.FormValue("cursor"); value != "" {
+		var err error
+		if cursor, err = parseKeyHistoryCursor(value); err != nil {
+			return handlers.WrapError("Invalid key history query", err)
+		}
+	}
+	limit := defaultKeyHistoryLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxKeyHistoryLimit {
+			return handlers.WrapError("Invalid key history query", fmt.Errorf("limit must be between 1 and %d", maxKeyHistoryLimit))
+		}
+	}
+
+	keys, next, err := c.fetchIssuerKeyHistory(c.resolveIssuerType(issuerTypeParam(r)), cursor, limit)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not fetch issuer keys",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if len(keys) == 0 && cursor == nil {
+		return &handlers.AppError{
+			Message: "Issuer not found",
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	response := IssuerKeyHistoryResponse{Keys: keys}
+	if next != nil {
+		response.NextCursor = next.String()
+	}
+	return encodeResponse(w, response)
+}
+
+// rateLimiter counts the requests of each caller in fixed one minute windows. Counts
+// are kept per instance, so callers spread across instances get the limit of each.
+type rateLimiter struct {
+	perMinute int
+
+	mu     sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, counts: map[string]int{}}
+}
+
+// allow counts a request of caller at now, returning when the window ends if the
+// caller is over the limit
+func (rl *rateLimiter) allow(caller string, now time.Time) (bool, time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	window := now.Truncate(time.Minute)
+	if !window.Equal(rl.window) {
+		// Dropping the counts of past windows bounds the memory to the active callers
+		rl.window, rl.counts = window, map[string]int{}
+	}
+	rl.counts[caller]++
+	return rl.counts[caller] <= rl.perMinute, window.Add(time.Minute)
+}
+
+// rateLimit rejects callers exceeding the limiter's requests per minute with a 429
+func rateLimit(rl *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			if allowed, resetAt := rl.allow(clientKeyID(r), now); !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(resetAt.Sub(now).Seconds())+1))
+				handlers.AppError{
+					Message: fmt.Sprintf("Rate limit of %d requests per minute exceeded", rl.perMinute),
+					Code:    http.StatusTooManyRequests,
+					Data: map[string]interface{}{
+						"error_code": ErrorCodeRateLimited,
+					},
+				}.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
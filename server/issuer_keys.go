@@ -0,0 +1,165 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	uuid "github.com/satori/go.uuid"
+)
+
+// IssuerKey is a signing key of a version 3 issuer, valid for the bucket [StartAt, EndAt)
+type IssuerKey struct {
+	ID         string
+	SigningKey *crypto.SigningKey
+	StartAt    time.Time
+	EndAt      time.Time
+}
+
+// bucketStart returns the start of the bucket of length d containing t
+func bucketStart(t time.Time, d time.Duration) time.Time {
+	return t.UTC().Truncate(d)
+}
+
+// keyAt returns the key whose bucket contains t, or nil if there is none
+func (issuer *Issuer) keyAt(t time.Time) *IssuerKey {
+	for i := range issuer.Keys {
+		key := &issuer.Keys[i]
+		if !t.Before(key.StartAt) && t.Before(key.EndAt) {
+			return key
+		}
+	}
+	return nil
+}
+
+// hasBufferedKeys reports whether the issuer has keys for the current bucket and the buffered ones after it
+func (issuer *Issuer) hasBufferedKeys(now time.Time) bool {
+	start := bucketStart(now, issuer.BucketDuration)
+	for i := 0; i < issuer.Buffer; i++ {
+		if issuer.keyAt(start.Add(time.Duration(i)*issuer.BucketDuration)) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// bufferedKeys returns the keys for the current bucket and the buffered ones after it
+func (issuer *Issuer) bufferedKeys(now time.Time) []*IssuerKey {
+	start := bucketStart(now, issuer.BucketDuration)
+	keys := []*IssuerKey{}
+	for i := 0; i < issuer.Buffer; i++ {
+		if key := issuer.keyAt(start.Add(time.Duration(i) * issuer.BucketDuration)); key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (c *Server) fetchIssuerKeys(query func(string, ...interface{}) (*sql.Rows, error), issuerID string) ([]IssuerKey, error) {
+	// Keys that ended longer than the clock skew ago can no longer verify redemptions
+	rows, err := query(
+		`SELECT id, signing_key, start_at, end_at FROM issuer_keys WHERE issuer_id = $1 AND end_at > $2 ORDER BY start_at`,
+		issuerID, time.Now().Add(-c.clockSkew()))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []IssuerKey{}
+	for rows.Next() {
+		var signingKey []byte
+		var key IssuerKey
+		if err := rows.Scan(&key.ID, &signingKey, &key.StartAt, &key.EndAt); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if key.SigningKey, err = unsealSigningKey(signingKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertIssuerKeys generates keys for any of the issuer's buffered buckets that do not yet have one.
+// Concurrent callers may race to create the same bucket, only one key per bucket is kept.
+func insertIssuerKeys(db execer, issuer *Issuer, now time.Time) (int, error) {
+	start := bucketStart(now, issuer.BucketDuration)
+	created := 0
+	for i := 0; i < issuer.Buffer; i++ {
+		startAt := start.Add(time.Duration(i) * issuer.BucketDuration)
+		if issuer.keyAt(startAt) != nil {
+			continue
+		}
+
+		signingKey, err := crypto.RandomSigningKey()
+		if err != nil {
+			return created, err
+		}
+		signingKeyTxt, err := sealSigningKey(signingKey)
+		if err != nil {
+			return created, err
+		}
+
+		result, err := db.Exec(
+			`INSERT INTO issuer_keys(id, issuer_id, signing_key, start_at, end_at) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (issuer_id, start_at) DO NOTHING`,
+			uuid.NewV4().String(), issuer.ID, signingKeyTxt, startAt, startAt.Add(issuer.BucketDuration))
+		zeroize(signingKeyTxt)
+		if err != nil {
+			return created, err
+		}
+		// Keys another instance created first are not counted
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return created, err
+		}
+		created += int(inserted)
+	}
+	return created, nil
+}
+
+// ensureIssuerKeys makes sure a version 3 issuer has keys for its buffered buckets,
+// returning the issuer with a refreshed key set if any had to be created
+func (c *Server) ensureIssuerKeys(issuer *Issuer, now time.Time) (*Issuer, error) {
+	if issuer.Version != IssuerVersion3 || issuer.hasBufferedKeys(now) {
+		return issuer, nil
+	}
+
+	created, err := insertIssuerKeys(c.db, issuer, now)
+	if err != nil {
+		return nil, err
+	}
+	if created > 0 {
+		c.recordAudit(AuditEntry{
+			Actor:      AuditActorSystem,
+			Action:     AuditIssuerKeyCreate,
+			IssuerID:   issuer.ID,
+			IssuerType: issuer.IssuerType,
+			Details:    fmt.Sprintf("%d keys", created),
+		})
+	}
+	return c.reloadIssuerKeys(issuer)
+}
+
+// reloadIssuerKeys refreshes the key set of a version 3 issuer from the primary,
+// the cached issuers of its type are dropped so they are reloaded on next use
+func (c *Server) reloadIssuerKeys(issuer *Issuer) (*Issuer, error) {
+	keys, err := c.fetchIssuerKeys(c.db.Query, issuer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed := *issuer
+	refreshed.Keys = keys
+	c.forgetIssuers(issuer.IssuerType)
+	return &refreshed, nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// issuerChangeChannel is the Postgres channel issuer types are announced on whenever
+// their issuers change, so that every instance drops them from its cache
+const issuerChangeChannel = "issuer_changes"
+
+var (
+	issuerListenerMinReconnect = time.Second
+	issuerListenerMaxReconnect = time.Minute
+	issuerListenerPingInterval = 90 * time.Second
+
+	issuerNotificationCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "issuer_notification_count",
+		Help: "Number of issuer change notifications, by whether they were sent or received",
+	}, []string{"direction"})
+)
+
+// notifyIssuerChange tells every instance listening that the issuers of a type changed.
+// Notifications are delivered once the surrounding transaction commits, callers send
+// them after committing so that listeners never reload the old issuers. A lost
+// notification leaves other instances with stale issuers until their cache expires.
+func (c *Server) notifyIssuerChange(issuerType string) {
+	if c.db == nil {
+		return
+	}
+	if _, err := c.db.Exec(`SELECT pg_notify($1, $2)`, issuerChangeChannel, issuerType); err != nil {
+		lg.Errorf("Could not notify other instances of changed issuers of %s: %s", issuerType, err)
+		c.reportError(nil, err, map[string]string{"issuer_type": issuerType})
+		return
+	}
+	issuerNotificationCounter.With(prometheus.Labels{"direction": "sent"}).Inc()
+}
+
+// cacheListener listens for cache changes until it is closed
+type cacheListener struct {
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func (l *cacheListener) Close() error {
+	close(l.closing)
+	<-l.done
+	return nil
+}
+
+// openCacheListener listens on the cache change channels with a connection URI. pq
+// reconnects a listener with the URI it was opened with, so it is replaced whenever
+// the database credentials are rotated.
+func openCacheListener(uri string) (*pq.Listener, error) {
+	listener := pq.NewListener(uri, issuerListenerMinReconnect, issuerListenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				lg.Errorf("Issuer change listener failed: %s", err)
+			}
+		})
+	for _, channel := range []string{issuerChangeChannel, apiKeyRevocationChannel} {
+		if err := listener.Listen(channel); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// listenForCacheChanges drops the issuers of announced types and revoked API keys from
+// the cache of this instance until the returned listener is closed. Notifications sent
+// while the listener reconnects are lost, so both caches are dropped on reconnection.
+// After a rotation the listener is replaced by one with the new credentials, which
+// listens before the old one is closed so that nothing is missed.
+func (c *Server) listenForCacheChanges() (*cacheListener, error) {
+	uri, rotated := c.dbConfig.ConnectionURI, (<-chan struct{})(nil)
+	if c.dbConnector != nil {
+		uri, rotated = c.dbConnector.watch()
+	}
+	listener, err := openCacheListener(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &cacheListener{closing: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		defer func() { _ = listener.Close() }()
+		// stale is set while the listener still uses credentials that were rotated
+		stale := false
+		reopen := func() {
+			next, err := openCacheListener(uri)
+			if err != nil {
+				stale = true
+				lg.Errorf("Could not listen for issuer changes with rotated credentials: %s", err)
+				c.reportError(nil, err, map[string]string{"job": "cache_listener"})
+				return
+			}
+			_ = listener.Close()
+			listener, stale = next, false
+		}
+		for {
+			select {
+			case <-l.closing:
+				return
+			case <-rotated:
+				uri, rotated = c.dbConnector.watch()
+				reopen()
+			case notification, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				if notification == nil {
+					c.caches["issuers"].Flush()
+					c.caches["api_keys"].Flush()
+					continue
+				}
+				if notification.Channel == apiKeyRevocationChannel {
+					c.caches["api_keys"].Delete(notification.Extra)
+					continue
+				}
+				issuerNotificationCounter.With(prometheus.Labels{"direction": "received"}).Inc()
+				c.dropCachedIssuers(notification.Extra)
+			case <-time.After(issuerListenerPingInterval):
+				if stale {
+					reopen()
+					continue
+				}
+				// Detects connections that dropped without an error
+				go func(listener *pq.Listener) { _ = listener.Ping() }(listener)
+			}
+		}
+	}()
+	return l, nil
+}
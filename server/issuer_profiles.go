@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+)
+
+var UnknownIssuerProfileError = errors.New("Unknown issuer profile")
+
+// IssuerProfile is a named set of issuer settings, such as "ads-daily", that issuers
+// can be created from instead of repeating every setting
+type IssuerProfile struct {
+	MaxTokens          int   `json:"max_tokens,omitempty"`
+	Version            int   `json:"version,omitempty"`
+	BucketSeconds      int64 `json:"bucket_seconds,omitempty"`
+	Buffer             int   `json:"buffer,omitempty"`
+	ValidDays          int   `json:"valid_days,omitempty"`
+	RotationWindowDays int   `json:"rotation_window_days,omitempty"`
+	// RedemptionRetentionDays is how long redemptions of the issuer's type are kept in
+	// the database before archival, instead of ArchiveAfterDays
+	RedemptionRetentionDays int `json:"redemption_retention_days,omitempty"`
+	// RedemptionStore is where redemptions of the issuer's type are recorded
+	RedemptionStore string `json:"redemption_store,omitempty"`
+	// PayloadPolicy lists the transformers redemption payloads go through before they
+	// are persisted
+	PayloadPolicy []string `json:"payload_policy,omitempty"`
+}
+
+// applyIssuerProfile fills the settings a request leaves unset from its profile, so
+// that a request naming only a profile gets every setting of the profile
+func (c *Server) applyIssuerProfile(req IssuerCreateRequest) (IssuerCreateRequest, error) {
+	if req.Profile == "" {
+		return req, nil
+	}
+	profile, ok := c.IssuerProfiles[req.Profile]
+	if !ok {
+		return req, UnknownIssuerProfileError
+	}
+
+	if req.MaxTokens == 0 {
+		req.MaxTokens = profile.MaxTokens
+	}
+	if req.Version == 0 {
+		req.Version = profile.Version
+	}
+	if req.BucketSeconds == 0 {
+		req.BucketSeconds = profile.BucketSeconds
+	}
+	if req.Buffer == 0 {
+		req.Buffer = profile.Buffer
+	}
+	if req.ValidDays == 0 {
+		req.ValidDays = profile.ValidDays
+	}
+	if req.RotationWindowDays == 0 {
+		req.RotationWindowDays = profile.RotationWindowDays
+	}
+	if req.RedemptionRetentionDays == 0 {
+		req.RedemptionRetentionDays = profile.RedemptionRetentionDays
+	}
+	if req.RedemptionStore == "" {
+		req.RedemptionStore = profile.RedemptionStore
+	}
+	if req.PayloadPolicy == nil {
+		req.PayloadPolicy = profile.PayloadPolicy
+	}
+	return req, nil
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/go-chi/chi"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrorCodeIssuerRevoked is the data.error_code of redemptions rejected because their
+// token was signed by a revoked issuer
+const ErrorCodeIssuerRevoked = "issuer_revoked"
+
+var (
+	ErrRevocationReasonRequired = errors.New("A reason is required to revoke an issuer")
+	ErrIssuerAlreadyRevoked     = newStorageError(ErrDuplicate, "Issuer has already been revoked")
+
+	revokeIssuerCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "issuer_revocation_count",
+		Help: "Number of issuers revoked as compromised",
+	}, []string{"issuer_type"})
+
+	revokedRedemptionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "revoked_issuer_redemption_count",
+		Help: "Number of redemptions rejected because a revoked issuer signed the token",
+	}, []string{"issuer_type"})
+)
+
+// IssuerRevokeRequest revokes an issuer, Replace creates a replacement with the same
+// settings when the revoked issuer was the active one
+type IssuerRevokeRequest struct {
+	Reason  string `json:"reason"`
+	Replace bool   `json:"replace,omitempty"`
+}
+
+// IssuerRevokeResponse describes the revoked issuer and its replacement, if any
+type IssuerRevokeResponse struct {
+	Revoked     IssuerMetadataResponse `json:"revoked"`
+	Replacement *IssuerResponse        `json:"replacement,omitempty"`
+}
+
+// IssuerRevocation is posted as JSON to RevocationWebhookURL for every revoked issuer
+type IssuerRevocation struct {
+	IssuerID      string    `json:"issuer_id"`
+	IssuerType    string    `json:"issuer_type"`
+	Reason        string    `json:"reason"`
+	RevokedAt     time.Time `json:"revoked_at"`
+	Actor         string    `json:"actor"`
+	ReplacementID string    `json:"replacement_id,omitempty"`
+}
+
+func revokedIssuersCacheKey(issuerType string) string {
+	return "revoked:" + issuerType
+}
+
+// revokeIssuer immediately expires an issuer whose keys were compromised, unlike
+// retirement the tokens it signed are rejected as revoked rather than as invalid.
+// With replace, an active issuer is replaced by a new one with the same settings,
+// pending successors are discarded rather than activated since they were generated
+// by the same server. The entry gives the actor and request recorded in the audit log.
+func (c *Server) revokeIssuer(id, reason string, replace bool, entry AuditEntry) (*Issuer, *Issuer, error) {
+	if reason == "" {
+		return nil, nil, ErrRevocationReasonRequired
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := tx.Query(`SELECT `+issuerColumns+` FROM issuers WHERE id = $1 FOR UPDATE`, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, nil, err
+	}
+	issuers, err := c.scanIssuers(rows, tx.Query)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, nil, err
+	}
+	if len(issuers) == 0 {
+		_ = tx.Rollback()
+		return nil, nil, IssuerNotFoundError
+	}
+	revoked := issuers[0]
+	if !revoked.RevokedAt.IsZero() {
+		_ = tx.Rollback()
+		return nil, nil, ErrIssuerAlreadyRevoked
+	}
+
+	now := time.Now()
+	err = tx.QueryRow(
+		`UPDATE issuers SET revoked_at = NOW(), revocation_reason = $2, rotated_at = COALESCE(rotated_at, NOW()),
+			expires_at = LEAST(COALESCE(expires_at, 'infinity'), NOW() - make_interval(secs => $3))
+		WHERE id = $1 RETURNING revoked_at, expires_at`, id, reason, c.ClockSkewSec).Scan(&revoked.RevokedAt, &revoked.ExpiresAt)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, nil, err
+	}
+
+	var replacement *Issuer
+	if replace && revoked.RotatedAt.IsZero() {
+		replacement = revoked.successor(now)
+		// A revoked canary is replaced by a canary, the active issuer keeps its place
+		replacement.CanaryPercent = revoked.CanaryPercent
+		if err := c.insertIssuer(tx, replacement); err != nil {
+			_ = tx.Rollback()
+			return nil, nil, err
+		}
+	}
+	if revoked.RotatedAt.IsZero() {
+		revoked.RotatedAt = revoked.RevokedAt
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	c.forgetIssuers(revoked.IssuerType)
+	signingKeys.evict(issuerSigningKeys([]*Issuer{revoked})...)
+	if err := forgetPendingIssuers(c.db, revoked.IssuerType); err != nil {
+		lg.Errorf("Could not discard pending successors of revoked issuer %s: %s", revoked.ID, err)
+	}
+
+	revokeIssuerCounter.With(prometheus.Labels{"issuer_type": revoked.IssuerType}).Inc()
+	entry.Action = AuditIssuerRevoke
+	entry.IssuerID = revoked.ID
+	entry.IssuerType = revoked.IssuerType
+	entry.Details = reason
+	c.recordAudit(entry)
+
+	revocation := IssuerRevocation{
+		IssuerID:   revoked.ID,
+		IssuerType: revoked.IssuerType,
+		Reason:     reason,
+		RevokedAt:  revoked.RevokedAt,
+		Actor:      entry.Actor,
+	}
+	if replacement != nil {
+		incrementCounter(rotateIssuerCounter)
+		entry.Action = AuditIssuerRotate
+		entry.IssuerID = replacement.ID
+		entry.Details = fmt.Sprintf("replaces revoked %s", revoked.ID)
+		c.recordAudit(entry)
+		revocation.ReplacementID = replacement.ID
+	}
+	if c.RevocationWebhookURL != "" {
+		postWebhook("revocation", c.RevocationWebhookURL, revocation)
+	}
+	return revoked, replacement, nil
+}
+
+// fetchRevokedIssuers returns the revoked issuers of a type, which are only looked up
+// to explain why a redemption failed
+func (c *Server) fetchRevokedIssuers(issuerType string) ([]*Issuer, error) {
+	key := revokedIssuersCacheKey(issuerType)
+	if c.caches != nil {
+		if cached, found := c.caches["issuers"].Get(key); found {
+			return cached.([]*Issuer), nil
+		}
+	}
+
+	rows, err := c.queryReadOnly(`SELECT `+issuerColumns+` FROM issuers WHERE issuer_type = $1 AND revoked_at IS NOT NULL`, issuerType)
+	if err != nil {
+		return nil, err
+	}
+	issuers, err := c.scanIssuers(rows, c.queryReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.caches != nil {
+		c.caches["issuers"].SetDefault(key, issuers)
+	}
+	return issuers, nil
+}
+
+// revokedIssuerOf returns the revoked issuer that signed a token, whatever the
+// validity of its keys, or nil if none did
+func (c *Server) revokedIssuerOf(issuerType string, preimage *crypto.TokenPreimage, signature *crypto.VerificationSignature, payload string) *Issuer {
+	revoked, err := c.fetchRevokedIssuers(issuerType)
+	if err != nil {
+		lg.Errorf("Could not look up revoked issuers of %s: %s", issuerType, err)
+		return nil
+	}
+	for _, issuer := range revoked {
+		// Expired keys only make verification report ErrTokenOutsideValidity
+		if err := verifyIssuerRedemption(issuer, preimage, signature, payload, time.Now(), 0); err == nil || err == ErrTokenOutsideValidity {
+			return issuer
+		}
+	}
+	return nil
+}
+
+func revokedIssuerAppError(revoked *Issuer) *handlers.AppError {
+	revokedRedemptionCounter.With(prometheus.Labels{"issuer_type": revoked.IssuerType}).Inc()
+	return &handlers.AppError{
+		Message: "Token was signed by a revoked issuer",
+		Code:    http.StatusGone,
+		Data: map[string]interface{}{
+			"error_code": ErrorCodeIssuerRevoked,
+			"revoked_at": revoked.RevokedAt,
+		},
+	}
+}
+
+// verifyRedemptionAppError verifies a redemption against the issuers of a type, or the
+// error of looking them up. Tokens of revoked issuers are rejected with a 410 and
+// ErrorCodeIssuerRevoked, so that clients can tell them from invalid tokens.
+func (c *Server) verifyRedemptionAppError(issuerType string, issuers []*Issuer, lookupErr *handlers.AppError, preimage *crypto.TokenPreimage, signature *crypto.VerificationSignature, payload string) *handlers.AppError {
+	var err error
+	var older []*Issuer
+	if lookupErr == nil {
+		var candidates []*Issuer
+		candidates, older = c.redemptionIssuers(issuers)
+		if err = c.verifyRedemption(candidates, preimage, signature, payload); err == nil {
+			return nil
+		}
+	}
+	if lookupErr == nil || lookupErr.Code == http.StatusNotFound {
+		if revoked := c.revokedIssuerOf(c.resolveIssuerType(issuerType), preimage, signature, payload); revoked != nil {
+			return revokedIssuerAppError(revoked)
+		}
+	}
+	if lookupErr != nil {
+		return lookupErr
+	}
+	if len(older) > 0 {
+		return keyExpiredAppError()
+	}
+	return handlers.WrapError("Could not verify that token redemption is valid", err)
+}
+
+func (c *Server) issuerRevokeHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req IssuerRevokeRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	// Issuers of other tenants are not found rather than forbidden
+	issuer, err := c.fetchIssuerByID(chi.URLParam(r, "id"))
+	if err == nil && !inTenant(requestTenant(r), issuer.IssuerType) {
+		err = IssuerNotFoundError
+	}
+	var revoked, replacement *Issuer
+	if err == nil {
+		revoked, replacement, err = c.revokeIssuer(issuer.ID, req.Reason, req.Replace, newAuditEntry(r, AuditIssuerRevoke, nil))
+	}
+	switch {
+	case err == ErrRevocationReasonRequired:
+		return handlers.WrapError("Invalid revocation", err)
+	case errors.Is(err, IssuerNotFoundError):
+		return &handlers.AppError{
+			Message: "Issuer not found",
+			Code:    http.StatusNotFound,
+		}
+	case err != nil:
+		return storageAppError(err, "Could not revoke issuer")
+	}
+
+	return encodeResponse(w, newIssuerRevokeResponse(revoked, replacement, time.Now()))
+}
+
+func newIssuerRevokeResponse(revoked, replacement *Issuer, now time.Time) IssuerRevokeResponse {
+	resp := IssuerRevokeResponse{Revoked: newIssuerMetadataResponse(revoked, now)}
+	if replacement != nil {
+		replacementResp := newIssuerResponse(replacement, now)
+		resp.Replacement = &replacementResp
+	}
+	return resp
+}
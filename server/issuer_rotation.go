@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// issuerRotationWindow is how long before expiry an issuer is replaced unless it sets
+	// its own window, tokens signed by the replaced issuer remain redeemable until it expires
+	issuerRotationWindow   = 7 * 24 * time.Hour
+	issuerRotationInterval = time.Hour
+
+	rotateIssuerCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rotate_issuer_count",
+		Help: "Number of issuers replaced ahead of their expiry",
+	})
+)
+
+// rotationDue matches issuers expiring within their rotation window of $1, falling back
+// to $2 seconds, issuers with a validity period shorter than the window are rotated
+// halfway through instead
+const rotationDue = `expires_at < $1::timestamp + COALESCE(rotation_window_days * interval '1 day', $2::float8 * interval '1 second')
+	AND created_at + (expires_at - created_at) / 2 < $1`
+
+// rotateIssuers replaces every active issuer that expires within the rotation window.
+// When any issuer of a group is due, all active issuers of the group are replaced in
+// the same transaction so that the group is never left half rotated. Replacements
+// keep the settings of the issuer they replace and are valid for its ValidDays, or
+// the same validity period when it is unset. A pending issuer generated ahead of the
+// rotation becomes the replacement.
+func (c *Server) rotateIssuers(now time.Time) ([]*Issuer, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(
+		`SELECT `+issuerColumns+` FROM issuers WHERE rotated_at IS NULL AND canary_percent IS NULL AND (
+			(`+rotationDue+`) OR
+			group_id IN (SELECT group_id FROM issuers WHERE rotated_at IS NULL AND `+rotationDue+`))
+		ORDER BY issuer_type FOR UPDATE`, now.UTC(), issuerRotationWindow.Seconds())
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	rotating, err := c.scanIssuers(rows, tx.Query)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	replacements := make([]*Issuer, len(rotating))
+	for i, old := range rotating {
+		if _, err := tx.Exec(`UPDATE issuers SET rotated_at = NOW() WHERE id = $1`, old.ID); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		replacement := old.successor(now)
+
+		// Clients may already have fetched the key of a pre-generated replacement
+		pending, err := takePendingIssuer(tx, old.ID)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		if pending != nil && old.Version == IssuerVersion1 {
+			replacement.ID = pending.ID
+			replacement.SigningKey = pending.SigningKey
+			replacement.ExpiresAt = pending.ExpiresAt
+		}
+		if err := c.insertIssuer(tx, replacement); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		replacements[i] = replacement
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for i, replacement := range replacements {
+		c.forgetIssuers(replacement.IssuerType)
+		incrementCounter(rotateIssuerCounter)
+		c.recordAudit(AuditEntry{
+			Actor:      AuditActorSystem,
+			Action:     AuditIssuerRotate,
+			IssuerID:   replacement.ID,
+			IssuerType: replacement.IssuerType,
+			Details:    fmt.Sprintf("replaces %s", rotating[i].ID),
+		})
+	}
+	return replacements, nil
+}
+
+// successor returns a replacement for the issuer with the same settings, which is
+// valid for its ValidDays or the same validity period when it is unset
+func (issuer *Issuer) successor(now time.Time) *Issuer {
+	replacement := &Issuer{
+		IssuerType:     issuer.IssuerType,
+		MaxTokens:      issuer.MaxTokens,
+		Version:        issuer.Version,
+		BucketDuration: issuer.BucketDuration,
+		Buffer:         issuer.Buffer,
+		GroupID:        issuer.GroupID,
+
+		RotationWindowDays:      issuer.RotationWindowDays,
+		ValidDays:               issuer.ValidDays,
+		RedemptionRetentionDays: issuer.RedemptionRetentionDays,
+		RedemptionStore:         issuer.RedemptionStore,
+		PayloadPolicy:           issuer.PayloadPolicy,
+		Flags:                   issuer.Flags,
+	}
+	if !issuer.ExpiresAt.IsZero() {
+		replacement.ExpiresAt = issuer.successorExpiry(now)
+	}
+	return replacement
+}
+
+// setRotationPolicy changes the rotation window and validity of the active issuer of a
+// type, nil leaves a setting unchanged and zero restores the default. Replacements
+// inherit the policy, pending replacements are regenerated to match it.
+func (c *Server) setRotationPolicy(issuerType string, rotationWindowDays, validDays *int) error {
+	for _, days := range []*int{rotationWindowDays, validDays} {
+		if days != nil && *days < 0 {
+			return InvalidRotationError
+		}
+	}
+
+	result, err := c.db.Exec(
+		`UPDATE issuers SET
+			rotation_window_days = CASE WHEN $2 THEN NULLIF($3, 0) ELSE rotation_window_days END,
+			valid_days = CASE WHEN $4 THEN NULLIF($5, 0) ELSE valid_days END
+		WHERE issuer_type = $1 AND rotated_at IS NULL AND `+unexpiredIssuers,
+		issuerType, rotationWindowDays != nil, intOrZero(rotationWindowDays), validDays != nil, intOrZero(validDays))
+	if err != nil {
+		return err
+	}
+	c.forgetIssuers(issuerType)
+	if err := forgetPendingIssuers(c.db, issuerType); err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return IssuerNotFoundError
+	}
+	return nil
+}
+
+func intOrZero(v *int) int {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// retireIssuer immediately expires every unexpired issuer of a type. Retired issuers
+// stop signing and tokens they signed can no longer be redeemed.
+func (c *Server) retireIssuer(issuerType string) (int64, error) {
+	retired, err := c.fetchIssuers(issuerType)
+	if err != nil && !errors.Is(err, IssuerNotFoundError) {
+		return 0, err
+	}
+
+	result, err := c.db.Exec(
+		`UPDATE issuers SET rotated_at = COALESCE(rotated_at, NOW()), expires_at = NOW() - make_interval(secs => $2)
+		WHERE issuer_type = $1 AND `+unexpiredIssuersWithSkew, issuerType, c.ClockSkewSec)
+	if err != nil {
+		return 0, err
+	}
+	c.forgetIssuers(issuerType)
+	signingKeys.evict(issuerSigningKeys(retired)...)
+	if err := forgetPendingIssuers(c.db, issuerType); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// rotateIssuersPeriodically runs issuer rotation until the process exits. Instances
+// racing to rotate the same issuers are serialized by the row locks in rotateIssuers.
+func (c *Server) rotateIssuersPeriodically() {
+	for {
+		if _, err := c.rotateIssuers(time.Now()); err != nil {
+			lg.Errorf("Could not rotate issuers: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "rotate_issuers"})
+		}
+		if _, err := c.pregenerateIssuers(time.Now()); err != nil {
+			lg.Errorf("Could not pre-generate issuers: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "pregenerate_issuers"})
+		}
+		if err := c.pruneSigningKeys(); err != nil {
+			lg.Errorf("Could not drop signing keys of expired issuers: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "prune_signing_keys"})
+		}
+		time.Sleep(issuerRotationInterval)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+)
+
+// RedemptionCounts counts redemptions or attempts overall and over the last day and week
+type RedemptionCounts struct {
+	Total   int64 `json:"total"`
+	Last24h int64 `json:"last_24h"`
+	Last7d  int64 `json:"last_7d"`
+}
+
+// IssuerStatsResponse is served at /v1/issuer/{type}/stats
+type IssuerStatsResponse struct {
+	Name              string           `json:"name"`
+	Redemptions       RedemptionCounts `json:"redemptions"`
+	DuplicateAttempts RedemptionCounts `json:"duplicate_attempts"`
+}
+
+// fetchIssuerStats counts the redemptions and duplicate attempts of an issuer type.
+// Voided and archived redemptions are not counted.
+func (c *Server) fetchIssuerStats(issuerType string) (RedemptionCounts, RedemptionCounts, error) {
+	var redemptions, duplicates RedemptionCounts
+	err := c.db.QueryRow(
+		`SELECT COUNT(*),
+			COUNT(*) FILTER (WHERE ts > NOW() - interval '1 day'),
+			COUNT(*) FILTER (WHERE ts > NOW() - interval '7 days')
+		FROM redemptions WHERE `+issuerTypeNames("$1")+` AND voided_at IS NULL`,
+		issuerType).Scan(&redemptions.Total, &redemptions.Last24h, &redemptions.Last7d)
+	if err != nil {
+		return redemptions, duplicates, err
+	}
+	err = c.db.QueryRow(
+		`SELECT COALESCE(SUM(attempts), 0),
+			COALESCE(SUM(attempts) FILTER (WHERE hour > NOW() - interval '1 day'), 0),
+			COALESCE(SUM(attempts) FILTER (WHERE hour > NOW() - interval '7 days'), 0)
+		FROM redemption_duplicates WHERE issuer_type = $1`,
+		issuerType).Scan(&duplicates.Total, &duplicates.Last24h, &duplicates.Last7d)
+	return redemptions, duplicates, err
+}
+
+func (c *Server) issuerStatsHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	issuer, appErr := c.getIssuer(issuerTypeParam(r))
+	if appErr != nil {
+		return appErr
+	}
+
+	redemptions, duplicates, err := c.fetchIssuerStats(issuer.IssuerType)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not count redemptions",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	_, name := splitIssuerType(issuer.IssuerType)
+	return encodeResponse(w, IssuerStatsResponse{
+		Name:              name,
+		Redemptions:       redemptions,
+		DuplicateAttempts: duplicates,
+	})
+}
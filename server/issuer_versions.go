@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+)
+
+const (
+	// issuerVersionHeader lists the issuer versions a client can use the tokens of,
+	// comma separated. The version query parameter is used when it is missing.
+	issuerVersionHeader = "Accept-Issuer-Version"
+	// issuerVersionResponseHeader gives the version of the issuer that signed
+	issuerVersionResponseHeader = "Issuer-Version"
+)
+
+// acceptedIssuerVersions returns the issuer versions a request accepts, nil when it
+// accepts any
+func acceptedIssuerVersions(r *http.Request) ([]int, error) {
+	header := r.Header.Get(issuerVersionHeader)
+	if header == "" {
+		header = r.URL.Query().Get("version")
+	}
+	if header == "" {
+		return nil, nil
+	}
+
+	var versions []int
+	for _, value := range strings.Split(header, ",") {
+		version, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		if version != IssuerVersion1 && version != IssuerVersion3 {
+			return nil, UnsupportedVersionError
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// negotiateIssuerVersion rejects issuance requests that do not accept the version of
+// the active issuer with a 406, rather than signing tokens the client cannot use
+func negotiateIssuerVersion(w http.ResponseWriter, r *http.Request, issuer *Issuer) *handlers.AppError {
+	w.Header().Add("Vary", issuerVersionHeader)
+	w.Header().Set(issuerVersionResponseHeader, strconv.Itoa(issuer.Version))
+	versions, err := acceptedIssuerVersions(r)
+	if err != nil {
+		return handlers.WrapError("Invalid "+issuerVersionHeader, err)
+	}
+	if versions == nil {
+		return nil
+	}
+
+	for _, version := range versions {
+		if version == issuer.Version {
+			return nil
+		}
+	}
+	return &handlers.AppError{
+		Message: "Issuer does not sign tokens of the requested version",
+		Code:    http.StatusNotAcceptable,
+		Data: map[string]interface{}{
+			"requested": versions,
+			"available": []int{issuer.Version},
+		},
+	}
+}
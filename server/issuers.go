@@ -1,12 +1,13 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/brave-intl/bat-go/middleware"
-	"github.com/brave-intl/bat-go/utils/closers"
 	"github.com/brave-intl/bat-go/utils/handlers"
 	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
 	"github.com/go-chi/chi"
@@ -14,19 +15,196 @@ import (
 )
 
 type IssuerResponse struct {
-	Name      string            `json:"name"`
+	Name      string              `json:"name"`
+	Tenant    string              `json:"tenant,omitempty"`
+	PublicKey *crypto.PublicKey   `json:"public_key"`
+	Version   int                 `json:"version,omitempty"`
+	Keys      []IssuerKeyResponse `json:"keys,omitempty"`
+	ExpiresAt *time.Time          `json:"expires_at,omitempty"`
+	// MaxTokens is the most tokens signed per issuance request
+	MaxTokens int `json:"max_tokens,omitempty"`
+
+	RotationWindowDays      int      `json:"rotation_window_days,omitempty"`
+	ValidDays               int      `json:"valid_days,omitempty"`
+	RedemptionRetentionDays int      `json:"redemption_retention_days,omitempty"`
+	RedemptionStore         string   `json:"redemption_store,omitempty"`
+	PayloadPolicy           []string `json:"payload_policy,omitempty"`
+	// Flags holds the issuer flags set for the type
+	Flags map[string]bool `json:"flags,omitempty"`
+	// CanaryPercent is set for canary issuers, see IssuerCanaryRequest
+	CanaryPercent int `json:"canary_percent,omitempty"`
+
+	// Upcoming lists the keys of pending replacements in order of activation
+	Upcoming []UpcomingKeyResponse `json:"upcoming,omitempty"`
+}
+
+// IssuerMetadataResponse describes an issuer looked up by ID, which may have been
+// rotated or have expired
+type IssuerMetadataResponse struct {
+	ID string `json:"id"`
+	IssuerResponse
+	CreatedAt time.Time  `json:"created_at"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Status is active, rotated once a replacement signs in its place, expired,
+	// revoked once its keys were compromised, or canary
+	Status string `json:"status"`
+}
+
+type UpcomingKeyResponse struct {
+	PublicKey   *crypto.PublicKey `json:"public_key"`
+	ActivatesAt time.Time         `json:"activates_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+}
+
+type IssuerKeyResponse struct {
 	PublicKey *crypto.PublicKey `json:"public_key"`
+	ValidFrom time.Time         `json:"valid_from"`
+	ValidTo   time.Time         `json:"valid_to"`
 }
 
 type IssuerCreateRequest struct {
-	Name      string `json:"name"`
-	MaxTokens int    `json:"max_tokens"`
+	Name          string     `json:"name"`
+	MaxTokens     int        `json:"max_tokens"`
+	Version       int        `json:"version"`
+	BucketSeconds int64      `json:"bucket_seconds"`
+	Buffer        int        `json:"buffer"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	// RotationWindowDays and ValidDays override the global rotation policy, an issuer
+	// with ValidDays and no ExpiresAt expires ValidDays after creation
+	RotationWindowDays int `json:"rotation_window_days"`
+	ValidDays          int `json:"valid_days"`
+	// RedemptionRetentionDays keeps redemptions of the type in the database for that
+	// many days before archival, instead of ArchiveAfterDays
+	RedemptionRetentionDays int `json:"redemption_retention_days"`
+	// RedemptionStore is postgres, the default, or redis to record redemptions of the
+	// type in Redis only
+	RedemptionStore string `json:"redemption_store"`
+	// PayloadPolicy lists the transformers redemption payloads of the type go through
+	// before they are persisted, such as ["strip:email", "truncate:256"]
+	PayloadPolicy []string `json:"payload_policy"`
+	// Flags sets issuer flags such as {"async_only": true}, see IssuerFlagsRequest
+	Flags map[string]bool `json:"flags"`
+	// Profile fills the settings left unset from a configured IssuerProfile
+	Profile string `json:"profile"`
 }
 
-func (c *Server) getIssuer(issuerType string) (*Issuer, *handlers.AppError) {
-	issuer, err := c.fetchIssuer(issuerType)
+// IssuerPolicyRequest changes the rotation and payload policies of an issuer, omitted
+// fields are left unchanged and zero restores the default
+type IssuerPolicyRequest struct {
+	RotationWindowDays *int      `json:"rotation_window_days"`
+	ValidDays          *int      `json:"valid_days"`
+	PayloadPolicy      *[]string `json:"payload_policy"`
+}
+
+// IssuerGroupCreateRequest creates a set of issuers together, ExpiresAt applies
+// to any issuer in the group that does not set its own
+type IssuerGroupCreateRequest struct {
+	Name      string                `json:"name"`
+	ExpiresAt *time.Time            `json:"expires_at"`
+	Issuers   []IssuerCreateRequest `json:"issuers"`
+}
+
+type IssuerGroupResponse struct {
+	Name      string           `json:"name"`
+	CreatedAt time.Time        `json:"created_at"`
+	Issuers   []IssuerResponse `json:"issuers"`
+}
+
+func (req IssuerCreateRequest) issuer() *Issuer {
+	issuer := &Issuer{
+		IssuerType:     req.Name,
+		MaxTokens:      req.MaxTokens,
+		Version:        req.Version,
+		BucketDuration: time.Duration(req.BucketSeconds) * time.Second,
+		Buffer:         req.Buffer,
+
+		RotationWindowDays:      req.RotationWindowDays,
+		ValidDays:               req.ValidDays,
+		RedemptionRetentionDays: req.RedemptionRetentionDays,
+		RedemptionStore:         req.RedemptionStore,
+		PayloadPolicy:           req.PayloadPolicy,
+		Flags:                   req.Flags,
+	}
+	if issuer.Buffer == 0 {
+		issuer.Buffer = 1
+	}
+	if req.ExpiresAt != nil {
+		issuer.ExpiresAt = *req.ExpiresAt
+	}
+	return issuer
+}
+
+// createIssuerError maps errors from issuer creation to responses
+func createIssuerError(err error) *handlers.AppError {
+	switch {
+	case err == UnsupportedVersionError, err == InvalidBucketError, err == InvalidExpiryError, err == InvalidRotationError, err == InvalidMaxTokensError,
+		err == InvalidIssuerNameError, err == EmptyIssuerGroupError, err == UnknownIssuerProfileError,
+		err == ErrInvalidRedemptionStore, err == ErrRedisRedemptionExpiry, err == ErrRedisDisabled, err == ErrInvalidPayloadPolicy, err == ErrUnknownIssuerFlag:
+		return handlers.WrapError("Invalid issuer", err)
+	case errors.Is(err, ErrDuplicate):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	}
+	return &handlers.AppError{
+		Error:   err,
+		Message: "Could not create new issuer",
+		Code:    500,
+	}
+}
+
+// newIssuerResponse describes the issuer's public keys. For version 3 issuers the
+// top level public key is the one for the bucket containing now.
+func newIssuerResponse(issuer *Issuer, now time.Time) IssuerResponse {
+	tenant, name := splitIssuerType(issuer.IssuerType)
+	resp := IssuerResponse{
+		Name:      name,
+		Tenant:    tenant,
+		Version:   issuer.Version,
+		MaxTokens: issuer.MaxTokens,
+
+		RotationWindowDays:      issuer.RotationWindowDays,
+		ValidDays:               issuer.ValidDays,
+		RedemptionRetentionDays: issuer.RedemptionRetentionDays,
+		RedemptionStore:         issuer.RedemptionStore,
+		PayloadPolicy:           issuer.PayloadPolicy,
+		Flags:                   issuer.Flags,
+		CanaryPercent:           issuer.CanaryPercent,
+	}
+	if !issuer.ExpiresAt.IsZero() {
+		expiresAt := issuer.ExpiresAt
+		resp.ExpiresAt = &expiresAt
+	}
+	if issuer.SigningKey != nil {
+		resp.PublicKey = issuer.SigningKey.PublicKey()
+	}
+	for i := range issuer.Keys {
+		key := &issuer.Keys[i]
+		resp.Keys = append(resp.Keys, IssuerKeyResponse{
+			PublicKey: key.SigningKey.PublicKey(),
+			ValidFrom: key.StartAt,
+			ValidTo:   key.EndAt,
+		})
+		if issuer.keyAt(now) == key {
+			resp.PublicKey = resp.Keys[i].PublicKey
+		}
+	}
+	return resp
+}
+
+// getIssuers returns every issuer of a type that can verify redemptions, the active
+// issuer that signs new tokens first
+func (c *Server) getIssuers(issuerType string) ([]*Issuer, *handlers.AppError) {
+	issuers, err := c.fetchIssuers(issuerType)
+	if errors.Is(err, IssuerNotFoundError) {
+		if renamed, renamedErr := c.fetchRenamedIssuers(issuerType); renamedErr != IssuerAliasNotFoundError {
+			issuers, err = renamed, renamedErr
+		}
+	}
 	if err != nil {
-		if err == IssuerNotFoundError {
+		if errors.Is(err, IssuerNotFoundError) {
 			return nil, &handlers.AppError{
 				Message: "Issuer not found",
 				Code:    404,
@@ -38,55 +216,333 @@ func (c *Server) getIssuer(issuerType string) (*Issuer, *handlers.AppError) {
 			Code:    500,
 		}
 	}
-	return issuer, nil
+
+	// Another instance may have created the key for the current bucket since this issuer was cached
+	if issuer := issuers[0]; issuer.Version == IssuerVersion3 && issuer.keyAt(time.Now()) == nil {
+		issuer, err = c.reloadIssuerKeys(issuer)
+		if err != nil {
+			return nil, &handlers.AppError{
+				Error:   err,
+				Message: "Error finding issuer keys",
+				Code:    500,
+			}
+		}
+		issuers = append([]*Issuer{issuer}, issuers[1:]...)
+	}
+	return issuers, nil
 }
 
-func (c *Server) issuerHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
-	defer closers.Panic(r.Body)
+func (c *Server) getIssuer(issuerType string) (*Issuer, *handlers.AppError) {
+	issuers, appErr := c.getIssuers(issuerType)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return issuers[0], nil
+}
 
-	if issuerType := chi.URLParam(r, "type"); issuerType != "" {
+func (c *Server) issuerHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	if issuerType := issuerTypeParam(r); issuerType != "" {
 		issuer, appErr := c.getIssuer(issuerType)
 		if appErr != nil {
 			return appErr
 		}
 
-		err := json.NewEncoder(w).Encode(IssuerResponse{issuer.IssuerType, issuer.SigningKey.PublicKey()})
-		if err != nil {
-			panic(err)
-		}
-		return nil
+		return encodeConditionalResponse(w, r, newIssuerResponse(issuer, time.Now()))
 	}
 	return nil
 }
 
+func (c *Server) issuerByIDHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	issuer, err := c.fetchIssuerByID(chi.URLParam(r, "id"))
+	// Issuers of other tenants are not found rather than forbidden
+	if errors.Is(err, IssuerNotFoundError) || (err == nil && !inTenant(requestTenant(r), issuer.IssuerType)) {
+		return &handlers.AppError{
+			Message: "Issuer not found",
+			Code:    404,
+		}
+	}
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Error finding issuer",
+			Code:    500,
+		}
+	}
+
+	return encodeConditionalResponse(w, r, newIssuerMetadataResponse(issuer, time.Now()))
+}
+
+func newIssuerMetadataResponse(issuer *Issuer, now time.Time) IssuerMetadataResponse {
+	resp := IssuerMetadataResponse{
+		ID:             issuer.ID,
+		IssuerResponse: newIssuerResponse(issuer, now),
+		CreatedAt:      issuer.CreatedAt,
+		Status:         issuerStatus(issuer, now),
+	}
+	if !issuer.RotatedAt.IsZero() {
+		rotatedAt := issuer.RotatedAt
+		resp.RotatedAt = &rotatedAt
+	}
+	if !issuer.RevokedAt.IsZero() {
+		revokedAt := issuer.RevokedAt
+		resp.RevokedAt = &revokedAt
+	}
+	return resp
+}
+
+// issuerDirectoryHandler lists the active issuer of every type along with the keys
+// that will replace it, so clients can fetch them before rotation. Query parameters
+// filter and sort the list as described by parseIssuerFilter.
+func (c *Server) issuerDirectoryHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	resp, appErr := c.issuerDirectory(r, time.Now())
+	if appErr != nil {
+		return appErr
+	}
+	return encodeConditionalResponse(w, r, resp)
+}
+
+// issuerDirectory lists the issuers of the directory visible to a request
+func (c *Server) issuerDirectory(r *http.Request, now time.Time) ([]IssuerResponse, *handlers.AppError) {
+	filter, err := parseIssuerFilter(r.URL.Query())
+	if err != nil {
+		return nil, handlers.WrapError("Invalid issuer filter", err)
+	}
+	issuers, err := c.fetchAllIssuers(filter.includesExpired())
+	if err != nil {
+		return nil, &handlers.AppError{
+			Error:   err,
+			Message: "Error finding issuers",
+			Code:    500,
+		}
+	}
+	pending, err := c.fetchPendingIssuers()
+	if err != nil {
+		return nil, &handlers.AppError{
+			Error:   err,
+			Message: "Error finding pending issuers",
+			Code:    500,
+		}
+	}
+
+	upcoming := map[string][]UpcomingKeyResponse{}
+	for _, p := range pending {
+		upcoming[p.IssuerType] = append(upcoming[p.IssuerType], UpcomingKeyResponse{
+			PublicKey:   p.SigningKey.PublicKey(),
+			ActivatesAt: p.ActivatesAt,
+			ExpiresAt:   p.ExpiresAt,
+		})
+	}
+
+	tenant := requestTenant(r)
+	filter.sortIssuers(issuers)
+	resp := []IssuerResponse{}
+	for _, issuer := range issuers {
+		if !filter.matches(issuer, now) || !inTenant(tenant, issuer.IssuerType) {
+			continue
+		}
+		issuerResp := newIssuerResponse(issuer, now)
+		if issuerStatus(issuer, now) == IssuerStatusActive {
+			issuerResp.Upcoming = upcoming[issuer.IssuerType]
+		}
+		resp = append(resp, issuerResp)
+	}
+	return resp, nil
+}
+
 func (c *Server) issuerCreateHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
 	log := lg.Log(r.Context())
 
-	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
 	var req IssuerCreateRequest
-	if err := decoder.Decode(&req); err != nil {
-		return handlers.WrapError("Could not parse the request body", err)
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	if err := validIssuerName(req.Name); err != nil {
+		return createIssuerError(err)
+	}
+	req.Name = scopedIssuerType(r, req.Name)
+	req, err := c.applyIssuerProfile(req)
+	if err != nil {
+		return createIssuerError(err)
+	}
+
+	issuer := req.issuer()
+	if err := c.createIssuer(issuer); err != nil {
+		appErr := createIssuerError(err)
+		if appErr.Code == 500 {
+			log.Errorf("%s", err)
+		}
+		return appErr
+	}
+
+	entry := newAuditEntry(r, AuditIssuerCreate, issuer)
+	if req.Profile != "" {
+		entry.Details = "profile " + req.Profile
 	}
+	c.recordAudit(entry)
 
-	if err := c.createIssuer(req.Name, req.MaxTokens); err != nil {
-		log.Errorf("%s", err)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (c *Server) issuerPolicyHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req IssuerPolicyRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	issuerType := c.resolveIssuerType(issuerTypeParam(r))
+	err := c.setRotationPolicy(issuerType, req.RotationWindowDays, req.ValidDays)
+	if err == nil && req.PayloadPolicy != nil {
+		err = c.setPayloadPolicy(issuerType, *req.PayloadPolicy)
+	}
+	if err != nil {
+		switch {
+		case err == InvalidRotationError:
+			return handlers.WrapError("Invalid rotation policy", err)
+		case err == ErrInvalidPayloadPolicy:
+			return handlers.WrapError("Invalid payload policy", err)
+		case errors.Is(err, IssuerNotFoundError):
+			return &handlers.AppError{
+				Message: "Issuer not found",
+				Code:    404,
+			}
+		}
 		return &handlers.AppError{
 			Error:   err,
-			Message: "Could not create new issuer",
+			Message: "Could not update issuer",
 			Code:    500,
 		}
 	}
 
+	issuer, appErr := c.getIssuer(issuerType)
+	if appErr != nil {
+		return appErr
+	}
+
+	entry := newAuditEntry(r, AuditIssuerPolicy, issuer)
+	entry.Details = fmt.Sprintf("rotation_window_days=%d valid_days=%d payload_policy=%q", issuer.RotationWindowDays, issuer.ValidDays, issuer.PayloadPolicy)
+	c.recordAudit(entry)
+
+	return encodeResponse(w, newIssuerResponse(issuer, time.Now()))
+}
+
+func (c *Server) issuerGroupCreateHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	log := lg.Log(r.Context())
+
+	var req IssuerGroupCreateRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+
+	if err := validIssuerName(req.Name); err != nil {
+		return createIssuerError(err)
+	}
+	group := IssuerGroup{Name: scopedIssuerType(r, req.Name)}
+	for _, issuerReq := range req.Issuers {
+		if err := validIssuerName(issuerReq.Name); err != nil {
+			return createIssuerError(err)
+		}
+		issuerReq.Name = scopedIssuerType(r, issuerReq.Name)
+		if issuerReq.ExpiresAt == nil {
+			issuerReq.ExpiresAt = req.ExpiresAt
+		}
+		issuerReq, err := c.applyIssuerProfile(issuerReq)
+		if err != nil {
+			return createIssuerError(err)
+		}
+		group.Issuers = append(group.Issuers, issuerReq.issuer())
+	}
+	if err := c.createIssuerGroup(&group); err != nil {
+		appErr := createIssuerError(err)
+		if appErr.Code == 500 {
+			log.Errorf("%s", err)
+		}
+		return appErr
+	}
+
+	for _, issuer := range group.Issuers {
+		entry := newAuditEntry(r, AuditIssuerCreate, issuer)
+		entry.Details = "group " + group.Name
+		c.recordAudit(entry)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
-func (c *Server) issuerRouter() chi.Router {
+func (c *Server) issuerGroupHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	group, err := c.fetchIssuerGroup(scopedIssuerType(r, chi.URLParam(r, "name")))
+	if err != nil {
+		if errors.Is(err, IssuerGroupNotFoundError) {
+			return &handlers.AppError{
+				Message: "Issuer group not found",
+				Code:    404,
+			}
+		}
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Error finding issuer group",
+			Code:    500,
+		}
+	}
+
+	now := time.Now()
+	_, name := splitIssuerType(group.Name)
+	resp := IssuerGroupResponse{
+		Name:      name,
+		CreatedAt: group.CreatedAt,
+		Issuers:   make([]IssuerResponse, len(group.Issuers)),
+	}
+	for i, issuer := range group.Issuers {
+		resp.Issuers[i] = newIssuerResponse(issuer, now)
+	}
+	return encodeConditionalResponse(w, r, resp)
+}
+
+// issuerRouter serves the issuer directory, and creating and updating issuers when
+// writes is set
+func (c *Server) issuerRouter(writes bool) chi.Router {
 	r := chi.NewRouter()
+	r.Use(c.corsHandler)
+	r.Use(c.requireReady)
 	if os.Getenv("ENV") == "production" {
-		r.Use(middleware.SimpleTokenAuthorizedOnly)
+		r.Use(authorized)
+	}
+	read := r.With(requireScope(ScopeIssuersRead))
+	read.Method("GET", "/", middleware.InstrumentHandler("GetIssuerDirectory", c.appHandler(c.issuerDirectoryHandler)))
+	read.Method("GET", "/attestation", middleware.InstrumentHandler("GetIssuerAttestation", c.appHandler(c.issuerAttestationHandler)))
+	read.Method("GET", "/{type}", middleware.InstrumentHandler("GetIssuer", c.appHandler(c.issuerHandler)))
+	read.Method("GET", "/{type}/freeze", middleware.InstrumentHandler("GetIssuerFreeze", c.appHandler(c.issuerFreezeStatusHandler)))
+	read.Method("GET", "/{type}/flags", middleware.InstrumentHandler("GetIssuerFlags", c.appHandler(c.issuerFlagsHandler)))
+	read.Method("GET", "/{type}/stats", middleware.InstrumentHandler("GetIssuerStats", c.appHandler(c.issuerStatsHandler)))
+	read.Method("GET", "/{type}/canary", middleware.InstrumentHandler("GetIssuerCanary", c.appHandler(c.issuerCanaryHandler)))
+	if c.keyHistoryLimiter == nil {
+		c.keyHistoryLimiter = newRateLimiter(c.keyHistoryRatePerMinute())
+	}
+	read.With(rateLimit(c.keyHistoryLimiter)).Method("GET", "/{type}/keys", middleware.InstrumentHandler("GetIssuerKeyHistory", c.appHandler(c.issuerKeyHistoryHandler)))
+	read.Method("GET", "/group/{name}", middleware.InstrumentHandler("GetIssuerGroup", c.appHandler(c.issuerGroupHandler)))
+	read.Method("GET", "/id/{id}", middleware.InstrumentHandler("GetIssuerByID", c.appHandler(c.issuerByIDHandler)))
+	read.Method("GET", "/ceremony/{id}", middleware.InstrumentHandler("GetKeyCeremony", c.appHandler(c.keyCeremonyHandler)))
+	if !writes {
+		return r
 	}
-	r.Method("GET", "/{type}", middleware.InstrumentHandler("GetIssuer", handlers.AppHandler(c.issuerHandler)))
-	r.Method("POST", "/", middleware.InstrumentHandler("CreateIssuer", handlers.AppHandler(c.issuerCreateHandler)))
+	write := r.With(requireScope(ScopeIssuersWrite), c.requireSignature)
+	write.Method("PATCH", "/{type}", middleware.InstrumentHandler("UpdateIssuerPolicy", c.appHandler(c.issuerPolicyHandler)))
+	write.Method("POST", "/", middleware.InstrumentHandler("CreateIssuer", c.appHandler(c.issuerCreateHandler)))
+	write.Method("POST", "/group", middleware.InstrumentHandler("CreateIssuerGroup", c.appHandler(c.issuerGroupCreateHandler)))
+	// Ceremonies tell contributors apart by their request signing key, so they are
+	// never served unsigned
+	ceremony := r.With(requireScope(ScopeIssuersWrite), c.requireSigned)
+	ceremony.Method("POST", "/ceremony", middleware.InstrumentHandler("CreateKeyCeremony", c.appHandler(c.keyCeremonyCreateHandler)))
+	ceremony.Method("POST", "/ceremony/{id}/share", middleware.InstrumentHandler("ContributeKeyCeremonyShare", c.appHandler(c.keyCeremonyShareHandler)))
+	write.Method("POST", "/{type}/freeze", middleware.InstrumentHandler("FreezeIssuer", c.appHandler(c.issuerFreezeHandler)))
+	write.Method("DELETE", "/{type}/freeze", middleware.InstrumentHandler("UnfreezeIssuer", c.appHandler(c.issuerUnfreezeHandler)))
+	write.Method("PATCH", "/{type}/flags", middleware.InstrumentHandler("UpdateIssuerFlags", c.appHandler(c.issuerFlagsUpdateHandler)))
+	write.Method("POST", "/{type}/canary", middleware.InstrumentHandler("CreateIssuerCanary", c.appHandler(c.issuerCanaryCreateHandler)))
+	write.Method("PATCH", "/{type}/canary", middleware.InstrumentHandler("UpdateIssuerCanary", c.appHandler(c.issuerCanaryUpdateHandler)))
+	write.Method("DELETE", "/{type}/canary", middleware.InstrumentHandler("AbortIssuerCanary", c.appHandler(c.issuerCanaryAbortHandler)))
+	write.Method("POST", "/{type}/canary/promote", middleware.InstrumentHandler("PromoteIssuerCanary", c.appHandler(c.issuerCanaryPromoteHandler)))
+	write.Method("POST", "/id/{id}/revoke", middleware.InstrumentHandler("RevokeIssuer", c.appHandler(c.issuerRevokeHandler)))
 	return r
 }
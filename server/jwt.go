@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Scopes JWT callers need for each route, callers using API keys or the shared token
+// list can use every route
+const (
+	ScopeTokensIssue  = "tokens:issue"
+	ScopeTokensRedeem = "tokens:redeem"
+	ScopeTokensRead   = "tokens:read"
+	ScopeTokensRecord = "tokens:record"
+	ScopeIssuersRead  = "issuers:read"
+	ScopeIssuersWrite = "issuers:write"
+	ScopeBundleRead   = "bundle:read"
+)
+
+const (
+	defaultJWKSRefresh = time.Hour
+	// jwksMinRefresh limits how often an unknown key id triggers a JWKS fetch
+	jwksMinRefresh = time.Minute
+	jwtLeeway      = time.Minute
+)
+
+var (
+	ErrJWTAlgorithm = errors.New("JWT must be signed with RS256 or EdDSA")
+	ErrJWTKeyID     = errors.New("JWT is signed by an unknown key")
+	ErrJWTExpiry    = errors.New("JWT must have an expiry")
+
+	jwtFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "jwt_auth_failure_count",
+		Help: "Number of requests with a JWT that could not be verified",
+	})
+)
+
+// JWTConfig accepts JWTs from a central identity provider as an alternative to bearer
+// tokens, verified against the keys published at JWKSURL
+type JWTConfig struct {
+	JWKSURL  string `json:"jwks_url,omitempty"`
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+	// RefreshSec is how often the JWKS is fetched, keys with an unknown key id
+	// also trigger a fetch so rotated keys are picked up immediately
+	RefreshSec int `json:"refresh_sec,omitempty"`
+}
+
+// JWTClaims are the claims used to authorize a caller
+type JWTClaims struct {
+	jwt.Claims
+	// Scope is the space separated list of granted scopes
+	Scope string `json:"scope,omitempty"`
+	// Tenant namespaces the caller's issuers the same way tenant tokens do
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func (claims *JWTClaims) hasScope(scope string) bool {
+	for _, granted := range strings.Fields(claims.Scope) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type jwtClaimsKey struct{}
+
+// jwks caches the key set, it is shared by pointer since servers are copied by value
+type jwks struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+// initJWT prepares the JWKS cache if JWT authentication is configured
+func (c *Server) initJWT() {
+	if c.JWT.JWKSURL == "" {
+		c.jwks = nil
+		return
+	}
+	refresh := time.Duration(c.JWT.RefreshSec) * time.Second
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	c.jwks = &jwks{
+		url:     c.JWT.JWKSURL,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (k *jwks) fetch() error {
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS request failed with status %d", resp.StatusCode)
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return err
+	}
+	k.keys = keys
+	k.fetchedAt = time.Now()
+	return nil
+}
+
+// key returns the key with the key id, fetching the JWKS when it is stale or does not
+// have the key yet
+func (k *jwks) key(kid string) (*jose.JSONWebKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	age := time.Since(k.fetchedAt)
+	found := k.keys.Key(kid)
+	if age > k.refresh || (len(found) == 0 && age > jwksMinRefresh) {
+		if err := k.fetch(); err != nil {
+			// Keep using the cached keys while the identity provider is unavailable
+			lg.Errorf("Could not fetch JWKS: %s", err)
+		} else {
+			found = k.keys.Key(kid)
+		}
+	}
+	if len(found) == 0 {
+		return nil, ErrJWTKeyID
+	}
+	return &found[0], nil
+}
+
+// verifyJWT checks the signature, issuer, audience and lifetime of a JWT
+func (c *Server) verifyJWT(raw string) (*JWTClaims, error) {
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.Headers) != 1 {
+		return nil, ErrJWTAlgorithm
+	}
+	header := token.Headers[0]
+	alg := jose.SignatureAlgorithm(header.Algorithm)
+	if alg != jose.RS256 && alg != jose.EdDSA {
+		return nil, ErrJWTAlgorithm
+	}
+
+	key, err := c.jwks.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != "" && key.Algorithm != string(alg) {
+		return nil, ErrJWTAlgorithm
+	}
+
+	var claims JWTClaims
+	if err := token.Claims(key.Key, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, ErrJWTExpiry
+	}
+	expected := jwt.Expected{Issuer: c.JWT.Issuer, Time: time.Now()}
+	if c.JWT.Audience != "" {
+		expected.Audience = jwt.Audience{c.JWT.Audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// resolveJWT adds the claims of a valid JWT bearer token to the request context, along
+// with the tenant claim. Invalid JWTs are left for the authorization middleware to reject.
+func (c *Server) resolveJWT(next http.Handler) http.Handler {
+	if c.jwks == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer := r.Header.Get("Authorization")
+		// Only tokens in the three part JWT format are verified, other tokens skip the JWKS
+		if len(bearer) > 7 && strings.ToUpper(bearer[0:6]) == "BEARER" && strings.Count(bearer[7:], ".") == 2 {
+			claims, err := c.verifyJWT(bearer[7:])
+			if err == nil {
+				ctx := context.WithValue(r.Context(), jwtClaimsKey{}, claims)
+				if claims.Tenant != "" {
+					ctx = context.WithValue(ctx, tenantKey{}, claims.Tenant)
+				}
+				r = r.WithContext(ctx)
+			} else {
+				incrementCounter(jwtFailureCounter)
+				lg.Warnf("Rejected JWT: %s", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestClaims(r *http.Request) *JWTClaims {
+	claims, _ := r.Context().Value(jwtClaimsKey{}).(*JWTClaims)
+	return claims
+}
+
+// requireScope rejects JWT callers without the scope, other callers are authorized by
+// the router
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if claims := requestClaims(r); claims != nil && !claims.hasScope(scope) {
+				handlers.AppError{
+					Message: "Missing scope " + scope,
+					Code:    http.StatusForbidden,
+				}.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
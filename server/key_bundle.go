@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/brave-intl/challenge-bypass-server/btd"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultKeyBundleValiditySec        = 24 * 60 * 60
+	defaultKeyBundlePublishIntervalSec = 5 * 60
+	defaultKeyBundleS3Key              = "keys.json"
+)
+
+var (
+	ErrKeyBundleNotConfigured = errors.New("key bundles require a key bundle public key and an attestation key")
+
+	keyBundlePublishFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "key_bundle_publish_failure_count",
+		Help: "Number of key bundles that could not be published",
+	})
+)
+
+// KeyBundleConfig configures the signed bundles of issuer signing keys that edge
+// services verify redemptions with offline, only calling the server to record them
+type KeyBundleConfig struct {
+	// PublicKeyPath is the PEM encoded RSA public key of the edge services, signing keys
+	// are encrypted under it. Key bundles are disabled when empty.
+	PublicKeyPath string `json:"public_key_path,omitempty"`
+	// ValiditySec is how long edge services accept a bundle, 86400 by default
+	ValiditySec int `json:"validity_sec,omitempty"`
+	// S3Bucket enables uploading a bundle to S3Key every PublishIntervalSec, for a CDN
+	// to serve
+	S3Bucket           string `json:"s3_bucket,omitempty"`
+	S3Key              string `json:"s3_key,omitempty"`
+	PublishIntervalSec int    `json:"publish_interval_sec,omitempty"`
+}
+
+// initKeyBundle loads the public key of the edge services, it does nothing unless a
+// path is configured
+func (c *Server) initKeyBundle() error {
+	if c.KeyBundle.PublicKeyPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.KeyBundle.PublicKeyPath)
+	if err != nil {
+		return err
+	}
+	key, err := parseBackupPublicKey(data)
+	if err != nil {
+		return err
+	}
+	c.keyBundleRecipient = key
+	return nil
+}
+
+// buildKeyBundle signs a bundle of the signing keys of every unexpired issuer of the
+// issuer types matched by include. Tokens of rotated issuers stay redeemable until
+// they expire, so their keys are included alongside those of the active issuers.
+func (c *Server) buildKeyBundle(include func(issuerType string) bool, now time.Time) (*btd.SignedKeyBundle, error) {
+	if c.keyBundleRecipient == nil || c.attestationKey == nil {
+		return nil, ErrKeyBundleNotConfigured
+	}
+	if err := c.ensureDb(); err != nil {
+		return nil, err
+	}
+
+	issuers, err := c.fetchAllIssuers(false)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string][]btd.BundledKey{}
+	for _, issuer := range issuers {
+		if !include(issuer.IssuerType) {
+			continue
+		}
+		if issuer.Version != IssuerVersion3 {
+			keys[issuer.IssuerType] = append(keys[issuer.IssuerType], btd.BundledKey{ID: issuer.ID, Key: btd.Key{SigningKey: issuer.SigningKey}})
+			continue
+		}
+		for _, key := range issuer.Keys {
+			keys[issuer.IssuerType] = append(keys[issuer.IssuerType], btd.BundledKey{
+				ID:  key.ID,
+				Key: btd.Key{SigningKey: key.SigningKey, StartAt: key.StartAt, EndAt: key.EndAt},
+			})
+		}
+	}
+
+	bundle, err := btd.SealKeyBundle(keys, c.keyBundleRecipient)
+	if err != nil {
+		return nil, err
+	}
+	validity := c.KeyBundle.ValiditySec
+	if validity == 0 {
+		validity = defaultKeyBundleValiditySec
+	}
+	bundle.GeneratedAt = now.UTC()
+	bundle.ExpiresAt = bundle.GeneratedAt.Add(time.Duration(validity) * time.Second)
+	// Instances share a clock closely enough for the time to order bundles
+	bundle.Version = bundle.GeneratedAt.UnixNano() / int64(time.Millisecond)
+
+	encoded, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	return &btd.SignedKeyBundle{
+		Algorithm: attestationAlgorithm,
+		KeyID:     attestationKeyID(c.attestationKey.Public().(ed25519.PublicKey)),
+		Bundle:    encoded,
+		Signature: ed25519.Sign(c.attestationKey, encoded),
+	}, nil
+}
+
+func (c *Server) keyBundleHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	tenant := requestTenant(r)
+	signed, err := c.buildKeyBundle(func(issuerType string) bool {
+		return inTenant(tenant, issuerType)
+	}, time.Now())
+	if err == ErrKeyBundleNotConfigured {
+		return &handlers.AppError{
+			Message: "Key bundles are not configured",
+			Code:    http.StatusNotFound,
+		}
+	}
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not build key bundle",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	c.recordAudit(newAuditEntry(r, AuditKeyBundleExport, nil))
+
+	return encodeResponse(w, signed)
+}
+
+// publishKeyBundle uploads a key bundle of every tenant to S3, replacing the last one
+func (c *Server) publishKeyBundle(now time.Time) error {
+	signed, err := c.buildKeyBundle(func(string) bool { return true }, now)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+
+	sess, err := c.getAWSSession()
+	if err != nil {
+		return err
+	}
+	key := c.KeyBundle.S3Key
+	if key == "" {
+		key = defaultKeyBundleS3Key
+	}
+	_, err = s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(c.KeyBundle.S3Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		// Caches revalidate so that edge services pick up rotated keys promptly
+		CacheControl: aws.String("no-cache"),
+	})
+	return err
+}
+
+// publishKeyBundlesPeriodically publishes key bundles until the process exits. Every
+// instance publishes, the last upload wins and edge services skip older versions.
+func (c *Server) publishKeyBundlesPeriodically() {
+	interval := time.Duration(c.KeyBundle.PublishIntervalSec) * time.Second
+	if interval == 0 {
+		interval = defaultKeyBundlePublishIntervalSec * time.Second
+	}
+	for {
+		if err := c.publishKeyBundle(time.Now()); err != nil {
+			incrementCounter(keyBundlePublishFailureCounter)
+			lg.Errorf("Could not publish key bundle: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "publish_key_bundle"})
+		}
+		time.Sleep(interval)
+	}
+}
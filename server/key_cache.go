@@ -0,0 +1,179 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultMaxKeysInMemory = 1000
+
+var (
+	// signingKeys holds the unsealed signing keys, it lives outside of Server since
+	// signing keys are read by functions outside of Server
+	signingKeys = newKeyCache(defaultMaxKeysInMemory)
+
+	keyEvictionCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "signing_key_eviction_count",
+		Help: "Number of signing keys evicted from memory because the cache was full or the issuer was retired",
+	})
+)
+
+// keyCache holds at most max signing keys, least recently used keys are evicted.
+// Entries are keyed by a hash of the stored key so that the plaintext of keys kept in
+// the database never becomes a map key.
+type keyCache struct {
+	mu      sync.Mutex
+	max     int
+	order   *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type cachedKey struct {
+	id  [sha256.Size]byte
+	key *crypto.SigningKey
+}
+
+func newKeyCache(max int) *keyCache {
+	return &keyCache{
+		max:     max,
+		order:   list.New(),
+		entries: map[[sha256.Size]byte]*list.Element{},
+	}
+}
+
+func (kc *keyCache) get(stored []byte) *crypto.SigningKey {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	if elem, ok := kc.entries[sha256.Sum256(stored)]; ok {
+		kc.order.MoveToFront(elem)
+		return elem.Value.(*cachedKey).key
+	}
+	return nil
+}
+
+func (kc *keyCache) add(stored []byte, key *crypto.SigningKey) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	id := sha256.Sum256(stored)
+	if elem, ok := kc.entries[id]; ok {
+		elem.Value.(*cachedKey).key = key
+		kc.order.MoveToFront(elem)
+		return
+	}
+	kc.entries[id] = kc.order.PushFront(&cachedKey{id: id, key: key})
+	kc.trim()
+}
+
+// resize changes the number of keys held, zero uses the default
+func (kc *keyCache) resize(max int) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	if max <= 0 {
+		max = defaultMaxKeysInMemory
+	}
+	kc.max = max
+	kc.trim()
+}
+
+// evict drops the given keys, e.g. those of retired issuers
+func (kc *keyCache) evict(keys ...*crypto.SigningKey) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	drop := map[*crypto.SigningKey]bool{}
+	for _, key := range keys {
+		drop[key] = true
+	}
+	for elem := kc.order.Front(); elem != nil; {
+		next := elem.Next()
+		if drop[elem.Value.(*cachedKey).key] {
+			kc.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// retain drops every key that is not in keep
+func (kc *keyCache) retain(keep map[*crypto.SigningKey]bool) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	for elem := kc.order.Front(); elem != nil; {
+		next := elem.Next()
+		if !keep[elem.Value.(*cachedKey).key] {
+			kc.remove(elem)
+		}
+		elem = next
+	}
+}
+
+func (kc *keyCache) len() int {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	return kc.order.Len()
+}
+
+func (kc *keyCache) trim() {
+	for kc.order.Len() > kc.max {
+		kc.remove(kc.order.Back())
+	}
+}
+
+// remove drops the cache's reference to a key. The native key is freed by its
+// finalizer once no cached issuer refers to it any more.
+func (kc *keyCache) remove(elem *list.Element) {
+	entry := kc.order.Remove(elem).(*cachedKey)
+	delete(kc.entries, entry.id)
+	entry.key = nil
+	incrementCounter(keyEvictionCounter)
+}
+
+// zeroize overwrites key material held in Go memory once it is no longer needed
+func zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// issuerSigningKeys lists every signing key of the issuers
+func issuerSigningKeys(issuers []*Issuer) []*crypto.SigningKey {
+	var keys []*crypto.SigningKey
+	for _, issuer := range issuers {
+		if issuer.SigningKey != nil {
+			keys = append(keys, issuer.SigningKey)
+		}
+		for i := range issuer.Keys {
+			keys = append(keys, issuer.Keys[i].SigningKey)
+		}
+	}
+	return keys
+}
+
+// pruneSigningKeys drops the keys of issuers that have expired
+func (c *Server) pruneSigningKeys() error {
+	issuers, err := c.fetchAllIssuers(false)
+	if err != nil {
+		return err
+	}
+	pending, err := c.fetchPendingIssuers()
+	if err != nil {
+		return err
+	}
+
+	keep := map[*crypto.SigningKey]bool{}
+	for _, key := range issuerSigningKeys(issuers) {
+		keep[key] = true
+	}
+	for _, p := range pending {
+		keep[p.SigningKey] = true
+	}
+	signingKeys.retain(keep)
+	return nil
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	keyCeremonyTTL       = 24 * time.Hour
+	keyCeremonyMinShares = 2
+	keyCeremonyMaxShares = 16
+	keyCeremonyShareSize = 32
+)
+
+var (
+	ErrInvalidCeremonyShares = fmt.Errorf("shares must be between %d and %d", keyCeremonyMinShares, keyCeremonyMaxShares)
+	ErrCeremonyVersion       = errors.New("key ceremonies create version 1 issuers")
+	ErrInvalidCeremonyShare  = errors.New("share must be 32 random bytes, base64 encoded")
+	ErrCeremonyNotFound      = newStorageError(ErrNotFound, "Key ceremony not found or expired")
+	ErrCeremonyContributor   = newStorageError(ErrDuplicate, "Caller already contributed a share to the key ceremony")
+	ErrCeremonyUnsealed      = errors.New("key ceremonies need Vault key storage to seal the shares")
+)
+
+// KeyCeremonyRequest starts a key ceremony, which creates Issuer once Shares operators
+// have each contributed a share of its signing key
+type KeyCeremonyRequest struct {
+	Issuer IssuerCreateRequest `json:"issuer"`
+	Shares int                 `json:"shares"`
+}
+
+// KeyCeremonyShareRequest contributes a share to a key ceremony, 32 random bytes
+// base64 encoded
+type KeyCeremonyShareRequest struct {
+	Share string `json:"share"`
+}
+
+// KeyCeremonyResponse is the progress of a key ceremony, Issuer is set once the last
+// share was contributed
+type KeyCeremonyResponse struct {
+	ID             string          `json:"id"`
+	IssuerType     string          `json:"issuer_type"`
+	SharesRequired int             `json:"shares_required"`
+	Contributors   []string        `json:"contributors"`
+	ExpiresAt      time.Time       `json:"expires_at"`
+	Issuer         *IssuerResponse `json:"issuer,omitempty"`
+}
+
+// keyCeremony is an issuer waiting for the shares of its signing key. The shares
+// contributed so far are kept combined, sealed like signing keys.
+type keyCeremony struct {
+	KeyCeremonyResponse
+	request     IssuerCreateRequest
+	accumulated string
+}
+
+// combineShare XORs a share into the shares combined so far. The top four bits of
+// every share are cleared, so that the combined key is always a canonical scalar,
+// below 2^252 and the order of the Ristretto group.
+func combineShare(accumulated, share []byte) []byte {
+	combined := make([]byte, keyCeremonyShareSize)
+	copy(combined, accumulated)
+	for i := range combined {
+		combined[i] ^= share[i]
+	}
+	combined[keyCeremonyShareSize-1] &= 0x0f
+	return combined
+}
+
+// sealCeremonyKey returns the stored form of combined shares, sealed with Vault.
+// Ceremonies are refused without Vault key storage, since the combined shares would
+// otherwise be stored as they are.
+func sealCeremonyKey(key []byte) (string, error) {
+	if keyStore == nil {
+		return "", ErrCeremonyUnsealed
+	}
+	text := []byte(base64.StdEncoding.EncodeToString(key))
+	defer zeroize(text)
+	stored, err := keyStore.seal(text)
+	return string(stored), err
+}
+
+func unsealCeremonyKey(stored string) ([]byte, error) {
+	if stored == "" {
+		return make([]byte, keyCeremonyShareSize), nil
+	}
+	if keyStore == nil {
+		return nil, ErrCeremonyUnsealed
+	}
+	if !strings.HasPrefix(stored, vaultKVPrefix) && !strings.HasPrefix(stored, vaultTransitPrefix) {
+		return nil, ErrVaultKeyStorage
+	}
+	text, err := keyStore.unseal(stored)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(text)
+	return base64.StdEncoding.DecodeString(string(text))
+}
+
+func (c *Server) createKeyCeremony(createdBy string, req KeyCeremonyRequest, now time.Time) (*keyCeremony, error) {
+	if keyStore == nil {
+		return nil, ErrCeremonyUnsealed
+	}
+	if req.Shares < keyCeremonyMinShares || req.Shares > keyCeremonyMaxShares {
+		return nil, ErrInvalidCeremonyShares
+	}
+	if req.Issuer.Version != 0 && req.Issuer.Version != IssuerVersion1 {
+		return nil, ErrCeremonyVersion
+	}
+	if err := c.validateNewIssuer(req.Issuer.issuer()); err != nil {
+		return nil, err
+	}
+	request, err := json.Marshal(req.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	ceremony := &keyCeremony{
+		KeyCeremonyResponse: KeyCeremonyResponse{
+			ID:             uuid.NewV4().String(),
+			IssuerType:     req.Issuer.Name,
+			SharesRequired: req.Shares,
+			Contributors:   []string{},
+			ExpiresAt:      now.Add(keyCeremonyTTL).UTC(),
+		},
+		request: req.Issuer,
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(`DELETE FROM key_ceremonies WHERE expires_at < $1`, now.UTC()); err != nil {
+		return nil, err
+	}
+	var taken bool
+	if err := tx.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM issuers WHERE issuer_type = $1) OR EXISTS(SELECT 1 FROM key_ceremonies WHERE issuer_type = $1)`,
+		ceremony.IssuerType).Scan(&taken); err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, IssuerExistsError
+	}
+	_, err = tx.Exec(
+		`INSERT INTO key_ceremonies(id, issuer_type, request, shares_required, created_by, expires_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		ceremony.ID, ceremony.IssuerType, request, ceremony.SharesRequired, createdBy, ceremony.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return ceremony, tx.Commit()
+}
+
+func scanKeyCeremony(row rowScanner) (*keyCeremony, error) {
+	var (
+		ceremony    keyCeremony
+		request     []byte
+		accumulated sql.NullString
+	)
+	err := row.Scan(&ceremony.ID, &ceremony.IssuerType, &request, &ceremony.SharesRequired,
+		pq.Array(&ceremony.Contributors), &accumulated, &ceremony.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrCeremonyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(request, &ceremony.request); err != nil {
+		return nil, err
+	}
+	ceremony.accumulated = accumulated.String
+	if ceremony.Contributors == nil {
+		ceremony.Contributors = []string{}
+	}
+	return &ceremony, nil
+}
+
+const keyCeremonyColumns = `id, issuer_type, request, shares_required, contributors, accumulated_key, expires_at`
+
+func (c *Server) fetchKeyCeremony(id string, now time.Time) (*keyCeremony, error) {
+	if _, err := uuid.FromString(id); err != nil {
+		return nil, ErrCeremonyNotFound
+	}
+	return scanKeyCeremony(c.db.QueryRow(
+		`SELECT `+keyCeremonyColumns+` FROM key_ceremonies WHERE id = $1 AND expires_at > $2`, id, now.UTC()))
+}
+
+// contributeShare adds the share of a contributor to a key ceremony of a tenant. The
+// issuer is created with the combined key along with the last share, and the ceremony
+// deleted.
+func (c *Server) contributeShare(tenant, id, contributor string, share []byte, now time.Time) (*keyCeremony, *Issuer, error) {
+	if len(share) != keyCeremonyShareSize {
+		return nil, nil, ErrInvalidCeremonyShare
+	}
+	if _, err := uuid.FromString(id); err != nil {
+		return nil, nil, ErrCeremonyNotFound
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	ceremony, err := scanKeyCeremony(tx.QueryRow(
+		`SELECT `+keyCeremonyColumns+` FROM key_ceremonies WHERE id = $1 AND expires_at > $2 FOR UPDATE`, id, now.UTC()))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Ceremonies of other tenants are not found rather than forbidden
+	if !inTenant(tenant, ceremony.IssuerType) {
+		return nil, nil, ErrCeremonyNotFound
+	}
+	for _, existing := range ceremony.Contributors {
+		if existing == contributor {
+			return nil, nil, ErrCeremonyContributor
+		}
+	}
+	accumulated, err := unsealCeremonyKey(ceremony.accumulated)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zeroize(accumulated)
+	combined := combineShare(accumulated, share)
+	defer zeroize(combined)
+	ceremony.Contributors = append(ceremony.Contributors, contributor)
+
+	if len(ceremony.Contributors) < ceremony.SharesRequired {
+		stored, err := sealCeremonyKey(combined)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.Exec(`UPDATE key_ceremonies SET contributors = $2, accumulated_key = $3 WHERE id = $1`,
+			id, pq.Array(ceremony.Contributors), stored)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ceremony, nil, tx.Commit()
+	}
+
+	nonZero := false
+	for _, b := range combined {
+		nonZero = nonZero || b != 0
+	}
+	if !nonZero {
+		return nil, nil, ErrInvalidCeremonyShare
+	}
+	text := []byte(base64.StdEncoding.EncodeToString(combined))
+	defer zeroize(text)
+	signingKey := &crypto.SigningKey{}
+	if err := signingKey.UnmarshalText(text); err != nil {
+		return nil, nil, err
+	}
+
+	issuer := ceremony.request.issuer()
+	issuer.SigningKey = signingKey
+	if err := c.insertIssuer(tx, issuer); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM key_ceremonies WHERE id = $1`, id); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	c.forgetIssuers(issuer.IssuerType)
+	return ceremony, issuer, nil
+}
+
+func keyCeremonyError(err error) *handlers.AppError {
+	switch {
+	case err == ErrInvalidCeremonyShares, err == ErrCeremonyVersion, err == ErrInvalidCeremonyShare:
+		return handlers.WrapError("Invalid key ceremony", err)
+	case errors.Is(err, ErrCeremonyNotFound):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
+		}
+	case errors.Is(err, ErrCeremonyContributor):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	case err == ErrCeremonyUnsealed:
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusForbidden,
+		}
+	}
+	return createIssuerError(err)
+}
+
+// keyCeremonyCreateHandler starts a key ceremony for a version 1 issuer, validating
+// its settings ahead of the shares
+func (c *Server) keyCeremonyCreateHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req KeyCeremonyRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+	if err := validIssuerName(req.Issuer.Name); err != nil {
+		return createIssuerError(err)
+	}
+	req.Issuer.Name = scopedIssuerType(r, req.Issuer.Name)
+	var err error
+	if req.Issuer, err = c.applyIssuerProfile(req.Issuer); err != nil {
+		return createIssuerError(err)
+	}
+
+	ceremony, err := c.createKeyCeremony(r.Header.Get(SignatureKeyIDHeader), req, time.Now())
+	if err != nil {
+		return keyCeremonyError(err)
+	}
+
+	entry := newAuditEntry(r, AuditIssuerCeremony, &Issuer{IssuerType: ceremony.IssuerType})
+	entry.Details = fmt.Sprintf("ceremony %s started for %d shares", ceremony.ID, ceremony.SharesRequired)
+	c.recordAudit(entry)
+
+	return encodeResponse(w, ceremony.KeyCeremonyResponse)
+}
+
+func (c *Server) keyCeremonyHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	ceremony, err := c.fetchKeyCeremony(chi.URLParam(r, "id"), time.Now())
+	if err == nil && !inTenant(requestTenant(r), ceremony.IssuerType) {
+		err = ErrCeremonyNotFound
+	}
+	if err != nil {
+		return keyCeremonyError(err)
+	}
+	return encodeResponse(w, ceremony.KeyCeremonyResponse)
+}
+
+// keyCeremonyShareHandler contributes the share of the caller. Contributors are told
+// apart by the request signing key they signed with rather than how they
+// authenticated, since one operator may hold several API keys or tokens, and each
+// contributes at most one share so that no single operator holds the whole key.
+func (c *Server) keyCeremonyShareHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	var req KeyCeremonyShareRequest
+	if appErr := decodeRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+	share, err := base64.StdEncoding.DecodeString(req.Share)
+	if err != nil {
+		return keyCeremonyError(ErrInvalidCeremonyShare)
+	}
+	defer zeroize(share)
+
+	ceremony, issuer, err := c.contributeShare(requestTenant(r), chi.URLParam(r, "id"), r.Header.Get(SignatureKeyIDHeader), share, time.Now())
+	if err != nil {
+		return keyCeremonyError(err)
+	}
+
+	entry := newAuditEntry(r, AuditIssuerCeremony, &Issuer{IssuerType: ceremony.IssuerType})
+	entry.Details = fmt.Sprintf("ceremony %s share %d of %d", ceremony.ID, len(ceremony.Contributors), ceremony.SharesRequired)
+	c.recordAudit(entry)
+	if issuer != nil {
+		entry = newAuditEntry(r, AuditIssuerCreate, issuer)
+		entry.Details = "ceremony " + ceremony.ID
+		c.recordAudit(entry)
+
+		issuerResp := newIssuerResponse(issuer, time.Now())
+		ceremony.Issuer = &issuerResp
+	}
+	return encodeResponse(w, ceremony.KeyCeremonyResponse)
+}
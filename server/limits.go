@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/brave-intl/challenge-bypass-server/btd"
+)
+
+// RequestLimits caps request body sizes per class of route, zero values fall back to maxRequestSize
+type RequestLimits struct {
+	IssuanceBytes   int64 `json:"issuance_bytes,omitempty"`
+	RedemptionBytes int64 `json:"redemption_bytes,omitempty"`
+	AdminBytes      int64 `json:"admin_bytes,omitempty"`
+}
+
+func limitOrDefault(limit int64) int64 {
+	if limit > 0 {
+		return limit
+	}
+	return maxRequestSize
+}
+
+func (c *Server) issuanceLimit() int64 {
+	return limitOrDefault(c.RequestLimits.IssuanceBytes)
+}
+
+func (c *Server) redemptionLimit() int64 {
+	return limitOrDefault(c.RequestLimits.RedemptionBytes)
+}
+
+func (c *Server) adminLimit() int64 {
+	return limitOrDefault(c.RequestLimits.AdminBytes)
+}
+
+// limitedBody records whether a read failed after the body size limit was reached
+type limitedBody struct {
+	r        io.Reader
+	n        int64
+	limit    int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF && b.n >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// decodeRequest decodes the JSON body of r into v, rejecting bodies over limit bytes
+// with a 413 that reports the limit
+func decodeRequest(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) *handlers.AppError {
+	return decodeBody(w, r, limit, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(v)
+	})
+}
+
+// decodeBody decodes the body of r with decode, rejecting bodies over limit bytes
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, decode func(io.Reader) error) *handlers.AppError {
+	body := &limitedBody{r: http.MaxBytesReader(w, r.Body, limit), limit: limit}
+	if err := decode(body); err != nil {
+		if body.exceeded {
+			return &handlers.AppError{
+				Message: ErrRequestTooLarge.Error(),
+				Code:    http.StatusRequestEntityTooLarge,
+				Data: map[string]interface{}{
+					"max_bytes": limit,
+				},
+			}
+		}
+		return handlers.WrapError("Could not parse the request body", err)
+	}
+	return nil
+}
+
+// maxJSONDepth bounds the nesting of the fields skipped while streaming a request
+const maxJSONDepth = 32
+
+var (
+	errTooManyTokens = errors.New("Too many tokens requested")
+	errJSONTooDeep   = errors.New("JSON nesting is too deep")
+)
+
+// decodeIssueJSON decodes an issuance request one blinded token at a time, stopping
+// with errTooManyTokens as soon as the request lists more than maxTokens so that an
+// oversized request costs no more to reject than the tokens up to the limit. Fields
+// other than blinded_tokens are skipped without being decoded.
+func decodeIssueJSON(body io.Reader, maxTokens int, request *BlindedTokenIssueRequest) error {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.New("Request must be a JSON object")
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		// encoding/json matches field names case insensitively
+		if name, _ := key.(string); !strings.EqualFold(name, "blinded_tokens") {
+			if err := skipJSONValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+		if request.BlindedTokens, err = decodeBlindedTokens(dec, maxTokens); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// decodeBlindedTokens decodes the blinded_tokens array, which may be null
+func decodeBlindedTokens(dec *json.Decoder, maxTokens int) ([]*crypto.BlindedToken, error) {
+	tok, err := dec.Token()
+	if err != nil || tok == nil {
+		return nil, err
+	}
+	if tok != json.Delim('[') {
+		return nil, errors.New("blinded_tokens must be an array")
+	}
+	tokens := []*crypto.BlindedToken{}
+	for dec.More() {
+		if len(tokens) >= maxTokens {
+			return nil, errTooManyTokens
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		text, ok := tok.(string)
+		if !ok {
+			return nil, errors.New("blinded_tokens must be strings")
+		}
+		if err := btd.ValidateBlindedToken([]byte(text)); err != nil {
+			return nil, err
+		}
+		token := &crypto.BlindedToken{}
+		if err := token.UnmarshalText([]byte(text)); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// skipJSONValue reads past the next value, rejecting values nested deeper than
+// maxJSONDepth
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > maxJSONDepth {
+				return errJSONTooDeep
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+)
+
+// maintenanceLockID is the advisory lock held while maintenance runs, so that only
+// one instance runs it at a time
+const maintenanceLockID = 0x63627364 // "cbsd"
+
+// maintenanceTables are analyzed, and vacuumed when enabled, on MaintenanceSchedule
+var maintenanceTables = []string{"redemptions", "issuers"}
+
+var maintenanceGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "maintenance_last_success_timestamp_seconds",
+	Help: "Time the last database maintenance run completed",
+})
+
+// parseMaintenanceSchedule parses a standard five field cron expression, or a
+// descriptor like @daily
+func parseMaintenanceSchedule(expr string) (cron.Schedule, error) {
+	return cron.ParseStandard(expr)
+}
+
+// maintenanceTargets lists the quoted names of the tables to maintain, the partitions
+// of a partitioned table in place of the table itself so that each is vacuumed on
+// its own
+func maintenanceTargets(ctx context.Context, conn *sql.Conn, table string) ([]string, error) {
+	rows, err := conn.QueryContext(ctx,
+		`SELECT n.nspname, c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE i.inhparent = $1::regclass ORDER BY 1, 2`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []string
+	for rows.Next() {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, pq.QuoteIdentifier(schema)+"."+pq.QuoteIdentifier(name))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(partitions) == 0 {
+		return []string{pq.QuoteIdentifier(table)}, nil
+	}
+	return partitions, nil
+}
+
+// runMaintenance analyzes the redemption and issuer tables, vacuuming them as well
+// when MaintenanceVacuum is set. It returns false without doing anything when
+// another instance is already running maintenance.
+func (c *Server) runMaintenance(ctx context.Context) (bool, error) {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, maintenanceLockID).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, maintenanceLockID)
+	}()
+
+	command := "ANALYZE"
+	if c.MaintenanceVacuum {
+		command = "VACUUM ANALYZE"
+	}
+	for _, table := range maintenanceTables {
+		targets, err := maintenanceTargets(ctx, conn, table)
+		if err != nil {
+			return true, err
+		}
+		for _, target := range targets {
+			started := time.Now()
+			// VACUUM cannot run in a transaction, each statement runs on its own
+			if _, err := conn.ExecContext(ctx, command+" "+target); err != nil {
+				return true, fmt.Errorf("%s %s: %s", command, target, err)
+			}
+			lg.Infof("%s %s took %s", command, target, time.Since(started))
+		}
+	}
+	maintenanceGauge.SetToCurrentTime()
+	return true, nil
+}
+
+// runMaintenancePeriodically runs maintenance on MaintenanceSchedule until the
+// process exits. Config validation has already checked the schedule.
+func (c *Server) runMaintenancePeriodically() {
+	schedule, err := parseMaintenanceSchedule(c.MaintenanceSchedule)
+	if err != nil {
+		lg.Errorf("Invalid maintenance schedule: %s", err)
+		return
+	}
+	for {
+		time.Sleep(time.Until(schedule.Next(time.Now())))
+		if ran, err := c.runMaintenance(context.Background()); err != nil {
+			lg.Errorf("Could not run database maintenance: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "maintenance"})
+		} else if !ran {
+			lg.Infof("Database maintenance is already running on another instance")
+		}
+	}
+}
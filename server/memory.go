@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Estimated memory held while issuing, covering the decoded blinded tokens, the signed
+// tokens on both sides of the FFI, and their encoding in the response
+const (
+	issuanceBytesPerToken   = 1024
+	issuanceBytesPerRequest = 64 << 10
+)
+
+var (
+	ErrIssuanceMemoryExhausted = errors.New("Too many issuance requests are holding memory")
+	ErrMemoryLimitUnsupported  = errors.New("memory_limit_bytes requires a build with Go 1.19 or later")
+
+	// issuanceMemory accounts for the memory of every issuance request, it lives
+	// outside of Server for the same reason as signers
+	issuanceMemory = newMemoryBudget(0)
+
+	issuanceMemoryGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "issuance_memory_reserved_bytes",
+		Help: "Estimated memory held by issuance requests being served",
+	})
+
+	issuanceMemoryRejectCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "issuance_memory_reject_count",
+		Help: "Number of issuance requests rejected because the memory budget was spent",
+	})
+)
+
+// estimateIssuanceBytes estimates the memory held while issuing a batch of tokens
+func estimateIssuanceBytes(tokens int) int64 {
+	return issuanceBytesPerRequest + int64(tokens)*issuanceBytesPerToken
+}
+
+// memoryBudget bounds the estimated memory of concurrent requests, a limit of zero
+// admits every request
+type memoryBudget struct {
+	limit int64
+
+	mu       sync.Mutex
+	reserved int64
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+// reserve takes bytes from the budget, reporting false without taking anything when
+// the requests already admitted leave too little
+func (b *memoryBudget) reserve(bytes int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.reserved+bytes > b.limit {
+		return false
+	}
+	b.reserved += bytes
+	issuanceMemoryGauge.Add(float64(bytes))
+	return true
+}
+
+// release returns bytes taken by reserve
+func (b *memoryBudget) release(bytes int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reserved -= bytes
+	issuanceMemoryGauge.Sub(float64(bytes))
+}
+
+// issuanceMemoryBudget is the configured budget, half of the soft memory limit when
+// only that is set
+func (c *Server) issuanceMemoryBudget() int64 {
+	if c.IssuanceMemoryBytes > 0 {
+		return c.IssuanceMemoryBytes
+	}
+	return c.MemoryLimitBytes / 2
+}
+
+// reserveIssuanceMemory takes the estimated memory of a batch from the budget, the
+// returned function gives it back once the response is written. Batches that could
+// never fit are rejected with a 413, others are asked to retry once requests finish.
+func reserveIssuanceMemory(w http.ResponseWriter, tokens int) (func(), *handlers.AppError) {
+	bytes := estimateIssuanceBytes(tokens)
+	if issuanceMemory.limit > 0 && bytes > issuanceMemory.limit {
+		incrementCounter(issuanceMemoryRejectCounter)
+		maxTokens := (issuanceMemory.limit - issuanceBytesPerRequest) / issuanceBytesPerToken
+		if maxTokens < 0 {
+			maxTokens = 0
+		}
+		return nil, &handlers.AppError{
+			Message: "Batch exceeds the issuance memory budget",
+			Code:    http.StatusRequestEntityTooLarge,
+			Data: map[string]interface{}{
+				"max_tokens": maxTokens,
+				"suggestion": fmt.Sprintf("Split the request into batches of at most %d tokens", maxTokens),
+			},
+		}
+	}
+	if !issuanceMemory.reserve(bytes) {
+		incrementCounter(issuanceMemoryRejectCounter)
+		w.Header().Set("Retry-After", "1")
+		return nil, &handlers.AppError{
+			Message: ErrIssuanceMemoryExhausted.Error(),
+			Code:    http.StatusServiceUnavailable,
+		}
+	}
+	return func() { issuanceMemory.release(bytes) }, nil
+}
+
+// initMemory tunes the garbage collector of the process, it only applies to the
+// serving process since commands run briefly
+func (c *Server) initMemory() error {
+	if c.GCPercent > 0 {
+		debug.SetGCPercent(c.GCPercent)
+	}
+	if c.MemoryLimitBytes > 0 {
+		return setMemoryLimit(c.MemoryLimitBytes)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build go1.19
+// +build go1.19
+
+package server
+
+import "runtime/debug"
+
+// setMemoryLimit sets the soft memory limit the garbage collector works to stay under,
+// like GOMEMLIMIT
+func setMemoryLimit(bytes int64) error {
+	debug.SetMemoryLimit(bytes)
+	return nil
+}
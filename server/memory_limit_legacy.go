@@ -0,0 +1,10 @@
+//go:build !go1.19
+// +build !go1.19
+
+package server
+
+// setMemoryLimit fails since the runtime has no soft memory limit before Go 1.19,
+// rather than leaving the server to run without the configured limit
+func setMemoryLimit(bytes int64) error {
+	return ErrMemoryLimitUnsupported
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"encoding"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brave-intl/challenge-bypass-server/btd"
+	"github.com/go-chi/chi"
+)
+
+// apiOperation documents a route. Request and Response are zero values of the
+// types decoded from and encoded to the body, nil when there is no body.
+type apiOperation struct {
+	Summary  string
+	Tag      string
+	Query    []string
+	Request  interface{}
+	Response interface{}
+	// Operator operations are only listed in the document served to operators, along
+	// with every operation tagged admin
+	Operator bool
+}
+
+func (op apiOperation) operatorOnly() bool {
+	return op.Operator || op.Tag == "admin"
+}
+
+// oneOf documents a body that is one of several types
+type oneOf []interface{}
+
+// apiOperations documents the routes served by either listener, keyed by method and
+// route pattern. Routes without an entry, like profiling and metrics, are left out
+// of the OpenAPI document.
+var apiOperations = map[string]apiOperation{
+	"POST /v1/blindedToken/{type}": {Summary: "Sign blinded tokens", Tag: "tokens",
+		Query: []string{"include", "version"}, Request: BlindedTokenIssueRequest{}, Response: oneOf{BlindedTokenIssueResponse{}, BlindedTokenIssueResponseV3{}}},
+	"POST /v1/blindedToken/{type}/redemption/": {Summary: "Redeem a token", Tag: "tokens",
+		Request: BlindedTokenRedeemRequest{}},
+	"POST /v1/blindedToken/{type}/redemption/record": {Summary: "Record a token verified with a key bundle as spent", Tag: "tokens",
+		Request: BlindedTokenRecordRequest{}},
+	"POST /v1/blindedToken/{type}/verify": {Summary: "Check that a token can be redeemed without redeeming it, optionally reserving it", Tag: "tokens",
+		Request: BlindedTokenVerifyRequest{}, Response: BlindedTokenVerifyResponse{}},
+	"POST /v1/blindedToken/{type}/reservation/": {Summary: "Reserve a token for its redemption", Tag: "tokens",
+		Request: BlindedTokenVerifyRequest{}, Response: BlindedTokenVerifyResponse{}},
+	"POST /v1/blindedToken/{type}/reservation/{id}/commit": {Summary: "Redeem a reserved token", Tag: "tokens", Response: TokenReservation{}},
+	"POST /v1/blindedToken/{type}/reservation/{id}/abort":  {Summary: "Release a reserved token", Tag: "tokens", Response: TokenReservation{}},
+	"POST /v1/blindedToken/bulk/redemption/": {Summary: "Redeem tokens of several issuers at once", Tag: "tokens",
+		Request: BlindedTokenBulkRedeemRequest{}},
+	"GET /v1/blindedToken/{type}/redemption/": {Summary: "Check whether a token was redeemed", Tag: "tokens",
+		Query: []string{"tokenId"}, Response: Redemption{}},
+	"POST /v1/blindedToken/{type}/redemption/check": {Summary: "Check whether a token was redeemed, with the preimage in the body", Tag: "tokens",
+		Request: BlindedTokenRedemptionCheckRequest{}, Response: Redemption{}},
+
+	"GET /v1/issuer/": {Summary: "List issuers", Tag: "issuers",
+		Query: []string{"status", "version", "prefix", "expires_after", "expires_before", "sort"}, Response: []IssuerResponse{}},
+	"GET /v1/issuer/attestation": {Summary: "Get a signed statement of the issuer directory", Tag: "issuers",
+		Query: []string{"status", "version", "prefix", "expires_after", "expires_before", "sort"}, Response: IssuerAttestation{}},
+	"GET /v1/issuer/{type}":        {Summary: "Get the active issuer of a type", Tag: "issuers", Response: IssuerResponse{}},
+	"GET /v1/issuer/{type}/stats":  {Summary: "Count the redemptions of an issuer type", Tag: "issuers", Response: IssuerStatsResponse{}},
+	"GET /v1/issuer/{type}/canary": {Operator: true, Summary: "Get the canary of an issuer type", Tag: "issuers", Response: IssuerMetadataResponse{}},
+	"POST /v1/issuer/{type}/canary": {Operator: true, Summary: "Create a canary signing a share of issuance requests", Tag: "issuers",
+		Request: IssuerCanaryRequest{}, Response: IssuerMetadataResponse{}},
+	"PATCH /v1/issuer/{type}/canary": {Operator: true, Summary: "Change the share of issuance requests the canary signs", Tag: "issuers",
+		Request: IssuerCanaryRequest{}, Response: IssuerMetadataResponse{}},
+	"GET /v1/issuer/{type}/keys": {Summary: "Get the history of an issuer type's keys, newest first", Tag: "issuers",
+		Query: []string{"cursor", "limit"}, Response: IssuerKeyHistoryResponse{}},
+	"DELETE /v1/issuer/{type}/canary":       {Operator: true, Summary: "Stop the canary of an issuer type from signing", Tag: "issuers"},
+	"POST /v1/issuer/{type}/canary/promote": {Operator: true, Summary: "Make the canary the active issuer", Tag: "issuers", Response: IssuerMetadataResponse{}},
+	"GET /v1/issuer/group/{name}":           {Summary: "Get an issuer group", Tag: "issuers", Response: IssuerGroupResponse{}},
+	"GET /v1/issuer/id/{id}":                {Summary: "Get an issuer by ID", Tag: "issuers", Response: IssuerMetadataResponse{}},
+	"PATCH /v1/issuer/{type}": {Operator: true, Summary: "Update the rotation policy of an issuer type", Tag: "issuers",
+		Request: IssuerPolicyRequest{}, Response: IssuerResponse{}},
+	"POST /v1/issuer/":      {Operator: true, Summary: "Create an issuer", Tag: "issuers", Request: IssuerCreateRequest{}},
+	"POST /v1/issuer/group": {Operator: true, Summary: "Create an issuer group", Tag: "issuers", Request: IssuerGroupCreateRequest{}},
+	"POST /v1/issuer/ceremony": {Operator: true, Summary: "Start a key ceremony for a split-key issuer", Tag: "issuers",
+		Request: KeyCeremonyRequest{}, Response: KeyCeremonyResponse{}},
+	"GET /v1/issuer/ceremony/{id}": {Operator: true, Summary: "Get the progress of a key ceremony", Tag: "issuers", Response: KeyCeremonyResponse{}},
+	"POST /v1/issuer/ceremony/{id}/share": {Operator: true, Summary: "Contribute a share to a key ceremony", Tag: "issuers",
+		Request: KeyCeremonyShareRequest{}, Response: KeyCeremonyResponse{}},
+	"GET /v1/issuer/{type}/freeze": {Operator: true, Summary: "Get the freeze of an issuer type", Tag: "issuers", Response: IssuerFreeze{}},
+	"POST /v1/issuer/{type}/freeze": {Operator: true, Summary: "Freeze issuance, redemption or both for an issuer type", Tag: "issuers",
+		Request: IssuerFreezeRequest{}, Response: IssuerFreeze{}},
+	"DELETE /v1/issuer/{type}/freeze": {Operator: true, Summary: "Unfreeze an issuer type", Tag: "issuers"},
+	"GET /v1/issuer/{type}/flags":     {Operator: true, Summary: "Get the flags of an issuer type", Tag: "issuers", Response: map[string]bool{}},
+	"PATCH /v1/issuer/{type}/flags": {Operator: true, Summary: "Set or reset flags of an issuer type", Tag: "issuers",
+		Request: IssuerFlagsRequest{}, Response: map[string]bool{}},
+	"POST /v1/issuer/id/{id}/revoke": {Operator: true, Summary: "Revoke a compromised issuer", Tag: "issuers",
+		Request: IssuerRevokeRequest{}, Response: IssuerRevokeResponse{}},
+
+	"GET /v1/bundle/": {Summary: "Get the verification bundle of edge services", Tag: "bundle", Response: VerificationBundle{}},
+	"GET /v1/bundle/spent": {Summary: "Get the tokens spent since a time", Tag: "bundle",
+		Query: []string{"since", "limit"}, Response: SpentTokenDelta{}},
+	"GET /v1/bundle/keys": {Summary: "Get the signed bundle of encrypted issuer signing keys", Tag: "bundle", Response: btd.SignedKeyBundle{}},
+
+	"GET /v1/audit/": {Summary: "Query the audit log", Tag: "admin",
+		Query: []string{"issuer_id", "issuer_type", "action", "since", "until", "before_id", "limit"}, Response: []AuditEntry{}},
+	"POST /v1/audit/export": {Summary: "Export the audit log to S3", Tag: "admin", Query: []string{"issuer_id", "issuer_type", "action", "since", "until"}},
+	"GET /v1/audit/issuance": {Summary: "Aggregate sampled issuance requests", Tag: "admin",
+		Query: []string{"issuer", "since"}, Response: []IssuanceSummary{}},
+	"GET /v1/audit/receipts": {Summary: "List receipts of the issuance log", Tag: "admin",
+		Query: []string{"start", "limit"}, Response: []IssuanceReceipt{}},
+	"GET /v1/audit/receipts/head": {Summary: "Get the signed head of the issuance log", Tag: "admin", Response: IssuanceTreeHead{}},
+	"GET /v1/audit/receipts/{index}/proof": {Summary: "Prove a receipt is in the issuance log", Tag: "admin",
+		Query: []string{"tree_size"}, Response: IssuanceInclusionProof{}},
+	"POST /v1/redemption/void":    {Summary: "Void a redemption", Tag: "admin", Request: RedemptionCorrectionRequest{}, Response: Redemption{}},
+	"POST /v1/redemption/restore": {Summary: "Restore a voided redemption", Tag: "admin", Request: RedemptionCorrectionRequest{}, Response: Redemption{}},
+	"GET /v1/redemption/attributes": {Summary: "Count redemptions by country", Tag: "admin",
+		Query: []string{"issuer", "since"}, Response: []RedemptionAttributes{}},
+	"GET /v1/redemption/duplicates": {Summary: "Aggregate attempts to redeem spent tokens", Tag: "admin",
+		Query: []string{"issuer", "since"}, Response: []DuplicateAttemptSummary{}},
+	"POST /v1/apikey/": {Summary: "Create an API key", Tag: "admin", Request: APIKeyCreateRequest{}, Response: APIKeyResponse{}},
+	"GET /v1/apikey/":  {Summary: "List API keys", Tag: "admin", Response: []APIKeyResponse{}},
+	"GET /v1/apikey/{name}/usage": {Summary: "Get the daily usage of an API key", Tag: "admin",
+		Query: []string{"since", "until"}, Response: []APIKeyUsage{}},
+	"DELETE /v1/apikey/{name}": {Summary: "Revoke an API key", Tag: "admin"},
+	"POST /v1/admin/selftest": {Summary: "Time token signing with a throwaway key", Tag: "admin",
+		Query: []string{"tokens"}, Response: SelfTestResult{}},
+	"POST /v1/graphql/": {Summary: "Query issuers, redemptions and stats with GraphQL", Tag: "admin", Request: GraphQLRequest{}},
+	"GET /health":       {Summary: "Readiness of the server", Tag: "admin", Response: HealthStatus{}},
+}
+
+var (
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	timeType          = reflect.TypeOf(time.Time{})
+	pathParamPattern  = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+)
+
+// routePath turns a route walked by chi into its path, without the wildcards of
+// mounted routers
+func routePath(route string) string {
+	route = strings.Replace(route, "/*/", "/", -1)
+	return strings.TrimSuffix(route, "/*")
+}
+
+// buildOpenAPI describes the documented routes served by r as an OpenAPI 3 document,
+// leaving out operator operations unless operator is set
+func buildOpenAPI(r chi.Routes, operator bool) (map[string]interface{}, error) {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+	err := chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		path := routePath(route)
+		op, ok := apiOperations[method+" "+path]
+		if !ok || (op.operatorOnly() && !operator) {
+			return nil
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(method)] = op.describe(path, schemas)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Challenge Bypass Server",
+			"version": Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []map[string][]string{{"bearerAuth": {}}},
+	}, nil
+}
+
+func (op apiOperation) describe(path string, schemas map[string]interface{}) map[string]interface{} {
+	var parameters []map[string]interface{}
+	for _, match := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		parameters = append(parameters, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+		})
+	}
+	for _, name := range op.Query {
+		parameters = append(parameters, map[string]interface{}{
+			"name": name, "in": "query", "schema": map[string]string{"type": "string"},
+		})
+	}
+
+	success := map[string]interface{}{"description": "OK"}
+	if op.Response != nil {
+		success["content"] = jsonContent(op.Response, schemas)
+	}
+	operation := map[string]interface{}{
+		"summary": op.Summary,
+		"tags":    []string{op.Tag},
+		"responses": map[string]interface{}{
+			"200":     success,
+			"default": map[string]interface{}{"description": "Error", "content": jsonContent(errorBody{}, schemas)},
+		},
+	}
+	if parameters != nil {
+		operation["parameters"] = parameters
+	}
+	if op.Request != nil {
+		operation["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(op.Request, schemas)}
+	}
+	return operation
+}
+
+// errorBody is the body handlers.AppError is served with
+type errorBody struct {
+	Message string                 `json:"message"`
+	Code    int                    `json:"code"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+func jsonContent(body interface{}, schemas map[string]interface{}) map[string]interface{} {
+	var schema interface{}
+	if alternatives, ok := body.(oneOf); ok {
+		var options []interface{}
+		for _, alternative := range alternatives {
+			options = append(options, typeSchema(reflect.TypeOf(alternative), schemas))
+		}
+		schema = map[string]interface{}{"oneOf": options}
+	} else {
+		schema = typeSchema(reflect.TypeOf(body), schemas)
+	}
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// typeSchema describes how t is encoded to JSON. Named structs are added to schemas
+// and referred to, types encoding themselves as text are strings.
+func typeSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Registered before the fields so that recursive types terminate
+			schemas[t.Name()] = map[string]interface{}{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema describes the fields of a struct as encoding/json encodes them
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				addFields(field.Type)
+				continue
+			}
+			if field.Type.Kind() == reflect.Func || field.Type.Kind() == reflect.Chan {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = typeSchema(field.Type, schemas)
+			if !strings.Contains(tag, "omitempty") && field.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// openAPIHandler serves the OpenAPI document of the routes of r, built on the first
+// request once every route has been mounted
+func openAPIHandler(r chi.Routes, operator bool) http.HandlerFunc {
+	var once sync.Once
+	var document map[string]interface{}
+	var buildErr error
+	return func(w http.ResponseWriter, req *http.Request) {
+		once.Do(func() {
+			document, buildErr = buildOpenAPI(r, operator)
+		})
+		if buildErr != nil {
+			http.Error(w, buildErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = encodeResponse(w, document)
+	}
+}
+
+// swaggerUIPage renders the OpenAPI document with Swagger UI, whose assets are
+// loaded from unpkg rather than bundled with the server
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Challenge Bypass Server API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@3/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@3/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/v1/admin/openapi.json", dom_id: "#swagger-ui"})</script>
+</body>
+</html>
+`
+
+func swaggerUIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/brave-intl/challenge-bypass-server/migrations"
+)
+
+// ensureDb connects to the database for operations run outside of a serving process
+func (c *Server) ensureDb() error {
+	if c.db != nil {
+		return nil
+	}
+	return c.initDb()
+}
+
+// Migrate applies any pending database migrations and returns them. A positive
+// baseline first records the migrations up to that version as applied, for databases
+// created before migrations were recorded.
+func (c *Server) Migrate(baseline int) ([]migrations.Migration, error) {
+	db, err := c.openMigrationDb()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = db.Close() }()
+
+	migrator, err := c.migrator(db)
+	if err != nil {
+		return nil, err
+	}
+	return migrator.Up(baseline)
+}
+
+// RevertMigrations reverts the latest steps applied database migrations and returns them
+func (c *Server) RevertMigrations(steps int) ([]migrations.Migration, error) {
+	db, err := c.openMigrationDb()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = db.Close() }()
+
+	migrator, err := c.migrator(db)
+	if err != nil {
+		return nil, err
+	}
+	return migrator.Down(steps)
+}
+
+// sqliteRegistered reports whether the binary was built with the sqlite3 driver
+func sqliteRegistered() bool {
+	for _, driver := range sql.Drivers() {
+		if driver == migrations.SQLite.DriverName() {
+			return true
+		}
+	}
+	return false
+}
+
+// openMigrationDb opens the database without applying migrations, waiting for it to
+// come up like the server does. Unlike the server it can open SQLite databases, in a
+// build tagged sqlite that registers the sqlite3 driver.
+func (c *Server) openMigrationDb() (*sql.DB, error) {
+	backend, err := migrations.ParseBackend(c.dbConfig.Backend)
+	if err != nil {
+		return nil, err
+	}
+	var db *sql.DB
+	if backend == migrations.SQLite {
+		if !sqliteRegistered() {
+			return nil, ErrNoSQLiteDriver
+		}
+		if db, err = sql.Open(backend.DriverName(), c.dbConfig.ConnectionURI); err != nil {
+			return nil, err
+		}
+	} else {
+		db, _ = openRotatingDB(c.dbConfig.ConnectionURI)
+	}
+	if err := c.retryStartup(string(backend), db.Ping); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// CreateIssuer creates an issuer on behalf of an operator
+func (c *Server) CreateIssuer(req IssuerCreateRequest) (*IssuerResponse, error) {
+	if err := c.ensureDb(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.applyIssuerProfile(req)
+	if err != nil {
+		return nil, err
+	}
+	issuer := req.issuer()
+	if err := c.createIssuer(issuer); err != nil {
+		return nil, err
+	}
+	entry := AuditEntry{
+		Actor:      AuditActorCLI,
+		Action:     AuditIssuerCreate,
+		IssuerID:   issuer.ID,
+		IssuerType: issuer.IssuerType,
+	}
+	if req.Profile != "" {
+		entry.Details = "profile " + req.Profile
+	}
+	c.recordAudit(entry)
+
+	resp := newIssuerResponse(issuer, time.Now())
+	return &resp, nil
+}
+
+// RotateIssuers replaces any issuers that are due for rotation without waiting for
+// the periodic job of a running server
+func (c *Server) RotateIssuers() ([]IssuerResponse, error) {
+	if err := c.ensureDb(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	replacements, err := c.rotateIssuers(now)
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]IssuerResponse, len(replacements))
+	for i, issuer := range replacements {
+		resp[i] = newIssuerResponse(issuer, now)
+	}
+	return resp, nil
+}
+
+// RetireIssuer immediately expires every issuer of a type, returning how many were retired
+func (c *Server) RetireIssuer(issuerType string) (int64, error) {
+	if err := c.ensureDb(); err != nil {
+		return 0, err
+	}
+
+	retired, err := c.retireIssuer(issuerType)
+	if err != nil {
+		return 0, err
+	}
+	if retired == 0 {
+		return 0, IssuerNotFoundError
+	}
+	c.recordAudit(AuditEntry{
+		Actor:      AuditActorCLI,
+		Action:     AuditIssuerRetire,
+		IssuerType: issuerType,
+	})
+	return retired, nil
+}
+
+// RevokeIssuer revokes a compromised issuer by ID, replacing it when replace is set
+func (c *Server) RevokeIssuer(id, reason string, replace bool) (*IssuerRevokeResponse, error) {
+	if err := c.ensureDb(); err != nil {
+		return nil, err
+	}
+
+	revoked, replacement, err := c.revokeIssuer(id, reason, replace, AuditEntry{Actor: AuditActorCLI})
+	if err != nil {
+		return nil, err
+	}
+	resp := newIssuerRevokeResponse(revoked, replacement, time.Now())
+	return &resp, nil
+}
+
+// RenameIssuer renames every issuer of a type, the old name keeps resolving to the
+// renamed issuers
+func (c *Server) RenameIssuer(oldType, newType string) error {
+	if err := c.ensureDb(); err != nil {
+		return err
+	}
+
+	if err := c.renameIssuerType(oldType, newType); err != nil {
+		return err
+	}
+	c.recordAudit(AuditEntry{
+		Actor:      AuditActorCLI,
+		Action:     AuditIssuerRename,
+		IssuerType: newType,
+		Details:    "renamed from " + oldType,
+	})
+	return nil
+}
+
+// CreateAPIKey creates an API key on behalf of an operator, the returned response is
+// the only place the key itself is shown
+func (c *Server) CreateAPIKey(name, tenant string) (*APIKeyResponse, error) {
+	if err := c.ensureDb(); err != nil {
+		return nil, err
+	}
+
+	key, err := c.createAPIKey(name, tenant)
+	if err != nil {
+		return nil, err
+	}
+	c.recordAudit(AuditEntry{
+		Actor:   AuditActorCLI,
+		Action:  AuditAPIKeyCreate,
+		Details: key.Name,
+	})
+	return key, nil
+}
+
+// ListIssuers describes every unexpired issuer, including rotated ones
+func (c *Server) ListIssuers() ([]IssuerResponse, error) {
+	if err := c.ensureDb(); err != nil {
+		return nil, err
+	}
+
+	issuers, err := c.fetchAllIssuers(false)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	resp := make([]IssuerResponse, len(issuers))
+	for i, issuer := range issuers {
+		resp[i] = newIssuerResponse(issuer, now)
+	}
+	return resp, nil
+}
+
+// ExportRedemptions writes redemptions recorded after since as newline delimited JSON,
+// optionally limited to a single issuer type, and returns how many were written
+func (c *Server) ExportRedemptions(w io.Writer, issuerType string, since time.Time) (int, error) {
+	if err := c.ensureDb(); err != nil {
+		return 0, err
+	}
+
+	rows, err := c.db.Query(
+		`SELECT id, issuer_type, ts, payload FROM redemptions
+		WHERE ts > $1 AND ($2 = '' OR `+issuerTypeNames("$2")+`) AND voided_at IS NULL ORDER BY ts`, since.UTC(), issuerType)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+	count := 0
+	for rows.Next() {
+		var redemption Redemption
+		if err := rows.Scan(&redemption.Id, &redemption.IssuerType, &redemption.Timestamp, &redemption.Payload); err != nil {
+			return count, err
+		}
+		if err := encoder.Encode(redemption); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// BackfillDynamo copies redemptions of issuers that are dual written from Postgres to
+// DynamoDB and returns how many were copied
+func (c *Server) BackfillDynamo() (int, error) {
+	if err := c.ensureDb(); err != nil {
+		return 0, err
+	}
+	return c.backfillDynamo()
+}
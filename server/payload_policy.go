@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Payload transformers built into the server, a step of a payload policy is a
+// transformer name optionally followed by a colon and its argument
+const (
+	// PayloadHash replaces the payload with its salted SHA-256 hash, as for token ids
+	PayloadHash = "hash"
+	// PayloadTruncate keeps the first N bytes of the payload, e.g. truncate:64
+	PayloadTruncate = "truncate"
+	// PayloadStrip removes comma separated top level fields from JSON object payloads,
+	// e.g. strip:email,ip, other payloads are left as they are
+	PayloadStrip = "strip"
+	// PayloadDrop records redemptions without their payload
+	PayloadDrop = "drop"
+)
+
+var ErrInvalidPayloadPolicy = errors.New("payload_policy must list known transformers with valid arguments")
+
+// PayloadTransformer rewrites redemption payloads before they are persisted, so that
+// issuers can keep only the part of the payload they need. Programs embedding the
+// server register their own in PayloadTransformers under the name issuer policies
+// refer to them by.
+type PayloadTransformer interface {
+	// TransformPayload returns the payload to persist for a redemption of issuerType,
+	// arg is what follows the transformer name in the policy step. Errors fail the
+	// redemption rather than persist the payload as it is.
+	TransformPayload(issuerType, payload, arg string) (string, error)
+}
+
+// PayloadTransformerFunc adapts a function to a PayloadTransformer
+type PayloadTransformerFunc func(issuerType, payload, arg string) (string, error)
+
+func (f PayloadTransformerFunc) TransformPayload(issuerType, payload, arg string) (string, error) {
+	return f(issuerType, payload, arg)
+}
+
+func splitPayloadStep(step string) (name, arg string) {
+	if i := strings.Index(step, ":"); i >= 0 {
+		return step[:i], step[i+1:]
+	}
+	return step, ""
+}
+
+// payloadTransformer returns the transformer a policy step names, registered
+// transformers take precedence over built in ones
+func (c *Server) payloadTransformer(name string) PayloadTransformer {
+	if transformer, ok := c.PayloadTransformers[name]; ok {
+		return transformer
+	}
+	switch name {
+	case PayloadHash:
+		return PayloadTransformerFunc(func(_, payload, _ string) (string, error) {
+			if payload == "" {
+				return "", nil
+			}
+			return c.redemptionIDHash(payload), nil
+		})
+	case PayloadTruncate:
+		return PayloadTransformerFunc(truncatePayload)
+	case PayloadStrip:
+		return PayloadTransformerFunc(stripPayload)
+	case PayloadDrop:
+		return PayloadTransformerFunc(func(_, _, _ string) (string, error) {
+			return "", nil
+		})
+	}
+	return nil
+}
+
+// validatePayloadPolicy checks that every step of a policy names a transformer, and
+// that built in transformers get the argument they need
+func (c *Server) validatePayloadPolicy(policy []string) error {
+	for _, step := range policy {
+		name, arg := splitPayloadStep(step)
+		if c.payloadTransformer(name) == nil {
+			return ErrInvalidPayloadPolicy
+		}
+		if _, registered := c.PayloadTransformers[name]; registered {
+			continue
+		}
+		switch name {
+		case PayloadTruncate:
+			if n, err := strconv.Atoi(arg); err != nil || n < 0 {
+				return ErrInvalidPayloadPolicy
+			}
+		case PayloadStrip:
+			if arg == "" {
+				return ErrInvalidPayloadPolicy
+			}
+		}
+	}
+	return nil
+}
+
+// applyPayloadPolicy runs the steps of an issuer's payload policy in order
+func (c *Server) applyPayloadPolicy(issuer *Issuer, payload string) (string, error) {
+	for _, step := range issuer.PayloadPolicy {
+		name, arg := splitPayloadStep(step)
+		transformer := c.payloadTransformer(name)
+		if transformer == nil {
+			return "", fmt.Errorf("unknown payload transformer %q", name)
+		}
+		var err error
+		if payload, err = transformer.TransformPayload(issuer.IssuerType, payload, arg); err != nil {
+			return "", err
+		}
+	}
+	return payload, nil
+}
+
+// setPayloadPolicy replaces the payload policy of the active issuer of a type, its
+// replacements inherit the policy
+func (c *Server) setPayloadPolicy(issuerType string, policy []string) error {
+	if err := c.validatePayloadPolicy(policy); err != nil {
+		return err
+	}
+
+	result, err := c.db.Exec(
+		`UPDATE issuers SET payload_policy = $2 WHERE issuer_type = $1 AND rotated_at IS NULL AND `+unexpiredIssuers,
+		issuerType, pq.Array(policy))
+	if err != nil {
+		return err
+	}
+	c.forgetIssuers(issuerType)
+	if err := forgetPendingIssuers(c.db, issuerType); err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return IssuerNotFoundError
+	}
+	return nil
+}
+
+// transformPayload applies the payload policy of an issuer type, payloads of types
+// without unexpired issuers are left as they are
+func (c *Server) transformPayload(issuerType, payload string) (string, error) {
+	issuers, err := c.fetchIssuers(issuerType)
+	if errors.Is(err, IssuerNotFoundError) {
+		return payload, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return c.applyPayloadPolicy(issuers[0], payload)
+}
+
+func truncatePayload(_, payload, arg string) (string, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return "", ErrInvalidPayloadPolicy
+	}
+	if len(payload) <= n {
+		return payload, nil
+	}
+	// Cut before a partial rune rather than store invalid UTF-8
+	for n > 0 && !utf8.RuneStart(payload[n]) {
+		n--
+	}
+	return payload[:n], nil
+}
+
+func stripPayload(_, payload, arg string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil || fields == nil {
+		return payload, nil
+	}
+	for _, field := range strings.Split(arg, ",") {
+		delete(fields, strings.TrimSpace(field))
+	}
+	stripped, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(stripped), nil
+}
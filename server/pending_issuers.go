@@ -0,0 +1,218 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+)
+
+var pregenerateIssuerCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pregenerate_issuer_count",
+	Help: "Number of issuer keys generated ahead of their activation",
+})
+
+// PendingIssuer is a pre-generated replacement for the issuer PredecessorID. When the
+// predecessor rotates the pending issuer becomes its replacement, keeping its id and key.
+type PendingIssuer struct {
+	ID            string
+	PredecessorID string
+	IssuerType    string
+	SigningKey    *crypto.SigningKey
+	// ActivatesAt is when the predecessor is expected to rotate, group rotation may
+	// activate it earlier
+	ActivatesAt time.Time
+	ExpiresAt   time.Time
+}
+
+const pendingIssuerColumns = `id, predecessor_id, issuer_type, signing_key, activates_at, expires_at`
+
+func scanPendingIssuer(row rowScanner) (*PendingIssuer, error) {
+	var signingKey []byte
+	pending := &PendingIssuer{}
+	if err := row.Scan(&pending.ID, &pending.PredecessorID, &pending.IssuerType, &signingKey, &pending.ActivatesAt, &pending.ExpiresAt); err != nil {
+		return nil, err
+	}
+	var err error
+	if pending.SigningKey, err = unsealSigningKey(signingKey); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// rotationTime is when rotateIssuers replaces the issuer, matching rotationDue
+func (issuer *Issuer) rotationTime() time.Time {
+	window := issuerRotationWindow
+	if issuer.RotationWindowDays > 0 {
+		window = time.Duration(issuer.RotationWindowDays) * 24 * time.Hour
+	}
+	due := issuer.ExpiresAt.Add(-window)
+	if midpoint := issuer.CreatedAt.Add(issuer.ExpiresAt.Sub(issuer.CreatedAt) / 2); midpoint.After(due) {
+		due = midpoint
+	}
+	return due
+}
+
+// successorExpiry is when the replacement of an issuer rotated at now expires. The
+// replacement is valid for ValidDays, or the issuer's own validity period when unset,
+// from when the issuer expires.
+func (issuer *Issuer) successorExpiry(now time.Time) time.Time {
+	start := issuer.ExpiresAt
+	if start.Before(now) {
+		start = now
+	}
+	validity := issuer.ExpiresAt.Sub(issuer.CreatedAt)
+	if issuer.ValidDays > 0 {
+		validity = time.Duration(issuer.ValidDays) * 24 * time.Hour
+	}
+	return start.Add(validity)
+}
+
+// successor describes the issuer the pending issuer will become, so that its own
+// successors can be planned
+func (pending *PendingIssuer) successor(predecessor *Issuer) *Issuer {
+	return &Issuer{
+		ID:                      pending.ID,
+		IssuerType:              pending.IssuerType,
+		CreatedAt:               pending.ActivatesAt,
+		ExpiresAt:               pending.ExpiresAt,
+		RotationWindowDays:      predecessor.RotationWindowDays,
+		ValidDays:               predecessor.ValidDays,
+		RedemptionRetentionDays: predecessor.RedemptionRetentionDays,
+		RedemptionStore:         predecessor.RedemptionStore,
+		PayloadPolicy:           predecessor.PayloadPolicy,
+		Flags:                   predecessor.Flags,
+	}
+}
+
+// pregenerateIssuers makes sure every active version 1 issuer with an expiry has
+// FutureIssuerKeys pending successors, returning how many were generated. Version 3
+// issuers already sign ahead with their buffered keys.
+func (c *Server) pregenerateIssuers(now time.Time) (int, error) {
+	if c.FutureIssuerKeys <= 0 {
+		return 0, nil
+	}
+
+	rows, err := c.db.Query(
+		`SELECT `+issuerColumns+` FROM issuers
+		WHERE rotated_at IS NULL AND canary_percent IS NULL AND version = $1 AND expires_at > NOW() ORDER BY issuer_type`, IssuerVersion1)
+	if err != nil {
+		return 0, err
+	}
+	issuers, err := c.scanIssuers(rows, c.db.Query)
+	if err != nil {
+		return 0, err
+	}
+
+	pending, err := c.fetchPendingIssuers()
+	if err != nil {
+		return 0, err
+	}
+	byPredecessor := map[string]*PendingIssuer{}
+	for _, p := range pending {
+		byPredecessor[p.PredecessorID] = p
+	}
+
+	created := 0
+	for _, issuer := range issuers {
+		predecessor := issuer
+		for i := 0; i < c.FutureIssuerKeys; i++ {
+			next, ok := byPredecessor[predecessor.ID]
+			if !ok {
+				next, err = c.insertPendingIssuer(predecessor, now)
+				if err != nil {
+					return created, err
+				}
+				if next == nil {
+					// Another instance generated it first, continue on the next run
+					break
+				}
+				created++
+			}
+			predecessor = next.successor(predecessor)
+		}
+	}
+	return created, nil
+}
+
+// insertPendingIssuer generates the successor of an issuer, returning nil if one
+// already exists
+func (c *Server) insertPendingIssuer(predecessor *Issuer, now time.Time) (*PendingIssuer, error) {
+	signingKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	signingKeyTxt, err := sealSigningKey(signingKey)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroize(signingKeyTxt)
+
+	pending := &PendingIssuer{
+		ID:            uuid.NewV4().String(),
+		PredecessorID: predecessor.ID,
+		IssuerType:    predecessor.IssuerType,
+		SigningKey:    signingKey,
+		ActivatesAt:   predecessor.rotationTime().UTC(),
+		ExpiresAt:     predecessor.successorExpiry(now).UTC(),
+	}
+	result, err := c.db.Exec(
+		`INSERT INTO pending_issuers(`+pendingIssuerColumns+`) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (predecessor_id) DO NOTHING`,
+		pending.ID, pending.PredecessorID, pending.IssuerType, signingKeyTxt, pending.ActivatesAt, pending.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return nil, err
+	}
+
+	incrementCounter(pregenerateIssuerCounter)
+	c.recordAudit(AuditEntry{
+		Actor:      AuditActorSystem,
+		Action:     AuditIssuerKeyCreate,
+		IssuerID:   pending.ID,
+		IssuerType: pending.IssuerType,
+		Details:    fmt.Sprintf("pending, activates at %s", pending.ActivatesAt.Format(time.RFC3339)),
+	})
+	return pending, nil
+}
+
+// fetchPendingIssuers returns every pending issuer in order of activation
+func (c *Server) fetchPendingIssuers() ([]*PendingIssuer, error) {
+	rows, err := c.db.Query(`SELECT ` + pendingIssuerColumns + ` FROM pending_issuers ORDER BY issuer_type, activates_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := []*PendingIssuer{}
+	for rows.Next() {
+		p, err := scanPendingIssuer(rows)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+// takePendingIssuer removes and returns the pending successor of an issuer, if any
+func takePendingIssuer(tx *sql.Tx, predecessorID string) (*PendingIssuer, error) {
+	pending, err := scanPendingIssuer(tx.QueryRow(
+		`DELETE FROM pending_issuers WHERE predecessor_id = $1 RETURNING `+pendingIssuerColumns, predecessorID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pending, err
+}
+
+// forgetPendingIssuers drops the pending issuers of a type once they no longer match
+// its policy, they are generated again on the next run
+func forgetPendingIssuers(db execer, issuerType string) error {
+	_, err := db.Exec(`DELETE FROM pending_issuers WHERE issuer_type = $1`, issuerType)
+	return err
+}
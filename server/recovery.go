@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	chiware "github.com/go-chi/chi/middleware"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrorCodePanic is the data.error_code of the 500 answered when a handler panics
+const ErrorCodePanic = "internal_panic"
+
+var (
+	panicCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "handler_panic_count",
+		Help: "Number of requests whose handler panicked",
+	}, []string{"route"})
+
+	alertClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// PanicReport describes a handler panic, it is posted as JSON to PanicWebhookURL
+type PanicReport struct {
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"request_id,omitempty"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+	Version   string    `json:"version"`
+}
+
+// recoverPanics answers a handler panic with a 500 carrying ErrorCodePanic and the
+// request id, and reports it to the metrics, the log, the error reporter and the
+// alert hooks. Aborted handlers keep panicking so that net/http drops the connection.
+func (c *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			report := PanicReport{
+				Timestamp: time.Now(),
+				RequestID: chiware.GetReqID(r.Context()),
+				Method:    r.Method,
+				Route:     routePattern(r),
+				Panic:     fmt.Sprint(rec),
+				Stack:     string(debug.Stack()),
+				Version:   Version,
+			}
+			panicCounter.With(prometheus.Labels{"route": report.Route}).Inc()
+			lg.Errorf("Handler panicked on %s %s: %s\n%s", report.Method, report.Route, report.Panic, report.Stack)
+			c.reportError(r, fmt.Errorf("panic: %s", report.Panic), nil)
+			c.alertPanic(report)
+
+			handlers.AppError{
+				Message: http.StatusText(http.StatusInternalServerError),
+				Code:    http.StatusInternalServerError,
+				Data: map[string]interface{}{
+					"error_code": ErrorCodePanic,
+					"request_id": report.RequestID,
+				},
+			}.ServeHTTP(w, r)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// alertPanic calls PanicHook and posts the report to PanicWebhookURL, in the
+// background so that the response is not held up by a slow receiver
+func (c *Server) alertPanic(report PanicReport) {
+	if c.PanicHook != nil {
+		go c.PanicHook(report)
+	}
+	if c.PanicWebhookURL != "" {
+		postWebhook("panic", c.PanicWebhookURL, report)
+	}
+}
+
+// postWebhook posts a report as JSON in the background, failures are only logged
+func postWebhook(kind, url string, report interface{}) {
+	go func() {
+		body, err := json.Marshal(report)
+		if err != nil {
+			lg.Errorf("Could not encode %s report: %s", kind, err)
+			return
+		}
+		resp, err := alertClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lg.Errorf("Could not post %s report: %s", kind, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			lg.Errorf("Webhook of %s reports responded with %d", kind, resp.StatusCode)
+		}
+	}()
+}
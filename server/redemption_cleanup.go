@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	cleanupInterval            = time.Hour
+	defaultCleanupBatchSize    = 1000
+	defaultCleanupBatchDelayMs = 100
+)
+
+var deletedRedemptionCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "deleted_redemption_count",
+	Help: "Number of redemptions of expired issuer types deleted from the database",
+})
+
+// expiredIssuerTypes lists the issuer types whose every issuer expired before $1.
+// Their tokens can no longer be verified, so their redemptions are not needed to
+// prevent double spends. Types with an issuer that never expires are left alone.
+const expiredIssuerTypes = `SELECT issuer_type FROM issuers GROUP BY issuer_type
+	HAVING bool_and(expires_at IS NOT NULL) AND MAX(expires_at) < $1`
+
+// cleanupRedemptions deletes the redemptions of issuer types that expired more than
+// CleanupAfterDays ago. Rows are deleted in batches of CleanupBatchSize with
+// CleanupBatchDelayMs between them, so that no statement holds locks for long and
+// replicas can keep up.
+func (c *Server) cleanupRedemptions(now time.Time) (int64, error) {
+	cutoff := now.Add(-time.Duration(c.CleanupAfterDays) * 24 * time.Hour).UTC()
+	batchSize := c.CleanupBatchSize
+	if batchSize == 0 {
+		batchSize = defaultCleanupBatchSize
+	}
+	delay := time.Duration(c.CleanupBatchDelayMs) * time.Millisecond
+	if c.CleanupBatchDelayMs == 0 {
+		delay = defaultCleanupBatchDelayMs * time.Millisecond
+	}
+
+	rows, err := c.db.Query(expiredIssuerTypes, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var issuerTypes []string
+	for rows.Next() {
+		var issuerType string
+		if err := rows.Scan(&issuerType); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		issuerTypes = append(issuerTypes, issuerType)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, issuerType := range issuerTypes {
+		var deleted int64
+		for {
+			result, err := c.db.Exec(
+				`DELETE FROM redemptions WHERE ctid IN (SELECT ctid FROM redemptions WHERE `+issuerTypeNames("$1")+` LIMIT $2)`,
+				issuerType, batchSize)
+			if err != nil {
+				return total, err
+			}
+			count, err := result.RowsAffected()
+			if err != nil {
+				return total, err
+			}
+			deleted += count
+			total += count
+			deletedRedemptionCounter.Add(float64(count))
+			if count < int64(batchSize) {
+				break
+			}
+			time.Sleep(delay)
+		}
+
+		if deleted > 0 {
+			c.recordAudit(AuditEntry{
+				Actor:      AuditActorSystem,
+				Action:     AuditRedemptionCleanup,
+				IssuerType: issuerType,
+				Details:    fmt.Sprintf("%d redemptions", deleted),
+			})
+		}
+	}
+	return total, nil
+}
+
+// cleanupRedemptionsPeriodically runs redemption cleanup until the process exits.
+// Instances running it at once only contend for the same batches.
+func (c *Server) cleanupRedemptionsPeriodically() {
+	for {
+		if count, err := c.cleanupRedemptions(time.Now()); err != nil {
+			lg.Errorf("Could not clean up redemptions: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "cleanup_redemptions"})
+		} else if count > 0 {
+			lg.Infof("Deleted %d redemptions of expired issuer types", count)
+		}
+		time.Sleep(cleanupInterval)
+	}
+}
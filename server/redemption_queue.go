@@ -0,0 +1,251 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultQueueMaxEntries        = 10000
+	defaultQueueReplayIntervalSec = 5
+	// queuedWriteTolerance is how far apart the queued time of a redemption and the
+	// time of a redemption found on replay may be for it to be the same write, which
+	// went through before the connection to Postgres dropped
+	queuedWriteTolerance = time.Minute
+)
+
+var (
+	redemptionQueueBucket = []byte("redemptions")
+
+	ErrRedemptionQueueFull = newStorageError(ErrUnavailable, "redemption queue is full")
+
+	queuedRedemptionsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "queued_redemptions",
+		Help: "Number of redemptions waiting in the local queue to be written to Postgres",
+	})
+
+	queuedRedemptionConflictCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "queued_redemption_conflict_count",
+		Help: "Number of queued redemptions found to be redeemed elsewhere when replayed",
+	}, []string{"issuer_type"})
+)
+
+// RedemptionQueueConfig configures the local queue that accepts redemptions while
+// Postgres is unavailable
+type RedemptionQueueConfig struct {
+	// Path is the queue file, redemptions fail while Postgres is unavailable when empty
+	Path string `json:"path,omitempty"`
+	// MaxEntries bounds the queue, redemptions fail once it is full, 10000 by default
+	MaxEntries int `json:"max_entries,omitempty"`
+	// ReplayIntervalSec is how often queued redemptions are written to Postgres, 5 by default
+	ReplayIntervalSec int `json:"replay_interval_sec,omitempty"`
+}
+
+// queuedRedemption is a redemption accepted while Postgres was unavailable
+type queuedRedemption struct {
+	IssuerType string    `json:"issuer_type"`
+	ID         string    `json:"id"`
+	Payload    string    `json:"payload,omitempty"`
+	Timestamp  time.Time `json:"ts"`
+}
+
+// initRedemptionQueue opens the queue file of a serving process, it does nothing
+// unless a path is configured
+func (c *Server) initRedemptionQueue() error {
+	if c.RedemptionQueue.Path == "" {
+		return nil
+	}
+
+	queue, err := bolt.Open(c.RedemptionQueue.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = queue.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(redemptionQueueBucket)
+		if err != nil {
+			return err
+		}
+		queuedRedemptionsGauge.Set(float64(bucket.Stats().KeyN))
+		return nil
+	})
+	if err != nil {
+		_ = queue.Close()
+		return err
+	}
+	c.redemptionQueue = queue
+	return nil
+}
+
+// queueable reports whether a failed redemption write can be queued, which is the
+// case when Postgres is unavailable rather than rejecting the redemption
+func queueable(err error) bool {
+	err = classifyStorageError(err)
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrConflict)
+}
+
+// queueRedemption accepts a redemption to be written to Postgres once it is available
+// again. Tokens already in the queue are duplicates, tokens redeemed on another
+// instance in the meantime are only found when the redemption is replayed.
+func (c *Server) queueRedemption(issuerType, id, payload string) error {
+	value, err := json.Marshal(queuedRedemption{IssuerType: issuerType, ID: id, Payload: payload, Timestamp: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	maxEntries := c.RedemptionQueue.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = defaultQueueMaxEntries
+	}
+	return c.redemptionQueue.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(redemptionQueueBucket)
+		if bucket.Get([]byte(id)) != nil {
+			return DuplicateRedemptionError
+		}
+		if bucket.Stats().KeyN >= maxEntries {
+			return ErrRedemptionQueueFull
+		}
+		if err := bucket.Put([]byte(id), value); err != nil {
+			return err
+		}
+		queuedRedemptionsGauge.Inc()
+		return nil
+	})
+}
+
+// isQueued reports whether a token is waiting in the queue, whatever its issuer type
+func (c *Server) isQueued(id string) bool {
+	var queued bool
+	_ = c.redemptionQueue.View(func(tx *bolt.Tx) error {
+		queued = tx.Bucket(redemptionQueueBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return queued
+}
+
+// fetchQueuedRedemption returns a redemption that is still waiting in the queue
+func (c *Server) fetchQueuedRedemption(issuerType, id string) (*Redemption, error) {
+	var queued *queuedRedemption
+	err := c.redemptionQueue.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(redemptionQueueBucket).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+		queued = &queuedRedemption{}
+		return json.Unmarshal(value, queued)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if queued == nil || queued.IssuerType != issuerType {
+		return nil, RedemptionNotFoundError
+	}
+	return &Redemption{IssuerType: issuerType, Id: id, Timestamp: queued.Timestamp, Payload: queued.Payload}, nil
+}
+
+// replayRedemptionQueue writes queued redemptions to Postgres with the time they are
+// replayed, so that spent token deltas taken while they were queued still include them.
+// It returns how many were written. It stops at the first failure, which
+// means Postgres is still unavailable. A queued token that turns out to have been
+// redeemed elsewhere was spent twice, which can not be undone, it is counted and
+// recorded as a duplicate attempt.
+func (c *Server) replayRedemptionQueue() (int, error) {
+	var queued []queuedRedemption
+	err := c.redemptionQueue.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(redemptionQueueBucket).ForEach(func(_, value []byte) error {
+			var redemption queuedRedemption
+			if err := json.Unmarshal(value, &redemption); err != nil {
+				return err
+			}
+			queued = append(queued, redemption)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, redemption := range queued {
+		err := c.insertRedemption(c.db, redemption.IssuerType, redemption.ID, redemption.Payload)
+		if errors.Is(err, ErrDuplicate) {
+			err = c.resolveQueuedDuplicate(redemption)
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		err = c.redemptionQueue.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(redemptionQueueBucket).Delete([]byte(redemption.ID))
+		})
+		if err != nil {
+			return replayed, err
+		}
+		queuedRedemptionsGauge.Dec()
+		replayed++
+	}
+	return replayed, nil
+}
+
+// resolveQueuedDuplicate tells a queued redemption whose write reached Postgres before
+// the failure was noticed from a token that was also redeemed elsewhere
+func (c *Server) resolveQueuedDuplicate(queued queuedRedemption) error {
+	var ts time.Time
+	var payload sql.NullString
+	err := c.db.QueryRow(`SELECT ts, payload FROM redemptions WHERE id = $1`, queued.ID).Scan(&ts, &payload)
+	if err != nil {
+		return err
+	}
+	offset := ts.Sub(queued.Timestamp)
+	if payload.String == queued.Payload && offset < queuedWriteTolerance && offset > -queuedWriteTolerance {
+		return nil
+	}
+
+	queuedRedemptionConflictCounter.With(prometheus.Labels{"issuer_type": queued.IssuerType}).Inc()
+	lg.Warnf("Queued redemption of %s was also redeemed elsewhere while Postgres was unavailable", queued.IssuerType)
+	return c.recordDuplicateAttempt(queued.IssuerType, queued.ID, queued.Payload, "queue")
+}
+
+// replayRedemptionQueuePeriodically writes queued redemptions to Postgres until the
+// process exits
+func (c *Server) replayRedemptionQueuePeriodically() {
+	interval := time.Duration(c.RedemptionQueue.ReplayIntervalSec) * time.Second
+	if interval == 0 {
+		interval = defaultQueueReplayIntervalSec * time.Second
+	}
+	for {
+		if count, err := c.replayRedemptionQueue(); err != nil {
+			lg.Errorf("Could not replay queued redemptions: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "replay_redemption_queue"})
+		} else if count > 0 {
+			lg.Infof("Replayed %d queued redemptions", count)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// redeemQueued queues a redemption whose Postgres write failed, returning the original
+// error if it can not be queued
+func (c *Server) redeemQueued(issuerType string, preimage *crypto.TokenPreimage, payload string, writeErr error) error {
+	if c.redemptionQueue == nil || !queueable(writeErr) {
+		return writeErr
+	}
+	id, err := preimage.MarshalText()
+	if err != nil {
+		return writeErr
+	}
+	if err := c.queueRedemption(issuerType, string(id), payload); err != nil {
+		if errors.Is(err, ErrDuplicate) {
+			return err
+		}
+		lg.Errorf("Could not queue redemption of %s: %s", issuerType, err)
+		return writeErr
+	}
+	return nil
+}
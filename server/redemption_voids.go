@@ -0,0 +1,180 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/middleware"
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/go-chi/chi"
+)
+
+var ErrVoidReasonRequired = errors.New("A reason is required to void or restore a redemption")
+
+// RedemptionCorrectionRequest identifies a redemption to void or restore
+type RedemptionCorrectionRequest struct {
+	Issuer        string                `json:"issuer"`
+	TokenPreimage *crypto.TokenPreimage `json:"t"`
+	Reason        string                `json:"reason"`
+}
+
+// voidRedemption marks a redemption as voided so that the token can be redeemed
+// again. The row is kept, along with when and why it was voided.
+func (c *Server) voidRedemption(issuerType, id, reason string) (*Redemption, error) {
+	if c.redisRedemptions(issuerType) {
+		return c.voidRedisRedemption(issuerType, id, reason)
+	}
+
+	redemption := &Redemption{IssuerType: issuerType, Id: id, VoidReason: reason}
+	var voidedAt time.Time
+	err := c.db.QueryRow(
+		`UPDATE redemptions SET voided_at = NOW(), void_reason = $4
+		WHERE `+issuerTypeNames("$1")+` AND (id_hash = $2 OR (id_hash IS NULL AND id = $3)) AND voided_at IS NULL
+		RETURNING ts, payload, voided_at`,
+		issuerType, c.redemptionIDHash(id), id, reason).Scan(&redemption.Timestamp, &redemption.Payload, &voidedAt)
+	if err == sql.ErrNoRows {
+		return nil, RedemptionNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+	redemption.VoidedAt = &voidedAt
+
+	c.forgetRedemption(issuerType, id)
+	if c.dualWrites(issuerType) {
+		c.deleteDynamoRedemption(id, "")
+	}
+	return redemption, nil
+}
+
+// voidRedisRedemption removes a redemption from Redis, which keeps no record of
+// voided redemptions beyond the audit log, so they can not be restored
+func (c *Server) voidRedisRedemption(issuerType, id, reason string) (*Redemption, error) {
+	redemption, err := c.getRedisRedemption(issuerType, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.deleteRedisRedemption(id); err != nil {
+		return nil, err
+	}
+	voidedAt := time.Now().UTC()
+	redemption.VoidedAt = &voidedAt
+	redemption.VoidReason = reason
+
+	c.forgetRedemption(issuerType, id)
+	return redemption, nil
+}
+
+// restoreRedemption undoes voidRedemption, unless the token has been redeemed again
+// since it was voided
+func (c *Server) restoreRedemption(issuerType, id string) (*Redemption, error) {
+	redemption := &Redemption{IssuerType: issuerType, Id: id}
+	err := c.db.QueryRow(
+		`UPDATE redemptions SET voided_at = NULL, void_reason = NULL
+		WHERE `+issuerTypeNames("$1")+` AND (id_hash = $2 OR (id_hash IS NULL AND id = $3)) AND voided_at IS NOT NULL
+		RETURNING ts, payload`,
+		issuerType, c.redemptionIDHash(id), id).Scan(&redemption.Timestamp, &redemption.Payload)
+	if err == sql.ErrNoRows {
+		return nil, RedemptionNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.forgetRedemption(issuerType, id)
+	if c.dualWrites(issuerType) {
+		if err := c.copyRedemptionToDynamo(*redemption); err != nil {
+			return nil, err
+		}
+	}
+	return redemption, nil
+}
+
+// forgetRedemption drops any cached state of a redemption on this instance
+func (c *Server) forgetRedemption(issuerType, id string) {
+	if c.caches != nil {
+		c.caches["redemptions"].Delete(fmt.Sprintf("%s:%s", issuerType, id))
+		c.caches["redeemed"].Delete(fmt.Sprintf("%s:%s", issuerType, id))
+	}
+}
+
+func (c *Server) redemptionVoidHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	return c.correctRedemption(w, r, AuditRedemptionVoid, func(issuerType, id, reason string) (*Redemption, error) {
+		return c.voidRedemption(issuerType, id, reason)
+	})
+}
+
+func (c *Server) redemptionRestoreHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	return c.correctRedemption(w, r, AuditRedemptionRestore, func(issuerType, id, reason string) (*Redemption, error) {
+		return c.restoreRedemption(issuerType, id)
+	})
+}
+
+// correctRedemption applies a void or restore and records it in the audit log, which
+// keeps the history of corrections since restoring clears the void of the row
+func (c *Server) correctRedemption(w http.ResponseWriter, r *http.Request, action string, correct func(issuerType, id, reason string) (*Redemption, error)) *handlers.AppError {
+	var req RedemptionCorrectionRequest
+	if appErr := decodeTokenRequest(w, r, c.adminLimit(), &req); appErr != nil {
+		return appErr
+	}
+	if req.Issuer == "" || req.TokenPreimage == nil {
+		return &handlers.AppError{
+			Message: "Missing issuer or preimage",
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if req.Reason == "" {
+		return &handlers.AppError{
+			Message: ErrVoidReasonRequired.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	tokenID, err := req.TokenPreimage.MarshalText()
+	if err != nil {
+		return handlers.WrapError("Could not parse the token preimage", err)
+	}
+	issuerType := c.resolveIssuerType(req.Issuer)
+
+	redemption, err := correct(issuerType, string(tokenID), req.Reason)
+	if errors.Is(err, ErrNotFound) {
+		return &handlers.AppError{
+			Message: "No matching redemption",
+			Code:    http.StatusNotFound,
+		}
+	}
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not update redemption",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	// Preimages are kept out of the audit log, the salted hash identifies the redemption
+	entry := newAuditEntry(r, action, nil)
+	entry.IssuerType = issuerType
+	entry.Details = fmt.Sprintf("id_hash=%s reason=%q", c.redemptionIDHash(string(tokenID)), req.Reason)
+	c.recordAudit(entry)
+
+	return encodeResponse(w, redemption)
+}
+
+// redemptionRouter always requires a valid bearer token since voiding a redemption
+// lifts double spend protection for the token
+func (c *Server) redemptionRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(c.requireReady)
+	r.Use(tokenAuthorizedOnly)
+	r.Use(operatorOnly)
+	r.Use(c.requireSignature)
+	r.Method(http.MethodPost, "/void", middleware.InstrumentHandler("VoidRedemption", c.appHandler(c.redemptionVoidHandler)))
+	r.Method(http.MethodPost, "/restore", middleware.InstrumentHandler("RestoreRedemption", c.appHandler(c.redemptionRestoreHandler)))
+	r.Method(http.MethodGet, "/attributes", middleware.InstrumentHandler("GetRedemptionAttributes", c.appHandler(c.redemptionAttributesHandler)))
+	r.Method(http.MethodGet, "/duplicates", middleware.InstrumentHandler("GetDuplicateAttempts", c.appHandler(c.duplicateAttemptsHandler)))
+	return r
+}
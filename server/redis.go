@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// RedemptionStorePostgres records redemptions in Postgres, the default
+	RedemptionStorePostgres = "postgres"
+	// RedemptionStoreRedis records redemptions in Redis only, with SET NX as the
+	// double spend check and a TTL covering the validity of the issuer
+	RedemptionStoreRedis = "redis"
+
+	redisRedemptionPrefix = "redemption:"
+	defaultRedisTimeoutMs = 100
+)
+
+var (
+	ErrRedisDisabled          = errors.New("Redis redemption store is not configured")
+	ErrInvalidRedemptionStore = errors.New("redemption_store must be postgres or redis")
+	ErrRedisRedemptionExpiry  = errors.New("Issuers using the redis redemption store must expire")
+	ErrMixedRedemptionStores  = errors.New("Bulk redemptions can not mix issuers using different redemption stores")
+
+	redisRedemptionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "redis_redemption_duration_seconds",
+		Help:    "Latency of recording redemptions in Redis",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	})
+)
+
+// RedisConfig configures the Redis redemption store, which issuers opt into with
+// their redemption store
+type RedisConfig struct {
+	// URL is a redis:// or rediss:// URL of a single primary, Redis is not used when empty
+	URL string `json:"url,omitempty"`
+	// TimeoutMs bounds every Redis call, 100 by default
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+}
+
+// redisRedemption is the value stored for a redemption, keyed by the salted hash of
+// the token id so that Redis never holds preimages
+type redisRedemption struct {
+	IssuerType string    `json:"issuer_type"`
+	Timestamp  time.Time `json:"ts"`
+	Payload    string    `json:"payload,omitempty"`
+}
+
+// redeemRedisScript records a set of redemptions only if none of them exist, it
+// returns the 1-based index of the first one that does, 0 once all are recorded.
+// ARGV holds the value and the TTL in milliseconds of each key in turn.
+var redeemRedisScript = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+  if redis.call("EXISTS", key) == 1 then
+    return i
+  end
+end
+for i, key in ipairs(KEYS) do
+  redis.call("SET", key, ARGV[2*i-1], "PX", ARGV[2*i])
+end
+return 0
+`)
+
+// initRedis creates the Redis client, it does nothing unless a URL is configured
+func (c *Server) initRedis() error {
+	if c.Redis.URL == "" {
+		return nil
+	}
+
+	options, err := redis.ParseURL(c.Redis.URL)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(c.Redis.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultRedisTimeoutMs * time.Millisecond
+	}
+	options.DialTimeout = timeout
+	options.ReadTimeout = timeout
+	options.WriteTimeout = timeout
+	// Calls are retried by c.retry, which knows which of them are idempotent
+	options.MaxRetries = 0
+	c.redis = redis.NewClient(options)
+	return nil
+}
+
+// redisRedemptions reports whether redemptions of an issuer type are recorded in Redis
+func (c *Server) redisRedemptions(issuerType string) bool {
+	issuers, err := c.fetchIssuers(issuerType)
+	return err == nil && issuers[0].RedemptionStore == RedemptionStoreRedis
+}
+
+// redisRedemptionKey returns the key of a token id, ids are unique across issuer types
+// as they are in Postgres so that renaming a type keeps its redemptions
+func (c *Server) redisRedemptionKey(id string) string {
+	return redisRedemptionPrefix + c.redemptionIDHash(id)
+}
+
+// redisRedemptionTTL keeps a redemption until every issuer of the type that could have
+// signed the token has expired, allowing for clock skew
+func (c *Server) redisRedemptionTTL(issuerType string, now time.Time) (time.Duration, error) {
+	issuers, err := c.fetchIssuers(issuerType)
+	if err != nil {
+		return 0, err
+	}
+	var expiresAt time.Time
+	for _, issuer := range issuers {
+		if issuer.ExpiresAt.IsZero() {
+			return 0, ErrRedisRedemptionExpiry
+		}
+		if issuer.ExpiresAt.After(expiresAt) {
+			expiresAt = issuer.ExpiresAt
+		}
+	}
+	return expiresAt.Sub(now) + time.Duration(c.ClockSkewSec)*time.Second, nil
+}
+
+// redisRedemptionArgs returns the key, value and TTL of a redemption
+func (c *Server) redisRedemptionArgs(issuerType, id, payload string, now time.Time) (string, string, time.Duration, error) {
+	if c.redis == nil {
+		return "", "", 0, ErrRedisDisabled
+	}
+	ttl, err := c.redisRedemptionTTL(issuerType, now)
+	if err != nil {
+		return "", "", 0, err
+	}
+	value, err := json.Marshal(redisRedemption{IssuerType: issuerType, Timestamp: now.UTC(), Payload: payload})
+	if err != nil {
+		return "", "", 0, err
+	}
+	return c.redisRedemptionKey(id), string(value), ttl, nil
+}
+
+// redeemRedisToken records a redemption unless the token was already redeemed, in
+// which case it returns DuplicateRedemptionError. SET NX is not retried, a retry
+// could find the first attempt's write and reject the token as a duplicate.
+func (c *Server) redeemRedisToken(issuerType, id, payload string) error {
+	key, value, ttl, err := c.redisRedemptionArgs(issuerType, id, payload, time.Now())
+	if err != nil {
+		return err
+	}
+
+	timer := prometheus.NewTimer(redisRedemptionDuration)
+	set, err := c.redis.SetNX(key, value, ttl).Result()
+	timer.ObserveDuration()
+	if err != nil {
+		return err
+	}
+	if !set {
+		return DuplicateRedemptionError
+	}
+	return nil
+}
+
+// redeemRedisTokens records a set of redemptions atomically, either all of them are
+// recorded or, if any token was already redeemed, none are and the index of that
+// token is returned along with DuplicateRedemptionError
+func (c *Server) redeemRedisTokens(issuerTypes, ids, payloads []string) (int, error) {
+	now := time.Now()
+	keys := make([]string, len(ids))
+	args := make([]interface{}, 0, 2*len(ids))
+	for i := range ids {
+		key, value, ttl, err := c.redisRedemptionArgs(issuerTypes[i], ids[i], payloads[i], now)
+		if err != nil {
+			return i, err
+		}
+		keys[i] = key
+		args = append(args, value, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+
+	timer := prometheus.NewTimer(redisRedemptionDuration)
+	duplicate, err := redeemRedisScript.Run(c.redis, keys, args...).Int()
+	timer.ObserveDuration()
+	if err != nil {
+		return 0, err
+	}
+	if duplicate > 0 {
+		return duplicate - 1, DuplicateRedemptionError
+	}
+	return 0, nil
+}
+
+// deleteRedisRedemption removes a redemption so that the token can be redeemed again
+func (c *Server) deleteRedisRedemption(id string) error {
+	return c.retry("redis_delete", true, func() error {
+		return c.redis.Del(c.redisRedemptionKey(id)).Err()
+	})
+}
+
+// getRedisRedemption reads a redemption, redemptions recorded under a name the type
+// has since been renamed from are found under the new name
+func (c *Server) getRedisRedemption(issuerType, id string) (*Redemption, error) {
+	if c.redis == nil {
+		return nil, ErrRedisDisabled
+	}
+
+	var value string
+	err := c.retry("redis_get", true, func() error {
+		var err error
+		value, err = c.redis.Get(c.redisRedemptionKey(id)).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return nil, RedemptionNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored redisRedemption
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return nil, err
+	}
+	if stored.IssuerType != issuerType && c.resolveIssuerType(stored.IssuerType) != issuerType {
+		return nil, RedemptionNotFoundError
+	}
+	return &Redemption{IssuerType: issuerType, Id: id, Timestamp: stored.Timestamp, Payload: stored.Payload}, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	raven "github.com/getsentry/raven-go"
+	"github.com/go-chi/chi"
+	chiware "github.com/go-chi/chi/middleware"
+)
+
+// ErrorReporter receives the errors that need an operator's attention: 5xx responses,
+// handler panics, storage failures outside of requests and failed periodic jobs.
+// Tags carry the request, issuer type and version the error occurred with.
+type ErrorReporter interface {
+	ReportError(err error, tags map[string]string)
+}
+
+// sentryReporter reports errors to Sentry
+type sentryReporter struct {
+	client *raven.Client
+}
+
+func (s sentryReporter) ReportError(err error, tags map[string]string) {
+	s.client.CaptureError(err, tags)
+}
+
+// initReporting reports errors to Sentry when SentryDSN is set and no other reporter
+// was configured. The default Sentry client is used so that errors reported by the
+// request logger and main carry the same release.
+func (c *Server) initReporting() error {
+	if c.SentryDSN == "" || c.Reporter != nil {
+		return nil
+	}
+	if err := raven.SetDSN(c.SentryDSN); err != nil {
+		return err
+	}
+	raven.SetRelease(Version)
+	raven.SetEnvironment(os.Getenv("ENV"))
+	c.Reporter = sentryReporter{client: raven.DefaultClient}
+	return nil
+}
+
+// reportError hands err to the configured reporter along with the context of r,
+// which is nil for errors outside of requests
+func (c *Server) reportError(r *http.Request, err error, tags map[string]string) {
+	if c.Reporter == nil || err == nil {
+		return
+	}
+	context := map[string]string{"version": Version}
+	if r != nil {
+		context["request_id"] = chiware.GetReqID(r.Context())
+		context["method"] = r.Method
+		context["route"] = routePattern(r)
+		context["client"] = clientKeyID(r)
+		if ip := clientIP(r); ip != nil {
+			context["client_ip"] = ip.String()
+		}
+		if issuerType := issuerTypeParam(r); issuerType != "" {
+			context["issuer_type"] = issuerType
+		}
+	}
+	for key, value := range tags {
+		if value != "" {
+			context[key] = value
+		}
+	}
+	c.Reporter.ReportError(err, context)
+}
+
+// appHandler is handlers.AppHandler reporting the errors of 5xx responses. 503s are
+// left out since they shed load rather than signal a failure.
+func (c *Server) appHandler(h handlers.AppHandler) handlers.AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+		appErr := h(w, r)
+		if appErr != nil && appErr.Code >= http.StatusInternalServerError && appErr.Code != http.StatusServiceUnavailable {
+			err := appErr.Error
+			if err == nil {
+				err = errors.New(appErr.Message)
+			}
+			c.reportError(r, err, map[string]string{"message": appErr.Message})
+		}
+		return appErr
+	}
+}
+
+// routePattern is the matched route of r, falling back to its path before routing
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return rctx.RoutePattern()
+	}
+	return r.URL.Path
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultSigningMaxSkew = 5 * time.Minute
+	signingNonceInterval  = 10 * time.Minute
+	signingMinNonce       = 16
+	signingMaxNonce       = 128
+	signingMinSecret      = 32
+
+	signingAlgHMAC    = "hmac"
+	signingAlgEd25519 = "ed25519"
+
+	// Headers of signed requests
+	SignatureKeyIDHeader     = "X-Signature-Key-Id"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+	SignatureHeader          = "X-Signature"
+)
+
+// ErrorCodeRequestSignature is the data.error_code of admin requests rejected for a
+// missing, invalid, stale or replayed signature, data.reason tells which
+const ErrorCodeRequestSignature = "request_signature"
+
+// Reasons signed requests are rejected for, as data.reason
+var (
+	errSignatureMissing   = errors.New("missing")
+	errSignatureKey       = errors.New("unknown_key")
+	errSignatureTimestamp = errors.New("stale")
+	errSignatureNonce     = errors.New("invalid_nonce")
+	errSignatureInvalid   = errors.New("invalid")
+	errSignatureReplayed  = errors.New("replayed")
+
+	signatureMessages = map[error]string{
+		errSignatureMissing:   "Request must be signed",
+		errSignatureKey:       "Request is signed with an unknown key",
+		errSignatureTimestamp: "Request signature timestamp is too far from the server clock",
+		errSignatureNonce:     "Request signature nonce must be 16 to 128 characters",
+		errSignatureInvalid:   "Request signature is invalid",
+		errSignatureReplayed:  "Request was already served",
+	}
+
+	signatureFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "request_signature_failure_count",
+		Help: "Number of admin requests rejected for their signature, by reason",
+	}, []string{"reason"})
+)
+
+// RequestSigningConfig requires admin requests to be signed on top of their bearer
+// token, so that a leaked token alone can not rotate or revoke keys and captured
+// requests can not be replayed
+type RequestSigningConfig struct {
+	// Keys are id:hmac:<hex secret> or id:ed25519:<base64 public key> entries, admin
+	// requests are only required to be signed when there are keys
+	Keys []string `json:"keys,omitempty"`
+	// MaxSkewSec is how far the timestamp of a signed request may be from the server
+	// clock, 300 by default. Nonces are remembered for twice as long.
+	MaxSkewSec int `json:"max_skew_sec,omitempty"`
+}
+
+type signingKey struct {
+	alg    string
+	secret []byte
+	public ed25519.PublicKey
+}
+
+// parseSigningKeys parses the entries of RequestSigningConfig.Keys, returning the
+// entries that are invalid
+func parseSigningKeys(entries []string) (map[string]signingKey, []string) {
+	keys := map[string]signingKey{}
+	var invalid []string
+	for _, entry := range entries {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			invalid = append(invalid, parts[0])
+			continue
+		}
+		id, alg, value := parts[0], parts[1], parts[2]
+		switch alg {
+		case signingAlgHMAC:
+			secret, err := hex.DecodeString(value)
+			if err == nil && len(secret) >= signingMinSecret {
+				keys[id] = signingKey{alg: alg, secret: secret}
+				continue
+			}
+		case signingAlgEd25519:
+			public, err := base64.StdEncoding.DecodeString(value)
+			if err == nil && len(public) == ed25519.PublicKeySize {
+				keys[id] = signingKey{alg: alg, public: ed25519.PublicKey(public)}
+				continue
+			}
+		}
+		invalid = append(invalid, id)
+	}
+	return keys, invalid
+}
+
+// signingPayload is the message signed for a request: its method, path with query,
+// timestamp, nonce and the hex SHA-256 of its body, separated by newlines
+func signingPayload(method, uri, timestamp, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{method, uri, timestamp, nonce, hex.EncodeToString(sum[:])}, "\n"))
+}
+
+func (key signingKey) verify(payload, signature []byte) bool {
+	if key.alg == signingAlgEd25519 {
+		return ed25519.Verify(key.public, payload, signature)
+	}
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), signature)
+}
+
+func (c *Server) signingMaxSkew() time.Duration {
+	if c.RequestSigning.MaxSkewSec > 0 {
+		return time.Duration(c.RequestSigning.MaxSkewSec) * time.Second
+	}
+	return defaultSigningMaxSkew
+}
+
+// rememberNonce records the nonce of a signed request, failing with
+// errSignatureReplayed when the key already signed a request with it
+func (c *Server) rememberNonce(keyID, nonce string) error {
+	result, err := c.db.Exec(
+		`INSERT INTO request_nonces(key_id, nonce) VALUES ($1, $2) ON CONFLICT DO NOTHING`, keyID, nonce)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return errSignatureReplayed
+	}
+	return nil
+}
+
+// verifySignature checks the signature headers of a request against its body
+func (c *Server) verifySignature(keys map[string]signingKey, r *http.Request, body []byte, now time.Time) error {
+	keyID := r.Header.Get(SignatureKeyIDHeader)
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	nonce := r.Header.Get(SignatureNonceHeader)
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(SignatureHeader))
+	if keyID == "" || timestamp == "" || nonce == "" || err != nil || len(signature) == 0 {
+		return errSignatureMissing
+	}
+	key, ok := keys[keyID]
+	if !ok {
+		return errSignatureKey
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errSignatureTimestamp
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > c.signingMaxSkew() || skew < -c.signingMaxSkew() {
+		return errSignatureTimestamp
+	}
+	if len(nonce) < signingMinNonce || len(nonce) > signingMaxNonce {
+		return errSignatureNonce
+	}
+	if !key.verify(signingPayload(r.Method, r.URL.RequestURI(), timestamp, nonce, body), signature) {
+		return errSignatureInvalid
+	}
+	// Only nonces of valid signatures are stored, so that they can not be filled by
+	// unauthenticated callers
+	return c.rememberNonce(keyID, nonce)
+}
+
+// requireSignature rejects admin requests that are not signed by one of the
+// RequestSigning keys, or replay a request already served
+func (c *Server) requireSignature(next http.Handler) http.Handler {
+	return c.checkSignature(next, false)
+}
+
+// requireSigned is requireSignature for routes that must never be served unsigned,
+// whatever the caller authenticated with. They are refused while no RequestSigning
+// keys are configured.
+func (c *Server) requireSigned(next http.Handler) http.Handler {
+	return c.checkSignature(next, true)
+}
+
+func (c *Server) checkSignature(next http.Handler, required bool) http.Handler {
+	keys, _ := parseSigningKeys(c.RequestSigning.Keys)
+	if len(keys) == 0 {
+		if !required {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.AppError{
+				Message: "Request signing has to be configured for this route",
+				Code:    http.StatusForbidden,
+				Data: map[string]interface{}{
+					"error_code": ErrorCodeRequestSignature,
+					"reason":     "unconfigured",
+				},
+			}.ServeHTTP(w, r)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, c.adminLimit()))
+		if err != nil {
+			handlers.AppError{
+				Message: ErrRequestTooLarge.Error(),
+				Code:    http.StatusRequestEntityTooLarge,
+				Data: map[string]interface{}{
+					"max_bytes": c.adminLimit(),
+				},
+			}.ServeHTTP(w, r)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if err := c.verifySignature(keys, r, body, time.Now()); err != nil {
+			var appErr *handlers.AppError
+			if message, ok := signatureMessages[err]; ok {
+				signatureFailureCounter.With(prometheus.Labels{"reason": err.Error()}).Inc()
+				appErr = &handlers.AppError{
+					Message: message,
+					Code:    http.StatusUnauthorized,
+					Data: map[string]interface{}{
+						"error_code": ErrorCodeRequestSignature,
+						"reason":     err.Error(),
+					},
+				}
+			} else {
+				appErr = storageAppError(err, "Could not check request nonce")
+			}
+			appErr.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pruneNonces deletes the nonces of requests whose timestamp is too old to be accepted
+func (c *Server) pruneNonces(now time.Time) (int64, error) {
+	result, err := c.db.Exec(`DELETE FROM request_nonces WHERE seen_at < $1`, now.Add(-2*c.signingMaxSkew()).UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (c *Server) pruneNoncesPeriodically() {
+	for {
+		if count, err := c.pruneNonces(time.Now()); err != nil {
+			lg.Errorf("Could not prune request nonces: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "prune_request_nonces"})
+		} else if count > 0 {
+			lg.Infof("Pruned %d request nonces", count)
+		}
+		time.Sleep(signingNonceInterval)
+	}
+}
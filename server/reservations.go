@@ -0,0 +1,479 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/go-chi/chi"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	defaultReservationWindowSec = 300
+	reservationPruneInterval    = time.Hour
+
+	// ErrorCodeTokenReserved is the data.error_code of redemptions rejected because
+	// another caller holds a reservation of the token
+	ErrorCodeTokenReserved = "token_reserved"
+	// ErrorCodeReservationExpired is the data.error_code of commits of reservations
+	// that ran out, the token may have been reserved or redeemed by another caller since
+	ErrorCodeReservationExpired = "reservation_expired"
+
+	// A reservation is reserved until it is committed, which spends the token, or
+	// aborted, which releases it. Reservations that are neither release the token
+	// once they expire.
+	ReservationReserved  = "reserved"
+	ReservationCommitted = "committed"
+	ReservationAborted   = "aborted"
+)
+
+var (
+	ErrTokenReserved       = errors.New("Token is reserved by another redemption")
+	ErrReservationNotFound = newStorageError(ErrNotFound, "Reservation not found")
+	ErrReservationExpired  = errors.New("Reservation has expired")
+	ErrReservationClosed   = errors.New("Reservation was already committed or aborted")
+
+	reservationCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "token_reservation_count",
+		Help: "Number of tokens reserved, and of reservations committed and aborted",
+	}, []string{"issuer_type", "state"})
+)
+
+// BlindedTokenVerifyRequest checks a redemption without recording it. ReserveSeconds
+// holds the token for that long, so that only a redemption giving the returned
+// reservation ID can spend it in the meantime.
+type BlindedTokenVerifyRequest struct {
+	Payload        string                        `json:"payload"`
+	TokenPreimage  *crypto.TokenPreimage         `json:"t"`
+	Signature      *crypto.VerificationSignature `json:"signature"`
+	ReserveSeconds int                           `json:"reserve_seconds,omitempty"`
+}
+
+// BlindedTokenVerifyResponse is returned for tokens that can be redeemed
+type BlindedTokenVerifyResponse struct {
+	ReservationID string     `json:"reservation_id,omitempty"`
+	ReservedUntil *time.Time `json:"reserved_until,omitempty"`
+}
+
+// reservationFrozenError and reservationRevokedError reject commits of reservations
+// whose issuer type was frozen or whose issuer was revoked since the token was reserved
+type reservationFrozenError struct{ freeze *IssuerFreeze }
+
+func (e *reservationFrozenError) Error() string { return "Issuer type is frozen" }
+
+type reservationRevokedError struct{ issuer *Issuer }
+
+func (e *reservationRevokedError) Error() string { return "Token was signed by a revoked issuer" }
+
+// TokenReservation describes a reservation once it is committed or aborted
+type TokenReservation struct {
+	ID         string    `json:"id"`
+	IssuerType string    `json:"issuer_type"`
+	State      string    `json:"state"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+const reservationColumns = `reservation_id, issuer_type, state, created_at, expires_at`
+
+func scanReservation(row *sql.Row) (*TokenReservation, error) {
+	var reservation TokenReservation
+	if err := row.Scan(&reservation.ID, &reservation.IssuerType, &reservation.State, &reservation.CreatedAt, &reservation.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// reservationWindow is the longest a token can be reserved for, and how long the
+// reservation endpoint reserves tokens for by default
+func (c *Server) reservationWindow() int {
+	if c.ReservationWindowSec > 0 {
+		return c.ReservationWindowSec
+	}
+	return defaultReservationWindowSec
+}
+
+// blindedTokenVerifyHandler answers as a redemption of the token would, without
+// spending it
+func (c *Server) blindedTokenVerifyHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	return c.verifyToken(w, r, false)
+}
+
+// blindedTokenReserveHandler verifies a token and reserves it for the reservation
+// window unless the request asks for less
+func (c *Server) blindedTokenReserveHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	return c.verifyToken(w, r, true)
+}
+
+func (c *Server) verifyToken(w http.ResponseWriter, r *http.Request, reserve bool) *handlers.AppError {
+	if issuerType := issuerTypeParam(r); issuerType != "" {
+		issuers, lookupErr := c.getIssuers(issuerType)
+		if lookupErr != nil && lookupErr.Code != http.StatusNotFound {
+			return lookupErr
+		}
+
+		var request BlindedTokenVerifyRequest
+
+		if appErr := decodeTokenRequest(w, r, c.redemptionLimit(), &request); appErr != nil {
+			return appErr
+		}
+
+		if request.TokenPreimage == nil || request.Signature == nil {
+			return &handlers.AppError{
+				Message: "Empty request",
+				Code:    http.StatusBadRequest,
+			}
+		}
+		if request.ReserveSeconds < 0 || request.ReserveSeconds > c.reservationWindow() {
+			return &handlers.AppError{
+				Message: "reserve_seconds must not exceed the reservation window",
+				Code:    http.StatusBadRequest,
+				Data: map[string]interface{}{
+					"reservation_window_sec": c.reservationWindow(),
+				},
+			}
+		}
+		if reserve && request.ReserveSeconds == 0 {
+			request.ReserveSeconds = c.reservationWindow()
+		}
+
+		if appErr := c.verifyRedemptionAppError(issuerType, issuers, lookupErr, request.TokenPreimage, request.Signature, request.Payload); appErr != nil {
+			return appErr
+		}
+		issuerType = issuers[0].IssuerType
+		if appErr := c.frozenAppError(issuerType, FreezeRedemption); appErr != nil {
+			return appErr
+		}
+		// Verifying and reserving lead up to committing a reservation
+		if appErr := issuerFlagAppError(issuers[0], request.Payload, false, true); appErr != nil {
+			return appErr
+		}
+
+		preimageTxt, err := request.TokenPreimage.MarshalText()
+		if err != nil {
+			return handlers.WrapError("Could not parse the token preimage", err)
+		}
+		id := string(preimageTxt)
+		if _, err := c.fetchRedemption(issuerType, id); err == nil {
+			return c.duplicateRedemptionAppError(DuplicateRedemptionError, issuerType, request.TokenPreimage, request.Payload)
+		} else if !errors.Is(err, ErrNotFound) {
+			return storageAppError(err, "Could not check token redemption")
+		}
+
+		if request.ReserveSeconds == 0 {
+			if appErr := c.checkReservation(id, ""); appErr != nil {
+				return appErr
+			}
+			return encodeResponse(w, BlindedTokenVerifyResponse{})
+		}
+
+		// Reserved payloads are persisted as the redemption would persist them
+		payload, err := c.applyPayloadPolicy(issuers[0], request.Payload)
+		if err != nil {
+			return &handlers.AppError{
+				Error:   err,
+				Message: "Could not apply payload policy",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		signatureTxt, err := request.Signature.MarshalText()
+		if err != nil {
+			return handlers.WrapError("Could not parse the token signature", err)
+		}
+		reservationID, until, err := c.reserveToken(issuerType, id, payload, string(signatureTxt), request.Payload, request.ReserveSeconds)
+		if err == ErrTokenReserved {
+			return tokenReservedAppError()
+		}
+		if err != nil {
+			return storageAppError(err, "Could not reserve token")
+		}
+		return encodeResponse(w, BlindedTokenVerifyResponse{ReservationID: reservationID, ReservedUntil: &until})
+	}
+	return nil
+}
+
+// reserveToken holds a token for its redemption with a payload, unless another
+// reservation of it is still running. The signature and the payload as requested are
+// kept to check the token against revoked issuers when the reservation is committed.
+func (c *Server) reserveToken(issuerType, id, payload, signature, requestPayload string, seconds int) (string, time.Time, error) {
+	reservationID := uuid.NewV4().String()
+	var until time.Time
+	err := c.db.QueryRow(
+		`INSERT INTO token_reservations(id_hash, issuer_type, reservation_id, expires_at, token_id, payload, state, signature, request_payload)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4), $5, $6, $7, $8, $9)
+		ON CONFLICT (id_hash) DO UPDATE SET issuer_type = EXCLUDED.issuer_type,
+			reservation_id = EXCLUDED.reservation_id, expires_at = EXCLUDED.expires_at, token_id = EXCLUDED.token_id,
+			payload = EXCLUDED.payload, state = EXCLUDED.state, created_at = EXCLUDED.created_at,
+			signature = EXCLUDED.signature, request_payload = EXCLUDED.request_payload
+		WHERE token_reservations.expires_at <= NOW() OR token_reservations.state <> $7
+		RETURNING expires_at`,
+		c.redemptionIDHash(id), issuerType, reservationID, seconds, id, payload, ReservationReserved, signature, requestPayload).Scan(&until)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, ErrTokenReserved
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	reservationCounter.With(prometheus.Labels{"issuer_type": issuerType, "state": ReservationReserved}).Inc()
+	return reservationID, until, nil
+}
+
+// checkReservation rejects redemptions of a token reserved under another reservation
+// ID. Reservations only order callers, the redemptions table still prevents double
+// spends, so the check lets redemptions through when Postgres can not be reached.
+func (c *Server) checkReservation(id, reservationID string) *handlers.AppError {
+	var held string
+	err := c.db.QueryRow(
+		`SELECT reservation_id FROM token_reservations WHERE id_hash = $1 AND state = $2 AND expires_at > NOW()`,
+		c.redemptionIDHash(id), ReservationReserved).Scan(&held)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		lg.Errorf("Could not check token reservation: %s", err)
+		return nil
+	}
+	if held != reservationID {
+		return tokenReservedAppError()
+	}
+	return nil
+}
+
+// checkPreimageReservation is checkReservation for a token preimage
+func (c *Server) checkPreimageReservation(preimage *crypto.TokenPreimage, reservationID string) *handlers.AppError {
+	preimageTxt, err := preimage.MarshalText()
+	if err != nil {
+		return handlers.WrapError("Could not parse the token preimage", err)
+	}
+	return c.checkReservation(string(preimageTxt), reservationID)
+}
+
+// closeReservation marks the reservation of a token redeemed directly as committed
+func (c *Server) closeReservation(preimage *crypto.TokenPreimage, reservationID string) {
+	if reservationID == "" {
+		return
+	}
+	preimageTxt, err := preimage.MarshalText()
+	if err != nil {
+		return
+	}
+	if _, err := c.db.Exec(`UPDATE token_reservations SET state = $3 WHERE id_hash = $1 AND reservation_id = $2`,
+		c.redemptionIDHash(string(preimageTxt)), reservationID, ReservationCommitted); err != nil {
+		lg.Errorf("Could not close token reservation: %s", err)
+	}
+}
+
+// commitReservation redeems a reserved token with the payload it was reserved with.
+// Freezes and revocations since the token was reserved are checked once the
+// reservation is locked. Redemptions stored in Postgres alone are written in the same
+// transaction as the reservation, so that a commit failing midway can be retried.
+// Those stored in Redis or DynamoDB are written before the reservation is closed.
+func (c *Server) commitReservation(issuerType, reservationID string) (*TokenReservation, error) {
+	if _, err := uuid.FromString(reservationID); err != nil {
+		return nil, ErrReservationNotFound
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var tokenID, payload, signatureTxt, requestPayload sql.NullString
+	var live bool
+	var reservation TokenReservation
+	err = tx.QueryRow(
+		`SELECT `+reservationColumns+`, token_id, payload, signature, request_payload, expires_at > NOW() FROM token_reservations
+		WHERE reservation_id = $1 AND issuer_type = $2 FOR UPDATE`, reservationID, issuerType).Scan(
+		&reservation.ID, &reservation.IssuerType, &reservation.State, &reservation.CreatedAt, &reservation.ExpiresAt,
+		&tokenID, &payload, &signatureTxt, &requestPayload, &live)
+	if err == sql.ErrNoRows {
+		return nil, ErrReservationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reservation.State != ReservationReserved {
+		return nil, ErrReservationClosed
+	}
+	if !live {
+		return nil, ErrReservationExpired
+	}
+
+	freeze := &IssuerFreeze{IssuerType: issuerType}
+	err = tx.QueryRow(`SELECT operations, reason, actor, frozen_at FROM issuer_freezes WHERE issuer_type = $1`, issuerType).Scan(
+		&freeze.Operations, &freeze.Reason, &freeze.Actor, &freeze.FrozenAt)
+	if err == nil && freeze.stops(FreezeRedemption) {
+		return nil, &reservationFrozenError{freeze}
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var preimage crypto.TokenPreimage
+	if err := preimage.UnmarshalText([]byte(tokenID.String)); err != nil {
+		return nil, err
+	}
+	// Reservations made before signatures were kept are only checked when reserved
+	if signatureTxt.Valid {
+		var signature crypto.VerificationSignature
+		if err := signature.UnmarshalText([]byte(signatureTxt.String)); err != nil {
+			return nil, err
+		}
+		if revoked := c.revokedIssuerOf(issuerType, &preimage, &signature, requestPayload.String); revoked != nil {
+			return nil, &reservationRevokedError{revoked}
+		}
+	}
+
+	stored := !c.redisRedemptions(issuerType) && !c.dualWrites(issuerType)
+	if stored {
+		incrementCounter(redeemTokenCounter)
+		if c.redeemedRecently(issuerType, tokenID.String) || c.redemptionQueue != nil && c.isQueued(tokenID.String) {
+			err = DuplicateRedemptionError
+		} else {
+			err = c.redeemTokenWithDB(tx, issuerType, &preimage, payload.String)
+		}
+		if errors.Is(err, ErrDuplicate) {
+			c.rememberRedemption(issuerType, tokenID.String)
+		}
+	} else {
+		err = c.redeemTransformedToken(issuerType, &preimage, payload.String)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE token_reservations SET state = $2 WHERE reservation_id = $1`, reservationID, ReservationCommitted); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if stored {
+		c.rememberRedemption(issuerType, tokenID.String)
+		c.publishRedemption(issuerType, &preimage, payload.String)
+		c.countRedemptions(issuerType, 1)
+	}
+
+	reservation.State = ReservationCommitted
+	reservationCounter.With(prometheus.Labels{"issuer_type": issuerType, "state": ReservationCommitted}).Inc()
+	return &reservation, nil
+}
+
+// abortReservation releases a reserved token, aborting an aborted or expired
+// reservation does nothing
+func (c *Server) abortReservation(issuerType, reservationID string) (*TokenReservation, error) {
+	if _, err := uuid.FromString(reservationID); err != nil {
+		return nil, ErrReservationNotFound
+	}
+
+	reservation, err := scanReservation(c.db.QueryRow(
+		`UPDATE token_reservations SET state = CASE WHEN state = $3 THEN $4 ELSE state END
+		WHERE reservation_id = $1 AND issuer_type = $2 RETURNING `+reservationColumns,
+		reservationID, issuerType, ReservationReserved, ReservationAborted))
+	if err == sql.ErrNoRows {
+		return nil, ErrReservationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reservation.State == ReservationCommitted {
+		return nil, ErrReservationClosed
+	}
+	reservationCounter.With(prometheus.Labels{"issuer_type": issuerType, "state": ReservationAborted}).Inc()
+	return reservation, nil
+}
+
+func (c *Server) reservationCommitHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	if issuerType := issuerTypeParam(r); issuerType != "" {
+		issuerType = c.resolveIssuerType(issuerType)
+		if appErr := c.frozenAppError(issuerType, FreezeRedemption); appErr != nil {
+			return appErr
+		}
+		reservation, err := c.commitReservation(issuerType, chi.URLParam(r, "id"))
+		if err != nil {
+			return reservationAppError(err, "Could not commit reservation")
+		}
+		c.recordUsage(r, 0, 1)
+		c.enrichRedemptions(r, issuerType, 1)
+		return encodeResponse(w, reservation)
+	}
+	return nil
+}
+
+func (c *Server) reservationAbortHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	if issuerType := issuerTypeParam(r); issuerType != "" {
+		reservation, err := c.abortReservation(c.resolveIssuerType(issuerType), chi.URLParam(r, "id"))
+		if err != nil {
+			return reservationAppError(err, "Could not abort reservation")
+		}
+		return encodeResponse(w, reservation)
+	}
+	return nil
+}
+
+func reservationAppError(err error, message string) *handlers.AppError {
+	var frozen *reservationFrozenError
+	var revoked *reservationRevokedError
+	switch {
+	case errors.As(err, &frozen):
+		return frozen.freeze.appError(FreezeRedemption)
+	case errors.As(err, &revoked):
+		return revokedIssuerAppError(revoked.issuer)
+	case errors.Is(err, ErrReservationNotFound):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
+		}
+	case err == ErrReservationExpired:
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusGone,
+			Data: map[string]interface{}{
+				"error_code": ErrorCodeReservationExpired,
+			},
+		}
+	case err == ErrReservationClosed:
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	}
+	return storageAppError(err, message)
+}
+
+func tokenReservedAppError() *handlers.AppError {
+	return &handlers.AppError{
+		Message: ErrTokenReserved.Error(),
+		Code:    http.StatusConflict,
+		Data: map[string]interface{}{
+			"error_code": ErrorCodeTokenReserved,
+		},
+	}
+}
+
+// pruneReservations deletes expired reservations, whatever their state
+func (c *Server) pruneReservations() (int64, error) {
+	result, err := c.db.Exec(`DELETE FROM token_reservations WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (c *Server) pruneReservationsPeriodically() {
+	for {
+		if count, err := c.pruneReservations(); err != nil {
+			lg.Errorf("Could not prune token reservations: %s", err)
+			c.reportError(nil, err, map[string]string{"job": "prune_reservations"})
+		} else if count > 0 {
+			lg.Infof("Pruned %d expired token reservations", count)
+		}
+		time.Sleep(reservationPruneInterval)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultRetryAttempts       = 3
+	defaultRetryInitialBackoff = 25 * time.Millisecond
+	defaultRetryMaxBackoff     = 500 * time.Millisecond
+)
+
+var (
+	retryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "retry_count",
+		Help: "Number of calls retried after a transient error",
+	}, []string{"operation"})
+
+	retryExhaustedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "retry_exhausted_count",
+		Help: "Number of calls that still failed with a transient error after every attempt",
+	}, []string{"operation"})
+)
+
+// RetryConfig retries Postgres and DynamoDB calls that fail with transient errors,
+// so that brief outages are not returned to clients
+type RetryConfig struct {
+	// MaxAttempts includes the first attempt, 3 by default, 1 disables retries
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// InitialBackoffMs doubles after every attempt up to MaxBackoffMs, each wait is
+	// drawn at random below it. 25 and 500 by default.
+	InitialBackoffMs int `json:"initial_backoff_ms,omitempty"`
+	MaxBackoffMs     int `json:"max_backoff_ms,omitempty"`
+}
+
+// retry calls fn until it succeeds, fails with an error that is not transient or
+// runs out of attempts. Calls that are not idempotent are only retried when the
+// error guarantees they had no effect, a redemption retried after its connection
+// dropped could otherwise be reported as a duplicate of itself. The final error is
+// classified by kind.
+func (c *Server) retry(operation string, idempotent bool, fn func() error) error {
+	attempts := c.Retry.MaxAttempts
+	if attempts == 0 {
+		attempts = defaultRetryAttempts
+	}
+	backoff := time.Duration(c.Retry.InitialBackoffMs) * time.Millisecond
+	if backoff == 0 {
+		backoff = defaultRetryInitialBackoff
+	}
+	maxBackoff := time.Duration(c.Retry.MaxBackoffMs) * time.Millisecond
+	if maxBackoff == 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err, idempotent) {
+			return classifyStorageError(err)
+		}
+		if attempt >= attempts {
+			retryExhaustedCounter.With(prometheus.Labels{"operation": operation}).Inc()
+			return classifyStorageError(err)
+		}
+
+		retryCounter.With(prometheus.Labels{"operation": operation}).Inc()
+		time.Sleep(time.Duration(rand.Int63n(int64(backoff)) + 1))
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// retryable reports whether err is transient. Serialization failures, deadlocks and
+// throttling are rejected before anything is applied, so they are always retried.
+// Dropped connections and server errors leave the outcome unknown.
+func retryable(err error, idempotent bool) bool {
+	switch {
+	case errors.Is(err, driver.ErrBadConn):
+		// database/sql only returns ErrBadConn before the statement was sent
+		return true
+	case errors.Is(err, ErrDependencyTimeout):
+		// The call may still complete after the breaker gave up on it
+		return idempotent
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrThrottled), errors.Is(err, ErrNotFound), errors.Is(err, ErrDuplicate):
+		// An open breaker and a shedding throttle reject retries as well, the others
+		// are answers
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "40001", pqErr.Code == "40P01", pqErr.Code == "57P03":
+			return true
+		case strings.HasPrefix(string(pqErr.Code), "08"), pqErr.Code == "57P01":
+			return idempotent
+		}
+		return false
+	}
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+	if request.IsErrorRetryable(err) {
+		return idempotent
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return idempotent
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// schemaTable is a table the server relies on, with the columns it reads and writes
+// and the unique keys that uniqueness checks and upserts depend on
+type schemaTable struct {
+	Name       string
+	Columns    []string
+	UniqueKeys [][]string
+}
+
+// expectedSchema is the schema of the latest migration as far as the server uses it.
+// Extra tables, columns and indexes are not reported.
+var expectedSchema = []schemaTable{
+	{Name: "issuers", Columns: []string{"id", "issuer_type", "signing_key", "max_tokens", "version", "created_at", "bucket_seconds", "buffer",
+		"expires_at", "rotated_at", "group_id", "rotation_window_days", "valid_days", "redemption_retention_days", "redemption_store",
+		"revoked_at", "revocation_reason", "payload_policy", "flags", "canary_percent"},
+		// issuer_type is only unique among active issuers and among canaries
+		UniqueKeys: [][]string{{"id"}, {"issuer_type"}}},
+	{Name: "issuer_keys", Columns: []string{"id", "issuer_id", "signing_key", "start_at", "end_at", "created_at"},
+		UniqueKeys: [][]string{{"id"}, {"issuer_id", "start_at"}}},
+	{Name: "issuer_groups", Columns: []string{"id", "name", "created_at"},
+		UniqueKeys: [][]string{{"id"}, {"name"}}},
+	{Name: "pending_issuers", Columns: []string{"id", "predecessor_id", "issuer_type", "signing_key", "activates_at", "expires_at", "created_at"},
+		UniqueKeys: [][]string{{"id"}, {"predecessor_id"}}},
+	{Name: "issuer_aliases", Columns: []string{"alias", "issuer_type", "created_at"},
+		UniqueKeys: [][]string{{"alias"}}},
+	{Name: "issuer_freezes", Columns: []string{"issuer_type", "operations", "reason", "actor", "frozen_at"},
+		UniqueKeys: [][]string{{"issuer_type"}}},
+	{Name: "redemptions", Columns: []string{"id", "issuer_type", "ts", "payload", "id_hash", "voided_at", "void_reason"},
+		// The unique id is what rejects double spends
+		UniqueKeys: [][]string{{"id"}}},
+	{Name: "redemption_hash_salt", Columns: []string{"id", "salt"},
+		UniqueKeys: [][]string{{"id"}}},
+	{Name: "redemption_duplicates", Columns: []string{"issuer_type", "hour", "attempts"},
+		UniqueKeys: [][]string{{"issuer_type", "hour"}}},
+	{Name: "duplicate_attempts", Columns: []string{"id", "issuer_type", "id_hash", "payload", "caller", "attempted_at"}},
+	{Name: "redemption_attributes", Columns: []string{"issuer_type", "bucket", "country", "redemptions"},
+		UniqueKeys: [][]string{{"issuer_type", "bucket", "country"}}},
+	{Name: "token_reservations", Columns: []string{"id_hash", "issuer_type", "reservation_id", "expires_at", "token_id", "payload", "state", "created_at", "signature", "request_payload"},
+		UniqueKeys: [][]string{{"id_hash"}, {"reservation_id"}}},
+	{Name: "audit_log", Columns: []string{"id", "ts", "actor", "action", "issuer_id", "issuer_type", "request_id", "details"}},
+	{Name: "api_keys", Columns: []string{"id", "name", "key_hash", "tenant", "created_at", "revoked_at"},
+		UniqueKeys: [][]string{{"id"}, {"name"}, {"key_hash"}}},
+	{Name: "api_key_usage", Columns: []string{"api_key_id", "day", "issued", "redeemed"},
+		UniqueKeys: [][]string{{"api_key_id", "day"}}},
+	{Name: "issuance_samples", Columns: []string{"id", "issuer_id", "issuer_type", "caller", "batch_size", "duration_ms", "sample_percent", "sampled_at"}},
+	{Name: "request_nonces", Columns: []string{"key_id", "nonce", "seen_at"},
+		UniqueKeys: [][]string{{"key_id", "nonce"}}},
+	{Name: "issuance_quota_usage", Columns: []string{"issuer_type", "window_start", "used"},
+		UniqueKeys: [][]string{{"issuer_type", "window_start"}}},
+	{Name: "issuance_receipts", Columns: []string{"log_index", "issuer_id", "issuer_type", "public_key", "token_count", "batch_root", "leaf_hash", "signed_at"},
+		UniqueKeys: [][]string{{"log_index"}}},
+	{Name: "issuance_tree_nodes", Columns: []string{"level", "node_index", "hash"},
+		UniqueKeys: [][]string{{"level", "node_index"}}},
+	{Name: "issuance_tree_state", Columns: []string{"id", "tree_size"}},
+	{Name: "key_ceremonies", Columns: []string{"id", "issuer_type", "request", "shares_required", "contributors", "accumulated_key",
+		"created_by", "created_at", "expires_at"},
+		UniqueKeys: [][]string{{"id"}, {"issuer_type"}}},
+}
+
+// SchemaError lists every difference between the database and the expected schema
+type SchemaError struct {
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return "the database schema does not match the migrations: " + strings.Join(e.Problems, "; ")
+}
+
+// checkSchema verifies that the tables, columns and unique keys the server relies on
+// exist, independently of the recorded migrations, which do not catch migrations that
+// were skipped or schemas that were edited by hand
+func checkSchema(db *sql.DB, expected []schemaTable) error {
+	columns := map[string]bool{}
+	rows, err := db.Query(`SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema()`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return err
+		}
+		columns[table+"."+column] = true
+		columns[table] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	uniqueKeys := map[string]bool{}
+	rows, err = db.Query(`
+		SELECT t.relname, array_agg(a.attname::text ORDER BY a.attname)
+		FROM pg_index i
+		JOIN pg_class t ON t.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = ANY(i.indkey)
+		WHERE i.indisunique AND n.nspname = current_schema()
+		GROUP BY t.relname, i.indexrelid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		var key []string
+		if err := rows.Scan(&table, pq.Array(&key)); err != nil {
+			return err
+		}
+		uniqueKeys[table+" ("+strings.Join(key, ", ")+")"] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, table := range expected {
+		if !columns[table.Name] {
+			problems = append(problems, "table "+table.Name+" is missing")
+			continue
+		}
+		for _, column := range table.Columns {
+			if !columns[table.Name+"."+column] {
+				problems = append(problems, fmt.Sprintf("column %s.%s is missing", table.Name, column))
+			}
+		}
+		for _, key := range table.UniqueKeys {
+			sorted := append([]string{}, key...)
+			sort.Strings(sorted)
+			if !uniqueKeys[table.Name+" ("+strings.Join(sorted, ", ")+")"] {
+				problems = append(problems, fmt.Sprintf("unique index on %s (%s) is missing", table.Name, strings.Join(key, ", ")))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return &SchemaError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultSecretsPoll  = time.Minute
+	defaultSecretsGrace = time.Hour
+
+	secretSourceFile  = "file"
+	secretSourceVault = "vault"
+)
+
+var (
+	secretRotationCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "secret_rotation_count",
+		Help: "Number of rotated secrets applied at runtime, by secret and source",
+	}, []string{"secret", "source"})
+
+	secretReloadFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "secret_reload_failure_count",
+		Help: "Number of secret reloads that failed and kept the previous secrets, by source",
+	}, []string{"source"})
+
+	// sharedTokens holds the shared bearer tokens loaded from secrets, it is package
+	// level like middleware.TokenList
+	sharedTokens = newRotatingTokens()
+)
+
+// SecretsConfig rotates the shared bearer tokens and database credentials without a
+// restart. They are reloaded from File and from the Vault secret, and replaced ones
+// keep working for GraceSec so that the fleet can pick up new ones at its own pace.
+type SecretsConfig struct {
+	// File is a JSON file with the token_list, database_url and database_read_only_url
+	// fields of the Vault secret, it is read at startup and whenever it changes
+	File string `json:"file,omitempty"`
+	// PollSec is how often File and the Vault secret are checked, 60 by default
+	PollSec int `json:"poll_sec,omitempty"`
+	// GraceSec is how long replaced tokens are still accepted and connections opened
+	// with replaced database credentials are kept, 3600 by default
+	GraceSec int `json:"grace_sec,omitempty"`
+}
+
+// rotatingTokens holds the current tokens of each secret source, along with the tokens
+// they replaced until the end of their grace period
+type rotatingTokens struct {
+	mu      sync.RWMutex
+	sources map[string][]string
+	retired map[string]time.Time
+}
+
+func newRotatingTokens() *rotatingTokens {
+	return &rotatingTokens{sources: map[string][]string{}, retired: map[string]time.Time{}}
+}
+
+// set replaces the tokens of a source, the tokens it drops are accepted until the time
+// given. It returns whether the tokens changed.
+func (t *rotatingTokens) set(source string, tokens []string, until time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous := t.sources[source]
+	current := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		current[token] = true
+	}
+	changed := len(previous) != len(current)
+	for _, token := range previous {
+		if !current[token] {
+			t.retired[token] = until
+			changed = true
+		}
+	}
+	for token, retiredUntil := range t.retired {
+		if current[token] || time.Now().After(retiredUntil) {
+			delete(t.retired, token)
+		}
+	}
+	t.sources[source] = tokens
+	return changed
+}
+
+// valid reports whether a token is current or still in its grace period
+func (t *rotatingTokens) valid(token string, now time.Time) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	valid := false
+	for _, tokens := range t.sources {
+		for _, current := range tokens {
+			if subtle.ConstantTimeCompare([]byte(current), []byte(token)) == 1 {
+				valid = true
+			}
+		}
+	}
+	for retired, until := range t.retired {
+		if now.Before(until) && subtle.ConstantTimeCompare([]byte(retired), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// rotatingConnector opens database connections with the current connection URI, so
+// that connections opened after a rotation use the new credentials while open ones
+// keep working
+type rotatingConnector struct {
+	mu  sync.RWMutex
+	uri string
+	// rotated is closed when the URI changes, for connections held outside of the pool
+	rotated chan struct{}
+}
+
+func (c *rotatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.RLock()
+	uri := c.uri
+	c.mu.RUnlock()
+
+	connector, err := pq.NewConnector(uri)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *rotatingConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+func (c *rotatingConnector) current() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.uri
+}
+
+// watch returns the current URI along with a channel closed once it is rotated
+func (c *rotatingConnector) watch() (string, <-chan struct{}) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.uri, c.rotated
+}
+
+func (c *rotatingConnector) rotate(uri string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uri = uri
+	close(c.rotated)
+	c.rotated = make(chan struct{})
+}
+
+// openRotatingDB opens a pool whose credentials can be rotated
+func openRotatingDB(uri string) (*sql.DB, *rotatingConnector) {
+	connector := &rotatingConnector{uri: uri, rotated: make(chan struct{})}
+	return sql.OpenDB(connector), connector
+}
+
+func (c *Server) secretsPoll() time.Duration {
+	if c.Secrets.PollSec > 0 {
+		return time.Duration(c.Secrets.PollSec) * time.Second
+	}
+	return defaultSecretsPoll
+}
+
+func (c *Server) secretsGrace() time.Duration {
+	if c.Secrets.GraceSec > 0 {
+		return time.Duration(c.Secrets.GraceSec) * time.Second
+	}
+	return defaultSecretsGrace
+}
+
+// rotateDatabase switches a pool to a new connection URI once a connection with it
+// succeeds. Connections opened with the previous credentials are closed within the
+// grace period.
+func (c *Server) rotateDatabase(db *sql.DB, connector *rotatingConnector, uri string) (bool, error) {
+	if db == nil || connector == nil || connector.current() == uri {
+		return false, nil
+	}
+
+	probe, _ := openRotatingDB(uri)
+	defer probe.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := probe.PingContext(ctx); err != nil {
+		return false, err
+	}
+
+	connector.rotate(uri)
+
+	// Connections are recycled from then on, which also retires those of later rotations
+	db.SetConnMaxLifetime(c.secretsGrace())
+	return true, nil
+}
+
+// applySecrets rotates the tokens and database credentials found in a secret, the
+// previous ones are kept for whatever could not be applied
+func (c *Server) applySecrets(source string, data map[string]interface{}) {
+	if tokens, ok := data["token_list"].(string); ok {
+		if sharedTokens.set(source, splitList(tokens), time.Now().Add(c.secretsGrace())) {
+			secretRotationCounter.With(prometheus.Labels{"secret": "token_list", "source": source}).Inc()
+			lg.Infof("Rotated the token list from %s", source)
+		}
+	}
+
+	pools := []struct {
+		name      string
+		db        *sql.DB
+		connector *rotatingConnector
+	}{
+		{"database_url", c.db, c.dbConnector},
+		{"database_read_only_url", c.dbReadOnly, c.dbReadOnlyConnector},
+	}
+	for _, pool := range pools {
+		uri, ok := data[pool.name].(string)
+		if !ok || uri == "" {
+			continue
+		}
+		rotated, err := c.rotateDatabase(pool.db, pool.connector, uri)
+		if err != nil {
+			secretReloadFailureCounter.With(prometheus.Labels{"source": source}).Inc()
+			lg.Errorf("Could not rotate %s from %s, keeping the current credentials: %s", pool.name, source, err)
+			c.reportError(nil, err, map[string]string{"job": "secret_rotation", "secret": pool.name})
+		} else if rotated {
+			secretRotationCounter.With(prometheus.Labels{"secret": pool.name, "source": source}).Inc()
+			lg.Infof("Rotated %s from %s", pool.name, source)
+		}
+	}
+}
+
+func (c *Server) readSecretsFile() (map[string]interface{}, []byte, error) {
+	contents, err := ioutil.ReadFile(c.Secrets.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(contents, &data); err != nil {
+		return nil, nil, err
+	}
+	return data, contents, nil
+}
+
+// InitSecrets applies the secrets file at startup, its database URIs override the
+// database config from the environment and flags
+func (c *Server) InitSecrets() error {
+	if c.Secrets.File == "" {
+		return nil
+	}
+	data, contents, err := c.readSecretsFile()
+	if err != nil {
+		return err
+	}
+	c.secretsFile = contents
+
+	if uri, ok := data["database_url"].(string); ok && uri != "" {
+		c.dbConfig.ConnectionURI = uri
+	}
+	if uri, ok := data["database_read_only_url"].(string); ok && uri != "" {
+		c.dbConfig.ReadOnlyConnectionURI = uri
+	}
+	if tokens, ok := data["token_list"].(string); ok {
+		sharedTokens.set(secretSourceFile, splitList(tokens), time.Now())
+	}
+	return nil
+}
+
+// reloadSecrets applies the secrets file when it changed, and the Vault secret when it
+// has no lease or its lease ended. Reading a leased secret again would create new
+// credentials every time.
+func (c *Server) reloadSecrets(leaseEnded bool) {
+	if c.Secrets.File != "" {
+		data, contents, err := c.readSecretsFile()
+		if err != nil {
+			// A file being replaced may be briefly missing or partially written
+			secretReloadFailureCounter.With(prometheus.Labels{"source": secretSourceFile}).Inc()
+			lg.Warnf("Could not read secrets file %s: %s", c.Secrets.File, err)
+		} else if !bytes.Equal(contents, c.secretsFile) {
+			c.applySecrets(secretSourceFile, data)
+			c.secretsFile = contents
+		}
+	}
+	if c.vaultSecret != nil && (leaseEnded || c.vaultSecret.LeaseID == "") {
+		c.reloadVaultSecrets()
+	}
+}
+
+func (c *Server) reloadSecretsPeriodically() {
+	ticker := time.NewTicker(c.secretsPoll())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.reloadSecrets(false)
+		case <-c.vaultLeaseDone:
+			c.reloadSecrets(true)
+		}
+	}
+}
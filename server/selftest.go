@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+)
+
+const (
+	defaultSelfTestTokens = 100
+	maxSelfTestTokens     = 10000
+	selfTestPayload       = "selftest"
+)
+
+var ErrSelfTestRedemption = errors.New("Redemption of a self test token did not verify")
+
+// SelfTestResult has the time taken by each step of issuing and redeeming tokens with
+// a throwaway key, in milliseconds
+type SelfTestResult struct {
+	Tokens   int     `json:"tokens"`
+	BlindMs  float64 `json:"blind_ms"`
+	SignMs   float64 `json:"sign_ms"`
+	ProveMs  float64 `json:"prove_ms"`
+	VerifyMs float64 `json:"verify_ms"`
+	RedeemMs float64 `json:"redeem_ms"`
+	TotalMs  float64 `json:"total_ms"`
+	// SignedPerSecond is the signing throughput of a single worker
+	SignedPerSecond float64 `json:"signed_per_second"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// runSelfTest blinds, signs, proves and redeems n tokens on the calling goroutine.
+// It calls the crypto library directly so that the issuance metrics are unaffected.
+func runSelfTest(n int) (*SelfTestResult, error) {
+	result := &SelfTestResult{Tokens: n}
+	key, err := crypto.RandomSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	started := time.Now()
+
+	step := time.Now()
+	tokens := make([]*crypto.Token, n)
+	blindedTokens := make([]*crypto.BlindedToken, n)
+	for i := range tokens {
+		if tokens[i], err = crypto.RandomToken(); err != nil {
+			return nil, err
+		}
+		blindedTokens[i] = tokens[i].Blind()
+	}
+	result.BlindMs = milliseconds(time.Since(step))
+
+	step = time.Now()
+	signedTokens := make([]*crypto.SignedToken, n)
+	for i, blindedToken := range blindedTokens {
+		if signedTokens[i], err = key.Sign(blindedToken); err != nil {
+			return nil, err
+		}
+	}
+	signing := time.Since(step)
+	result.SignMs = milliseconds(signing)
+	result.SignedPerSecond = float64(n) / signing.Seconds()
+
+	step = time.Now()
+	proof, err := crypto.NewBatchDLEQProof(blindedTokens, signedTokens, key)
+	if err != nil {
+		return nil, err
+	}
+	result.ProveMs = milliseconds(time.Since(step))
+
+	step = time.Now()
+	unblindedTokens, err := proof.VerifyAndUnblind(tokens, blindedTokens, signedTokens, key.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	result.VerifyMs = milliseconds(time.Since(step))
+
+	// Clients sign redemptions ahead, only the server's side is timed
+	signatures := make([]*crypto.VerificationSignature, n)
+	for i, unblindedToken := range unblindedTokens {
+		if signatures[i], err = unblindedToken.DeriveVerificationKey().Sign(selfTestPayload); err != nil {
+			return nil, err
+		}
+	}
+	step = time.Now()
+	for i, unblindedToken := range unblindedTokens {
+		rederived := key.RederiveUnblindedToken(unblindedToken.Preimage())
+		valid, err := rederived.DeriveVerificationKey().Verify(signatures[i], selfTestPayload)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, ErrSelfTestRedemption
+		}
+	}
+	result.RedeemMs = milliseconds(time.Since(step))
+
+	result.TotalMs = milliseconds(time.Since(started))
+	return result, nil
+}
+
+func (c *Server) selfTestHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	n := defaultSelfTestTokens
+	if param := r.URL.Query().Get("tokens"); param != "" {
+		var err error
+		if n, err = strconv.Atoi(param); err != nil || n < 1 || n > maxSelfTestTokens {
+			return &handlers.AppError{
+				Message: fmt.Sprintf("tokens must be between 1 and %d", maxSelfTestTokens),
+				Code:    http.StatusBadRequest,
+			}
+		}
+	}
+
+	result, err := runSelfTest(n)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Self test failed",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return encodeResponse(w, result)
+}
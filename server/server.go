@@ -2,22 +2,30 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"strconv"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/brave-intl/bat-go/middleware"
+	"github.com/brave-intl/bat-go/utils/handlers"
 	"github.com/go-chi/chi"
 	chiware "github.com/go-chi/chi/middleware"
+	"github.com/go-redis/redis/v7"
+	vault "github.com/hashicorp/vault/api"
 	"github.com/pressly/lg"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
@@ -35,7 +43,68 @@ func init() {
 	prometheus.MustRegister(fetchIssuerCounter)
 	prometheus.MustRegister(createIssuerCounter)
 	prometheus.MustRegister(redeemTokenCounter)
+	prometheus.MustRegister(cachedDuplicateCounter)
 	prometheus.MustRegister(fetchRedemptionCounter)
+	prometheus.MustRegister(readOnlyFallbackCounter)
+	prometheus.MustRegister(warmFailureCounter)
+	prometheus.MustRegister(warmIssuersDuration)
+	prometheus.MustRegister(rotateIssuerCounter)
+	prometheus.MustRegister(pregenerateIssuerCounter)
+	prometheus.MustRegister(keyEvictionCounter)
+	prometheus.MustRegister(archivedRedemptionCounter)
+	prometheus.MustRegister(dynamoWriteFailureCounter)
+	prometheus.MustRegister(dynamoBatchFallbackCounter)
+	prometheus.MustRegister(dynamoReadFallbackCounter)
+	prometheus.MustRegister(dynamoReplicationConflictCounter)
+	prometheus.MustRegister(redisRedemptionDuration)
+	prometheus.MustRegister(queuedRedemptionsGauge)
+	prometheus.MustRegister(queuedRedemptionConflictCounter)
+	prometheus.MustRegister(issuerNotificationCounter)
+	prometheus.MustRegister(revokeIssuerCounter)
+	// Handlers
+	prometheus.MustRegister(oversizedIssuanceCounter)
+	prometheus.MustRegister(panicCounter)
+	prometheus.MustRegister(issuanceBatchSizeHistogram)
+	prometheus.MustRegister(issuanceSigningDuration)
+	prometheus.MustRegister(redemptionKeyPosition)
+	prometheus.MustRegister(signingQueueGauge)
+	prometheus.MustRegister(signingRejectCounter)
+	prometheus.MustRegister(issuanceMemoryGauge)
+	prometheus.MustRegister(issuanceMemoryRejectCounter)
+	prometheus.MustRegister(auditFailureCounter)
+	prometheus.MustRegister(eventFailureCounter)
+	prometheus.MustRegister(eventDropCounter)
+	prometheus.MustRegister(issuedTokenCounter)
+	prometheus.MustRegister(redeemedTokenCounter)
+	prometheus.MustRegister(usageFailureCounter)
+	prometheus.MustRegister(duplicateRedemptionCounter)
+	prometheus.MustRegister(issuanceSampleFailureCounter)
+	prometheus.MustRegister(revokedRedemptionCounter)
+	prometheus.MustRegister(frozenRequestCounter)
+	prometheus.MustRegister(reservationCounter)
+	prometheus.MustRegister(anomalyCounter)
+	prometheus.MustRegister(deletedRedemptionCounter)
+	prometheus.MustRegister(maintenanceGauge)
+	prometheus.MustRegister(jwtFailureCounter)
+	prometheus.MustRegister(vaultRenewFailureCounter)
+	prometheus.MustRegister(breakerStateGauge)
+	prometheus.MustRegister(issuerExpiryGauge)
+	prometheus.MustRegister(breakerRejectCounter)
+	prometheus.MustRegister(throttledCallCounter)
+	prometheus.MustRegister(throttleShedCounter)
+	prometheus.MustRegister(throttleProbabilityGauge)
+	prometheus.MustRegister(retryCounter)
+	prometheus.MustRegister(retryExhaustedCounter)
+	prometheus.MustRegister(signatureFailureCounter)
+	prometheus.MustRegister(secretRotationCounter)
+	prometheus.MustRegister(secretReloadFailureCounter)
+	prometheus.MustRegister(quotaExceededCounter)
+	prometheus.MustRegister(quotaLeaseCounter)
+	prometheus.MustRegister(quotaLeaseFailureCounter)
+	prometheus.MustRegister(issuanceLogFailureCounter)
+	prometheus.MustRegister(canaryIssuanceCounter)
+	prometheus.MustRegister(canaryRedemptionCounter)
+	prometheus.MustRegister(keyBundlePublishFailureCounter)
 	// DB latency
 	prometheus.MustRegister(fetchIssuerByTypeDBDuration)
 	prometheus.MustRegister(createIssuerDBDuration)
@@ -44,52 +113,258 @@ func init() {
 }
 
 type Server struct {
-	ListenPort   int    `json:"listen_port,omitempty"`
-	MaxTokens    int    `json:"max_tokens,omitempty"`
-	DbConfigPath string `json:"db_config_path"`
+	ListenPort int `json:"listen_port,omitempty"`
+	// DebugListenPort serves profiling and diagnostics without authentication on a
+	// separate port bound to DebugListenHost, loopback by default, they are served
+	// under /debug to operators otherwise
+	DebugListenPort int    `json:"debug_listen_port,omitempty"`
+	DebugListenHost string `json:"debug_listen_host,omitempty"`
+	// AdminListenPort moves metrics, diagnostics, health and the admin API off
+	// ListenPort onto a port bound to AdminListenHost
+	AdminListenPort int    `json:"admin_listen_port,omitempty"`
+	AdminListenHost string `json:"admin_listen_host,omitempty"`
+	MaxTokens       int    `json:"max_tokens,omitempty"`
+	DbConfigPath    string `json:"db_config_path"`
 
-	dbConfig DbConfig
-	db       *sql.DB
-	caches   map[string]CacheInterface
+	// TrustedProxies lists the IPs and CIDRs of load balancers and proxies whose
+	// Forwarded and X-Forwarded-For headers give the address of the client
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// StartupMaxWaitSec is how long to keep retrying dependencies at startup before exiting
+	StartupMaxWaitSec int `json:"startup_max_wait_sec,omitempty"`
+	// StartupServeUnavailable starts the listener immediately, serving 503s until dependencies are up
+	StartupServeUnavailable bool `json:"startup_serve_unavailable,omitempty"`
+
+	// AuditS3Bucket enables exporting the audit log to S3 under AuditS3Prefix
+	AuditS3Bucket string `json:"audit_s3_bucket,omitempty"`
+	AuditS3Prefix string `json:"audit_s3_prefix,omitempty"`
+
+	// ArchiveAfterDays enables moving redemptions older than this out of the database,
+	// into parquet files of up to ArchiveBatchSize redemptions under ArchiveLocalPath
+	// and/or ArchiveS3Bucket under ArchiveS3Prefix
+	ArchiveAfterDays int    `json:"archive_after_days,omitempty"`
+	ArchiveBatchSize int    `json:"archive_batch_size,omitempty"`
+	ArchiveLocalPath string `json:"archive_local_path,omitempty"`
+	ArchiveS3Bucket  string `json:"archive_s3_bucket,omitempty"`
+	ArchiveS3Prefix  string `json:"archive_s3_prefix,omitempty"`
+
+	// CleanupAfterDays enables deleting the redemptions of issuer types whose issuers
+	// all expired more than this many days ago, CleanupBatchSize rows at a time with
+	// CleanupBatchDelayMs between batches
+	CleanupAfterDays    int `json:"cleanup_after_days,omitempty"`
+	CleanupBatchSize    int `json:"cleanup_batch_size,omitempty"`
+	CleanupBatchDelayMs int `json:"cleanup_batch_delay_ms,omitempty"`
+
+	// MaintenanceSchedule is a cron expression on which the redemption and issuer
+	// tables are analyzed, and vacuumed as well when MaintenanceVacuum is set
+	MaintenanceSchedule string `json:"maintenance_schedule,omitempty"`
+	MaintenanceVacuum   bool   `json:"maintenance_vacuum,omitempty"`
+
+	// FutureIssuerKeys is how many successors to generate ahead for each expiring
+	// version 1 issuer, listed in the issuer directory before they activate
+	FutureIssuerKeys int `json:"future_issuer_keys,omitempty"`
+
+	// ClockSkewSec is how many seconds tokens are accepted past the end of their key's
+	// validity or their issuer's expiry, and how long before expiry issuers stop issuing
+	ClockSkewSec int `json:"clock_skew_sec,omitempty"`
+
+	// RedemptionIssuerLimit bounds the unexpired issuers of a type redemptions are
+	// verified against to the most recent ones, tokens of older issuers are rejected
+	// as expired. Every unexpired issuer is tried when it is 0.
+	RedemptionIssuerLimit int `json:"redemption_issuer_limit,omitempty"`
+
+	// ReservationWindowSec is how long reserved tokens are held for their redemption
+	// at most and by default, 300 by default
+	ReservationWindowSec int `json:"reservation_window_sec,omitempty"`
+
+	// DuplicateRedemptionDetails adds when a token was first redeemed and the hash of
+	// its payload to the 409 answering a duplicate redemption
+	DuplicateRedemptionDetails bool `json:"duplicate_redemption_details,omitempty"`
+
+	// IssuanceSamplePercent is the percentage of successful issuance requests recorded
+	// in issuance_samples, none when 0
+	IssuanceSamplePercent int `json:"issuance_sample_percent,omitempty"`
+
+	// IssuanceLog appends a receipt of every signed batch to the issuance log, which
+	// auditors check against signed tree heads
+	IssuanceLog bool `json:"issuance_log,omitempty"`
+
+	// MaxKeysInMemory bounds the number of unsealed signing keys held, least recently
+	// used keys are evicted and unsealed again when needed
+	MaxKeysInMemory int `json:"max_keys_in_memory,omitempty"`
+
+	// SigningWorkers bounds concurrent signing across all requests, one per CPU by
+	// default. Issuance fails with 503 once SigningQueueDepth batches are queued.
+	SigningWorkers    int `json:"signing_workers,omitempty"`
+	SigningQueueDepth int `json:"signing_queue_depth,omitempty"`
+
+	// IssuanceMemoryBytes bounds the memory estimated from the batch sizes of concurrent
+	// issuance requests, half of MemoryLimitBytes by default and unbounded without it
+	IssuanceMemoryBytes int64 `json:"issuance_memory_bytes,omitempty"`
+	// MemoryLimitBytes is the soft memory limit of the garbage collector, like
+	// GOMEMLIMIT, and GCPercent its target heap growth, like GOGC
+	MemoryLimitBytes int64 `json:"memory_limit_bytes,omitempty"`
+	GCPercent        int   `json:"gc_percent,omitempty"`
+
+	// BundleCacheSec is how long a verification bundle is served before it is built
+	// again, 60 by default
+	BundleCacheSec int `json:"bundle_cache_sec,omitempty"`
+
+	// KeyHistoryRatePerMinute bounds the requests of each caller for the key history
+	// of issuer types, which unseals every key listed, 60 by default
+	KeyHistoryRatePerMinute int `json:"key_history_rate_per_minute,omitempty"`
+
+	// AttestationKeyPath is a PEM encoded Ed25519 private key, provisioned offline, that
+	// the public keys of the issuer directory are signed with
+	AttestationKeyPath string `json:"attestation_key_path,omitempty"`
+
+	KeyBundle KeyBundleConfig `json:"key_bundle"`
+
+	// IssuerProfiles are the named sets of settings issuers can be created from
+	IssuerProfiles map[string]IssuerProfile `json:"issuer_profiles,omitempty"`
+
+	CORS CORSConfig `json:"cors"`
+
+	RequestLimits RequestLimits `json:"request_limits"`
+
+	Compression CompressionConfig `json:"compression"`
+
+	Events EventConfig `json:"events"`
+
+	// Tenants maps bearer tokens to tenants, the issuers of each tenant are kept in
+	// a separate namespace
+	Tenants map[string]string `json:"tenants,omitempty"`
+
+	JWT JWTConfig `json:"jwt"`
+
+	RequestSigning RequestSigningConfig `json:"request_signing"`
+
+	Secrets SecretsConfig `json:"secrets"`
+
+	Quotas QuotaConfig `json:"quotas"`
+
+	// Database is loaded as the database config once every setting is applied
+	Database DbConfig `json:"database"`
+
+	Vault VaultConfig `json:"vault"`
+
+	Dynamo DynamoConfig `json:"dynamo"`
+
+	Redis RedisConfig `json:"redis"`
+
+	RedemptionQueue RedemptionQueueConfig `json:"redemption_queue"`
+
+	Retry RetryConfig `json:"retry"`
+
+	// Anomaly enables the moving average detector of redemption spikes, programs
+	// embedding the server can set AnomalyDetector to plug in their own
+	Anomaly         AnomalyConfig   `json:"anomaly"`
+	AnomalyDetector AnomalyDetector `json:"-"`
+
+	// PayloadTransformers are the transformers issuer payload policies can name, in
+	// addition to and taking precedence over the built in ones
+	PayloadTransformers map[string]PayloadTransformer `json:"-"`
+
+	Enrichment EnrichmentConfig `json:"enrichment"`
+
+	// PanicWebhookURL receives a PanicReport for every handler panic, as does
+	// PanicHook when set by programs embedding the server
+	PanicWebhookURL string            `json:"panic_webhook_url,omitempty"`
+	PanicHook       func(PanicReport) `json:"-"`
+
+	// RevocationWebhookURL receives an IssuerRevocation for every revoked issuer
+	RevocationWebhookURL string `json:"revocation_webhook_url,omitempty"`
+
+	// SentryDSN reports errors to Sentry, unless Reporter is set by programs
+	// embedding the server
+	SentryDSN string        `json:"sentry_dsn,omitempty"`
+	Reporter  ErrorReporter `json:"-"`
+
+	dbConfig   DbConfig
+	db         *sql.DB
+	dbReadOnly *sql.DB
+	caches     map[string]CacheInterface
+	ready      int32
+
+	// The connectors of db and dbReadOnly, whose credentials are rotated by secrets
+	dbConnector         *rotatingConnector
+	dbReadOnlyConnector *rotatingConnector
+
+	redemptionHashSalt []byte
+	tenantsByToken     map[[sha256.Size]byte]string
+	jwks               *jwks
+	quotaLeases        *quotaLeases
+	vault              *vault.Client
+	vaultSecret        *vault.Secret
+	vaultLeaseDone     chan struct{}
+	secretsFile        []byte
+	dynamo             dynamodbiface.DynamoDBAPI
+	dynamoBreaker      *circuitBreaker
+	dynamoRegion       string
+	redis              *redis.Client
+	redemptionQueue    *bolt.DB
+	attestationKey     ed25519.PrivateKey
+	keyBundleRecipient *rsa.PublicKey
+	keyHistoryLimiter  *rateLimiter
 }
 
 var DefaultServer = &Server{
 	ListenPort: 2416,
 }
 
+// LoadConfigFile reads a JSON, YAML or TOML config file, which may be encrypted with
+// KMS and may reference environment variables as ${NAME}
 func LoadConfigFile(filePath string) (Server, error) {
 	conf := *DefaultServer
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return conf, err
 	}
-	err = json.Unmarshal(data, &conf)
-	if err != nil {
-		return conf, err
-	}
-	return conf, nil
+	err = conf.decodeConfig(filePath, data)
+	return conf, err
 }
 
 var (
 	ErrEmptyDbConfigPath = errors.New("no db config path specified")
 )
 
+// InitDbConfig applies the environment to the server's settings and loads the
+// resulting database config
 func (c *Server) InitDbConfig() error {
-	conf := DbConfig{}
+	if err := c.ApplyEnv(); err != nil {
+		return err
+	}
+	c.LoadDbConfig(c.Database)
+	return nil
+}
 
-	// Heroku style
-	if connectionURI := os.Getenv("DATABASE_URL"); connectionURI != "" {
-		conf.ConnectionURI = os.Getenv("DATABASE_URL")
+// clientKeyID identifies the caller in metrics and the audit log, by the name of
+// their API key, the subject of their JWT or a prefix of the hash of their bearer token
+func clientKeyID(r *http.Request) string {
+	if key := requestAPIKey(r); key != nil {
+		return key.Name
+	}
+	if claims := requestClaims(r); claims != nil && claims.Subject != "" {
+		return claims.Subject
+	}
+	bearer := r.Header.Get("Authorization")
+	if len(bearer) <= 7 || strings.ToUpper(bearer[0:6]) != "BEARER" {
+		return "anonymous"
 	}
+	sum := sha256.Sum256([]byte(bearer[7:]))
+	return hex.EncodeToString(sum[:4])
+}
 
-	if maxConnection := os.Getenv("MAX_DB_CONNECTION"); maxConnection != "" {
-		if count, err := strconv.Atoi(maxConnection); err == nil {
-			conf.MaxConnection = count
+// encodeResponse writes v as the JSON response body, converting encoding failures
+// into an error response rather than panicking
+func encodeResponse(w http.ResponseWriter, v interface{}) *handlers.AppError {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not encode response",
+			Code:    http.StatusInternalServerError,
 		}
 	}
-
-	c.LoadDbConfig(conf)
-
 	return nil
 }
 
@@ -106,29 +381,134 @@ func SetupLogger(ctx context.Context) (context.Context, *logrus.Logger) {
 }
 
 func (c *Server) setupRouter(ctx context.Context, logger *logrus.Logger) (context.Context, *chi.Mux) {
-	c.initDb()
-
 	//govalidator.SetFieldsRequiredByDefault(true)
 
+	c.initTenants()
+	c.initJWT()
+	c.initQuotas()
+	r := c.newRouter(logger)
+
+	r.Mount("/v1/blindedToken", c.tokenRouter())
+	r.Mount("/v1/issuer", c.issuerRouter(c.AdminListenPort == 0))
+	r.Mount("/v1/bundle", c.bundleRouter())
+	if c.AdminListenPort == 0 {
+		c.mountAdminRoutes(r)
+	}
+	r.Get("/v1/openapi.json", openAPIHandler(r, false))
+
+	return ctx, r
+}
+
+// newRouter returns a router with the middleware shared by the API and admin listeners
+func (c *Server) newRouter(logger *logrus.Logger) *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(chiware.RequestID)
 	r.Use(chiware.Heartbeat("/"))
 	r.Use(chiware.Timeout(60 * time.Second))
 	r.Use(middleware.BearerToken)
+	r.Use(c.resolveTenant)
+	r.Use(c.resolveJWT)
+	r.Use(c.resolveAPIKey)
+	// Before the request logger so that the log records the client rather than the proxy
+	r.Use(c.resolveClientIP)
 	if logger != nil {
-		// Also handles panic recovery
 		r.Use(middleware.RequestLogger(logger))
 	}
+	// Inside the request logger so that the log records the 500
+	r.Use(c.recoverPanics)
+	return r
+}
 
-	r.Mount("/v1/blindedToken", c.tokenRouter())
-	r.Mount("/v1/issuer", c.issuerRouter())
-	r.Get("/metrics", middleware.Metrics())
-
-	return ctx, r
+// startJobs starts the periodic jobs that run against the database
+func (c *Server) startJobs() {
+	c.renewVault()
+	if c.Secrets.File != "" || c.vaultSecret != nil {
+		go c.reloadSecretsPeriodically()
+	}
+	if c.caches != nil {
+		if _, err := c.listenForCacheChanges(); err != nil {
+			// Issuers and API keys changed elsewhere are picked up once their cache entry expires
+			lg.Errorf("Could not listen for issuer changes: %s", err)
+		}
+	}
+	go c.flushAPIKeyUsagePeriodically()
+	go c.rotateIssuersPeriodically()
+	go c.refreshIssuerExpiryPeriodically()
+	go c.pruneDuplicateAttemptsPeriodically()
+	go c.pruneIssuanceSamplesPeriodically()
+	go c.pruneReservationsPeriodically()
+	if len(c.RequestSigning.Keys) > 0 {
+		go c.pruneNoncesPeriodically()
+	}
+	if len(c.Quotas.Issuance) > 0 {
+		go c.pruneIssuanceQuotaUsagePeriodically()
+	}
+	if c.AnomalyDetector != nil {
+		go c.checkRedemptionRatesPeriodically()
+	}
+	if c.Enrichment.Enabled {
+		go c.flushRedemptionAttributesPeriodically()
+	}
+	if c.ArchiveAfterDays > 0 {
+		go c.archiveRedemptionsPeriodically()
+	}
+	if c.CleanupAfterDays > 0 {
+		go c.cleanupRedemptionsPeriodically()
+	}
+	if c.MaintenanceSchedule != "" {
+		go c.runMaintenancePeriodically()
+	}
+	if c.redemptionQueue != nil {
+		go c.replayRedemptionQueuePeriodically()
+	}
+	if c.KeyBundle.S3Bucket != "" {
+		go c.publishKeyBundlesPeriodically()
+	}
 }
 
 func (c *Server) ListenAndServe(ctx context.Context, logger *logrus.Logger) error {
+	if err := c.initReporting(); err != nil {
+		return err
+	}
+	c.initAnomalyDetector()
+	if err := c.initMemory(); err != nil {
+		return err
+	}
+	if err := c.initAttestation(); err != nil {
+		return err
+	}
+	if err := c.initKeyBundle(); err != nil {
+		return err
+	}
+	// Only the serving process holds the queue, commands fail rather than queue
+	if err := c.initRedemptionQueue(); err != nil {
+		return err
+	}
+	if c.StartupServeUnavailable {
+		go func() {
+			// Without the database the server can never become ready
+			if err := c.initDb(); err != nil {
+				logger.Fatal(err)
+			}
+			c.startJobs()
+		}()
+	} else {
+		if err := c.initDb(); err != nil {
+			return err
+		}
+		c.startJobs()
+	}
+
+	if c.DebugListenPort > 0 {
+		go c.listenAndServeDebug()
+	}
+
+	_, router := c.setupRouter(ctx, logger)
+	if c.AdminListenPort > 0 {
+		go c.listenAndServeAdmin(ctx, logger)
+	}
+
 	addr := fmt.Sprintf(":%d", c.ListenPort)
-	srv := http.Server{Addr: addr, Handler: chi.ServerBaseContext(c.setupRouter(ctx, logger))}
+	srv := http.Server{Addr: addr, Handler: chi.ServerBaseContext(ctx, router)}
 	return srv.ListenAndServe()
 }
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Setting is a tunable that can be set in the config file, in the environment and with
+// a command line flag. Flags take precedence over the environment, which takes
+// precedence over the config file, which takes precedence over the defaults.
+type Setting struct {
+	// Key is the config file field, nested fields are separated by dots
+	Key       string
+	Env       string
+	Flag      string
+	Shorthand string
+	Usage     string
+
+	set func(string) error
+}
+
+// Set parses a value given in the environment or as a flag
+func (s Setting) Set(value string) error {
+	if err := s.set(value); err != nil {
+		return fmt.Errorf("invalid value %q for %s: %s", value, s.Key, err)
+	}
+	return nil
+}
+
+// newSetting binds a setting to a string, int, int64, bool or list field, lists are
+// given comma separated
+func newSetting(key, env, flag, usage string, target interface{}) Setting {
+	setting := Setting{Key: key, Env: env, Flag: flag, Usage: usage}
+	switch target := target.(type) {
+	case *string:
+		setting.set = func(value string) error {
+			*target = value
+			return nil
+		}
+	case *int:
+		setting.set = func(value string) error {
+			parsed, err := strconv.Atoi(value)
+			if err == nil {
+				*target = parsed
+			}
+			return err
+		}
+	case *int64:
+		setting.set = func(value string) error {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				*target = parsed
+			}
+			return err
+		}
+	case *bool:
+		setting.set = func(value string) error {
+			parsed, err := strconv.ParseBool(value)
+			if err == nil {
+				*target = parsed
+			}
+			return err
+		}
+	case *[]string:
+		setting.set = func(value string) error {
+			*target = splitList(value)
+			return nil
+		}
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T for %s", target, key))
+	}
+	return setting
+}
+
+// splitList parses a comma separated list
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Settings lists every tunable of the server, bound to its fields
+func (c *Server) Settings() []Setting {
+	port := newSetting("listen_port", "PORT", "port", "port to listen on", &c.ListenPort)
+	port.Shorthand = "p"
+
+	tenants := Setting{
+		Key:   "tenants",
+		Env:   "TENANT_TOKENS",
+		Flag:  "tenant-tokens",
+		Usage: "comma separated tenant=token pairs, each tenant's issuers are kept in a separate namespace",
+		set: func(value string) error {
+			c.Tenants = map[string]string{}
+			for _, pair := range splitList(value) {
+				i := strings.Index(pair, "=")
+				if i <= 0 {
+					return fmt.Errorf("%q is not a tenant=token pair", pair)
+				}
+				c.Tenants[pair[i+1:]] = pair[:i]
+			}
+			return nil
+		},
+	}
+
+	quotas := Setting{
+		Key:   "quotas.issuance",
+		Env:   "ISSUANCE_QUOTAS",
+		Flag:  "issuance-quotas",
+		Usage: "comma separated issuer_type=tokens pairs limiting the tokens each type signs per quota window across the fleet",
+		set: func(value string) error {
+			c.Quotas.Issuance = map[string]int64{}
+			for _, pair := range splitList(value) {
+				i := strings.Index(pair, "=")
+				if i <= 0 {
+					return fmt.Errorf("%q is not an issuer_type=tokens pair", pair)
+				}
+				quota, err := strconv.ParseInt(pair[i+1:], 10, 64)
+				if err != nil {
+					return err
+				}
+				c.Quotas.Issuance[pair[:i]] = quota
+			}
+			return nil
+		},
+	}
+
+	return []Setting{
+		port,
+		newSetting("debug_listen_port", "DEBUG_PORT", "debug-port", "port serving profiling and diagnostics without authentication, instead of under /debug for operators", &c.DebugListenPort),
+		newSetting("debug_listen_host", "DEBUG_HOST", "debug-host", "interface the debug port is bound to, 127.0.0.1 by default", &c.DebugListenHost),
+		newSetting("admin_listen_port", "ADMIN_PORT", "admin-port", "port serving metrics, diagnostics, health and the admin API instead of the API port", &c.AdminListenPort),
+		newSetting("admin_listen_host", "ADMIN_HOST", "admin-host", "interface the admin port is bound to, all interfaces when empty", &c.AdminListenHost),
+		newSetting("trusted_proxies", "TRUSTED_PROXIES", "trusted-proxies", "comma separated IPs and CIDRs of proxies whose forwarding headers give the client address", &c.TrustedProxies),
+		newSetting("startup_max_wait_sec", "STARTUP_MAX_WAIT_SEC", "startup-max-wait-sec", "seconds to keep retrying dependencies at startup", &c.StartupMaxWaitSec),
+		newSetting("startup_serve_unavailable", "STARTUP_SERVE_UNAVAILABLE", "startup-serve-unavailable", "serve 503s until dependencies are up instead of waiting to listen", &c.StartupServeUnavailable),
+
+		newSetting("database.connectionURI", "DATABASE_URL", "database-url", "postgres connection URI", &c.Database.ConnectionURI),
+		newSetting("database.readOnlyConnectionURI", "DATABASE_READ_ONLY_URL", "database-read-only-url", "postgres read replica connection URI", &c.Database.ReadOnlyConnectionURI),
+		newSetting("database.maxConnection", "MAX_DB_CONNECTION", "db-max-connections", "maximum open database connections", &c.Database.MaxConnection),
+		newSetting("database.defaultMaxTokens", "DEFAULT_MAX_TOKENS", "default-max-tokens", "batch cap of issuers created without max_tokens", &c.Database.DefaultMaxTokens),
+		newSetting("database.warmConnections", "DB_WARM_CONNECTIONS", "db-warm-connections", "database connections to establish ahead of traffic", &c.Database.WarmConnections),
+		newSetting("database.warmIntervalSec", "DB_WARM_INTERVAL_SEC", "db-warm-interval-sec", "seconds between re-establishing warm connections", &c.Database.WarmIntervalSec),
+		newSetting("database.migrationsURL", "MIGRATIONS_URL", "migrations-url", "where migrations are read from", &c.Database.MigrationsURL),
+		newSetting("database.backend", "DATABASE_BACKEND", "database-backend", "postgres, migrate also supports cockroachdb and sqlite", &c.Database.Backend),
+		newSetting("database.caching.enabled", "CACHE_ENABLED", "cache-enabled", "cache issuers, redemptions and API keys in memory", &c.Database.CachingConfig.Enabled),
+		newSetting("database.caching.expirationSec", "CACHE_EXPIRATION_SEC", "cache-expiration-sec", "seconds cached entries are kept", &c.Database.CachingConfig.ExpirationSec),
+		newSetting("database.caching.warm", "CACHE_WARM", "cache-warm", "load active issuers and their signing keys before reporting ready", &c.Database.CachingConfig.Warm),
+
+		newSetting("audit_s3_bucket", "AUDIT_S3_BUCKET", "audit-s3-bucket", "S3 bucket audit log exports are written to", &c.AuditS3Bucket),
+		newSetting("audit_s3_prefix", "AUDIT_S3_PREFIX", "audit-s3-prefix", "key prefix of audit log exports", &c.AuditS3Prefix),
+
+		newSetting("archive_after_days", "REDEMPTION_ARCHIVE_AFTER_DAYS", "archive-after-days", "days after which redemptions are archived", &c.ArchiveAfterDays),
+		newSetting("archive_batch_size", "REDEMPTION_ARCHIVE_BATCH_SIZE", "archive-batch-size", "redemptions archived per file and transaction", &c.ArchiveBatchSize),
+		newSetting("archive_local_path", "REDEMPTION_ARCHIVE_PATH", "archive-local-path", "directory redemption archives are written to", &c.ArchiveLocalPath),
+		newSetting("archive_s3_bucket", "REDEMPTION_ARCHIVE_S3_BUCKET", "archive-s3-bucket", "S3 bucket redemption archives are uploaded to", &c.ArchiveS3Bucket),
+		newSetting("archive_s3_prefix", "REDEMPTION_ARCHIVE_S3_PREFIX", "archive-s3-prefix", "key prefix of redemption archives", &c.ArchiveS3Prefix),
+
+		newSetting("cleanup_after_days", "REDEMPTION_CLEANUP_AFTER_DAYS", "cleanup-after-days", "days after an issuer type expired that its redemptions are deleted", &c.CleanupAfterDays),
+		newSetting("cleanup_batch_size", "REDEMPTION_CLEANUP_BATCH_SIZE", "cleanup-batch-size", "redemptions deleted per statement by the cleanup job", &c.CleanupBatchSize),
+		newSetting("cleanup_batch_delay_ms", "REDEMPTION_CLEANUP_BATCH_DELAY_MS", "cleanup-batch-delay-ms", "milliseconds the cleanup job waits between batches", &c.CleanupBatchDelayMs),
+
+		newSetting("maintenance_schedule", "MAINTENANCE_SCHEDULE", "maintenance-schedule", "cron expression on which the redemption and issuer tables are analyzed", &c.MaintenanceSchedule),
+		newSetting("maintenance_vacuum", "MAINTENANCE_VACUUM", "maintenance-vacuum", "vacuum the tables as well during scheduled maintenance", &c.MaintenanceVacuum),
+
+		newSetting("future_issuer_keys", "FUTURE_ISSUER_KEYS", "future-issuer-keys", "successors to generate ahead for each expiring issuer", &c.FutureIssuerKeys),
+		newSetting("bundle_cache_sec", "BUNDLE_CACHE_SEC", "bundle-cache-sec", "seconds a verification bundle is served before it is built again, 60 by default", &c.BundleCacheSec),
+		newSetting("key_history_rate_per_minute", "KEY_HISTORY_RATE_PER_MINUTE", "key-history-rate-per-minute", "requests per minute each caller can make for issuer key histories", &c.KeyHistoryRatePerMinute),
+		newSetting("attestation_key_path", "ATTESTATION_KEY_PATH", "attestation-key-path", "PEM encoded Ed25519 private key the issuer directory is attested with", &c.AttestationKeyPath),
+		newSetting("key_bundle.public_key_path", "KEY_BUNDLE_PUBLIC_KEY_PATH", "key-bundle-public-key-path", "PEM encoded RSA public key signing keys of key bundles are encrypted under", &c.KeyBundle.PublicKeyPath),
+		newSetting("key_bundle.validity_sec", "KEY_BUNDLE_VALIDITY_SEC", "key-bundle-validity-sec", "seconds edge services accept a key bundle", &c.KeyBundle.ValiditySec),
+		newSetting("key_bundle.s3_bucket", "KEY_BUNDLE_S3_BUCKET", "key-bundle-s3-bucket", "S3 bucket key bundles are published to", &c.KeyBundle.S3Bucket),
+		newSetting("key_bundle.s3_key", "KEY_BUNDLE_S3_KEY", "key-bundle-s3-key", "S3 key key bundles are published under", &c.KeyBundle.S3Key),
+		newSetting("key_bundle.publish_interval_sec", "KEY_BUNDLE_PUBLISH_INTERVAL_SEC", "key-bundle-publish-interval-sec", "seconds between publishing key bundles", &c.KeyBundle.PublishIntervalSec),
+		newSetting("clock_skew_sec", "CLOCK_SKEW_SEC", "clock-skew-sec", "seconds of clock skew tolerated at key and issuer validity boundaries", &c.ClockSkewSec),
+		newSetting("redemption_issuer_limit", "REDEMPTION_ISSUER_LIMIT", "redemption-issuer-limit", "most recent issuers of a type redemptions are verified against, all unexpired ones when 0", &c.RedemptionIssuerLimit),
+		newSetting("reservation_window_sec", "RESERVATION_WINDOW_SEC", "reservation-window-sec", "seconds reserved tokens are held for their redemption at most and by default", &c.ReservationWindowSec),
+		newSetting("duplicate_redemption_details", "DUPLICATE_REDEMPTION_DETAILS", "duplicate-redemption-details", "describe the original redemption in duplicate redemption responses", &c.DuplicateRedemptionDetails),
+		newSetting("issuance_sample_percent", "ISSUANCE_SAMPLE_PERCENT", "issuance-sample-percent", "percentage of issuance requests recorded for capacity and abuse analysis", &c.IssuanceSamplePercent),
+		newSetting("issuance_log", "ISSUANCE_LOG", "issuance-log", "append a receipt of every signed batch to the issuance log", &c.IssuanceLog),
+		quotas,
+		newSetting("quotas.window_sec", "ISSUANCE_QUOTA_WINDOW_SEC", "issuance-quota-window-sec", "seconds in an issuance quota window", &c.Quotas.WindowSec),
+		newSetting("quotas.lease_percent", "ISSUANCE_QUOTA_LEASE_PERCENT", "issuance-quota-lease-percent", "percentage of a quota each instance takes from the shared counter at once", &c.Quotas.LeasePercent),
+		newSetting("max_keys_in_memory", "MAX_KEYS_IN_MEMORY", "max-keys-in-memory", "unsealed signing keys held in memory, 1000 by default", &c.MaxKeysInMemory),
+		newSetting("signing_workers", "SIGNING_WORKERS", "signing-workers", "concurrent signing workers across all requests, one per CPU by default", &c.SigningWorkers),
+		newSetting("signing_queue_depth", "SIGNING_QUEUE_DEPTH", "signing-queue-depth", "issuance batches signed or waiting before requests fail with 503, four per worker by default", &c.SigningQueueDepth),
+		newSetting("issuance_memory_bytes", "ISSUANCE_MEMORY_BYTES", "issuance-memory-bytes", "memory estimated from batch sizes that concurrent issuance requests may hold, half of memory_limit_bytes by default", &c.IssuanceMemoryBytes),
+		newSetting("memory_limit_bytes", "MEMORY_LIMIT_BYTES", "memory-limit-bytes", "soft memory limit of the garbage collector, like GOMEMLIMIT", &c.MemoryLimitBytes),
+		newSetting("gc_percent", "GC_PERCENT", "gc-percent", "heap growth that triggers garbage collection, like GOGC", &c.GCPercent),
+
+		newSetting("cors.allowed_origins", "CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "origins allowed to call the API from browsers", &c.CORS.AllowedOrigins),
+		newSetting("cors.allowed_methods", "CORS_ALLOWED_METHODS", "cors-allowed-methods", "methods allowed in CORS requests", &c.CORS.AllowedMethods),
+		newSetting("cors.allowed_headers", "CORS_ALLOWED_HEADERS", "cors-allowed-headers", "headers allowed in CORS requests", &c.CORS.AllowedHeaders),
+		newSetting("cors.max_age_sec", "CORS_MAX_AGE_SEC", "cors-max-age-sec", "seconds browsers may cache preflight responses", &c.CORS.MaxAgeSec),
+
+		newSetting("request_limits.issuance_bytes", "MAX_ISSUANCE_REQUEST_BYTES", "max-issuance-request-bytes", "maximum issuance request body size", &c.RequestLimits.IssuanceBytes),
+		newSetting("request_limits.redemption_bytes", "MAX_REDEMPTION_REQUEST_BYTES", "max-redemption-request-bytes", "maximum redemption request body size", &c.RequestLimits.RedemptionBytes),
+		newSetting("request_limits.admin_bytes", "MAX_ADMIN_REQUEST_BYTES", "max-admin-request-bytes", "maximum admin request body size", &c.RequestLimits.AdminBytes),
+
+		newSetting("compression.encodings", "COMPRESSION_ENCODINGS", "compression-encodings", "issuance response encodings in order of preference, among gzip, deflate and zstd", &c.Compression.Encodings),
+		newSetting("compression.min_bytes", "COMPRESSION_MIN_BYTES", "compression-min-bytes", "smallest issuance response that is compressed", &c.Compression.MinBytes),
+		newSetting("compression.disabled", "COMPRESSION_DISABLED", "compression-disabled", "serve issuance responses uncompressed", &c.Compression.Disabled),
+
+		newSetting("events.sns_topic_arn", "EVENTS_SNS_TOPIC_ARN", "events-sns-topic-arn", "SNS topic events are published to", &c.Events.SNSTopicARN),
+		newSetting("events.sqs_queue_url", "EVENTS_SQS_QUEUE_URL", "events-sqs-queue-url", "SQS queue events are sent to", &c.Events.SQSQueueURL),
+		newSetting("events.types", "EVENT_TYPES", "event-types", "event types to publish, a trailing * matches a prefix", &c.Events.Types),
+		newSetting("events.workers", "EVENT_WORKERS", "event-workers", "workers publishing events in batches, 4 by default", &c.Events.Workers),
+		newSetting("events.queue_depth", "EVENT_QUEUE_DEPTH", "event-queue-depth", "events waiting to be published before new ones are dropped, 10000 by default", &c.Events.QueueDepth),
+
+		tenants,
+
+		newSetting("jwt.jwks_url", "JWT_JWKS_URL", "jwt-jwks-url", "JWKS used to verify JWT bearer tokens", &c.JWT.JWKSURL),
+		newSetting("jwt.issuer", "JWT_ISSUER", "jwt-issuer", "required JWT issuer", &c.JWT.Issuer),
+		newSetting("jwt.audience", "JWT_AUDIENCE", "jwt-audience", "required JWT audience", &c.JWT.Audience),
+		newSetting("jwt.refresh_sec", "JWT_JWKS_REFRESH_SEC", "jwt-jwks-refresh-sec", "seconds between JWKS fetches", &c.JWT.RefreshSec),
+		newSetting("request_signing.keys", "REQUEST_SIGNING_KEYS", "request-signing-keys", "comma separated id:hmac:<hex secret> or id:ed25519:<base64 public key> entries admin requests must be signed with", &c.RequestSigning.Keys),
+		newSetting("request_signing.max_skew_sec", "REQUEST_SIGNING_MAX_SKEW_SEC", "request-signing-max-skew-sec", "seconds the timestamp of a signed request may be off", &c.RequestSigning.MaxSkewSec),
+
+		newSetting("vault.address", "VAULT_ADDR", "vault-addr", "Vault address, enables Vault", &c.Vault.Address),
+		newSetting("vault.role_id", "VAULT_ROLE_ID", "vault-role-id", "AppRole role id to log in to Vault with", &c.Vault.RoleID),
+		newSetting("vault.secret_path", "VAULT_SECRET_PATH", "vault-secret-path", "Vault secret read at startup", &c.Vault.SecretPath),
+		newSetting("vault.key_storage", "VAULT_KEY_STORAGE", "vault-key-storage", "kv or transit to keep signing keys in Vault", &c.Vault.KeyStorage),
+		newSetting("vault.key_mount", "VAULT_KEY_MOUNT", "vault-key-mount", "mount of the Vault engine signing keys are kept in", &c.Vault.KeyMount),
+		newSetting("vault.key_path", "VAULT_KEY_PATH", "vault-key-path", "KV path prefix or transit key name for signing keys", &c.Vault.KeyPath),
+		newSetting("secrets.file", "SECRETS_FILE", "secrets-file", "JSON file with token_list and database URLs, reloaded when it changes", &c.Secrets.File),
+		newSetting("secrets.poll_sec", "SECRETS_POLL_SEC", "secrets-poll-sec", "seconds between checks of the secrets file and Vault secret", &c.Secrets.PollSec),
+		newSetting("secrets.grace_sec", "SECRETS_GRACE_SEC", "secrets-grace-sec", "seconds replaced tokens and database credentials keep working", &c.Secrets.GraceSec),
+
+		newSetting("dynamo.mode", "DYNAMO_MODE", "dynamo-mode", "dual_write to migrate redemptions of version 1 issuers to DynamoDB", &c.Dynamo.Mode),
+		newSetting("dynamo.table", "DYNAMO_TABLE", "dynamo-table", "DynamoDB table redemptions are written to", &c.Dynamo.Table),
+		newSetting("dynamo.endpoint", "DYNAMO_ENDPOINT", "dynamo-endpoint", "DynamoDB endpoint, e.g. of DynamoDB local", &c.Dynamo.Endpoint),
+		newSetting("dynamo.breaker.timeout_ms", "DYNAMO_TIMEOUT_MS", "dynamo-timeout-ms", "latency budget of DynamoDB calls in milliseconds", &c.Dynamo.Breaker.TimeoutMs),
+		newSetting("dynamo.breaker.failure_threshold", "DYNAMO_BREAKER_FAILURES", "dynamo-breaker-failures", "consecutive DynamoDB failures that stop DynamoDB calls", &c.Dynamo.Breaker.FailureThreshold),
+		newSetting("dynamo.breaker.open_sec", "DYNAMO_BREAKER_OPEN_SEC", "dynamo-breaker-open-sec", "seconds DynamoDB calls are stopped before a trial call", &c.Dynamo.Breaker.OpenSec),
+		newSetting("dynamo.throttle.enabled", "DYNAMO_THROTTLE", "dynamo-throttle", "shed DynamoDB calls with 429 while DynamoDB throttles them", &c.Dynamo.Throttle.Enabled),
+		newSetting("dynamo.throttle.window_sec", "DYNAMO_THROTTLE_WINDOW_SEC", "dynamo-throttle-window-sec", "seconds of DynamoDB calls the shed probability is based on", &c.Dynamo.Throttle.WindowSec),
+		newSetting("dynamo.throttle.headroom_percent", "DYNAMO_THROTTLE_HEADROOM_PERCENT", "dynamo-throttle-headroom-percent", "percent by which DynamoDB calls may exceed the accepted ones before any are shed", &c.Dynamo.Throttle.HeadroomPercent),
+		newSetting("dynamo.global_table", "DYNAMO_GLOBAL_TABLE", "dynamo-global-table", "the DynamoDB table is a global table replicated to other regions", &c.Dynamo.GlobalTable),
+		newSetting("dynamo.region", "DYNAMO_REGION", "dynamo-region", "region of the DynamoDB replica to use, the AWS region by default", &c.Dynamo.Region),
+		newSetting("dynamo.replication_check_ms", "DYNAMO_REPLICATION_CHECK_MS", "dynamo-replication-check-ms", "milliseconds after which redemptions of a global table are checked for conflicts in other regions", &c.Dynamo.ReplicationCheckMs),
+		newSetting("dynamo.http.max_idle_conns_per_host", "DYNAMO_MAX_IDLE_CONNS_PER_HOST", "dynamo-max-idle-conns-per-host", "DynamoDB connections kept open for reuse, 100 by default", &c.Dynamo.HTTP.MaxIdleConnsPerHost),
+		newSetting("dynamo.http.idle_conn_timeout_sec", "DYNAMO_IDLE_CONN_TIMEOUT_SEC", "dynamo-idle-conn-timeout-sec", "seconds after which unused DynamoDB connections are closed, 90 by default", &c.Dynamo.HTTP.IdleConnTimeoutSec),
+		newSetting("dynamo.http.dial_timeout_ms", "DYNAMO_DIAL_TIMEOUT_MS", "dynamo-dial-timeout-ms", "milliseconds allowed to connect to DynamoDB, 2000 by default", &c.Dynamo.HTTP.DialTimeoutMs),
+		newSetting("dynamo.http.tls_handshake_timeout_ms", "DYNAMO_TLS_HANDSHAKE_TIMEOUT_MS", "dynamo-tls-handshake-timeout-ms", "milliseconds allowed for the TLS handshake with DynamoDB, 2000 by default", &c.Dynamo.HTTP.TLSHandshakeTimeoutMs),
+		newSetting("dynamo.http.response_timeout_ms", "DYNAMO_RESPONSE_TIMEOUT_MS", "dynamo-response-timeout-ms", "milliseconds DynamoDB has to respond once a call is sent, unlimited by default", &c.Dynamo.HTTP.ResponseTimeoutMs),
+		newSetting("dynamo.http.http2", "DYNAMO_HTTP2", "dynamo-http2", "negotiate HTTP/2 with DynamoDB endpoints that offer it", &c.Dynamo.HTTP.HTTP2),
+		newSetting("dynamo.fallback_to_postgres", "DYNAMO_FALLBACK_TO_POSTGRES", "dynamo-fallback-to-postgres", "record redemptions in Postgres while DynamoDB calls are stopped instead of failing with 503", &c.Dynamo.FallbackToPostgres),
+
+		newSetting("redis.url", "REDIS_URL", "redis-url", "Redis URL of the redemption store of issuers using redis", &c.Redis.URL),
+		newSetting("redis.timeout_ms", "REDIS_TIMEOUT_MS", "redis-timeout-ms", "latency budget of Redis calls in milliseconds", &c.Redis.TimeoutMs),
+		newSetting("redemption_queue.path", "REDEMPTION_QUEUE_PATH", "redemption-queue-path", "file queueing redemptions while Postgres is unavailable", &c.RedemptionQueue.Path),
+		newSetting("redemption_queue.max_entries", "REDEMPTION_QUEUE_MAX_ENTRIES", "redemption-queue-max-entries", "redemptions the queue holds before redemptions fail", &c.RedemptionQueue.MaxEntries),
+		newSetting("redemption_queue.replay_interval_sec", "REDEMPTION_QUEUE_REPLAY_INTERVAL_SEC", "redemption-queue-replay-interval-sec", "seconds between writing queued redemptions to Postgres", &c.RedemptionQueue.ReplayIntervalSec),
+		newSetting("retry.max_attempts", "RETRY_MAX_ATTEMPTS", "retry-max-attempts", "attempts of Postgres and DynamoDB calls failing with transient errors", &c.Retry.MaxAttempts),
+		newSetting("retry.initial_backoff_ms", "RETRY_INITIAL_BACKOFF_MS", "retry-initial-backoff-ms", "milliseconds of backoff after the first attempt", &c.Retry.InitialBackoffMs),
+		newSetting("retry.max_backoff_ms", "RETRY_MAX_BACKOFF_MS", "retry-max-backoff-ms", "maximum milliseconds of backoff between attempts", &c.Retry.MaxBackoffMs),
+
+		newSetting("anomaly.multiple", "ANOMALY_MULTIPLE", "anomaly-multiple", "multiple of the baseline redemption rate of an issuer type flagged as anomalous, 0 disables detection", &c.Anomaly.Multiple),
+		newSetting("anomaly.window_minutes", "ANOMALY_WINDOW_MINUTES", "anomaly-window-minutes", "minutes the baseline redemption rate is averaged over", &c.Anomaly.WindowMinutes),
+		newSetting("anomaly.min_redemptions", "ANOMALY_MIN_REDEMPTIONS", "anomaly-min-redemptions", "redemptions per minute below which a rate is never anomalous", &c.Anomaly.MinRedemptions),
+		newSetting("anomaly.webhook_url", "ANOMALY_WEBHOOK_URL", "anomaly-webhook-url", "URL anomalous redemption rates are posted to", &c.Anomaly.WebhookURL),
+
+		newSetting("enrichment.enabled", "ENRICHMENT_ENABLED", "enrichment-enabled", "count redemptions by client country and time bucket for abuse analysis", &c.Enrichment.Enabled),
+		newSetting("enrichment.country_header", "ENRICHMENT_COUNTRY_HEADER", "enrichment-country-header", "header the CDN sets to the two letter country of the client", &c.Enrichment.CountryHeader),
+		newSetting("enrichment.bucket_minutes", "ENRICHMENT_BUCKET_MINUTES", "enrichment-bucket-minutes", "minutes redemption times are bucketed to, at least 60", &c.Enrichment.BucketMinutes),
+		newSetting("enrichment.min_count", "ENRICHMENT_MIN_COUNT", "enrichment-min-count", "redemptions below which a country is only reported as other, at least 5", &c.Enrichment.MinCount),
+
+		newSetting("panic_webhook_url", "PANIC_WEBHOOK_URL", "panic-webhook-url", "URL a report with the stack trace is posted to when a handler panics", &c.PanicWebhookURL),
+		newSetting("revocation_webhook_url", "REVOCATION_WEBHOOK_URL", "revocation-webhook-url", "URL the issuer and reason are posted to when an issuer is revoked", &c.RevocationWebhookURL),
+		newSetting("sentry_dsn", "SENTRY_DSN", "sentry-dsn", "Sentry DSN 5xx responses, storage failures and failed jobs are reported to", &c.SentryDSN),
+	}
+}
+
+// ApplyEnv applies every setting given in the environment, empty variables are ignored
+func (c *Server) ApplyEnv() error {
+	for _, setting := range c.Settings() {
+		if value := os.Getenv(setting.Env); value != "" {
+			if err := setting.Set(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	"github.com/brave-intl/challenge-bypass-server/btd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// minSigningChunk is the smallest part of a batch signed by a single worker, smaller
+// batches are not worth spreading across cores
+const minSigningChunk = 64
+
+var (
+	ErrSigningSaturated = errors.New("Too many issuance requests are being signed")
+
+	// signers limits signing across every request, it lives outside of Server since
+	// servers are copied by value while being configured
+	signers = newSigningPool(0, 0)
+
+	signingQueueGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "signing_queue_depth",
+		Help: "Number of issuance batches being signed or waiting for a signing worker",
+	})
+
+	signingRejectCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "signing_reject_count",
+		Help: "Number of issuance batches rejected because the signing queue was full",
+	})
+)
+
+// signingPool spreads the signing of large batches across workers, while bounding
+// the crypto work of the whole server to one slot per worker
+type signingPool struct {
+	slots    chan struct{}
+	maxQueue int32
+	queued   int32
+}
+
+// newSigningPool creates a pool of workers, one per CPU by default, that admits up to
+// maxQueue batches at once, four per worker by default
+func newSigningPool(workers, maxQueue int) *signingPool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if maxQueue <= 0 {
+		maxQueue = 4 * workers
+	}
+	return &signingPool{
+		slots:    make(chan struct{}, workers),
+		maxQueue: int32(maxQueue),
+	}
+}
+
+// approveTokens signs a batch and creates its proof like btd.ApproveTokens, returning
+// ErrSigningSaturated without doing any work when too many batches are queued
+func (p *signingPool) approveTokens(blindedTokens []*crypto.BlindedToken, key *crypto.SigningKey) ([]*crypto.SignedToken, *crypto.BatchDLEQProof, error) {
+	if atomic.AddInt32(&p.queued, 1) > p.maxQueue {
+		atomic.AddInt32(&p.queued, -1)
+		incrementCounter(signingRejectCounter)
+		return nil, nil, ErrSigningSaturated
+	}
+	signingQueueGauge.Inc()
+	defer func() {
+		atomic.AddInt32(&p.queued, -1)
+		signingQueueGauge.Dec()
+	}()
+
+	chunk := (len(blindedTokens) + cap(p.slots) - 1) / cap(p.slots)
+	if chunk < minSigningChunk {
+		chunk = minSigningChunk
+	}
+
+	signedTokens := make([]*crypto.SignedToken, len(blindedTokens))
+	errs := make(chan error, (len(blindedTokens)+chunk-1)/chunk)
+	var wg sync.WaitGroup
+	for start := 0; start < len(blindedTokens); start += chunk {
+		end := start + chunk
+		if end > len(blindedTokens) {
+			end = len(blindedTokens)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			p.slots <- struct{}{}
+			defer func() { <-p.slots }()
+			if err := btd.SignTokens(blindedTokens[start:end], signedTokens[start:end], key); err != nil {
+				errs <- err
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, nil, err
+	}
+
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	proof, err := btd.ProveTokens(blindedTokens, signedTokens, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signedTokens, proof, nil
+}
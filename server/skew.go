@@ -0,0 +1,19 @@
+package server
+
+import "time"
+
+// unexpiredIssuersWithSkew is unexpiredIssuers for redemptions, which also accept
+// issuers that expired less than $2 seconds ago
+const unexpiredIssuersWithSkew = `(expires_at IS NULL OR expires_at > NOW() - make_interval(secs => $2))`
+
+// clockSkew is how far clocks are allowed to drift at issuer and key validity
+// boundaries, so that tokens used right at a rotation are not spuriously rejected
+func (c *Server) clockSkew() time.Duration {
+	return time.Duration(c.ClockSkewSec) * time.Second
+}
+
+// expiresWithin reports whether an issuer expires before now plus skew, in which case
+// it no longer issues tokens even though its tokens are still redeemable
+func (issuer *Issuer) expiresWithin(now time.Time, skew time.Duration) bool {
+	return !issuer.ExpiresAt.IsZero() && !issuer.ExpiresAt.After(now.Add(skew))
+}
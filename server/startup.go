@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/pressly/lg"
+)
+
+var (
+	initialStartupBackoff = 500 * time.Millisecond
+	maxStartupBackoff     = 30 * time.Second
+)
+
+// retryStartup calls connect until it succeeds, backing off exponentially between
+// attempts. It gives up and returns the last error once StartupMaxWaitSec has elapsed.
+func (c *Server) retryStartup(dependency string, connect func() error) error {
+	deadline := time.Now().Add(time.Duration(c.StartupMaxWaitSec) * time.Second)
+	backoff := initialStartupBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		lg.Warnf("%s not ready (attempt %d), retrying in %s: %s", dependency, attempt, backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+func (c *Server) markReady() {
+	atomic.StoreInt32(&c.ready, 1)
+}
+
+func (c *Server) isReady() bool {
+	return atomic.LoadInt32(&c.ready) == 1
+}
+
+// requireReady responds with 503 until the server's dependencies have come up
+func (c *Server) requireReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.isReady() {
+			w.Header().Set("Retry-After", "1")
+			handlers.AppError{
+				Message: "Server is starting up",
+				Code:    http.StatusServiceUnavailable,
+			}.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/lib/pq"
+)
+
+// Every storage error is of one of these kinds, callers test for them with errors.Is
+// rather than comparing against the errors of a particular store
+var (
+	// ErrNotFound means the record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate means the record already exists, such as a redeemed token
+	ErrDuplicate = errors.New("duplicate")
+	// ErrConflict means the write lost to a concurrent one and can be retried
+	ErrConflict = errors.New("conflict")
+	// ErrUnavailable means the store could not be reached, the outcome of a write
+	// is unknown unless the error says otherwise
+	ErrUnavailable = errors.New("storage unavailable")
+)
+
+// storageError is an error of a kind, either with its own message or wrapping the
+// error of a store
+type storageError struct {
+	kind error
+	msg  string
+	err  error
+}
+
+// newStorageError returns an error of a kind with a message of its own
+func newStorageError(kind error, msg string) error {
+	return &storageError{kind: kind, msg: msg}
+}
+
+func (e *storageError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return e.msg
+}
+
+func (e *storageError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *storageError) Unwrap() error {
+	return e.err
+}
+
+// classifyStorageError wraps an error returned by Postgres, DynamoDB or Redis with its
+// kind, errors of no kind and errors that already have one are returned as they are.
+// The store's error stays available to errors.As.
+func classifyStorageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *storageError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	kind := storageErrorKind(err)
+	if kind == nil {
+		return err
+	}
+	return &storageError{kind: kind, err: err}
+}
+
+func storageErrorKind(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrUnavailable
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "23505": // unique constraint violation
+			return ErrDuplicate
+		case pqErr.Code == "40001", pqErr.Code == "40P01": // serialization failure, deadlock
+			return ErrConflict
+		case strings.HasPrefix(string(pqErr.Code), "08"), pqErr.Code == "57P01", pqErr.Code == "57P03":
+			return ErrUnavailable
+		}
+		return nil
+	}
+	// The SDK considers errors it does not know retryable, only its own are classified
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		if request.IsErrorThrottle(awsErr) || request.IsErrorRetryable(awsErr) {
+			return ErrUnavailable
+		}
+		return nil
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// storageAppError maps a failed write to a response, duplicates and conflicts are
+// answered with a 409 and unavailable stores with a 503. Calls shed by a throttle are
+// answered with a 429, so that clients back off rather than retry right away.
+func storageAppError(err error, message string) *handlers.AppError {
+	err = classifyStorageError(err)
+	switch {
+	case errors.Is(err, ErrThrottled):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusTooManyRequests,
+			Data: map[string]interface{}{
+				"error_code": ErrorCodeThrottled,
+			},
+		}
+	case errors.Is(err, ErrDuplicate), errors.Is(err, ErrConflict):
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusConflict,
+		}
+	case errors.Is(err, ErrUnavailable):
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Storage is unavailable",
+			Code:    http.StatusServiceUnavailable,
+		}
+	}
+	return &handlers.AppError{
+		Error:   err,
+		Message: message,
+		Code:    http.StatusInternalServerError,
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultThrottleWindowSec       = 60
+	defaultThrottleHeadroomPercent = 100
+)
+
+// ErrorCodeThrottled is the data.error_code of requests shed because a dependency is
+// throttling calls
+const ErrorCodeThrottled = "throttled"
+
+var (
+	// ErrThrottled is of the ErrUnavailable kind, so that callers falling back on an
+	// unavailable dependency fall back on a throttling one as well
+	ErrThrottled = newStorageError(ErrUnavailable, "Dependency is throttling calls, shedding load")
+
+	throttledCallCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "throttled_call_count",
+		Help: "Number of calls a dependency rejected for exceeding its throughput",
+	}, []string{"dependency"})
+
+	throttleShedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "throttle_shed_count",
+		Help: "Number of calls shed before reaching a throttling dependency",
+	}, []string{"dependency"})
+
+	throttleProbabilityGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "throttle_shed_probability",
+		Help: "Probability that a call to a dependency is shed",
+	}, []string{"dependency"})
+)
+
+// ThrottleConfig sheds calls to a dependency in proportion to how many of its recent
+// calls it throttled, e.g. DynamoDB exceeding its provisioned throughput
+type ThrottleConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// WindowSec is how many seconds of calls the shed probability is based on, 60 by
+	// default
+	WindowSec int `json:"window_sec,omitempty"`
+	// HeadroomPercent is how far calls may exceed the calls the dependency accepted
+	// before any are shed, 100 by default
+	HeadroomPercent int `json:"headroom_percent,omitempty"`
+}
+
+type throttleBucket struct {
+	second   int64
+	requests float64
+	accepts  float64
+}
+
+// adaptiveThrottle is client side adaptive throttling: once calls exceed the calls
+// the dependency accepted over the window by more than the headroom, the excess is
+// shed at random with probability (requests - k * accepts) / (requests + 1). Shed
+// calls count as requests, so the probability keeps up with the load.
+type adaptiveThrottle struct {
+	name   string
+	k      float64
+	now    func() time.Time
+	random func() float64
+
+	mu      sync.Mutex
+	buckets []throttleBucket
+}
+
+func newAdaptiveThrottle(name string, conf ThrottleConfig) *adaptiveThrottle {
+	window := conf.WindowSec
+	if window == 0 {
+		window = defaultThrottleWindowSec
+	}
+	headroom := conf.HeadroomPercent
+	if headroom == 0 {
+		headroom = defaultThrottleHeadroomPercent
+	}
+	throttleProbabilityGauge.With(prometheus.Labels{"dependency": name}).Set(0)
+	return &adaptiveThrottle{
+		name:    name,
+		k:       1 + float64(headroom)/100,
+		now:     time.Now,
+		random:  rand.Float64,
+		buckets: make([]throttleBucket, window),
+	}
+}
+
+// bucket returns the bucket of a second, reusing the bucket of a second that left
+// the window
+func (t *adaptiveThrottle) bucket(second int64) *throttleBucket {
+	b := &t.buckets[second%int64(len(t.buckets))]
+	if b.second != second {
+		*b = throttleBucket{second: second}
+	}
+	return b
+}
+
+// allow counts a call and decides whether it may go through
+func (t *adaptiveThrottle) allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	second := t.now().Unix()
+	var requests, accepts float64
+	for _, b := range t.buckets {
+		if second-b.second < int64(len(t.buckets)) {
+			requests += b.requests
+			accepts += b.accepts
+		}
+	}
+	probability := math.Max(0, (requests-t.k*accepts)/(requests+1))
+	throttleProbabilityGauge.With(prometheus.Labels{"dependency": t.name}).Set(probability)
+
+	t.bucket(second).requests++
+	if probability > 0 && t.random() < probability {
+		throttleShedCounter.With(prometheus.Labels{"dependency": t.name}).Inc()
+		return false
+	}
+	return true
+}
+
+// record counts the outcome of a call that went through, every answer other than
+// throttling means the dependency accepted the call
+func (t *adaptiveThrottle) record(err error) {
+	if isThrottle(err) {
+		throttledCallCounter.With(prometheus.Labels{"dependency": t.name}).Inc()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bucket(t.now().Unix()).accepts++
+}
+
+func isThrottle(err error) bool {
+	return err != nil && request.IsErrorThrottle(err)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	"github.com/brave-intl/challenge-bypass-server/btd"
+)
+
+// tokenFieldValidators check the encoding of the fields holding token preimages and
+// redemption signatures, in every object of a request
+var tokenFieldValidators = map[string]func([]byte) error{
+	"t":         btd.ValidateTokenPreimage,
+	"signature": btd.ValidateVerificationSignature,
+}
+
+// jsonFrame is an object or array being walked by validateTokenEncodings
+type jsonFrame struct {
+	object bool
+	// key is set while the next token of an object is a key, name is the last key
+	key  bool
+	name string
+}
+
+// decodeTokenRequest decodes the JSON body of a request holding token preimages or
+// signatures like decodeRequest, once their encodings are known to be canonical. The
+// FFI decodes them while the body is unmarshalled and its errors do not say what was
+// wrong, so malformed values are rejected before they reach it.
+func decodeTokenRequest(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) *handlers.AppError {
+	return decodeBody(w, r, limit, func(body io.Reader) error {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if err := validateTokenEncodings(data); err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// validateTokenEncodings walks a JSON document and validates every string value of a
+// field in tokenFieldValidators. Field names match case insensitively, as they do when
+// encoding/json unmarshals them.
+func validateTokenEncodings(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var stack []jsonFrame
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var top *jsonFrame
+		if len(stack) > 0 {
+			top = &stack[len(stack)-1]
+		}
+		if top != nil && top.object && top.key {
+			if tok == json.Delim('}') {
+				stack = stack[:len(stack)-1]
+			} else {
+				top.name, _ = tok.(string)
+				top.key = false
+			}
+			continue
+		}
+
+		name := ""
+		if top != nil && top.object {
+			name = top.name
+			top.key = true
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			if len(stack) >= maxJSONDepth {
+				return errJSONTooDeep
+			}
+			stack = append(stack, jsonFrame{object: tok == json.Delim('{'), key: true})
+		case json.Delim(']'):
+			stack = stack[:len(stack)-1]
+		default:
+			text, ok := tok.(string)
+			if !ok || name == "" {
+				continue
+			}
+			for field, validate := range tokenFieldValidators {
+				// EqualFold folds like encoding/json, e.g. "ſignature" sets Signature
+				if strings.EqualFold(name, field) {
+					if err := validate([]byte(text)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
@@ -1,17 +1,62 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/brave-intl/bat-go/middleware"
 	"github.com/brave-intl/bat-go/utils/handlers"
 	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
 	"github.com/brave-intl/challenge-bypass-server/btd"
 	"github.com/go-chi/chi"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var (
+	ErrTokenOutsideValidity = btd.ErrTokenOutsideValidity
+
+	oversizedIssuanceCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "oversized_issuance_request_count",
+		Help: "Number of issuance requests rejected for exceeding the issuer batch cap",
+	}, []string{"issuer_type", "client"})
+
+	issuanceBatchSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "issuance_batch_size",
+		Help:    "Number of blinded tokens per issuance request",
+		Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	}, []string{"issuer_type"})
+
+	issuanceSigningDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "issuance_signing_duration_seconds",
+		Help:    "Time spent signing the blinded tokens of an issuance request",
+		Buckets: prometheus.ExponentialBuckets(.001, 2, 14),
+	}, []string{"issuer_type"})
+
+	redemptionKeyPosition = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "redemption_issuer_position",
+		Help:    "Position of the issuer that verified a redemption among the issuers of its type, 0 being the active issuer",
+		Buckets: prometheus.LinearBuckets(0, 1, 8),
+	})
+)
+
+// maxParallelVerifications bounds the issuers a redemption is verified against at once
+const maxParallelVerifications = 4
+
+// maxRedemptionKeys bounds the keys of a version 3 issuer a redemption is verified
+// against to the latest ones that started
+const maxRedemptionKeys = 3
+
+// ErrorCodeKeyExpired is the data.error_code of redemptions that failed verification
+// while the type has issuers older than RedemptionIssuerLimit allows
+const ErrorCodeKeyExpired = "key_expired"
+
 type BlindedTokenIssueRequest struct {
 	BlindedTokens []*crypto.BlindedToken `json:"blinded_tokens"`
 }
@@ -19,18 +64,52 @@ type BlindedTokenIssueRequest struct {
 type BlindedTokenIssueResponse struct {
 	BatchProof   *crypto.BatchDLEQProof `json:"batch_proof"`
 	SignedTokens []*crypto.SignedToken  `json:"signed_tokens"`
+	// PublicKey and ExpiresAt describe the signing issuer when the request asks for
+	// them with include=issuer, sparing new clients a fetch of the issuer
+	PublicKey *crypto.PublicKey `json:"public_key,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+}
+
+// BlindedTokenIssueResponseV3 is returned by version 3 issuers, with a signing result per time bucket
+type BlindedTokenIssueResponseV3 struct {
+	SigningResults []SigningResult `json:"signing_results"`
+}
+
+type SigningResult struct {
+	ValidFrom    time.Time              `json:"valid_from"`
+	ValidTo      time.Time              `json:"valid_to"`
+	PublicKey    *crypto.PublicKey      `json:"public_key"`
+	BatchProof   *crypto.BatchDLEQProof `json:"batch_proof"`
+	SignedTokens []*crypto.SignedToken  `json:"signed_tokens"`
 }
 
 type BlindedTokenRedeemRequest struct {
 	Payload       string                        `json:"payload"`
 	TokenPreimage *crypto.TokenPreimage         `json:"t"`
 	Signature     *crypto.VerificationSignature `json:"signature"`
+	// ReservationID is returned by verifying the token with reserve_seconds, it is
+	// required to redeem the token while the reservation runs
+	ReservationID string `json:"reservation_id,omitempty"`
+}
+
+// BlindedTokenRecordRequest records a token as spent that the caller verified itself
+type BlindedTokenRecordRequest struct {
+	Payload       string                `json:"payload"`
+	TokenPreimage *crypto.TokenPreimage `json:"t"`
+	ReservationID string                `json:"reservation_id,omitempty"`
 }
 
 type BlindedTokenRedemptionInfo struct {
 	TokenPreimage *crypto.TokenPreimage         `json:"t"`
 	Signature     *crypto.VerificationSignature `json:"signature"`
 	Issuer        string                        `json:"issuer"`
+	ReservationID string                        `json:"reservation_id,omitempty"`
+}
+
+// BlindedTokenRedemptionCheckRequest carries the preimage in the body so that it does not
+// end up in access logs
+type BlindedTokenRedemptionCheckRequest struct {
+	TokenPreimage *crypto.TokenPreimage `json:"t"`
 }
 
 type BlindedTokenBulkRedeemRequest struct {
@@ -39,16 +118,32 @@ type BlindedTokenBulkRedeemRequest struct {
 }
 
 func (c *Server) blindedTokenIssuerHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
-	if issuerType := chi.URLParam(r, "type"); issuerType != "" {
-		issuer, appErr := c.getIssuer(issuerType)
+	start := time.Now()
+	if issuerType := issuerTypeParam(r); issuerType != "" {
+		issuers, appErr := c.getIssuers(issuerType)
 		if appErr != nil {
 			return appErr
 		}
+		issuer := chooseIssuer(r, issuers)
+		// Tokens signed right before expiry could not be redeemed by clients whose
+		// clocks are ahead
+		if issuer.expiresWithin(time.Now(), c.clockSkew()) {
+			return &handlers.AppError{
+				Message: "Issuer has expired",
+				Code:    http.StatusNotFound,
+			}
+		}
+		if appErr := c.frozenAppError(issuer.IssuerType, FreezeIssuance); appErr != nil {
+			return appErr
+		}
+		if appErr := negotiateIssuerVersion(w, r, issuer); appErr != nil {
+			return appErr
+		}
 
 		var request BlindedTokenIssueRequest
 
-		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&request); err != nil {
-			return handlers.WrapError("Could not parse the request body", err)
+		if appErr := decodeIssueRequest(w, r, c.issuanceLimit(), issuer, c.issuerMaxTokens(issuer), &request); appErr != nil {
+			return appErr
 		}
 
 		if request.BlindedTokens == nil {
@@ -58,34 +153,268 @@ func (c *Server) blindedTokenIssuerHandler(w http.ResponseWriter, r *http.Reques
 			}
 		}
 
-		signedTokens, proof, err := btd.ApproveTokens(request.BlindedTokens, issuer.SigningKey)
-		if err != nil {
-			return &handlers.AppError{
-				Error:   err,
-				Message: "Could not approve new tokens",
-				Code:    http.StatusInternalServerError,
+		issuanceBatchSizeHistogram.With(prometheus.Labels{"issuer_type": issuer.IssuerType}).Observe(float64(len(request.BlindedTokens)))
+		// Memory is reserved before the quota is spent, so that rejected batches
+		// do not count against it
+		release, appErr := reserveIssuanceMemory(w, len(request.BlindedTokens))
+		if appErr != nil {
+			return appErr
+		}
+		defer release()
+		if appErr := c.issuanceQuotaAppError(w, issuer, len(request.BlindedTokens)); appErr != nil {
+			return appErr
+		}
+
+		if issuer.Version == IssuerVersion3 {
+			if appErr := c.issueTimeLimitedTokens(w, r, issuer, request.BlindedTokens); appErr != nil {
+				return appErr
 			}
+			c.recordUsage(r, len(request.BlindedTokens), 0)
+			c.sampleIssuance(r, issuer, len(request.BlindedTokens), time.Since(start))
+			countCanaryIssuance(issuers, issuer)
+			return nil
 		}
 
-		err = json.NewEncoder(w).Encode(BlindedTokenIssueResponse{proof, signedTokens})
+		signingStart := time.Now()
+		signedTokens, proof, err := signers.approveTokens(request.BlindedTokens, issuer.SigningKey)
 		if err != nil {
-			panic(err)
+			return approvalError(w, err)
+		}
+		issuanceSigningDuration.With(prometheus.Labels{"issuer_type": issuer.IssuerType}).Observe(time.Since(signingStart).Seconds())
+		if appErr := c.logIssuance(issuer, []issuanceBatch{{issuer.SigningKey.PublicKey(), signedTokens}}); appErr != nil {
+			return appErr
 		}
+
+		response := BlindedTokenIssueResponse{BatchProof: proof, SignedTokens: signedTokens}
+		if includeIssuer(w, r, issuer) {
+			response.PublicKey = issuer.SigningKey.PublicKey()
+			if expiresAt := issuer.ExpiresAt; !expiresAt.IsZero() {
+				response.ExpiresAt = &expiresAt
+			}
+		}
+		if appErr := encodeIssueResponse(w, r, response); appErr != nil {
+			return appErr
+		}
+		c.recordUsage(r, len(signedTokens), 0)
+		c.sampleIssuance(r, issuer, len(signedTokens), time.Since(start))
+		countCanaryIssuance(issuers, issuer)
 	}
 	return nil
 }
 
+// tooManyTokensError rejects a request for more tokens than the issuer signs in one
+// batch, requested is zero when decoding stopped before counting every token
+func tooManyTokensError(r *http.Request, issuer *Issuer, maxTokens, requested int) *handlers.AppError {
+	oversizedIssuanceCounter.With(prometheus.Labels{
+		"issuer_type": issuer.IssuerType,
+		"client":      clientKeyID(r),
+	}).Inc()
+	data := map[string]interface{}{
+		"max_tokens": maxTokens,
+		"suggestion": fmt.Sprintf("Split the request into batches of at most %d tokens", maxTokens),
+	}
+	if requested > 0 {
+		data["requested"] = requested
+	}
+	return &handlers.AppError{
+		Message: "Too many tokens requested",
+		Code:    http.StatusRequestEntityTooLarge,
+		Data:    data,
+	}
+}
+
+// approvalError asks clients to retry shortly when the signing workers are saturated
+func approvalError(w http.ResponseWriter, err error) *handlers.AppError {
+	if err == ErrSigningSaturated {
+		w.Header().Set("Retry-After", "1")
+		return &handlers.AppError{
+			Message: err.Error(),
+			Code:    http.StatusServiceUnavailable,
+		}
+	}
+	return &handlers.AppError{
+		Error:   err,
+		Message: "Could not approve new tokens",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+// issueTimeLimitedTokens signs the blinded tokens for a version 3 issuer. The tokens are
+// split in order across the current bucket and the buffered buckets after it, with any
+// remainder going to the earliest buckets.
+func (c *Server) issueTimeLimitedTokens(w http.ResponseWriter, r *http.Request, issuer *Issuer, blindedTokens []*crypto.BlindedToken) *handlers.AppError {
+	issuer, err := c.ensureIssuerKeys(issuer, time.Now())
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not generate issuer keys",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	keys := issuer.bufferedKeys(time.Now())
+	if len(keys) == 0 {
+		return &handlers.AppError{
+			Message: "Issuer has no signing key for the current time",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	response := BlindedTokenIssueResponseV3{SigningResults: []SigningResult{}}
+	var batches []issuanceBatch
+	offset := 0
+	var signing time.Duration
+	for i, key := range keys {
+		count := len(blindedTokens) / len(keys)
+		if i < len(blindedTokens)%len(keys) {
+			count++
+		}
+		if count == 0 {
+			continue
+		}
+
+		signingStart := time.Now()
+		signedTokens, proof, err := signers.approveTokens(blindedTokens[offset:offset+count], key.SigningKey)
+		if err != nil {
+			return approvalError(w, err)
+		}
+		signing += time.Since(signingStart)
+		offset += count
+		batches = append(batches, issuanceBatch{key.SigningKey.PublicKey(), signedTokens})
+
+		response.SigningResults = append(response.SigningResults, SigningResult{
+			ValidFrom:    key.StartAt,
+			ValidTo:      key.EndAt,
+			PublicKey:    key.SigningKey.PublicKey(),
+			BatchProof:   proof,
+			SignedTokens: signedTokens,
+		})
+	}
+	issuanceSigningDuration.With(prometheus.Labels{"issuer_type": issuer.IssuerType}).Observe(signing.Seconds())
+	if appErr := c.logIssuance(issuer, batches); appErr != nil {
+		return appErr
+	}
+
+	// Signing results already carry their public key and validity
+	includeIssuer(w, r, issuer)
+	return encodeIssueResponse(w, r, response)
+}
+
+// verifyRedemption checks a token redemption against every issuer of its type, so that
+// tokens signed before a rotation stay redeemable until the rotated issuer expires
+func (c *Server) verifyRedemption(issuers []*Issuer, preimage *crypto.TokenPreimage, signature *crypto.VerificationSignature, payload string) error {
+	now := time.Now()
+	errs := make([]error, len(issuers))
+	if len(issuers) == 1 {
+		errs[0] = verifyIssuerRedemption(issuers[0], preimage, signature, payload, now, c.clockSkew())
+	} else {
+		// Issuers of a long rotation history are verified concurrently, those not
+		// started by the time one matches are skipped
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		slots := make(chan struct{}, maxParallelVerifications)
+		var wg sync.WaitGroup
+		for i, issuer := range issuers {
+			wg.Add(1)
+			go func(i int, issuer *Issuer) {
+				defer wg.Done()
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					errs[i] = ctx.Err()
+					return
+				}
+				if errs[i] = verifyIssuerRedemption(issuer, preimage, signature, payload, now, c.clockSkew()); errs[i] == nil {
+					cancel()
+				}
+			}(i, issuer)
+		}
+		wg.Wait()
+	}
+
+	var err error
+	for i, issuerErr := range errs {
+		if issuerErr == nil {
+			redemptionKeyPosition.Observe(float64(i))
+			countCanaryRedemption(issuers, issuers[i])
+			return nil
+		}
+		if err == nil || issuerErr == ErrTokenOutsideValidity {
+			err = issuerErr
+		}
+	}
+	return err
+}
+
+// redemptionIssuers splits the unexpired issuers of a type, active issuer first, into
+// the RedemptionIssuerLimit most recent ones redemptions are verified against and
+// the older ones
+func (c *Server) redemptionIssuers(issuers []*Issuer) ([]*Issuer, []*Issuer) {
+	if c.RedemptionIssuerLimit <= 0 || len(issuers) <= c.RedemptionIssuerLimit {
+		return issuers, nil
+	}
+	return issuers[:c.RedemptionIssuerLimit], issuers[c.RedemptionIssuerLimit:]
+}
+
+// keyExpiredAppError rejects a redemption that failed verification with a 410 and
+// ErrorCodeKeyExpired, so that clients discard the token rather than retry. Telling
+// whether one of the older issuers signed it would cost a verification per issuer, so
+// every failed redemption of a type with older issuers is reported this way.
+func keyExpiredAppError() *handlers.AppError {
+	return &handlers.AppError{
+		Message: "Token was not signed by an issuer that is still accepted",
+		Code:    http.StatusGone,
+		Data: map[string]interface{}{
+			"error_code": ErrorCodeKeyExpired,
+		},
+	}
+}
+
+// verifyIssuerRedemption checks a token redemption against the keys the issuer accepts
+// at now, keys whose validity ends or starts within skew of now are accepted as well
+func verifyIssuerRedemption(issuer *Issuer, preimage *crypto.TokenPreimage, signature *crypto.VerificationSignature, payload string, now time.Time, skew time.Duration) error {
+	return btd.VerifyTokenRedemptionAt(preimage, signature, payload, issuer.redemptionKeys(now, skew), now, skew)
+}
+
+// redemptionKeys returns the keys redemptions of the issuer's tokens are verified with
+// at now. Of a version 3 issuer, only the maxRedemptionKeys latest keys that started
+// within skew of now are, the tokens of earlier keys are no longer valid and those of
+// later keys not yet.
+func (issuer *Issuer) redemptionKeys(now time.Time, skew time.Duration) []btd.Key {
+	if issuer.Version != IssuerVersion3 {
+		return []btd.Key{{SigningKey: issuer.SigningKey}}
+	}
+	// Keys are ordered by the start of their validity
+	end := len(issuer.Keys)
+	for end > 0 && issuer.Keys[end-1].StartAt.After(now.Add(skew)) {
+		end--
+	}
+	start := end - maxRedemptionKeys
+	if start < 0 {
+		start = 0
+	}
+	keys := make([]btd.Key, 0, end-start)
+	for _, key := range issuer.Keys[start:end] {
+		keys = append(keys, btd.Key{SigningKey: key.SigningKey, StartAt: key.StartAt, EndAt: key.EndAt})
+	}
+	return keys
+}
+
 func (c *Server) blindedTokenRedeemHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
-	if issuerType := chi.URLParam(r, "type"); issuerType != "" {
-		issuer, appErr := c.getIssuer(issuerType)
-		if appErr != nil {
-			return appErr
+	if issuerType := issuerTypeParam(r); issuerType != "" {
+		// Unknown types are only rejected once the token is known not to be revoked
+		issuers, lookupErr := c.getIssuers(issuerType)
+		if lookupErr != nil && lookupErr.Code != http.StatusNotFound {
+			return lookupErr
 		}
 
 		var request BlindedTokenRedeemRequest
 
-		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&request); err != nil {
-			return handlers.WrapError("Could not parse the request body", err)
+		if appErr := decodeTokenRequest(w, r, c.redemptionLimit(), &request); appErr != nil {
+			return appErr
 		}
 
 		if request.TokenPreimage == nil || request.Signature == nil {
@@ -95,46 +424,113 @@ func (c *Server) blindedTokenRedeemHandler(w http.ResponseWriter, r *http.Reques
 			}
 		}
 
-		if err := btd.VerifyTokenRedemption(request.TokenPreimage, request.Signature, request.Payload, []*crypto.SigningKey{issuer.SigningKey}); err != nil {
-			return handlers.WrapError("Could not verify that token redemption is valid", err)
+		if appErr := c.verifyRedemptionAppError(issuerType, issuers, lookupErr, request.TokenPreimage, request.Signature, request.Payload); appErr != nil {
+			return appErr
+		}
+		if appErr := c.frozenAppError(issuers[0].IssuerType, FreezeRedemption); appErr != nil {
+			return appErr
+		}
+		if appErr := issuerFlagAppError(issuers[0], request.Payload, false, request.ReservationID != ""); appErr != nil {
+			return appErr
 		}
 
-		if err := c.redeemToken(issuerType, request.TokenPreimage, request.Payload); err != nil {
-			if err == DuplicateRedemptionError {
-				return &handlers.AppError{
-					Message: err.Error(),
-					Code:    http.StatusConflict,
-				}
-			} else {
-				return &handlers.AppError{
-					Error:   err,
-					Message: "Could not mark token redemption",
-					Code:    http.StatusInternalServerError,
-				}
+		if appErr := c.checkPreimageReservation(request.TokenPreimage, request.ReservationID); appErr != nil {
+			return appErr
+		}
+
+		// Redemptions are recorded under the current name of a renamed issuer type
+		if err := c.redeemToken(issuers[0].IssuerType, request.TokenPreimage, request.Payload); err != nil {
+			if errors.Is(err, ErrDuplicate) {
+				c.recordDuplicate(r, issuers[0].IssuerType, request.TokenPreimage, request.Payload)
+				return c.duplicateRedemptionAppError(err, issuers[0].IssuerType, request.TokenPreimage, request.Payload)
 			}
+			return storageAppError(err, "Could not mark token redemption")
 		}
+		c.closeReservation(request.TokenPreimage, request.ReservationID)
+		c.recordUsage(r, 0, 1)
+		c.enrichRedemptions(r, issuers[0].IssuerType, 1)
 	}
 	return nil
 }
 
+// blindedTokenRecordHandler records a redemption without verifying its signature, for
+// trusted callers that verified the token with the signing keys of a key bundle. The
+// server can not tell which issuer signed the token, so tokens of revoked issuers are
+// only rejected once the caller has loaded a bundle without their keys.
+func (c *Server) blindedTokenRecordHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	issuers, appErr := c.getIssuers(issuerTypeParam(r))
+	if appErr != nil {
+		return appErr
+	}
+
+	var request BlindedTokenRecordRequest
+	if appErr := decodeTokenRequest(w, r, c.redemptionLimit(), &request); appErr != nil {
+		return appErr
+	}
+	if request.TokenPreimage == nil {
+		return &handlers.AppError{
+			Message: "Empty request",
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	if appErr := c.frozenAppError(issuers[0].IssuerType, FreezeRedemption); appErr != nil {
+		return appErr
+	}
+	if appErr := issuerFlagAppError(issuers[0], request.Payload, false, request.ReservationID != ""); appErr != nil {
+		return appErr
+	}
+	if appErr := c.checkPreimageReservation(request.TokenPreimage, request.ReservationID); appErr != nil {
+		return appErr
+	}
+
+	if err := c.redeemToken(issuers[0].IssuerType, request.TokenPreimage, request.Payload); err != nil {
+		if errors.Is(err, ErrDuplicate) {
+			c.recordDuplicate(r, issuers[0].IssuerType, request.TokenPreimage, request.Payload)
+			return c.duplicateRedemptionAppError(err, issuers[0].IssuerType, request.TokenPreimage, request.Payload)
+		}
+		return storageAppError(err, "Could not mark token redemption")
+	}
+	c.closeReservation(request.TokenPreimage, request.ReservationID)
+	c.recordUsage(r, 0, 1)
+	c.enrichRedemptions(r, issuers[0].IssuerType, 1)
+	return nil
+}
+
 func (c *Server) blindedTokenBulkRedeemHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
 
 	var request BlindedTokenBulkRedeemRequest
 
-	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&request); err != nil {
-		return handlers.WrapError("Could not parse the request body", err)
+	if appErr := decodeTokenRequest(w, r, c.redemptionLimit(), &request); appErr != nil {
+		return appErr
 	}
 
-	tx, err := c.db.Begin()
+	var tx *sql.Tx
+	err := c.retry("postgres_begin", true, func() error {
+		var err error
+		tx, err = c.db.Begin()
+		return err
+	})
 	if err != nil {
 		return handlers.WrapError("Could not start bulk token redemption db transaction", err)
 	}
 
-	for _, token := range request.Tokens {
-		issuer, appErr := c.getIssuer(token.Issuer)
-		if appErr != nil {
+	// Redis can not take part in the Postgres transaction, so a bulk redemption is
+	// either recorded in Postgres or in Redis with a script that is just as atomic
+	var redisTypes, redisIDs, redisPayloads []string
+	payloads := make([]string, len(request.Tokens))
+	for i := range request.Tokens {
+		token := &request.Tokens[i]
+		if err := validIssuerName(token.Issuer); err != nil {
 			_ = tx.Rollback()
-			return appErr
+			return handlers.WrapError("Invalid issuer", err)
+		}
+		token.Issuer = scopedIssuerType(r, token.Issuer)
+
+		issuers, lookupErr := c.getIssuers(token.Issuer)
+		if lookupErr != nil && lookupErr.Code != http.StatusNotFound {
+			_ = tx.Rollback()
+			return lookupErr
 		}
 
 		if token.TokenPreimage == nil || token.Signature == nil {
@@ -145,29 +541,81 @@ func (c *Server) blindedTokenBulkRedeemHandler(w http.ResponseWriter, r *http.Re
 			}
 		}
 
-		if err := btd.VerifyTokenRedemption(token.TokenPreimage, token.Signature, request.Payload, []*crypto.SigningKey{issuer.SigningKey}); err != nil {
+		if appErr := c.verifyRedemptionAppError(token.Issuer, issuers, lookupErr, token.TokenPreimage, token.Signature, request.Payload); appErr != nil {
+			_ = tx.Rollback()
+			return appErr
+		}
+		token.Issuer = issuers[0].IssuerType
+		if appErr := c.frozenAppError(token.Issuer, FreezeRedemption); appErr != nil {
 			_ = tx.Rollback()
-			return handlers.WrapError("Could not verify that token redemption is valid", err)
+			return appErr
+		}
+		if appErr := issuerFlagAppError(issuers[0], request.Payload, true, token.ReservationID != ""); appErr != nil {
+			_ = tx.Rollback()
+			return appErr
 		}
 
-		if err := redeemTokenWithDB(tx, token.Issuer, token.TokenPreimage, request.Payload); err != nil {
+		if appErr := c.checkPreimageReservation(token.TokenPreimage, token.ReservationID); appErr != nil {
 			_ = tx.Rollback()
-			if err == DuplicateRedemptionError {
-				return &handlers.AppError{
-					Message: err.Error(),
-					Code:    http.StatusConflict,
-				}
-			} else {
-				return &handlers.AppError{
-					Error:   err,
-					Message: "Could not mark token redemption",
-					Code:    http.StatusInternalServerError,
-				}
+			return appErr
+		}
+
+		// Tokens of different types can be persisted with different payloads
+		payload, err := c.applyPayloadPolicy(issuers[0], request.Payload)
+		if err != nil {
+			_ = tx.Rollback()
+			return &handlers.AppError{
+				Error:   err,
+				Message: "Could not apply payload policy",
+				Code:    http.StatusInternalServerError,
 			}
 		}
+		payloads[i] = payload
+
+		useRedis := issuers[0].RedemptionStore == RedemptionStoreRedis
+		if i > 0 && useRedis != (len(redisIDs) > 0) {
+			_ = tx.Rollback()
+			return handlers.WrapError("Invalid bulk redemption", ErrMixedRedemptionStores)
+		}
+		preimageTxt, err := token.TokenPreimage.MarshalText()
+		if err != nil {
+			_ = tx.Rollback()
+			return handlers.WrapError("Could not parse the token preimage", err)
+		}
+		// Queued redemptions are not in Postgres until they are replayed, bulk redemptions
+		// are checked against the queue as single ones are
+		if c.redeemedRecently(token.Issuer, string(preimageTxt)) || !useRedis && c.redemptionQueue != nil && c.isQueued(string(preimageTxt)) {
+			_ = tx.Rollback()
+			c.rememberRedemption(token.Issuer, string(preimageTxt))
+			c.recordDuplicate(r, token.Issuer, token.TokenPreimage, request.Payload)
+			return c.duplicateRedemptionAppError(DuplicateRedemptionError, token.Issuer, token.TokenPreimage, request.Payload)
+		}
+		if useRedis {
+			redisTypes = append(redisTypes, token.Issuer)
+			redisIDs = append(redisIDs, string(preimageTxt))
+			redisPayloads = append(redisPayloads, payload)
+			continue
+		}
+
+		if err := c.redeemTokenWithDB(tx, token.Issuer, token.TokenPreimage, payload); err != nil {
+			_ = tx.Rollback()
+			if errors.Is(err, ErrDuplicate) {
+				c.recordDuplicate(r, token.Issuer, token.TokenPreimage, request.Payload)
+				return c.duplicateRedemptionAppError(err, token.Issuer, token.TokenPreimage, request.Payload)
+			}
+			return storageAppError(err, "Could not mark token redemption")
+		}
 	}
-	err = tx.Commit()
-	if err != nil {
+	if len(redisIDs) > 0 {
+		_ = tx.Rollback()
+		if i, err := c.redeemRedisTokens(redisTypes, redisIDs, redisPayloads); err != nil {
+			if errors.Is(err, ErrDuplicate) {
+				c.recordDuplicate(r, redisTypes[i], request.Tokens[i].TokenPreimage, request.Payload)
+				return c.duplicateRedemptionAppError(err, redisTypes[i], request.Tokens[i].TokenPreimage, request.Payload)
+			}
+			return storageAppError(err, "Could not mark token redemption")
+		}
+	} else if err := tx.Commit(); err != nil {
 		return &handlers.AppError{
 			Error:   err,
 			Message: "Could not mark token redemption",
@@ -175,44 +623,105 @@ func (c *Server) blindedTokenBulkRedeemHandler(w http.ResponseWriter, r *http.Re
 		}
 	}
 
+	// Postgres is the double spend check of bulk redemptions, DynamoDB is written
+	// once they are committed and the backfill catches up on failures
+	var dynamoRedemptions []Redemption
+	for i, token := range request.Tokens {
+		c.closeReservation(token.TokenPreimage, token.ReservationID)
+		if len(redisIDs) == 0 && c.dualWrites(token.Issuer) {
+			if preimageTxt, err := token.TokenPreimage.MarshalText(); err == nil {
+				dynamoRedemptions = append(dynamoRedemptions,
+					Redemption{IssuerType: token.Issuer, Id: string(preimageTxt), Timestamp: time.Now(), Payload: payloads[i]})
+			}
+		}
+		c.publishRedemption(token.Issuer, token.TokenPreimage, payloads[i])
+		c.countRedemptions(token.Issuer, 1)
+		c.enrichRedemptions(r, token.Issuer, 1)
+	}
+	if err := c.copyRedemptionsToDynamo(dynamoRedemptions); err != nil {
+		lg.Errorf("Could not write bulk redemption to DynamoDB: %s", err)
+		c.reportError(r, err, map[string]string{"storage": "dynamo"})
+	}
+	c.recordUsage(r, 0, len(request.Tokens))
+
 	return nil
 }
 
 func (c *Server) blindedTokenRedemptionHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
-	if issuerType := chi.URLParam(r, "type"); issuerType != "" {
-		tokenId := r.FormValue("tokenId")
-		redemption, err := c.fetchRedemption(issuerType, tokenId)
-		if err != nil {
-			if err == RedemptionNotFoundError {
-				return &handlers.AppError{
-					Message: err.Error(),
-					Code:    http.StatusBadRequest,
-				}
-			} else {
-				return &handlers.AppError{
-					Error:   err,
-					Message: "Could not check token redemption",
-					Code:    http.StatusInternalServerError,
-				}
+	if issuerType := issuerTypeParam(r); issuerType != "" {
+		return c.checkRedemption(w, c.resolveIssuerType(issuerType), r.FormValue("tokenId"))
+	}
+	return nil
+}
+
+func (c *Server) blindedTokenRedemptionCheckHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	if issuerType := issuerTypeParam(r); issuerType != "" {
+		var request BlindedTokenRedemptionCheckRequest
+
+		if appErr := decodeTokenRequest(w, r, c.redemptionLimit(), &request); appErr != nil {
+			return appErr
+		}
+
+		if request.TokenPreimage == nil {
+			return &handlers.AppError{
+				Message: "Empty request",
+				Code:    http.StatusBadRequest,
 			}
 		}
 
-		err = json.NewEncoder(w).Encode(redemption)
+		tokenID, err := request.TokenPreimage.MarshalText()
 		if err != nil {
-			panic(err)
+			return handlers.WrapError("Could not parse the token preimage", err)
 		}
+
+		return c.checkRedemption(w, c.resolveIssuerType(issuerType), string(tokenID))
 	}
 	return nil
 }
 
+func (c *Server) checkRedemption(w http.ResponseWriter, issuerType, tokenID string) *handlers.AppError {
+	redemption, err := c.fetchRedemption(issuerType, tokenID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return &handlers.AppError{
+				Message: err.Error(),
+				Code:    http.StatusBadRequest,
+			}
+		} else {
+			return &handlers.AppError{
+				Error:   err,
+				Message: "Could not check token redemption",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+	}
+
+	// The cached redemption is shared, only the response leaves out the tenant
+	resp := *redemption
+	_, resp.IssuerType = splitIssuerType(redemption.IssuerType)
+	return encodeResponse(w, resp)
+}
+
 func (c *Server) tokenRouter() chi.Router {
 	r := chi.NewRouter()
+	r.Use(c.corsHandler)
+	r.Use(c.requireReady)
 	if os.Getenv("ENV") == "production" {
-		r.Use(middleware.SimpleTokenAuthorizedOnly)
+		r.Use(authorized)
 	}
-	r.Method(http.MethodPost, "/{type}", middleware.InstrumentHandler("IssueTokens", handlers.AppHandler(c.blindedTokenIssuerHandler)))
-	r.Method(http.MethodPost, "/{type}/redemption/", middleware.InstrumentHandler("RedeemTokens", handlers.AppHandler(c.blindedTokenRedeemHandler)))
-	r.Method(http.MethodPost, "/bulk/redemption/", middleware.InstrumentHandler("BulkRedeemTokens", handlers.AppHandler(c.blindedTokenBulkRedeemHandler)))
-	r.Method(http.MethodGet, "/{type}/redemption/", middleware.InstrumentHandler("CheckToken", handlers.AppHandler(c.blindedTokenRedemptionHandler)))
+	r.With(requireScope(ScopeTokensIssue), c.compressResponse).Method(http.MethodPost, "/{type}", middleware.InstrumentHandler("IssueTokens", c.appHandler(c.blindedTokenIssuerHandler)))
+	redeem := r.With(requireScope(ScopeTokensRedeem))
+	redeem.Method(http.MethodPost, "/{type}/redemption/", middleware.InstrumentHandler("RedeemTokens", c.appHandler(c.blindedTokenRedeemHandler)))
+	redeem.Method(http.MethodPost, "/{type}/verify", middleware.InstrumentHandler("VerifyToken", c.appHandler(c.blindedTokenVerifyHandler)))
+	redeem.Method(http.MethodPost, "/{type}/reservation/", middleware.InstrumentHandler("ReserveToken", c.appHandler(c.blindedTokenReserveHandler)))
+	redeem.Method(http.MethodPost, "/{type}/reservation/{id}/commit", middleware.InstrumentHandler("CommitReservation", c.appHandler(c.reservationCommitHandler)))
+	redeem.Method(http.MethodPost, "/{type}/reservation/{id}/abort", middleware.InstrumentHandler("AbortReservation", c.appHandler(c.reservationAbortHandler)))
+	redeem.Method(http.MethodPost, "/bulk/redemption/", middleware.InstrumentHandler("BulkRedeemTokens", c.appHandler(c.blindedTokenBulkRedeemHandler)))
+	// Recording skips the signature check, so only operators holding a request signing
+	// key may record, however they authenticate and whatever the environment
+	r.With(operatorOnly, requireScope(ScopeTokensRecord), c.requireSigned).Method(http.MethodPost, "/{type}/redemption/record", middleware.InstrumentHandler("RecordTokenRedemption", c.appHandler(c.blindedTokenRecordHandler)))
+	read := r.With(requireScope(ScopeTokensRead))
+	read.Method(http.MethodGet, "/{type}/redemption/", middleware.InstrumentHandler("CheckToken", c.appHandler(c.blindedTokenRedemptionHandler)))
+	read.Method(http.MethodPost, "/{type}/redemption/check", middleware.InstrumentHandler("CheckTokenByPreimage", c.appHandler(c.blindedTokenRedemptionCheckHandler)))
 	return r
 }
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// VaultKeyStorageKV stores signing keys as KV version 2 secrets, the database
+	// only keeps a reference to them
+	VaultKeyStorageKV = "kv"
+	// VaultKeyStorageTransit encrypts signing keys with a transit key, the database
+	// keeps the ciphertext
+	VaultKeyStorageTransit = "transit"
+
+	defaultVaultKeyPath = "challenge-bypass"
+
+	// vaultKVPrefix marks signing keys stored in the KV engine, transit ciphertexts
+	// already start with vault:. Neither can be confused with plaintext keys, which
+	// are base64 encoded.
+	vaultKVPrefix      = "vault-kv:"
+	vaultTransitPrefix = "vault:"
+)
+
+var (
+	ErrUnknownKeyStorage = errors.New("Vault key storage must be kv or transit")
+	ErrVaultKeyNotFound  = errors.New("Signing key is missing from Vault")
+	ErrVaultKeyStorage   = errors.New("Signing key is stored in Vault but Vault key storage is not configured")
+
+	vaultRenewFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vault_renew_failure_count",
+		Help: "Number of Vault token or lease renewals that stopped with an error",
+	})
+
+	// keyStore seals signing keys when Vault key storage is enabled. Signing keys are
+	// read and written by functions outside of Server, and servers are copied by value.
+	keyStore *vaultKeyStore
+)
+
+// VaultConfig reads secrets from Vault at startup and optionally keeps issuer signing
+// keys in Vault. The token is read from VAULT_TOKEN, or obtained with AppRole when
+// RoleID is set, with the secret id read from VAULT_SECRET_ID.
+type VaultConfig struct {
+	Address string `json:"address,omitempty"`
+	RoleID  string `json:"role_id,omitempty"`
+	// SecretPath is read at startup, its database_url, database_read_only_url and
+	// token_list fields override the database config and extend the token list. It is
+	// read again when its lease ends, or every Secrets.PollSec when it has none, to
+	// rotate them.
+	SecretPath string `json:"secret_path,omitempty"`
+	// KeyStorage is kv or transit, signing keys stay in the database when empty
+	KeyStorage string `json:"key_storage,omitempty"`
+	// KeyMount is the mount of the KV or transit engine, "secret" or "transit" by default
+	KeyMount string `json:"key_mount,omitempty"`
+	// KeyPath is the KV path prefix or the transit key name
+	KeyPath string `json:"key_path,omitempty"`
+}
+
+type vaultKeyStore struct {
+	client  *vault.Client
+	storage string
+	mount   string
+	path    string
+}
+
+// InitVault logs in to Vault and applies the startup secrets, it does nothing when
+// Vault is not configured
+func (c *Server) InitVault() error {
+	if c.Vault.Address == "" {
+		return nil
+	}
+
+	config := vault.DefaultConfig()
+	config.Address = c.Vault.Address
+	client, err := vault.NewClient(config)
+	if err != nil {
+		return err
+	}
+	c.vault = client
+	c.vaultLeaseDone = make(chan struct{}, 1)
+
+	if c.Vault.RoleID != "" {
+		if err := c.vaultLogin(); err != nil {
+			return err
+		}
+	}
+
+	if c.Vault.SecretPath != "" {
+		if err := c.loadVaultSecrets(); err != nil {
+			return err
+		}
+	}
+
+	switch c.Vault.KeyStorage {
+	case "":
+	case VaultKeyStorageKV, VaultKeyStorageTransit:
+		store := &vaultKeyStore{
+			client:  client,
+			storage: c.Vault.KeyStorage,
+			mount:   c.Vault.KeyMount,
+			path:    c.Vault.KeyPath,
+		}
+		if store.mount == "" {
+			store.mount = map[string]string{VaultKeyStorageKV: "secret", VaultKeyStorageTransit: "transit"}[store.storage]
+		}
+		if store.path == "" {
+			store.path = defaultVaultKeyPath
+		}
+		keyStore = store
+	default:
+		return ErrUnknownKeyStorage
+	}
+	return nil
+}
+
+// vaultLogin replaces the client token with one obtained through AppRole
+func (c *Server) vaultLogin() error {
+	secret, err := c.vault.Logical().Write("auth/approle/login", map[string]interface{}{
+		"role_id":   c.Vault.RoleID,
+		"secret_id": os.Getenv("VAULT_SECRET_ID"),
+	})
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil {
+		return errors.New("Vault AppRole login did not return a token")
+	}
+	c.vault.SetToken(secret.Auth.ClientToken)
+	return nil
+}
+
+// readVaultData reads a secret, unwrapping the data of KV version 2 secrets
+func readVaultData(client *vault.Client, path string) (*vault.Secret, map[string]interface{}, error) {
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if secret == nil {
+		return nil, nil, nil
+	}
+	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+		return secret, data, nil
+	}
+	return secret, secret.Data, nil
+}
+
+func (c *Server) loadVaultSecrets() error {
+	secret, data, err := readVaultData(c.vault, c.Vault.SecretPath)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("Vault secret %s does not exist", c.Vault.SecretPath)
+	}
+	c.vaultSecret = secret
+
+	if uri, ok := data["database_url"].(string); ok && uri != "" {
+		c.dbConfig.ConnectionURI = uri
+	}
+	if uri, ok := data["database_read_only_url"].(string); ok && uri != "" {
+		c.dbConfig.ReadOnlyConnectionURI = uri
+	}
+	if tokens, ok := data["token_list"].(string); ok {
+		sharedTokens.set(secretSourceVault, splitList(tokens), time.Now())
+	}
+	return nil
+}
+
+// reloadVaultSecrets reads the Vault secret again and rotates what changed in it, a
+// new lease is renewed from then on
+func (c *Server) reloadVaultSecrets() {
+	secret, data, err := readVaultData(c.vault, c.Vault.SecretPath)
+	if err == nil && secret == nil {
+		err = fmt.Errorf("Vault secret %s does not exist", c.Vault.SecretPath)
+	}
+	if err != nil {
+		secretReloadFailureCounter.With(prometheus.Labels{"source": secretSourceVault}).Inc()
+		lg.Errorf("Could not reload Vault secret %s: %s", c.Vault.SecretPath, err)
+		c.reportError(nil, err, map[string]string{"job": "secret_rotation"})
+		return
+	}
+	c.applySecrets(secretSourceVault, data)
+
+	if secret.LeaseID != "" && secret.LeaseID != c.vaultSecret.LeaseID && secret.Renewable {
+		go c.watchVaultRenewal("secret "+c.Vault.SecretPath, secret, c.vaultLeaseDone)
+	}
+	c.vaultSecret = secret
+}
+
+// renewVault keeps the Vault token and the lease of the startup secret alive for as
+// long as Vault allows
+func (c *Server) renewVault() {
+	if c.vault == nil {
+		return
+	}
+
+	token, err := c.vault.Auth().Token().RenewSelf(0)
+	if err != nil {
+		// Root and other periodic tokens without a TTL cannot be renewed
+		lg.Warnf("Could not renew Vault token: %s", err)
+	} else {
+		go c.watchVaultRenewal("token", token, nil)
+	}
+	if c.vaultSecret != nil && c.vaultSecret.Renewable {
+		go c.watchVaultRenewal("secret "+c.Vault.SecretPath, c.vaultSecret, c.vaultLeaseDone)
+	}
+}
+
+// watchVaultRenewal renews a token or lease until Vault stops allowing it, then
+// signals done so that the secret is read again
+func (c *Server) watchVaultRenewal(name string, secret *vault.Secret, done chan<- struct{}) {
+	renewer, err := c.vault.NewRenewer(&vault.RenewerInput{Secret: secret})
+	if err != nil {
+		incrementCounter(vaultRenewFailureCounter)
+		lg.Errorf("Could not renew Vault %s: %s", name, err)
+		c.reportError(nil, err, map[string]string{"job": "vault_renewal"})
+		return
+	}
+	go renewer.Renew()
+	defer renewer.Stop()
+	if done != nil {
+		defer func() {
+			select {
+			case done <- struct{}{}:
+			default:
+			}
+		}()
+	}
+
+	for {
+		select {
+		case err := <-renewer.DoneCh():
+			if err != nil {
+				incrementCounter(vaultRenewFailureCounter)
+				lg.Errorf("Renewal of Vault %s stopped: %s", name, err)
+				c.reportError(nil, err, map[string]string{"job": "vault_renewal"})
+			} else {
+				lg.Warnf("Vault %s reached its maximum lifetime", name)
+			}
+			return
+		case <-renewer.RenewCh():
+		}
+	}
+}
+
+// sealSigningKey returns the form of a signing key that is stored in the database,
+// callers zeroize it once it is written
+func sealSigningKey(key *crypto.SigningKey) ([]byte, error) {
+	text, err := key.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	if keyStore == nil {
+		signingKeys.add(text, key)
+		return text, nil
+	}
+	defer zeroize(text)
+
+	stored, err := keyStore.seal(text)
+	if err != nil {
+		return nil, err
+	}
+	signingKeys.add(stored, key)
+	return stored, nil
+}
+
+// unsealSigningKey reads a signing key stored by sealSigningKey, keys stored before
+// Vault key storage was enabled are read as they are. The stored form is zeroized
+// since callers only keep the key.
+func unsealSigningKey(stored []byte) (*crypto.SigningKey, error) {
+	defer zeroize(stored)
+	if key := signingKeys.get(stored); key != nil {
+		return key, nil
+	}
+
+	text := stored
+	if strings.HasPrefix(string(stored), vaultKVPrefix) || strings.HasPrefix(string(stored), vaultTransitPrefix) {
+		if keyStore == nil {
+			return nil, ErrVaultKeyStorage
+		}
+		var err error
+		if text, err = keyStore.unseal(string(stored)); err != nil {
+			return nil, err
+		}
+		defer zeroize(text)
+	}
+
+	key := &crypto.SigningKey{}
+	if err := key.UnmarshalText(text); err != nil {
+		return nil, err
+	}
+	signingKeys.add(stored, key)
+	return key, nil
+}
+
+func (s *vaultKeyStore) seal(text []byte) ([]byte, error) {
+	var stored string
+	switch s.storage {
+	case VaultKeyStorageKV:
+		// Written ahead of the database row, a failed insert leaves an unused secret behind
+		path := fmt.Sprintf("%s/data/%s/%s", s.mount, s.path, uuid.NewV4().String())
+		_, err := s.client.Logical().Write(path, map[string]interface{}{
+			"data": map[string]interface{}{"signing_key": string(text)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		stored = vaultKVPrefix + path
+	case VaultKeyStorageTransit:
+		secret, err := s.client.Logical().Write(fmt.Sprintf("%s/encrypt/%s", s.mount, s.path), map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(text),
+		})
+		if err != nil {
+			return nil, err
+		}
+		var ciphertext string
+		if secret != nil {
+			ciphertext, _ = secret.Data["ciphertext"].(string)
+		}
+		if ciphertext == "" {
+			return nil, errors.New("Vault transit did not return a ciphertext")
+		}
+		stored = ciphertext
+	}
+	return []byte(stored), nil
+}
+
+func (s *vaultKeyStore) unseal(stored string) ([]byte, error) {
+	var text []byte
+	if strings.HasPrefix(stored, vaultKVPrefix) {
+		_, data, err := readVaultData(s.client, strings.TrimPrefix(stored, vaultKVPrefix))
+		if err != nil {
+			return nil, err
+		}
+		key, _ := data["signing_key"].(string)
+		if key == "" {
+			return nil, ErrVaultKeyNotFound
+		}
+		text = []byte(key)
+	} else {
+		// The key name is not part of the ciphertext, keys are always decrypted with
+		// the configured one
+		secret, err := s.client.Logical().Write(fmt.Sprintf("%s/decrypt/%s", s.mount, s.path), map[string]interface{}{
+			"ciphertext": stored,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			return nil, ErrVaultKeyNotFound
+		}
+		plaintext, _ := secret.Data["plaintext"].(string)
+		if text, err = base64.StdEncoding.DecodeString(plaintext); err != nil {
+			return nil, err
+		}
+	}
+	return text, nil
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"github.com/brave-intl/bat-go/utils/handlers"
+	crypto "github.com/brave-intl/challenge-bypass-ristretto-ffi"
+)
+
+const (
+	// DefaultVectorSeed and DefaultVectorMessage make the published vectors
+	// reproducible without arguments
+	DefaultVectorSeed    = "challenge-bypass-server test vectors"
+	DefaultVectorMessage = "test message"
+
+	defaultVectorTokens = 5
+	maxVectorTokens     = 100
+)
+
+var ErrVectorMismatch = errors.New("A generated test vector did not verify")
+
+// ristrettoOrder is the order l of the ristretto255 group, scalars are reduced mod l
+var ristrettoOrder, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+// TestVectorSet is a deterministic issuance and redemption run for client
+// implementations to check their interoperability against. Every value is base64 as
+// served by the API. The batch proof is randomized by the prover, so it differs
+// between runs, but it verifies against the same key and tokens.
+type TestVectorSet struct {
+	Seed       string       `json:"seed"`
+	Message    string       `json:"message"`
+	SigningKey string       `json:"signing_key"`
+	PublicKey  string       `json:"public_key"`
+	BatchProof string       `json:"batch_proof"`
+	Tokens     []TestVector `json:"tokens"`
+}
+
+// TestVector follows a single token from its creation to its redemption
+type TestVector struct {
+	Token          string `json:"token"`
+	BlindedToken   string `json:"blinded_token"`
+	SignedToken    string `json:"signed_token"`
+	UnblindedToken string `json:"unblinded_token"`
+	Preimage       string `json:"preimage"`
+	// Signature is the redemption signature of Message
+	Signature string `json:"signature"`
+}
+
+// seededBytes derives n bytes from the seed for a purpose, n is at most 64
+func seededBytes(seed, label string, n int) []byte {
+	sum := sha512.Sum512([]byte(seed + "\x00" + label))
+	return sum[:n]
+}
+
+// seededScalar derives a canonical little endian scalar from the seed
+func seededScalar(seed, label string) []byte {
+	wide := seededBytes(seed, label, 64)
+	bigEndian := make([]byte, len(wide))
+	for i, b := range wide {
+		bigEndian[len(wide)-1-i] = b
+	}
+	reduced := new(big.Int).Mod(new(big.Int).SetBytes(bigEndian), ristrettoOrder).Bytes()
+
+	scalar := make([]byte, 32)
+	for i, b := range reduced {
+		scalar[len(reduced)-1-i] = b
+	}
+	return scalar
+}
+
+// marshalVector encodes a crypto value as it is sent over the wire
+func marshalVector(v interface{ MarshalText() ([]byte, error) }) (string, error) {
+	text, err := v.MarshalText()
+	return string(text), err
+}
+
+// GenerateTestVectors issues and redeems n tokens derived from the seed. The key, the
+// tokens and every value computed from them are the same for a given seed, n and
+// message, apart from the batch proof. Each token is made of a 64 byte preimage
+// followed by its blinding scalar.
+func GenerateTestVectors(seed string, n int, message string) (*TestVectorSet, error) {
+	set := &TestVectorSet{Seed: seed, Message: message}
+	key := &crypto.SigningKey{}
+	if err := key.UnmarshalText([]byte(base64.StdEncoding.EncodeToString(seededScalar(seed, "signing key")))); err != nil {
+		return nil, err
+	}
+
+	tokens := make([]*crypto.Token, n)
+	blindedTokens := make([]*crypto.BlindedToken, n)
+	signedTokens := make([]*crypto.SignedToken, n)
+	for i := range tokens {
+		raw := append(seededBytes(seed, fmt.Sprintf("token %d", i), 64), seededScalar(seed, fmt.Sprintf("blind %d", i))...)
+		tokens[i] = &crypto.Token{}
+		if err := tokens[i].UnmarshalText([]byte(base64.StdEncoding.EncodeToString(raw))); err != nil {
+			return nil, err
+		}
+		blindedTokens[i] = tokens[i].Blind()
+		var err error
+		if signedTokens[i], err = key.Sign(blindedTokens[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	proof, err := crypto.NewBatchDLEQProof(blindedTokens, signedTokens, key)
+	if err != nil {
+		return nil, err
+	}
+	unblindedTokens, err := proof.VerifyAndUnblind(tokens, blindedTokens, signedTokens, key.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if set.SigningKey, err = marshalVector(key); err != nil {
+		return nil, err
+	}
+	if set.PublicKey, err = marshalVector(key.PublicKey()); err != nil {
+		return nil, err
+	}
+	if set.BatchProof, err = marshalVector(proof); err != nil {
+		return nil, err
+	}
+
+	for i, unblindedToken := range unblindedTokens {
+		signature, err := unblindedToken.DeriveVerificationKey().Sign(message)
+		if err != nil {
+			return nil, err
+		}
+		// The vectors are checked the way the server checks redemptions
+		rederived := key.RederiveUnblindedToken(unblindedToken.Preimage())
+		if valid, err := rederived.DeriveVerificationKey().Verify(signature, message); err != nil || !valid {
+			return nil, ErrVectorMismatch
+		}
+
+		var vector TestVector
+		for _, field := range []struct {
+			target *string
+			value  interface{ MarshalText() ([]byte, error) }
+		}{
+			{&vector.Token, tokens[i]},
+			{&vector.BlindedToken, blindedTokens[i]},
+			{&vector.SignedToken, signedTokens[i]},
+			{&vector.UnblindedToken, unblindedToken},
+			{&vector.Preimage, unblindedToken.Preimage()},
+			{&vector.Signature, signature},
+		} {
+			if *field.target, err = marshalVector(field.value); err != nil {
+				return nil, err
+			}
+		}
+		set.Tokens = append(set.Tokens, vector)
+	}
+	return set, nil
+}
+
+func (c *Server) testVectorsHandler(w http.ResponseWriter, r *http.Request) *handlers.AppError {
+	seed, message, n := DefaultVectorSeed, DefaultVectorMessage, defaultVectorTokens
+	if value := r.FormValue("seed"); value != "" {
+		seed = value
+	}
+	if value := r.FormValue("message"); value != "" {
+		message = value
+	}
+	if value := r.FormValue("tokens"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxVectorTokens {
+			return &handlers.AppError{
+				Message: fmt.Sprintf("tokens must be between 1 and %d", maxVectorTokens),
+				Code:    http.StatusBadRequest,
+			}
+		}
+		n = parsed
+	}
+
+	set, err := GenerateTestVectors(seed, n, message)
+	if err != nil {
+		return &handlers.AppError{
+			Error:   err,
+			Message: "Could not generate test vectors",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return encodeResponse(w, set)
+}
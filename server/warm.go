@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/pressly/lg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// issuerWarmWorkers bounds the issuer types loaded at once while warming issuers
+const issuerWarmWorkers = 8
+
+var (
+	defaultWarmIntervalSec = 30
+
+	warmIssuersDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "issuer_warm_duration_seconds",
+		Help: "Time spent loading active issuers and their signing keys at startup",
+	})
+
+	warmFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_warm_failure_count",
+		Help: "Number of failed attempts to pre-warm database connections",
+	})
+)
+
+// warmConnections holds n connections open at once so that the pool establishes
+// that many, then releases them back to the pool as idle connections
+func warmConnections(ctx context.Context, db *sql.DB, n int) error {
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		if err := conn.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Server) warmInterval() time.Duration {
+	if c.dbConfig.WarmIntervalSec > 0 {
+		return time.Duration(c.dbConfig.WarmIntervalSec) * time.Second
+	}
+	return time.Duration(defaultWarmIntervalSec) * time.Second
+}
+
+// warmAll establishes the configured number of warm connections to the primary and replica
+func (c *Server) warmAll() {
+	for _, db := range []*sql.DB{c.db, c.dbReadOnly} {
+		if db == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.warmInterval())
+		if err := warmConnections(ctx, db, c.dbConfig.WarmConnections); err != nil {
+			incrementCounter(warmFailureCounter)
+			lg.Warnf("Could not warm database connections: %s", err)
+		}
+		cancel()
+	}
+}
+
+// keepConnectionsWarm periodically re-establishes the warm connections, replacing
+// any that were dropped by the database or the network
+func (c *Server) keepConnectionsWarm() {
+	for {
+		time.Sleep(c.warmInterval())
+		c.warmAll()
+	}
+}
+
+// activeIssuerTypes lists the types with an active issuer
+func (c *Server) activeIssuerTypes() ([]string, error) {
+	rows, err := c.queryReadOnly(`SELECT DISTINCT issuer_type FROM issuers WHERE rotated_at IS NULL AND ` + unexpiredIssuers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []string
+	for rows.Next() {
+		var issuerType string
+		if err := rows.Scan(&issuerType); err != nil {
+			return nil, err
+		}
+		types = append(types, issuerType)
+	}
+	return types, rows.Err()
+}
+
+// warmIssuers loads the issuers of every active type, which caches them when caching
+// is enabled and unseals their signing keys either way, so that the first requests
+// after a deploy don't all fetch issuers at once. Types that fail to load are logged
+// and left to be loaded on demand.
+func (c *Server) warmIssuers() {
+	started := time.Now()
+	types, err := c.activeIssuerTypes()
+	if err != nil {
+		lg.Warnf("Could not warm issuers: %s", err)
+		return
+	}
+
+	slots := make(chan struct{}, issuerWarmWorkers)
+	var wg sync.WaitGroup
+	for _, issuerType := range types {
+		wg.Add(1)
+		go func(issuerType string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if _, err := c.fetchIssuers(issuerType); err != nil {
+				lg.Warnf("Could not warm issuers of %s: %s", issuerType, err)
+			}
+		}(issuerType)
+	}
+	wg.Wait()
+
+	warmIssuersDuration.Set(time.Since(started).Seconds())
+	lg.Infof("Warmed the issuers of %d types in %s", len(types), time.Since(started))
+}
@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// The sqlite3 driver needs cgo, so it is only linked into builds tagged sqlite, which
+// can run migrate against SQLite databases
+import _ "github.com/mattn/go-sqlite3"